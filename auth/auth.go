@@ -14,17 +14,37 @@ import (
 	"golang.org/x/crypto/bcrypt"
 )
 
+// Policy holds the configurable authentication policy
+type Policy struct {
+	TOTPIssuer        string
+	TOTPRequiredRoles []string
+	LockoutThreshold  int           // Failed logins before the account is locked (0 disables lockout)
+	LockoutBase       time.Duration // Duration of the first lockout, doubled for every further failure
+	LockoutMax        time.Duration // Upper bound for a single lockout
+}
+
 type AuthModule struct {
-	db        *pgxpool.Pool
-	redis     *redis.Client
-	JWTSecret string
+	db                *pgxpool.Pool
+	redis             *redis.Client
+	JWTSecret         string
+	totpIssuer        string
+	totpRequiredRoles map[string]bool
+	policy            Policy
 }
 
-func NewAuthModule(db *pgxpool.Pool, redis *redis.Client, JWTSecret string) *AuthModule {
+func NewAuthModule(db *pgxpool.Pool, redis *redis.Client, JWTSecret string, policy Policy) *AuthModule {
+	requiredRoles := make(map[string]bool)
+	for _, role := range policy.TOTPRequiredRoles {
+		requiredRoles[role] = true
+	}
+
 	return &AuthModule{
-		db:        db,
-		redis:     redis,
-		JWTSecret: JWTSecret,
+		db:                db,
+		redis:             redis,
+		JWTSecret:         JWTSecret,
+		totpIssuer:        policy.TOTPIssuer,
+		totpRequiredRoles: requiredRoles,
+		policy:            policy,
 	}
 }
 
@@ -74,33 +94,50 @@ func (a *AuthModule) generateJWT(userID int) (string, error) {
 	return token.SignedString([]byte(a.JWTSecret))
 }
 
-func (a *AuthModule) authenticateUser(ctx context.Context, username string, password string) (int, error) {
+func (a *AuthModule) authenticateUser(ctx context.Context, username, password, clientIP string) (int, error) {
+	if err := a.checkLockout(ctx, username, clientIP); err != nil {
+		return 0, err
+	}
+
 	var userID int
 	var passwordHash string
 	err := a.db.QueryRow(ctx, "SELECT id, password FROM users WHERE username = $1", username).Scan(&userID, &passwordHash)
 	if err != nil {
+		a.recordFailedLogin(ctx, username, clientIP)
 		return 0, errors.New("invalid credentials")
 	}
 
 	if err := bcrypt.CompareHashAndPassword([]byte(passwordHash), []byte(password)); err != nil {
+		a.recordFailedLogin(ctx, username, clientIP)
 		return 0, errors.New("invalid credentials")
 	}
 
+	a.clearFailedLogins(ctx, username, clientIP)
 	return userID, nil
 }
 
-func (a *AuthModule) RegisterWithJWT(ctx context.Context, username string, password string, email string) (string, error) {
-	userID, err := a.createUser(ctx, username, password, email)
+// verifyPassword checks the password of an already authenticated user
+func (a *AuthModule) verifyPassword(ctx context.Context, userID int, password string) error {
+	var passwordHash string
+	err := a.db.QueryRow(ctx, "SELECT password FROM users WHERE id = $1", userID).Scan(&passwordHash)
 	if err != nil {
-		return "", err
+		return errors.New("user not found")
 	}
+	if err := bcrypt.CompareHashAndPassword([]byte(passwordHash), []byte(password)); err != nil {
+		return errors.New("invalid password")
+	}
+	return nil
+}
 
-	token, err := a.generateJWT(userID)
+// RegisterWithJWT creates a user and logs them in through the same path as
+// LoginWithJWT, so roles that require 2FA get a setup challenge instead of a token
+func (a *AuthModule) RegisterWithJWT(ctx context.Context, username string, password string, email string) (*LoginResult, error) {
+	userID, err := a.createUser(ctx, username, password, email)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	return token, nil
+	return a.beginLogin(ctx, userID)
 }
 
 func (a *AuthModule) RegisterWithSession(ctx context.Context, username, password string, email string) (int, string, error) {
@@ -109,6 +146,16 @@ func (a *AuthModule) RegisterWithSession(ctx context.Context, username, password
 		return 0, "", err
 	}
 
+	// Session login has no second step, so new users whose role requires 2FA
+	// have to log in with a JWT and enroll first
+	_, role, _, _, err := a.getTwoFactorState(ctx, userID)
+	if err != nil {
+		return 0, "", err
+	}
+	if a.isTwoFactorRequired(role) {
+		return 0, "", errors.New("two-factor authentication required")
+	}
+
 	token, err := generateSecureToken(32)
 	if err != nil {
 		return 0, "", err
@@ -123,25 +170,32 @@ func (a *AuthModule) RegisterWithSession(ctx context.Context, username, password
 	return userID, token, nil
 }
 
-func (a *AuthModule) LoginWithJWT(ctx context.Context, username, password string) (string, error) {
-	userID, err := a.authenticateUser(ctx, username, password)
+// LoginWithJWT performs the password step of a login. Users with 2FA enabled (or
+// whose role requires it) receive a challenge instead of a token. Failed attempts
+// lock the username for the client IP they came from.
+func (a *AuthModule) LoginWithJWT(ctx context.Context, username, password, clientIP string) (*LoginResult, error) {
+	userID, err := a.authenticateUser(ctx, username, password, clientIP)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	token, err := a.generateJWT(userID)
+	return a.beginLogin(ctx, userID)
+}
+
+func (a *AuthModule) LoginWithSession(ctx context.Context, username, password, clientIP string) (int, string, error) {
+	userID, err := a.authenticateUser(ctx, username, password, clientIP)
 	if err != nil {
-		return "", err
+		return 0, "", err
 	}
 
-	return token, nil
-}
-
-func (a *AuthModule) LoginWithSession(ctx context.Context, username, password string) (int, string, error) {
-	userID, err := a.authenticateUser(ctx, username, password)
+	// Session login has no second step, so it is not available to 2FA users
+	_, role, _, enabled, err := a.getTwoFactorState(ctx, userID)
 	if err != nil {
 		return 0, "", err
 	}
+	if enabled || a.isTwoFactorRequired(role) {
+		return 0, "", errors.New("two-factor authentication required")
+	}
 
 	token, err := generateSecureToken(32)
 	if err != nil {
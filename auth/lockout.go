@@ -0,0 +1,138 @@
+package auth
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// failureWindow is how long failed login attempts are remembered
+const failureWindow = 24 * time.Hour
+
+// LockoutError is returned while an account is locked after too many failed logins
+type LockoutError struct {
+	RetryAfter time.Duration
+}
+
+func (e *LockoutError) Error() string {
+	return "too many failed login attempts, try again later"
+}
+
+// lockoutKeys keys failures on the username and the client IP, so guessing a
+// password from one address cannot lock the owner out from everywhere else
+func lockoutKeys(username, clientIP string) (failuresKey, lockKey string) {
+	subject := strings.ToLower(username) + ":" + clientIP
+	return "login_failures:" + subject, "login_lock:" + subject
+}
+
+// twoFactorLockoutKeys keys failed second factors on the user alone. Only someone
+// who knows the password gets this far, so every new challenge and address counts.
+func twoFactorLockoutKeys(userID int) (failuresKey, lockKey string) {
+	subject := strconv.Itoa(userID)
+	return "2fa_failures:" + subject, "2fa_lock:" + subject
+}
+
+// lockoutDuration returns how long to lock after failures failed attempts, or 0
+// below the threshold. Each failure beyond the threshold doubles the lockout.
+func (p Policy) lockoutDuration(failures int64) time.Duration {
+	if p.LockoutThreshold <= 0 || failures < int64(p.LockoutThreshold) {
+		return 0
+	}
+
+	lockout := p.LockoutBase
+	for i := int64(p.LockoutThreshold); i < failures && lockout < p.LockoutMax; i++ {
+		lockout *= 2
+	}
+	if p.LockoutMax > 0 && lockout > p.LockoutMax {
+		lockout = p.LockoutMax
+	}
+	if lockout < 0 {
+		return 0
+	}
+	return lockout
+}
+
+// checkLockout returns a LockoutError if the username is currently locked for the client IP
+func (a *AuthModule) checkLockout(ctx context.Context, username, clientIP string) error {
+	_, lockKey := lockoutKeys(username, clientIP)
+	return a.checkLock(ctx, lockKey, username+" from "+clientIP)
+}
+
+// recordFailedLogin counts a failed attempt and locks the username for the client
+// IP once the threshold is reached
+func (a *AuthModule) recordFailedLogin(ctx context.Context, username, clientIP string) {
+	failuresKey, lockKey := lockoutKeys(username, clientIP)
+	a.recordFailure(ctx, failuresKey, lockKey, "login for "+username+" from "+clientIP)
+}
+
+// clearFailedLogins resets the failure counter after a successful login
+func (a *AuthModule) clearFailedLogins(ctx context.Context, username, clientIP string) {
+	if a.policy.LockoutThreshold <= 0 {
+		return
+	}
+
+	failuresKey, lockKey := lockoutKeys(username, clientIP)
+	a.redis.Del(ctx, failuresKey, lockKey)
+}
+
+// checkTwoFactorLockout returns a LockoutError if the second factor of a user is currently locked
+func (a *AuthModule) checkTwoFactorLockout(ctx context.Context, userID int) error {
+	_, lockKey := twoFactorLockoutKeys(userID)
+	return a.checkLock(ctx, lockKey, "second factor of user "+strconv.Itoa(userID))
+}
+
+// recordFailedTwoFactor counts a wrong second factor and locks the user's second
+// factor once the threshold is reached
+func (a *AuthModule) recordFailedTwoFactor(ctx context.Context, userID int) {
+	failuresKey, lockKey := twoFactorLockoutKeys(userID)
+	a.recordFailure(ctx, failuresKey, lockKey, "second factor of user "+strconv.Itoa(userID))
+}
+
+// clearFailedTwoFactor resets the second factor failure counter after a successful login
+func (a *AuthModule) clearFailedTwoFactor(ctx context.Context, userID int) {
+	if a.policy.LockoutThreshold <= 0 {
+		return
+	}
+
+	failuresKey, lockKey := twoFactorLockoutKeys(userID)
+	a.redis.Del(ctx, failuresKey, lockKey)
+}
+
+func (a *AuthModule) checkLock(ctx context.Context, lockKey, subject string) error {
+	if a.policy.LockoutThreshold <= 0 {
+		return nil
+	}
+
+	ttl, err := a.redis.TTL(ctx, lockKey).Result()
+	if err != nil {
+		log.Printf("AUTH: Failed to check lockout for %s: %v", subject, err)
+		return nil
+	}
+	if ttl > 0 {
+		return &LockoutError{RetryAfter: ttl}
+	}
+	return nil
+}
+
+func (a *AuthModule) recordFailure(ctx context.Context, failuresKey, lockKey, subject string) {
+	if a.policy.LockoutThreshold <= 0 {
+		return
+	}
+
+	failures, err := a.redis.Incr(ctx, failuresKey).Result()
+	if err != nil {
+		log.Printf("AUTH: Failed to record failed attempt for %s: %v", subject, err)
+		return
+	}
+	a.redis.Expire(ctx, failuresKey, failureWindow)
+
+	lockout := a.policy.lockoutDuration(failures)
+	if lockout <= 0 {
+		return
+	}
+
+	a.redis.Set(ctx, lockKey, failures, lockout)
+	log.Printf("AUTH: Locked %s for %s after %d failed attempts", subject, lockout, failures)
+}
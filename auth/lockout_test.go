@@ -0,0 +1,71 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLockoutKeys(t *testing.T) {
+	tests := []struct {
+		username, clientIP string
+		wantFailures       string
+		wantLock           string
+	}{
+		{"alice", "192.168.1.10", "login_failures:alice:192.168.1.10", "login_lock:alice:192.168.1.10"},
+		{"Alice", "192.168.1.10", "login_failures:alice:192.168.1.10", "login_lock:alice:192.168.1.10"},
+		{"alice", "::1", "login_failures:alice:::1", "login_lock:alice:::1"},
+	}
+
+	for _, tt := range tests {
+		failures, lock := lockoutKeys(tt.username, tt.clientIP)
+		if failures != tt.wantFailures || lock != tt.wantLock {
+			t.Errorf("lockoutKeys(%q, %q) = (%q, %q), want (%q, %q)", tt.username, tt.clientIP, failures, lock, tt.wantFailures, tt.wantLock)
+		}
+	}
+
+	// The same username from another address must not share the lock
+	_, first := lockoutKeys("alice", "10.0.0.1")
+	_, second := lockoutKeys("alice", "10.0.0.2")
+	if first == second {
+		t.Error("lockoutKeys() shares a lock between client IPs")
+	}
+}
+
+func TestTwoFactorLockoutKeys(t *testing.T) {
+	failures, lock := twoFactorLockoutKeys(42)
+	if failures != "2fa_failures:42" || lock != "2fa_lock:42" {
+		t.Errorf("twoFactorLockoutKeys(42) = (%q, %q), want (%q, %q)", failures, lock, "2fa_failures:42", "2fa_lock:42")
+	}
+
+	// Second factor failures must not share keys with password failures
+	loginFailures, loginLock := lockoutKeys("42", "")
+	if failures == loginFailures || lock == loginLock {
+		t.Error("twoFactorLockoutKeys() shares keys with lockoutKeys()")
+	}
+}
+
+func TestLockoutDuration(t *testing.T) {
+	policy := Policy{LockoutThreshold: 3, LockoutBase: time.Minute, LockoutMax: 10 * time.Minute}
+	tests := []struct {
+		policy   Policy
+		failures int64
+		want     time.Duration
+	}{
+		{policy, 1, 0},
+		{policy, 2, 0},
+		{policy, 3, time.Minute},
+		{policy, 4, 2 * time.Minute},
+		{policy, 6, 8 * time.Minute},
+		{policy, 7, 10 * time.Minute},
+		{policy, 50, 10 * time.Minute},
+		{Policy{LockoutThreshold: 3, LockoutBase: time.Minute}, 5, time.Minute},
+		{Policy{LockoutBase: time.Minute, LockoutMax: time.Hour}, 100, 0},
+		{Policy{LockoutThreshold: 3, LockoutMax: time.Hour}, 3, 0},
+	}
+
+	for _, tt := range tests {
+		if got := tt.policy.lockoutDuration(tt.failures); got != tt.want {
+			t.Errorf("%+v.lockoutDuration(%d) = %s, want %s", tt.policy, tt.failures, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,449 @@
+package auth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	totpDigits        = 6
+	totpPeriod        = 30 * time.Second
+	totpSkew          = 1 // accepted time steps before/after the current one
+	recoveryCodeCount = 10
+	challengeTTL      = 5 * time.Minute
+	challengeAttempts = 5 // wrong codes allowed before a login challenge is invalidated
+)
+
+// LoginResult is the outcome of the first login step. When TwoFactorRequired or
+// TwoFactorSetupRequired is set, Token is empty and ChallengeToken has to be
+// exchanged for a JWT via CompleteLoginTwoFactor.
+type LoginResult struct {
+	UserID                 int
+	Token                  string
+	TwoFactorRequired      bool
+	TwoFactorSetupRequired bool
+	ChallengeToken         string
+}
+
+// TwoFactorStatus describes the 2FA state of a user
+type TwoFactorStatus struct {
+	Enabled                bool `json:"enabled"`
+	Required               bool `json:"required"`
+	RecoveryCodesRemaining int  `json:"recovery_codes_remaining"`
+}
+
+// TOTPEnrollment holds the data a client needs to provision an authenticator app
+type TOTPEnrollment struct {
+	Secret          string `json:"secret"`
+	ProvisioningURI string `json:"provisioning_uri"`
+}
+
+// generateTOTPSecret generates a random base32-encoded TOTP secret
+func generateTOTPSecret() (string, error) {
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(secret), nil
+}
+
+// totpCode computes the RFC 6238 code of a secret for the given time step
+func totpCode(secret string, counter uint64) (string, error) {
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%mod), nil
+}
+
+// validateTOTP checks a code against the secret, allowing for clock skew, and
+// returns the time step it matched
+func validateTOTP(secret, code string, now time.Time) (uint64, bool) {
+	code = strings.TrimSpace(code)
+	if len(code) != totpDigits {
+		return 0, false
+	}
+
+	counter := uint64(now.Unix()) / uint64(totpPeriod.Seconds())
+	for i := -totpSkew; i <= totpSkew; i++ {
+		expected, err := totpCode(secret, counter+uint64(i))
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return counter + uint64(i), true
+		}
+	}
+	return 0, false
+}
+
+// acceptTOTP validates a code and records its time step, so the same code (or an
+// older one still inside the skew window) cannot be replayed
+func (a *AuthModule) acceptTOTP(ctx context.Context, userID int, secret, code string) (bool, error) {
+	counter, ok := validateTOTP(secret, code, time.Now())
+	if !ok {
+		return false, nil
+	}
+	tag, err := a.db.Exec(ctx,
+		"UPDATE users SET totp_last_counter = $1 WHERE id = $2 AND (totp_last_counter IS NULL OR totp_last_counter < $1)",
+		int64(counter), userID)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+// provisioningURI builds the otpauth:// URI encoded into the enrollment QR code
+func provisioningURI(issuer, username, secret string) string {
+	label := url.PathEscape(issuer + ":" + username)
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", issuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprintf("%d", totpDigits))
+	params.Set("period", fmt.Sprintf("%d", int(totpPeriod.Seconds())))
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+// generateRecoveryCode generates a human-friendly recovery code (xxxxx-xxxxx)
+func generateRecoveryCode() (string, error) {
+	b := make([]byte, 5)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	code := hex.EncodeToString(b)
+	return code[:5] + "-" + code[5:], nil
+}
+
+// hashRecoveryCode hashes a recovery code for storage. Recovery codes carry
+// enough entropy that a plain SHA-256 is sufficient.
+func hashRecoveryCode(code string) string {
+	normalized := strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
+
+// isTwoFactorRequired reports whether the user's household role enforces 2FA
+func (a *AuthModule) isTwoFactorRequired(role string) bool {
+	return a.totpRequiredRoles[role]
+}
+
+// getTwoFactorState fetches the 2FA columns of a user
+func (a *AuthModule) getTwoFactorState(ctx context.Context, userID int) (username, role string, secret *string, enabled bool, err error) {
+	err = a.db.QueryRow(ctx, "SELECT username, role, totp_secret, totp_enabled FROM users WHERE id = $1", userID).
+		Scan(&username, &role, &secret, &enabled)
+	if err != nil {
+		return "", "", nil, false, errors.New("user not found")
+	}
+	return username, role, secret, enabled, nil
+}
+
+// createLoginChallenge stores a short-lived challenge for the second login step
+func (a *AuthModule) createLoginChallenge(ctx context.Context, userID int) (string, error) {
+	token, err := generateSecureToken(32)
+	if err != nil {
+		return "", err
+	}
+
+	key := "2fa_challenge:" + token
+	if err := a.redis.Set(ctx, key, userID, challengeTTL).Err(); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// resolveLoginChallenge returns the user ID behind a pending login challenge
+func (a *AuthModule) resolveLoginChallenge(ctx context.Context, challengeToken string) (int, error) {
+	userID, err := a.redis.Get(ctx, "2fa_challenge:"+challengeToken).Int()
+	if err == redis.Nil {
+		return 0, errors.New("invalid or expired challenge")
+	} else if err != nil {
+		return 0, err
+	}
+	return userID, nil
+}
+
+// beginLogin decides whether a password-authenticated user gets a token right away
+// or has to complete a second factor first
+func (a *AuthModule) beginLogin(ctx context.Context, userID int) (*LoginResult, error) {
+	_, role, _, enabled, err := a.getTwoFactorState(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if !enabled && !a.isTwoFactorRequired(role) {
+		token, err := a.generateJWT(userID)
+		if err != nil {
+			return nil, err
+		}
+		return &LoginResult{UserID: userID, Token: token}, nil
+	}
+
+	challenge, err := a.createLoginChallenge(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	return &LoginResult{
+		UserID:                 userID,
+		TwoFactorRequired:      enabled,
+		TwoFactorSetupRequired: !enabled,
+		ChallengeToken:         challenge,
+	}, nil
+}
+
+// BeginLoginTwoFactorSetup starts TOTP enrollment for a user whose role requires 2FA
+// but who has not enrolled yet. It is authenticated by the login challenge.
+func (a *AuthModule) BeginLoginTwoFactorSetup(ctx context.Context, challengeToken string) (*TOTPEnrollment, error) {
+	userID, err := a.resolveLoginChallenge(ctx, challengeToken)
+	if err != nil {
+		return nil, err
+	}
+	return a.BeginTOTPEnrollment(ctx, userID)
+}
+
+// CompleteLoginTwoFactor finishes a two-step login with a TOTP or recovery code.
+// The returned result carries the user ID even on a wrong code, once the
+// challenge itself is valid. For users completing a forced enrollment the code confirms the new secret and
+// the freshly generated recovery codes are returned alongside the token. Wrong
+// codes count towards a per-user lockout that spans challenges and addresses;
+// while locked a *LockoutError is returned.
+func (a *AuthModule) CompleteLoginTwoFactor(ctx context.Context, challengeToken, code string) (*LoginResult, []string, error) {
+	userID, err := a.resolveLoginChallenge(ctx, challengeToken)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := a.checkTwoFactorLockout(ctx, userID); err != nil {
+		return &LoginResult{UserID: userID}, nil, err
+	}
+
+	_, _, _, enabled, err := a.getTwoFactorState(ctx, userID)
+	if err != nil {
+		return &LoginResult{UserID: userID}, nil, err
+	}
+
+	var recoveryCodes []string
+	if enabled {
+		err = a.verifySecondFactor(ctx, userID, code)
+	} else {
+		recoveryCodes, err = a.ConfirmTOTPEnrollment(ctx, userID, code)
+	}
+	if err != nil {
+		a.recordFailedChallenge(ctx, challengeToken)
+		a.recordFailedTwoFactor(ctx, userID)
+		return &LoginResult{UserID: userID}, nil, err
+	}
+
+	a.redis.Del(ctx, "2fa_challenge:"+challengeToken)
+	a.clearFailedTwoFactor(ctx, userID)
+
+	token, err := a.generateJWT(userID)
+	if err != nil {
+		return &LoginResult{UserID: userID}, nil, err
+	}
+	return &LoginResult{UserID: userID, Token: token}, recoveryCodes, nil
+}
+
+// recordFailedChallenge invalidates a login challenge after too many wrong codes
+func (a *AuthModule) recordFailedChallenge(ctx context.Context, challengeToken string) {
+	key := "2fa_challenge_failures:" + challengeToken
+	failures, err := a.redis.Incr(ctx, key).Result()
+	if err != nil {
+		return
+	}
+	a.redis.Expire(ctx, key, challengeTTL)
+
+	if failures >= challengeAttempts {
+		a.redis.Del(ctx, "2fa_challenge:"+challengeToken, key)
+	}
+}
+
+// verifySecondFactor accepts either a current TOTP code or an unused recovery code
+func (a *AuthModule) verifySecondFactor(ctx context.Context, userID int, code string) error {
+	_, _, secret, enabled, err := a.getTwoFactorState(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if !enabled || secret == nil {
+		return errors.New("two-factor authentication is not enabled")
+	}
+
+	ok, err := a.acceptTOTP(ctx, userID, *secret, code)
+	if err != nil {
+		return err
+	}
+	if ok {
+		return nil
+	}
+
+	tag, err := a.db.Exec(ctx,
+		"UPDATE user_recovery_codes SET used_at = NOW() WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL",
+		userID, hashRecoveryCode(code))
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return errors.New("invalid two-factor code")
+	}
+	return nil
+}
+
+// BeginTOTPEnrollment generates a new (not yet active) TOTP secret for the user
+func (a *AuthModule) BeginTOTPEnrollment(ctx context.Context, userID int) (*TOTPEnrollment, error) {
+	username, _, _, enabled, err := a.getTwoFactorState(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if enabled {
+		return nil, errors.New("two-factor authentication is already enabled")
+	}
+
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := a.db.Exec(ctx, "UPDATE users SET totp_secret = $1, totp_enabled = false, totp_last_counter = NULL WHERE id = $2", secret, userID); err != nil {
+		return nil, err
+	}
+
+	return &TOTPEnrollment{
+		Secret:          secret,
+		ProvisioningURI: provisioningURI(a.totpIssuer, username, secret),
+	}, nil
+}
+
+// ConfirmTOTPEnrollment verifies the first code from the authenticator app, enables
+// 2FA and returns a fresh set of recovery codes
+func (a *AuthModule) ConfirmTOTPEnrollment(ctx context.Context, userID int, code string) ([]string, error) {
+	_, _, secret, enabled, err := a.getTwoFactorState(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if enabled {
+		return nil, errors.New("two-factor authentication is already enabled")
+	}
+	if secret == nil {
+		return nil, errors.New("two-factor enrollment not started")
+	}
+	ok, err := a.acceptTOTP(ctx, userID, *secret, code)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errors.New("invalid two-factor code")
+	}
+
+	if _, err := a.db.Exec(ctx, "UPDATE users SET totp_enabled = true WHERE id = $1", userID); err != nil {
+		return nil, err
+	}
+
+	return a.replaceRecoveryCodes(ctx, userID)
+}
+
+// RegenerateRecoveryCodes invalidates all recovery codes and issues new ones
+func (a *AuthModule) RegenerateRecoveryCodes(ctx context.Context, userID int, code string) ([]string, error) {
+	if err := a.verifySecondFactor(ctx, userID, code); err != nil {
+		return nil, err
+	}
+	return a.replaceRecoveryCodes(ctx, userID)
+}
+
+// replaceRecoveryCodes stores a new set of hashed recovery codes for the user
+func (a *AuthModule) replaceRecoveryCodes(ctx context.Context, userID int) ([]string, error) {
+	tx, err := a.db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, "DELETE FROM user_recovery_codes WHERE user_id = $1", userID); err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		code, err := generateRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := tx.Exec(ctx, "INSERT INTO user_recovery_codes (user_id, code_hash) VALUES ($1, $2)", userID, hashRecoveryCode(code)); err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// DisableTOTP turns 2FA off after verifying the password and a second factor.
+// Users whose role requires 2FA cannot disable it.
+func (a *AuthModule) DisableTOTP(ctx context.Context, userID int, password, code string) error {
+	if err := a.verifyPassword(ctx, userID, password); err != nil {
+		return err
+	}
+
+	_, role, _, _, err := a.getTwoFactorState(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if a.isTwoFactorRequired(role) {
+		return errors.New("two-factor authentication is required for your role")
+	}
+
+	if err := a.verifySecondFactor(ctx, userID, code); err != nil {
+		return err
+	}
+
+	if _, err := a.db.Exec(ctx, "UPDATE users SET totp_secret = NULL, totp_enabled = false, totp_last_counter = NULL WHERE id = $1", userID); err != nil {
+		return err
+	}
+	_, err = a.db.Exec(ctx, "DELETE FROM user_recovery_codes WHERE user_id = $1", userID)
+	return err
+}
+
+// GetTwoFactorStatus returns the 2FA state of a user
+func (a *AuthModule) GetTwoFactorStatus(ctx context.Context, userID int) (*TwoFactorStatus, error) {
+	_, role, _, enabled, err := a.getTwoFactorState(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	status := &TwoFactorStatus{Enabled: enabled, Required: a.isTwoFactorRequired(role)}
+	err = a.db.QueryRow(ctx, "SELECT COUNT(*) FROM user_recovery_codes WHERE user_id = $1 AND used_at IS NULL", userID).
+		Scan(&status.RecoveryCodesRemaining)
+	if err != nil {
+		return nil, err
+	}
+	return status, nil
+}
@@ -0,0 +1,157 @@
+package auth
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the SHA-1 key of the RFC 6238 test vectors ("12345678901234567890")
+const rfc6238Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTOTPCode(t *testing.T) {
+	// RFC 6238 appendix B, truncated to six digits
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+
+	for _, tt := range tests {
+		got, err := totpCode(rfc6238Secret, uint64(tt.unix)/30)
+		if err != nil {
+			t.Fatalf("totpCode(%d): %v", tt.unix, err)
+		}
+		if got != tt.want {
+			t.Errorf("totpCode(%d) = %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+
+	if _, err := totpCode("not base32!", 1); err == nil {
+		t.Error("totpCode with an invalid secret: expected an error")
+	}
+}
+
+func TestValidateTOTP(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	counter := uint64(now.Unix()) / 30
+	codeAt := func(step uint64) string {
+		code, err := totpCode(rfc6238Secret, step)
+		if err != nil {
+			t.Fatalf("totpCode: %v", err)
+		}
+		return code
+	}
+
+	tests := []struct {
+		name        string
+		secret      string
+		code        string
+		wantOK      bool
+		wantCounter uint64
+	}{
+		{"current step", rfc6238Secret, codeAt(counter), true, counter},
+		{"lowercase secret", strings.ToLower(rfc6238Secret), codeAt(counter), true, counter},
+		{"surrounding spaces", rfc6238Secret, " " + codeAt(counter) + " ", true, counter},
+		{"previous step", rfc6238Secret, codeAt(counter - 1), true, counter - 1},
+		{"next step", rfc6238Secret, codeAt(counter + 1), true, counter + 1},
+		{"outside skew", rfc6238Secret, codeAt(counter - 2), false, 0},
+		{"wrong code", rfc6238Secret, "000000", false, 0},
+		{"too short", rfc6238Secret, codeAt(counter)[:5], false, 0},
+		{"recovery code", rfc6238Secret, "abcde-12345", false, 0},
+		{"invalid secret", "not base32!", codeAt(counter), false, 0},
+	}
+
+	for _, tt := range tests {
+		got, ok := validateTOTP(tt.secret, tt.code, now)
+		if ok != tt.wantOK || got != tt.wantCounter {
+			t.Errorf("%s: validateTOTP() = (%d, %v), want (%d, %v)", tt.name, got, ok, tt.wantCounter, tt.wantOK)
+		}
+	}
+}
+
+func TestGenerateTOTPSecret(t *testing.T) {
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		t.Fatalf("generateTOTPSecret: %v", err)
+	}
+	if len(secret) != 32 {
+		t.Errorf("secret length = %d, want 32", len(secret))
+	}
+	if _, err := totpCode(secret, 1); err != nil {
+		t.Errorf("generated secret is not usable: %v", err)
+	}
+}
+
+func TestProvisioningURI(t *testing.T) {
+	uri := provisioningURI("Smart Home", "alice", rfc6238Secret)
+	u, err := url.Parse(uri)
+	if err != nil {
+		t.Fatalf("url.Parse(%q): %v", uri, err)
+	}
+	if u.Scheme != "otpauth" || u.Host != "totp" || u.Path != "/Smart Home:alice" {
+		t.Errorf("provisioningURI() = %s", uri)
+	}
+	want := map[string]string{"secret": rfc6238Secret, "issuer": "Smart Home", "algorithm": "SHA1", "digits": "6", "period": "30"}
+	for key, value := range want {
+		if got := u.Query().Get(key); got != value {
+			t.Errorf("provisioningURI() %s = %q, want %q", key, got, value)
+		}
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	format := regexp.MustCompile(`^[0-9a-f]{5}-[0-9a-f]{5}$`)
+	seen := make(map[string]bool)
+	for i := 0; i < recoveryCodeCount; i++ {
+		code, err := generateRecoveryCode()
+		if err != nil {
+			t.Fatalf("generateRecoveryCode: %v", err)
+		}
+		if !format.MatchString(code) {
+			t.Errorf("generateRecoveryCode() = %q, want xxxxx-xxxxx", code)
+		}
+		if seen[code] {
+			t.Errorf("generateRecoveryCode() repeated %q", code)
+		}
+		seen[code] = true
+	}
+
+	// Recovery codes are consumed by matching their hash, so every way of typing
+	// the same code has to hash identically and different codes must not
+	canonical := hashRecoveryCode("abcde-12345")
+	tests := []struct {
+		code string
+		same bool
+	}{
+		{"abcde-12345", true},
+		{"ABCDE-12345", true},
+		{"abcde12345", true},
+		{"  abcde-12345\n", true},
+		{"abcde-12346", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := hashRecoveryCode(tt.code) == canonical; got != tt.same {
+			t.Errorf("hashRecoveryCode(%q) matches canonical = %v, want %v", tt.code, got, tt.same)
+		}
+	}
+}
+
+func TestIsTwoFactorRequired(t *testing.T) {
+	a := NewAuthModule(nil, nil, "secret", Policy{TOTPRequiredRoles: []string{"admin", "member"}})
+	tests := map[string]bool{"admin": true, "member": true, "guest": false, "": false}
+	for role, want := range tests {
+		if got := a.isTwoFactorRequired(role); got != want {
+			t.Errorf("isTwoFactorRequired(%q) = %v, want %v", role, got, want)
+		}
+	}
+}
@@ -10,14 +10,19 @@ import (
 	"syscall"
 	"time"
 
+	"smarthome/internal/alarm"
+	"smarthome/internal/automation"
+	"smarthome/internal/clock"
 	"smarthome/internal/config"
 	"smarthome/internal/db"
 	"smarthome/internal/engine"
 	"smarthome/internal/internet_bridge"
 	"smarthome/internal/mqtt"
+	"smarthome/internal/presence"
 	"smarthome/internal/redis"
 	"smarthome/internal/scheduler"
 	"smarthome/internal/taskqueue"
+	"smarthome/internal/vacation"
 	"smarthome/internal/web"
 
 	"github.com/pion/mdns/v2"
@@ -32,6 +37,13 @@ func main() {
 		log.Fatalf("Failed to load config: %v", err)
 	}
 
+	loc, err := clock.LoadLocation(cfg.App.Timezone)
+	if err != nil {
+		log.Fatalf("Invalid HOME_TIMEZONE %q: %v", cfg.App.Timezone, err)
+	}
+	clock.SetLocation(loc)
+	log.Printf("Home timezone: %s", loc)
+
 	dbConn, err := db.NewDB(cfg.Database.URL)
 	if err != nil {
 		log.Fatalf("Failed to connect to DB: %v", err)
@@ -46,20 +58,30 @@ func main() {
 	}
 
 	taskqueue.SetGlobalInstances(dbConn, redisClient, mqttClient)
+	taskqueue.SetMaxChainDepth(cfg.Automation.MaxChainDepth)
+	taskqueue.SetTracing(cfg.Automation.TraceAllEvaluations, cfg.Automation.TraceMaxPerRule, cfg.Automation.TraceRetention)
 
 	go taskqueue.StartWorkers(cfg.Redis.Addr)
 
-	sched := scheduler.NewScheduler(dbConn)
+	sched := scheduler.NewScheduler(dbConn, redisClient)
+	sched.SetLeaderLease(cfg.Automation.SchedulerLeaderLease)
 	sched.Start()
 
+	automation.SetPresenceJustLeftWindow(cfg.Presence.JustLeftWindow)
+	tracker := presence.NewTracker(dbConn, redisClient, mqttClient)
+	tracker.SetDHCP(cfg.Presence.DHCPLeasesFile, cfg.Presence.DHCPPollInterval)
+
+	alarms := alarm.NewManager(dbConn, redisClient, mqttClient)
+	vacations := vacation.NewManager(dbConn, redisClient, mqttClient)
+
 	// Initialize engine first
-	eng := engine.NewEngine(mqttClient, redisClient, dbConn, sched)
+	eng := engine.NewEngine(mqttClient, redisClient, dbConn, sched, tracker, alarms, vacations)
 	if err := eng.Start(); err != nil {
 		log.Fatalf("Failed to start engine: %v", err)
 	}
 
 	// Pass engine to web server so it can notify about rule changes
-	webServer := web.NewWebServer(mqttClient, dbConn.Pool(), redisClient, cfg.JWT.Secret, eng, cfg.App.AgentID)
+	webServer := web.NewWebServer(mqttClient, dbConn.Pool(), redisClient, cfg.JWT.Secret, cfg.Auth, cfg.RateLimit, eng, cfg.App.AgentID)
 	go webServer.Start(fmt.Sprintf(":%d", cfg.App.Port))
 
 	// Start mDNS server
@@ -25,12 +25,13 @@ var upgrader = websocket.Upgrader{
 }
 
 type RequestMsg struct {
-	Type    string            `json:"type"`
-	ReqId   string            `json:"reqId"`
-	Method  string            `json:"method"`
-	Path    string            `json:"path"`
-	Headers map[string]string `json:"headers"`
-	Body    interface{}       `json:"body"`
+	Type     string            `json:"type"`
+	ReqId    string            `json:"reqId"`
+	Method   string            `json:"method"`
+	Path     string            `json:"path"`
+	Headers  map[string]string `json:"headers"`
+	Body     interface{}       `json:"body"`
+	ClientIP string            `json:"clientIp"`
 }
 
 type ResponseMsg struct {
@@ -135,12 +136,13 @@ func handleClientRequest(c *gin.Context) {
 	reqId := fmt.Sprintf("%d", time.Now().UnixNano())
 
 	msg := RequestMsg{
-		Type:    "request",
-		ReqId:   reqId,
-		Method:  c.Request.Method,
-		Path:    c.Request.URL.Path,
-		Headers: headers,
-		Body:    body,
+		Type:     "request",
+		ReqId:    reqId,
+		Method:   c.Request.Method,
+		Path:     c.Request.URL.Path,
+		Headers:  headers,
+		Body:     body,
+		ClientIP: c.ClientIP(),
 	}
 
 	data, _ := json.Marshal(msg)
@@ -0,0 +1,287 @@
+package alarm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"smarthome/internal/automation"
+	"smarthome/internal/clock"
+	"smarthome/internal/db"
+	"smarthome/internal/models"
+	"smarthome/internal/taskqueue"
+	"smarthome/internal/utils"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/jackc/pgx/v5"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// TriggeredByPanic is the trigger of an alarm set off by hand
+const TriggeredByPanic = "panic"
+
+// ErrNotDisarmed is returned when arming a panel whose alarm is going off
+var ErrNotDisarmed = errors.New("the alarm must be disarmed first")
+
+// ErrStateChanged is returned when the panel changed state while handling a request
+var ErrStateChanged = errors.New("alarm state changed concurrently")
+
+// Manager runs the alarm panels of all households. Arming waits out the exit delay
+// before watching sensors; a tripped sensor starts the entry delay, and the alarm
+// goes off unless it is disarmed in time. The siren sounds for the trigger time,
+// after which the panel returns to its armed mode. Delays run as queued tasks and
+// every change is a conditional update, so several engine replicas apply each once.
+type Manager struct {
+	db    *db.DB
+	redis *redis.Client
+	mqtt  mqtt.Client
+}
+
+// NewManager creates an alarm manager
+func NewManager(dbConn *db.DB, redisClient *redis.Client, mqttClient mqtt.Client) *Manager {
+	return &Manager{db: dbConn, redis: redisClient, mqtt: mqttClient}
+}
+
+// Start caches the state of every panel and watches device updates for tripped sensors
+func (m *Manager) Start() error {
+	panels, err := m.db.GetAllAlarmPanels(context.Background())
+	if err != nil {
+		return err
+	}
+	for _, p := range panels {
+		if err := automation.CacheAlarm(context.Background(), m.redis, p); err != nil {
+			log.Printf("ALARM: Failed to cache panel %s: %v", p.ID, err)
+		}
+	}
+	taskqueue.SetAlarmHandlers(m.onSensor, m.onTimer)
+	log.Printf("ALARM: Loaded %d alarm panels", len(panels))
+	return nil
+}
+
+// HashPIN returns the stored hash of a PIN
+func HashPIN(pin string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(pin), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// CheckPIN reports whether pin is the panel's PIN; a panel without a PIN accepts any
+func CheckPIN(panel models.AlarmPanel, pin string) bool {
+	if panel.PINHash == "" {
+		return true
+	}
+	return bcrypt.CompareHashAndPassword([]byte(panel.PINHash), []byte(pin)) == nil
+}
+
+// Remove forgets a deleted panel, which leaves the household disarmed
+func (m *Manager) Remove(panel models.AlarmPanel) error {
+	panel.State, panel.ArmedMode, panel.TriggeredBy = automation.AlarmDisarmed, "", ""
+	return automation.CacheAlarm(context.Background(), m.redis, panel)
+}
+
+// Refresh re-caches a created or changed panel
+func (m *Manager) Refresh(panelID string) error {
+	panel, err := m.db.GetAlarmPanelByID(context.Background(), panelID)
+	if err != nil {
+		return err
+	}
+	return automation.CacheAlarm(context.Background(), m.redis, *panel)
+}
+
+// Arm arms a panel in mode, after the exit delay if it has one. Arming an armed
+// panel in another mode switches modes right away; arming again during the exit
+// delay restarts it.
+func (m *Manager) Arm(panel *models.AlarmPanel, mode string) error {
+	if !automation.ValidAlarmMode(mode) {
+		return fmt.Errorf("unknown alarm mode %q", mode)
+	}
+	if panel.State == automation.AlarmTriggered || (panel.State == automation.AlarmPending && panel.TriggeredBy != "") {
+		return ErrNotDisarmed
+	}
+	if panel.ExitDelay > 0 && (panel.State == automation.AlarmDisarmed || panel.State == automation.AlarmPending) {
+		if err := m.transition(panel, automation.AlarmPending, mode, ""); err != nil {
+			return err
+		}
+		m.notify(*panel, fmt.Sprintf("%s arming %s in %d seconds", panel.Name, mode, panel.ExitDelay))
+		return taskqueue.EnqueueAlarmTimer(panel.ID, panel.StateChangedAt, time.Duration(panel.ExitDelay)*time.Second)
+	}
+	if err := m.transition(panel, mode, mode, ""); err != nil {
+		return err
+	}
+	m.notify(*panel, fmt.Sprintf("%s is %s", panel.Name, mode))
+	return nil
+}
+
+// Disarm disarms a panel, silencing the siren if it sounds
+func (m *Manager) Disarm(panel *models.AlarmPanel) error {
+	if panel.State == automation.AlarmDisarmed {
+		return nil
+	}
+	if err := m.transition(panel, automation.AlarmDisarmed, "", ""); err != nil {
+		return err
+	}
+	m.notify(*panel, fmt.Sprintf("%s is disarmed", panel.Name))
+	return nil
+}
+
+// Trigger sets off a panel's alarm right away
+func (m *Manager) Trigger(panel *models.AlarmPanel, triggeredBy string) error {
+	if panel.State == automation.AlarmTriggered {
+		return nil
+	}
+	armedMode := panel.ArmedMode
+	if panel.State == automation.AlarmPending && panel.TriggeredBy == "" {
+		// Set off during the exit delay: the panel was not armed yet
+		armedMode = ""
+	}
+	if err := m.transition(panel, automation.AlarmTriggered, armedMode, triggeredBy); err != nil {
+		return err
+	}
+	m.notify(*panel, fmt.Sprintf("%s triggered by %s", panel.Name, m.sensorName(triggeredBy)))
+	if panel.TriggerDuration > 0 {
+		return taskqueue.EnqueueAlarmTimer(panel.ID, panel.StateChangedAt, time.Duration(panel.TriggerDuration)*time.Second)
+	}
+	return nil
+}
+
+// onSensor starts the entry delay, or sets off the alarm, of every armed panel
+// watching a tripped sensor in its mode
+func (m *Manager) onSensor(deviceID string, state utils.DeviceState) {
+	if !Tripped(state) {
+		return
+	}
+	panels, err := m.db.GetArmedAlarmPanelsWatching(context.Background(), deviceID)
+	if err != nil {
+		log.Printf("ALARM: Failed to load panels watching device %s: %v", deviceID, err)
+		return
+	}
+	for i := range panels {
+		panel := &panels[i]
+		log.Printf("ALARM: Sensor %s tripped on panel %s (%s)", deviceID, panel.ID, panel.State)
+		if panel.EntryDelay <= 0 {
+			err = m.Trigger(panel, deviceID)
+		} else if err = m.transition(panel, automation.AlarmPending, panel.ArmedMode, deviceID); err == nil {
+			m.notify(*panel, fmt.Sprintf("%s tripped by %s, disarm within %d seconds", panel.Name, m.sensorName(deviceID), panel.EntryDelay))
+			err = taskqueue.EnqueueAlarmTimer(panel.ID, panel.StateChangedAt, time.Duration(panel.EntryDelay)*time.Second)
+		}
+		if err != nil && !errors.Is(err, ErrStateChanged) {
+			log.Printf("ALARM: Failed to handle sensor %s on panel %s: %v", deviceID, panel.ID, err)
+		}
+	}
+}
+
+// onTimer ends the exit delay, entry delay or trigger time the panel entered at
+// changedAt, unless it has changed state since
+func (m *Manager) onTimer(panelID string, changedAt time.Time) error {
+	panel, err := m.db.GetAlarmPanelByID(context.Background(), panelID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !panel.StateChangedAt.Equal(changedAt) {
+		return nil
+	}
+
+	switch {
+	case panel.State == automation.AlarmPending && panel.TriggeredBy != "":
+		err = m.Trigger(panel, panel.TriggeredBy)
+	case panel.State == automation.AlarmPending:
+		if err = m.transition(panel, panel.ArmedMode, panel.ArmedMode, ""); err == nil {
+			m.notify(*panel, fmt.Sprintf("%s is %s", panel.Name, panel.State))
+		}
+	case panel.State == automation.AlarmTriggered && panel.ArmedMode != "":
+		err = m.transition(panel, panel.ArmedMode, panel.ArmedMode, "")
+	case panel.State == automation.AlarmTriggered:
+		err = m.transition(panel, automation.AlarmDisarmed, "", "")
+	}
+	if errors.Is(err, ErrStateChanged) {
+		return nil
+	}
+	return err
+}
+
+// transition moves a panel to a state, sounds or silences the siren, and
+// re-evaluates the rules reading the alarm
+func (m *Manager) transition(panel *models.AlarmPanel, state, armedMode, triggeredBy string) error {
+	ctx := context.Background()
+	// Postgres keeps microseconds; timers compare against the stored time
+	at := clock.Now().Truncate(time.Microsecond)
+	changed, err := m.db.SetAlarmState(ctx, panel.ID, panel.StateChangedAt, state, armedMode, triggeredBy, at)
+	if err != nil {
+		return err
+	}
+	if !changed {
+		return ErrStateChanged
+	}
+	previous := panel.State
+	panel.State, panel.ArmedMode, panel.TriggeredBy, panel.StateChangedAt = state, armedMode, triggeredBy, at
+	log.Printf("ALARM: Panel %s (household %s) %s -> %s", panel.ID, panel.OwnerID, previous, state)
+
+	if err := automation.CacheAlarm(ctx, m.redis, *panel); err != nil {
+		log.Printf("ALARM: Failed to cache panel %s: %v", panel.ID, err)
+	}
+	switch {
+	case state == automation.AlarmTriggered:
+		m.runActions(*panel, panel.SirenActions)
+	case previous == automation.AlarmTriggered:
+		m.runActions(*panel, panel.SirenOffActions)
+	}
+	for _, ruleID := range automation.AlarmDependents(ctx, m.redis, panel.OwnerID) {
+		if err := taskqueue.EnqueueAlarmEvaluation(ruleID, panel.ID); err != nil {
+			log.Printf("ALARM: Failed to enqueue evaluation for rule %s: %v", ruleID, err)
+		}
+	}
+	return nil
+}
+
+// runActions publishes a panel's siren commands and sends its notifications, with
+// the sensor that set off the alarm as the templates' trigger device
+func (m *Manager) runActions(panel models.AlarmPanel, actionsRaw json.RawMessage) {
+	var actions []models.Action
+	if err := json.Unmarshal(actionsRaw, &actions); err != nil || len(actions) == 0 {
+		return
+	}
+	tctx := automation.TemplateContext{
+		RedisClient: m.redis,
+		Scope:       automation.VariableScope{OwnerID: panel.OwnerID},
+		Now:         clock.Now(),
+	}
+	if panel.TriggeredBy != TriggeredByPanic {
+		tctx.TriggerDeviceID = panel.TriggeredBy
+	}
+
+	for _, action := range actions {
+		if action.DeviceID == "" || m.mqtt == nil {
+			continue
+		}
+		var params map[string]interface{}
+		if err := json.Unmarshal(action.Params, &params); err != nil {
+			continue
+		}
+		if _, err := automation.PublishCommand(context.Background(), m.redis, m.mqtt, action.DeviceID, automation.RenderParams(params, tctx), "alarm:"+panel.ID); err != nil {
+			log.Printf("ALARM: Siren command to device %s not sent: %v", action.DeviceID, err)
+		}
+	}
+	automation.ExecuteNotifications(actionsRaw, tctx)
+}
+
+// notify sends an alarm notification
+func (m *Manager) notify(panel models.AlarmPanel, msg string) {
+	log.Printf("ALARM: Sending notification to household %s: %s", panel.OwnerID, msg)
+}
+
+// sensorName describes what set off an alarm
+func (m *Manager) sensorName(triggeredBy string) string {
+	if triggeredBy == TriggeredByPanic {
+		return "the panic button"
+	}
+	if device, err := m.db.GetDeviceByID(context.Background(), triggeredBy); err == nil && device.Name != "" {
+		return fmt.Sprintf("%s (%s)", device.Name, triggeredBy)
+	}
+	return "sensor " + triggeredBy
+}
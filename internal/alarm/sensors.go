@@ -0,0 +1,36 @@
+package alarm
+
+import (
+	"strings"
+
+	"smarthome/internal/utils"
+)
+
+// trippedKeys maps the state attributes door, window and motion sensors report to
+// the value meaning the sensor tripped
+var trippedKeys = map[string]bool{
+	"contact":   false, // Contact sensors report contact: false when the door opens
+	"open":      true,
+	"motion":    true,
+	"occupancy": true,
+	"presence":  true,
+	"tamper":    true,
+	"alarm":     true,
+}
+
+// Tripped reports whether a sensor state shows an open door or window, motion or
+// tampering, either as a boolean attribute or as a "state" of open, on or detected
+func Tripped(state utils.DeviceState) bool {
+	for key, tripped := range trippedKeys {
+		if value, ok := state[key].(bool); ok && value == tripped {
+			return true
+		}
+	}
+	if value, ok := state["state"].(string); ok {
+		switch strings.ToLower(value) {
+		case "open", "on", "detected", "motion":
+			return true
+		}
+	}
+	return false
+}
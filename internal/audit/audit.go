@@ -0,0 +1,256 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Audited actions
+const (
+	ActionLogin             = "login"
+	ActionLoginFailed       = "login_failed"
+	ActionTwoFactorEnable   = "2fa_enable"
+	ActionTwoFactorDisable  = "2fa_disable"
+	ActionDeviceAccept      = "device_accept"
+	ActionDeviceOwnerChange = "device_owner_change"
+	ActionDeviceDelete      = "device_delete"
+	ActionDeviceCommand     = "device_command"
+	ActionVirtualDeviceSave = "virtual_device_save"
+	ActionRuleCreate        = "rule_create"
+	ActionRuleUpdate        = "rule_update"
+	ActionRuleDelete        = "rule_delete"
+	ActionRuleCommand       = "rule_command"
+	ActionRuleRun           = "rule_run"
+	ActionVariableSet       = "variable_set"
+	ActionScheduleCreate    = "schedule_create"
+	ActionScheduleUpdate    = "schedule_update"
+	ActionScheduleDelete    = "schedule_delete"
+	ActionCalendarSave      = "calendar_save"
+	ActionCalendarDelete    = "calendar_delete"
+	ActionPersonSave        = "person_save"
+	ActionPersonDelete      = "person_delete"
+	ActionPresenceSet       = "presence_set"
+	ActionZoneSave          = "zone_save"
+	ActionZoneDelete        = "zone_delete"
+	ActionGeofenceCreate    = "geofence_device_create"
+	ActionGeofenceDelete    = "geofence_device_delete"
+	ActionAlarmSave         = "alarm_save"
+	ActionAlarmDelete       = "alarm_delete"
+	ActionAlarmArm          = "alarm_arm"
+	ActionAlarmDisarm       = "alarm_disarm"
+	ActionAlarmTrigger      = "alarm_trigger"
+	ActionAlarmPINFailed    = "alarm_pin_failed"
+	ActionInterlockSave     = "interlock_save"
+	ActionInterlockDelete   = "interlock_delete"
+	ActionCommandRejected   = "command_rejected"
+	ActionInterlockOff      = "interlock_off"
+	ActionVacationSave      = "vacation_save"
+	ActionVacationEnable    = "vacation_enable"
+	ActionVacationDisable   = "vacation_disable"
+	ActionTariffSave        = "energy_tariff_save"
+)
+
+// Sources for actions that did not come from a direct HTTP client
+const (
+	SourceEngine       = "engine"
+	SourceRemoteBridge = "remote bridge"
+)
+
+// RemoteBridgeHeader is set by the internet bridge agent on every proxied request
+const RemoteBridgeHeader = "X-Remote-Bridge"
+
+// RemoteClientIPHeader carries the IP of the client that sent a proxied request
+// to the public server
+const RemoteClientIPHeader = "X-Remote-Bridge-Client-IP"
+
+// Entry is a single audit log record
+type Entry struct {
+	ID        int64           `json:"id"`
+	Timestamp time.Time       `json:"timestamp"`
+	ActorID   string          `json:"actor_id,omitempty"` // User ID, empty for engine actions and failed logins
+	Actor     string          `json:"actor"`              // Username, attempted username or "rule:<id>"
+	OwnerID   string          `json:"owner_id,omitempty"` // User whose home the entry concerns; resolved from the rule, device or actor when empty
+	Action    string          `json:"action"`
+	Source    string          `json:"source"` // Client IP, "remote bridge" or "engine"
+	DeviceID  string          `json:"device_id,omitempty"`
+	RuleID    string          `json:"rule_id,omitempty"`
+	Details   json.RawMessage `json:"details,omitempty"`
+	Before    json.RawMessage `json:"before,omitempty"`
+	After     json.RawMessage `json:"after,omitempty"`
+}
+
+// Filter narrows down audit log queries. Empty fields are ignored.
+type Filter struct {
+	ActorID  string
+	OwnerID  string // Entries owned by or acted on by this user
+	DeviceID string
+	RuleID   string
+	Action   string
+	From     *time.Time
+	To       *time.Time
+	Limit    int
+}
+
+// Logger writes and reads the append-only audit log
+type Logger struct {
+	pool *pgxpool.Pool
+}
+
+// NewLogger creates an audit logger
+func NewLogger(pool *pgxpool.Pool) *Logger {
+	return &Logger{pool: pool}
+}
+
+// Record appends an entry. When Actor is empty it is resolved from the username of
+// ActorID. When OwnerID is empty it is the owner of the rule or device, or else the
+// actor, so engine entries without an actor stay visible to the rule's owner.
+// Failures are logged but never block the audited action.
+func (l *Logger) Record(ctx context.Context, e Entry) {
+	_, err := l.pool.Exec(ctx,
+		`INSERT INTO audit_log (actor_id, actor, action, source, device_id, rule_id, details, before, after, owner_id)
+		 VALUES ($1, COALESCE(NULLIF($2, ''), (SELECT username FROM users WHERE id = $1), ''), $3, $4, $5, $6, $7, $8, $9,
+		         COALESCE($10, (SELECT owner_id FROM rules WHERE id = $6), (SELECT owner_id FROM devices WHERE id = $5), $1))`,
+		nullIfEmpty(e.ActorID), e.Actor, e.Action, e.Source, nullIfEmpty(e.DeviceID), nullIfEmpty(e.RuleID),
+		nullIfEmptyJSON(e.Details), nullIfEmptyJSON(e.Before), nullIfEmptyJSON(e.After), nullIfEmpty(e.OwnerID))
+	if err != nil {
+		log.Printf("AUDIT: Failed to record %s by %s: %v", e.Action, e.Actor, err)
+	}
+}
+
+// Query returns entries matching the filter, newest first
+func (l *Logger) Query(ctx context.Context, f Filter) ([]Entry, error) {
+	var conditions []string
+	var args []interface{}
+	addCondition := func(clause string, value interface{}) {
+		args = append(args, value)
+		conditions = append(conditions, fmt.Sprintf(clause, len(args)))
+	}
+
+	if f.ActorID != "" {
+		addCondition("actor_id = $%d", f.ActorID)
+	}
+	if f.OwnerID != "" {
+		addCondition("(owner_id = $%[1]d OR actor_id = $%[1]d)", f.OwnerID)
+	}
+	if f.DeviceID != "" {
+		addCondition("device_id = $%d", f.DeviceID)
+	}
+	if f.RuleID != "" {
+		addCondition("rule_id = $%d", f.RuleID)
+	}
+	if f.Action != "" {
+		addCondition("action = $%d", f.Action)
+	}
+	if f.From != nil {
+		addCondition("timestamp >= $%d", *f.From)
+	}
+	if f.To != nil {
+		addCondition("timestamp <= $%d", *f.To)
+	}
+
+	query := "SELECT id, timestamp, actor_id, actor, owner_id, action, source, device_id, rule_id, details, before, after FROM audit_log"
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	limit := f.Limit
+	if limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+	query += fmt.Sprintf(" ORDER BY timestamp DESC, id DESC LIMIT %d", limit)
+
+	rows, err := l.pool.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []Entry{}
+	for rows.Next() {
+		var e Entry
+		var actorID, ownerID, deviceID, ruleID *string
+		if err := rows.Scan(&e.ID, &e.Timestamp, &actorID, &e.Actor, &ownerID, &e.Action, &e.Source, &deviceID, &ruleID, &e.Details, &e.Before, &e.After); err != nil {
+			return nil, err
+		}
+		e.ActorID = derefString(actorID)
+		e.OwnerID = derefString(ownerID)
+		e.DeviceID = derefString(deviceID)
+		e.RuleID = derefString(ruleID)
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// RequestSource returns the client IP of a request, or "remote bridge" for
+// requests proxied by the local internet bridge agent
+func RequestSource(r *http.Request) string {
+	host, bridged := requestHost(r)
+	if bridged {
+		return SourceRemoteBridge
+	}
+	return host
+}
+
+// ClientIP returns the IP of the client behind a request. For requests proxied
+// by the internet bridge agent it is the IP the public server saw, so lockouts
+// and rate limits do not lump every remote client together.
+func ClientIP(r *http.Request) string {
+	host, bridged := requestHost(r)
+	if !bridged {
+		return host
+	}
+	if ip := net.ParseIP(r.Header.Get(RemoteClientIPHeader)); ip != nil {
+		return ip.String()
+	}
+	return host
+}
+
+// requestHost returns the host of the connection and whether the request came
+// through the internet bridge agent
+func requestHost(r *http.Request) (string, bool) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	// Only trust the bridge marker on loopback connections, where the agent lives
+	ip := net.ParseIP(host)
+	return host, ip != nil && ip.IsLoopback() && r.Header.Get(RemoteBridgeHeader) != ""
+}
+
+// Marshal encodes a value for the Details/Before/After fields
+func Marshal(v interface{}) json.RawMessage {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+func nullIfEmpty(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+func nullIfEmptyJSON(raw json.RawMessage) interface{} {
+	if len(raw) == 0 {
+		return nil
+	}
+	return raw
+}
+
+func derefString(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
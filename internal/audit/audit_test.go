@@ -0,0 +1,74 @@
+package audit
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestClientIPAndRequestSource(t *testing.T) {
+	tests := []struct {
+		name       string
+		remoteAddr string
+		headers    map[string]string
+		wantIP     string
+		wantSource string
+	}{
+		{"direct client", "203.0.113.7:51234", nil, "203.0.113.7", "203.0.113.7"},
+		{"local client", "127.0.0.1:51234", nil, "127.0.0.1", "127.0.0.1"},
+		{
+			name:       "bridged client",
+			remoteAddr: "127.0.0.1:51234",
+			headers:    map[string]string{RemoteBridgeHeader: "1", RemoteClientIPHeader: "198.51.100.4"},
+			wantIP:     "198.51.100.4",
+			wantSource: SourceRemoteBridge,
+		},
+		{
+			name:       "bridged over IPv6 loopback",
+			remoteAddr: "[::1]:51234",
+			headers:    map[string]string{RemoteBridgeHeader: "1", RemoteClientIPHeader: "2001:db8::1"},
+			wantIP:     "2001:db8::1",
+			wantSource: SourceRemoteBridge,
+		},
+		{
+			name:       "bridged without a forwarded IP",
+			remoteAddr: "127.0.0.1:51234",
+			headers:    map[string]string{RemoteBridgeHeader: "1"},
+			wantIP:     "127.0.0.1",
+			wantSource: SourceRemoteBridge,
+		},
+		{
+			name:       "bridged with an invalid forwarded IP",
+			remoteAddr: "127.0.0.1:51234",
+			headers:    map[string]string{RemoteBridgeHeader: "1", RemoteClientIPHeader: "not an ip"},
+			wantIP:     "127.0.0.1",
+			wantSource: SourceRemoteBridge,
+		},
+		{
+			name:       "forwarded IP without the bridge marker",
+			remoteAddr: "127.0.0.1:51234",
+			headers:    map[string]string{RemoteClientIPHeader: "198.51.100.4"},
+			wantIP:     "127.0.0.1",
+			wantSource: "127.0.0.1",
+		},
+		{
+			name:       "bridge headers from a remote client",
+			remoteAddr: "203.0.113.7:51234",
+			headers:    map[string]string{RemoteBridgeHeader: "1", RemoteClientIPHeader: "198.51.100.4"},
+			wantIP:     "203.0.113.7",
+			wantSource: "203.0.113.7",
+		},
+	}
+
+	for _, tt := range tests {
+		r := &http.Request{RemoteAddr: tt.remoteAddr, Header: http.Header{}}
+		for key, value := range tt.headers {
+			r.Header.Set(key, value)
+		}
+		if got := ClientIP(r); got != tt.wantIP {
+			t.Errorf("%s: ClientIP() = %q, want %q", tt.name, got, tt.wantIP)
+		}
+		if got := RequestSource(r); got != tt.wantSource {
+			t.Errorf("%s: RequestSource() = %q, want %q", tt.name, got, tt.wantSource)
+		}
+	}
+}
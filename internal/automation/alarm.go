@@ -0,0 +1,140 @@
+package automation
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"smarthome/internal/models"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// An "alarm" condition leaf such as {"type": "alarm", "value": "armed_away"} reads
+// the state of the household's alarm panel. Values are the panel states, plus
+// "armed" for any armed mode. "op": "!=" inverts the leaf. Rules using it are
+// re-evaluated on every alarm state change, so {"type": "alarm", "value": "triggered"}
+// reacts to the alarm going off.
+
+// Alarm panel states
+const (
+	AlarmDisarmed   = "disarmed"
+	AlarmArmedHome  = "armed_home"
+	AlarmArmedAway  = "armed_away"
+	AlarmArmedNight = "armed_night"
+	AlarmPending    = "pending" // Exit delay after arming, or entry delay after a sensor tripped
+	AlarmTriggered  = "triggered"
+	AlarmArmed      = "armed" // Condition value matching any armed mode
+)
+
+// ValidAlarmMode reports whether mode is a mode the alarm can be armed in
+func ValidAlarmMode(mode string) bool {
+	return mode == AlarmArmedHome || mode == AlarmArmedAway || mode == AlarmArmedNight
+}
+
+// ValidAlarmValue reports whether value is an alarm condition value
+func ValidAlarmValue(value string) bool {
+	switch value {
+	case AlarmDisarmed, AlarmPending, AlarmTriggered, AlarmArmed:
+		return true
+	}
+	return ValidAlarmMode(value)
+}
+
+// AlarmRecord is the cached state of an alarm panel
+type AlarmRecord struct {
+	State       string    `json:"state"`
+	ArmedMode   string    `json:"armed_mode"`
+	TriggeredBy string    `json:"triggered_by"`
+	ChangedAt   time.Time `json:"changed_at"`
+}
+
+func alarmKey(ownerID string) string {
+	return fmt.Sprintf("alarm:%s", ownerID)
+}
+
+// alarmRulesKey is the Redis set of rules with an alarm leaf on a household
+func alarmRulesKey(ownerID string) string {
+	return fmt.Sprintf("alarm:%s:rules", ownerID)
+}
+
+// CacheAlarm stores the state of a household's alarm panel for condition evaluation
+func CacheAlarm(ctx context.Context, redisClient *redis.Client, panel models.AlarmPanel) error {
+	encoded, _ := json.Marshal(AlarmRecord{State: panel.State, ArmedMode: panel.ArmedMode, TriggeredBy: panel.TriggeredBy, ChangedAt: panel.StateChangedAt})
+	return redisClient.Set(ctx, alarmKey(panel.OwnerID), encoded, 0).Err()
+}
+
+// LoadAlarm returns the cached alarm state of a household
+func LoadAlarm(ctx context.Context, redisClient *redis.Client, ownerID string) (AlarmRecord, bool) {
+	raw, err := redisClient.Get(ctx, alarmKey(ownerID)).Result()
+	if err != nil {
+		return AlarmRecord{}, false
+	}
+	var record AlarmRecord
+	if err := json.Unmarshal([]byte(raw), &record); err != nil {
+		return AlarmRecord{}, false
+	}
+	return record, true
+}
+
+// HasAlarmCondition reports whether a rule's conditions read the alarm
+func HasAlarmCondition(conditionsRaw json.RawMessage) bool {
+	var condition models.Condition
+	if err := json.Unmarshal(conditionsRaw, &condition); err != nil {
+		return false
+	}
+	return hasAlarmConditionRecursive(condition)
+}
+
+func hasAlarmConditionRecursive(cond models.Condition) bool {
+	if cond.Type == "alarm" {
+		return true
+	}
+	for _, child := range cond.Children {
+		if hasAlarmConditionRecursive(child) {
+			return true
+		}
+	}
+	return false
+}
+
+// IndexRuleAlarm records that a rule reads its owner's alarm so state changes re-evaluate it
+func IndexRuleAlarm(ctx context.Context, redisClient *redis.Client, rule models.Rule) {
+	if !HasAlarmCondition(rule.Conditions) {
+		return
+	}
+	redisClient.SAdd(ctx, alarmRulesKey(rule.OwnerID), rule.ID)
+	log.Printf("AUTOMATION: Associated rule %s with alarm of household %s", rule.ID, rule.OwnerID)
+}
+
+// AlarmDependents returns the rules to re-evaluate when a household's alarm changes state
+func AlarmDependents(ctx context.Context, redisClient *redis.Client, ownerID string) []string {
+	ruleIDs, err := redisClient.SMembers(ctx, alarmRulesKey(ownerID)).Result()
+	if err != nil {
+		log.Printf("AUTOMATION: Failed to fetch rules for alarm of household %s: %v", ownerID, err)
+		return nil
+	}
+	return ruleIDs
+}
+
+// alarmMatches evaluates an alarm leaf for the household of scope; a household
+// without a panel is disarmed
+func alarmMatches(redisClient *redis.Client, cond models.Condition, scope VariableScope) bool {
+	if redisClient == nil {
+		return false
+	}
+	var value string
+	json.Unmarshal(cond.Value, &value)
+	record, ok := LoadAlarm(context.Background(), redisClient, scope.OwnerID)
+	if !ok {
+		record = AlarmRecord{State: AlarmDisarmed}
+	}
+	result := record.State == value || (value == AlarmArmed && strings.HasPrefix(record.State, "armed_"))
+	if cond.Op == "!=" {
+		return !result
+	}
+	return result
+}
@@ -0,0 +1,338 @@
+package automation
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// BlueprintInputPrefix marks a placeholder in a blueprint's conditions or actions.
+// A JSON string value of exactly "!input <name>" is replaced by the typed input value.
+const BlueprintInputPrefix = "!input "
+
+// Blueprint input types
+const (
+	InputDevice   = "device"
+	InputNumber   = "number"
+	InputBoolean  = "boolean"
+	InputString   = "string"
+	InputTime     = "time"     // "HH:MM"
+	InputDuration = "duration" // Go duration string, e.g. "5m"
+)
+
+var blueprintSlugPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+var timeOfDayPattern = regexp.MustCompile(`^([01][0-9]|2[0-3]):[0-5][0-9]$`)
+
+// Blueprint is a reusable rule template with typed inputs
+type Blueprint struct {
+	Slug        string           `json:"slug"`
+	Name        string           `json:"name"`
+	Description string           `json:"description"`
+	Inputs      []BlueprintInput `json:"inputs"`
+	Conditions  json.RawMessage  `json:"conditions"`
+	Actions     json.RawMessage  `json:"actions"`
+	Builtin     bool             `json:"builtin"`
+	OwnerID     *string          `json:"owner_id,omitempty"`
+}
+
+// BlueprintInput describes a single parameter of a blueprint
+type BlueprintInput struct {
+	Name        string      `json:"name"`
+	Type        string      `json:"type"`
+	DeviceType  string      `json:"device_type,omitempty"` // Required device type for device inputs
+	Description string      `json:"description,omitempty"`
+	Default     interface{} `json:"default,omitempty"`
+	Min         *float64    `json:"min,omitempty"`
+	Max         *float64    `json:"max,omitempty"`
+	Options     []string    `json:"options,omitempty"` // Allowed values for string inputs
+}
+
+// Validate checks the blueprint definition and that every placeholder refers to a declared input
+func (b *Blueprint) Validate() error {
+	if !blueprintSlugPattern.MatchString(b.Slug) {
+		return fmt.Errorf("invalid slug %q", b.Slug)
+	}
+	if b.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+
+	declared := make(map[string]bool)
+	for _, in := range b.Inputs {
+		if in.Name == "" {
+			return fmt.Errorf("input name is required")
+		}
+		if declared[in.Name] {
+			return fmt.Errorf("duplicate input %q", in.Name)
+		}
+		declared[in.Name] = true
+		switch in.Type {
+		case InputDevice, InputNumber, InputBoolean, InputString, InputTime, InputDuration:
+		default:
+			return fmt.Errorf("input %q has unknown type %q", in.Name, in.Type)
+		}
+		if in.Default != nil {
+			if _, err := in.coerce(in.Default); err != nil {
+				return fmt.Errorf("input %q has invalid default: %v", in.Name, err)
+			}
+		}
+	}
+
+	for _, doc := range []json.RawMessage{b.Conditions, b.Actions} {
+		var v interface{}
+		if err := json.Unmarshal(doc, &v); err != nil {
+			return fmt.Errorf("invalid conditions or actions: %v", err)
+		}
+		for _, name := range collectInputRefs(v) {
+			if !declared[name] {
+				return fmt.Errorf("placeholder refers to undeclared input %q", name)
+			}
+		}
+	}
+	return nil
+}
+
+// ResolveInputs validates the supplied values against the blueprint's inputs and
+// fills in defaults. deviceType returns the type of a device the user may use,
+// or false when the device is unknown or not theirs.
+func (b *Blueprint) ResolveInputs(values map[string]interface{}, deviceType func(string) (string, bool)) (map[string]interface{}, error) {
+	resolved := make(map[string]interface{}, len(b.Inputs))
+	for _, in := range b.Inputs {
+		raw, ok := values[in.Name]
+		if !ok || raw == nil {
+			if in.Default == nil {
+				return nil, fmt.Errorf("missing input %q", in.Name)
+			}
+			raw = in.Default
+		}
+
+		value, err := in.coerce(raw)
+		if err != nil {
+			return nil, fmt.Errorf("input %q: %v", in.Name, err)
+		}
+
+		if in.Type == InputDevice {
+			typ, found := deviceType(value.(string))
+			if !found {
+				return nil, fmt.Errorf("input %q: device %v not found", in.Name, value)
+			}
+			// Devices that never reported a type are accepted for any device input
+			if in.DeviceType != "" && typ != in.DeviceType && typ != "unknown" && typ != "" {
+				return nil, fmt.Errorf("input %q: device %v is a %s, expected %s", in.Name, value, typ, in.DeviceType)
+			}
+		}
+		resolved[in.Name] = value
+	}
+
+	for name := range values {
+		if !b.hasInput(name) {
+			return nil, fmt.Errorf("unknown input %q", name)
+		}
+	}
+	return resolved, nil
+}
+
+// Render substitutes resolved input values into the blueprint's conditions and actions
+func (b *Blueprint) Render(inputs map[string]interface{}) (json.RawMessage, json.RawMessage, error) {
+	conditions, err := renderBlueprintDocument(b.Conditions, inputs)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to render conditions: %v", err)
+	}
+	actions, err := renderBlueprintDocument(b.Actions, inputs)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to render actions: %v", err)
+	}
+	return conditions, actions, nil
+}
+
+func (b *Blueprint) hasInput(name string) bool {
+	for _, in := range b.Inputs {
+		if in.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// coerce converts a decoded JSON value into the input's type
+func (in BlueprintInput) coerce(v interface{}) (interface{}, error) {
+	switch in.Type {
+	case InputDevice:
+		switch id := v.(type) {
+		case string:
+			if id != "" {
+				return id, nil
+			}
+		case float64:
+			return fmt.Sprintf("%.0f", id), nil
+		}
+		return nil, fmt.Errorf("expected a device ID")
+	case InputNumber:
+		n, ok := v.(float64)
+		if !ok {
+			return nil, fmt.Errorf("expected a number")
+		}
+		if in.Min != nil && n < *in.Min {
+			return nil, fmt.Errorf("must be at least %v", *in.Min)
+		}
+		if in.Max != nil && n > *in.Max {
+			return nil, fmt.Errorf("must be at most %v", *in.Max)
+		}
+		return n, nil
+	case InputBoolean:
+		b, ok := v.(bool)
+		if !ok {
+			return nil, fmt.Errorf("expected a boolean")
+		}
+		return b, nil
+	case InputString:
+		s, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("expected a string")
+		}
+		if len(in.Options) > 0 {
+			for _, opt := range in.Options {
+				if s == opt {
+					return s, nil
+				}
+			}
+			return nil, fmt.Errorf("must be one of %s", strings.Join(in.Options, ", "))
+		}
+		return s, nil
+	case InputTime:
+		s, ok := v.(string)
+		if !ok || !timeOfDayPattern.MatchString(s) {
+			return nil, fmt.Errorf("expected a time of day as HH:MM")
+		}
+		return s, nil
+	case InputDuration:
+		s, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("expected a duration such as \"5m\"")
+		}
+		if _, err := time.ParseDuration(s); err != nil {
+			return nil, fmt.Errorf("expected a duration such as \"5m\"")
+		}
+		return s, nil
+	}
+	return nil, fmt.Errorf("unknown input type %q", in.Type)
+}
+
+func renderBlueprintDocument(doc json.RawMessage, inputs map[string]interface{}) (json.RawMessage, error) {
+	var v interface{}
+	if err := json.Unmarshal(doc, &v); err != nil {
+		return nil, err
+	}
+	return json.Marshal(substituteInputs(v, inputs))
+}
+
+func substituteInputs(v interface{}, inputs map[string]interface{}) interface{} {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(val))
+		for k, child := range val {
+			out[k] = substituteInputs(child, inputs)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(val))
+		for i, child := range val {
+			out[i] = substituteInputs(child, inputs)
+		}
+		return out
+	case string:
+		if name, ok := inputRef(val); ok {
+			if value, found := inputs[name]; found {
+				return value
+			}
+		}
+		return val
+	default:
+		return val
+	}
+}
+
+func collectInputRefs(v interface{}) []string {
+	var refs []string
+	switch val := v.(type) {
+	case map[string]interface{}:
+		for _, child := range val {
+			refs = append(refs, collectInputRefs(child)...)
+		}
+	case []interface{}:
+		for _, child := range val {
+			refs = append(refs, collectInputRefs(child)...)
+		}
+	case string:
+		if name, ok := inputRef(val); ok {
+			refs = append(refs, name)
+		}
+	}
+	return refs
+}
+
+func inputRef(s string) (string, bool) {
+	if !strings.HasPrefix(s, BlueprintInputPrefix) {
+		return "", false
+	}
+	return strings.TrimSpace(strings.TrimPrefix(s, BlueprintInputPrefix)), true
+}
+
+// BuiltinBlueprints returns the blueprints shipped with the engine
+func BuiltinBlueprints() []Blueprint {
+	return []Blueprint{
+		{
+			Slug:        "motion_light",
+			Name:        "Motion-activated light",
+			Description: "Turn a light on when motion is detected",
+			Inputs: []BlueprintInput{
+				{Name: "motion_sensor", Type: InputDevice, DeviceType: "motion_sensor", Description: "Motion sensor to watch"},
+				{Name: "light", Type: InputDevice, DeviceType: "light", Description: "Light to turn on"},
+				{Name: "brightness", Type: InputNumber, Description: "Brightness in percent", Default: float64(100), Min: floatPtr(1), Max: floatPtr(100)},
+			},
+			Conditions: json.RawMessage(`{"type":"sensor","device_id":"!input motion_sensor","key":"motion","op":"==","value":true}`),
+			Actions:    json.RawMessage(`[{"device_id":"!input light","action":"set_state","params":{"on":true,"brightness":"!input brightness"}}]`),
+			Builtin:    true,
+		},
+		{
+			Slug:        "window_heating_off",
+			Name:        "Window open - heating off",
+			Description: "Turn a heater off while a window is open",
+			Inputs: []BlueprintInput{
+				{Name: "window", Type: InputDevice, DeviceType: "window_sensor", Description: "Window contact sensor"},
+				{Name: "heater", Type: InputDevice, DeviceType: "heater", Description: "Heater or thermostat to turn off"},
+			},
+			Conditions: json.RawMessage(`{"type":"sensor","device_id":"!input window","key":"open","op":"==","value":true}`),
+			Actions:    json.RawMessage(`[{"device_id":"!input heater","action":"set_state","params":{"on":false}}]`),
+			Builtin:    true,
+		},
+		{
+			Slug:        "leak_alarm",
+			Name:        "Leak alarm",
+			Description: "Sound a siren and send a notification when a leak is detected",
+			Inputs: []BlueprintInput{
+				{Name: "leak_sensor", Type: InputDevice, DeviceType: "leak_sensor", Description: "Water leak sensor"},
+				{Name: "siren", Type: InputDevice, DeviceType: "siren", Description: "Siren to sound"},
+				{Name: "message", Type: InputString, Description: "Notification text", Default: "Water leak detected"},
+			},
+			Conditions: json.RawMessage(`{"type":"sensor","device_id":"!input leak_sensor","key":"leak","op":"==","value":true}`),
+			Actions:    json.RawMessage(`[{"device_id":"!input siren","action":"set_state","params":{"on":true}},{"action":"send_email","params":{"message":"!input message"}}]`),
+			Builtin:    true,
+		},
+	}
+}
+
+// BuiltinBlueprint returns the built-in blueprint with the given slug
+func BuiltinBlueprint(slug string) (*Blueprint, bool) {
+	for _, b := range BuiltinBlueprints() {
+		if b.Slug == slug {
+			return &b, true
+		}
+	}
+	return nil, false
+}
+
+func floatPtr(f float64) *float64 {
+	return &f
+}
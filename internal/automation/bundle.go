@@ -0,0 +1,191 @@
+package automation
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"time"
+
+	"smarthome/internal/models"
+)
+
+// BundleVersion is the current rule bundle format version
+const BundleVersion = 1
+
+// Bundle is a portable export of a home's automations. Devices are referenced
+// by a stable name instead of their ID so a bundle can be imported into another
+// home and remapped there. Scenes are not modelled by the backend yet and are
+// therefore not part of the bundle.
+type Bundle struct {
+	Version    int               `json:"version" yaml:"version"`
+	ExportedAt *time.Time        `json:"exported_at,omitempty" yaml:"exported_at,omitempty"` // Only set on request so repeated exports are identical
+	Devices    []BundleDevice    `json:"devices" yaml:"devices"`
+	Rules      []BundleRule      `json:"rules" yaml:"rules"`
+	Schedules  []BundleSchedule  `json:"schedules,omitempty" yaml:"schedules,omitempty"`
+	DeviceMap  map[string]string `json:"device_map,omitempty" yaml:"device_map,omitempty"` // Optional ref -> local device ID overrides used on import
+}
+
+// BundleDevice describes a device referenced by the bundle's rules
+type BundleDevice struct {
+	Ref  string `json:"ref" yaml:"ref"`
+	ID   string `json:"id" yaml:"id"`
+	Name string `json:"name" yaml:"name"`
+	Type string `json:"type" yaml:"type"`
+}
+
+// BundleRule is a rule whose device_id fields contain device refs and whose
+// rule_id fields contain the names of other rules in the bundle
+type BundleRule struct {
+	Name       string      `json:"name" yaml:"name"`
+	Enabled    bool        `json:"enabled" yaml:"enabled"`
+	Conditions interface{} `json:"conditions" yaml:"conditions"`
+	Actions    interface{} `json:"actions" yaml:"actions"`
+
+	Execution models.RuleExecution `json:"execution,omitempty" yaml:"execution,omitempty"`
+}
+
+// BundleSchedule attaches a manual cron or one-shot schedule to a rule by name.
+// Calendar schedules are not exported; schedules generated from time conditions
+// are recreated when the rule is imported.
+type BundleSchedule struct {
+	Rule           string     `json:"rule" yaml:"rule"`
+	CronExpression string     `json:"cron_expression,omitempty" yaml:"cron_expression,omitempty"`
+	RunAt          *time.Time `json:"run_at,omitempty" yaml:"run_at,omitempty"`
+	Timezone       string     `json:"timezone,omitempty" yaml:"timezone,omitempty"`
+	ExcludeDates   []string   `json:"exclude_dates,omitempty" yaml:"exclude_dates,omitempty"`
+	CatchUp        string     `json:"catch_up,omitempty" yaml:"catch_up,omitempty"`
+	CatchUpGrace   int        `json:"catch_up_grace_seconds,omitempty" yaml:"catch_up_grace_seconds,omitempty"`
+	Enabled        bool       `json:"enabled" yaml:"enabled"`
+}
+
+// DecodeJSONValue decodes raw JSON into a generic value for bundling
+func DecodeJSONValue(raw json.RawMessage) interface{} {
+	var v interface{}
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return nil
+	}
+	return v
+}
+
+// CollectDeviceIDs returns all device_id values found anywhere in a decoded
+// conditions or actions document
+func CollectDeviceIDs(v interface{}) []string {
+	seen := make(map[string]bool)
+	walkDeviceIDs(v, func(id string) (string, bool) {
+		seen[id] = true
+		return id, true
+	})
+
+	ids := make([]string, 0, len(seen))
+	for id := range seen {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// RemapDeviceIDs returns a copy of a decoded conditions or actions document with
+// every device_id rewritten by mapping. Values the mapping cannot resolve are
+// left untouched and returned as unresolved.
+func RemapDeviceIDs(v interface{}, mapping func(string) (string, bool)) (interface{}, []string) {
+	var unresolved []string
+	remapped := walkDeviceIDs(v, func(id string) (string, bool) {
+		newID, ok := mapping(id)
+		if !ok {
+			unresolved = append(unresolved, id)
+			return id, false
+		}
+		return newID, true
+	})
+	return remapped, unresolved
+}
+
+// CollectRuleRefs returns all rule_id values found anywhere in a decoded conditions
+// or actions document, i.e. rule_fired leaves and rule chaining action params
+func CollectRuleRefs(v interface{}) []string {
+	seen := make(map[string]bool)
+	walkRuleRefs(v, func(id string) (string, bool) {
+		seen[id] = true
+		return id, true
+	})
+
+	refs := make([]string, 0, len(seen))
+	for ref := range seen {
+		refs = append(refs, ref)
+	}
+	sort.Strings(refs)
+	return refs
+}
+
+// RemapRuleRefs returns a copy of a decoded document with every rule_id rewritten
+// by mapping; unresolvable values are left untouched and returned as unresolved
+func RemapRuleRefs(v interface{}, mapping func(string) (string, bool)) (interface{}, []string) {
+	var unresolved []string
+	remapped := walkRuleRefs(v, func(id string) (string, bool) {
+		newID, ok := mapping(id)
+		if !ok {
+			unresolved = append(unresolved, id)
+			return id, false
+		}
+		return newID, true
+	})
+	return remapped, unresolved
+}
+
+func walkRuleRefs(v interface{}, fn func(string) (string, bool)) interface{} {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(val))
+		for k, child := range val {
+			if id, ok := child.(string); ok && k == "rule_id" && id != "" {
+				out[k], _ = fn(id)
+				continue
+			}
+			out[k] = walkRuleRefs(child, fn)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(val))
+		for i, child := range val {
+			out[i] = walkRuleRefs(child, fn)
+		}
+		return out
+	default:
+		return val
+	}
+}
+
+// walkDeviceIDs copies a decoded JSON/YAML value, passing every string device_id
+// and every device referenced by an expression or a template through fn
+func walkDeviceIDs(v interface{}, fn func(string) (string, bool)) interface{} {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(val))
+		for k, child := range val {
+			if id, ok := child.(string); ok && k == "device_id" && id != "" && !strings.Contains(id, "{{") {
+				out[k], _ = fn(id)
+				continue
+			}
+			if src, ok := child.(string); ok && k == "expression" {
+				out[k], _ = RewriteExpressionDevices(src, fn)
+				continue
+			}
+			out[k] = walkDeviceIDs(child, fn)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(val))
+		for i, child := range val {
+			out[i] = walkDeviceIDs(child, fn)
+		}
+		return out
+	case string:
+		if strings.Contains(val, "{{") {
+			rewritten, _ := RewriteTemplateDevices(val, fn)
+			return rewritten
+		}
+		return val
+	default:
+		return val
+	}
+}
@@ -0,0 +1,43 @@
+package automation
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestCollectAndRemapDeviceIDs(t *testing.T) {
+	actions := DecodeJSONValue(json.RawMessage(`[
+		{"device_id": "1", "action": "set", "params": {"brightness": "{{ device.2.lux | scale(0, 1000, 100, 0) }}"}},
+		{"action": "send_email", "params": {"message": "Door {{ device.3.name }} opened, {{ trigger.value }}"}},
+		{"device_id": "{{ vars.target }}", "action": "set", "params": {"on": true}}
+	]`))
+	conditions := DecodeJSONValue(json.RawMessage(`{"operator": "AND", "children": [
+		{"type": "device", "device_id": "4", "key": "on", "op": "==", "value": true},
+		{"type": "expression", "expression": "device.5.power > 100"}
+	]}`))
+
+	if got, want := CollectDeviceIDs(actions), []string{"1", "2", "3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("CollectDeviceIDs(actions) = %v, want %v", got, want)
+	}
+	if got, want := CollectDeviceIDs(conditions), []string{"4", "5"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("CollectDeviceIDs(conditions) = %v, want %v", got, want)
+	}
+
+	mapping := map[string]string{"1": "11", "2": "12"}
+	remapped, unresolved := RemapDeviceIDs(actions, func(id string) (string, bool) {
+		v, ok := mapping[id]
+		return v, ok
+	})
+	if want := []string{"3"}; !reflect.DeepEqual(unresolved, want) {
+		t.Errorf("RemapDeviceIDs() unresolved = %v, want %v", unresolved, want)
+	}
+	want := DecodeJSONValue(json.RawMessage(`[
+		{"device_id": "11", "action": "set", "params": {"brightness": "{{ device.12.lux | scale(0, 1000, 100, 0) }}"}},
+		{"action": "send_email", "params": {"message": "Door {{ device.3.name }} opened, {{ trigger.value }}"}},
+		{"device_id": "{{ vars.target }}", "action": "set", "params": {"on": true}}
+	]`))
+	if !reflect.DeepEqual(remapped, want) {
+		t.Errorf("RemapDeviceIDs() = %v, want %v", remapped, want)
+	}
+}
@@ -0,0 +1,89 @@
+package automation
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+
+	"smarthome/internal/calendar"
+	"smarthome/internal/models"
+	"smarthome/internal/utils"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// A "calendar" condition leaf such as {"type": "calendar", "calendar_id": "3", "value": "away"}
+// is true while an event of calendar 3 tagged "away" (a category, or text in its summary)
+// is in progress. Without a value any event matches; "op": "!=" inverts the leaf.
+// Rules using it are re-evaluated when a matching event starts or ends.
+
+// calendarRulesKey is the Redis set of rules with a calendar leaf on a calendar
+func calendarRulesKey(calendarID string) string {
+	return fmt.Sprintf("calendar:%s:rules", calendarID)
+}
+
+// ExtractCalendarRefs returns the calendars a rule's conditions read
+func ExtractCalendarRefs(conditionsRaw json.RawMessage) []string {
+	var condition models.Condition
+	if err := json.Unmarshal(conditionsRaw, &condition); err != nil {
+		return nil
+	}
+	seen := make(map[string]bool)
+	extractCalendarRefsRecursive(condition, seen)
+
+	calendarIDs := make([]string, 0, len(seen))
+	for id := range seen {
+		calendarIDs = append(calendarIDs, id)
+	}
+	sort.Strings(calendarIDs)
+	return calendarIDs
+}
+
+func extractCalendarRefsRecursive(cond models.Condition, seen map[string]bool) {
+	if cond.Type == "calendar" && cond.CalendarID != "" {
+		seen[cond.CalendarID] = true
+	}
+	for _, child := range cond.Children {
+		extractCalendarRefsRecursive(child, seen)
+	}
+}
+
+// IndexRuleCalendars records which calendars a rule reads so their events re-evaluate it
+func IndexRuleCalendars(ctx context.Context, redisClient *redis.Client, rule models.Rule) {
+	for _, id := range ExtractCalendarRefs(rule.Conditions) {
+		redisClient.SAdd(ctx, calendarRulesKey(id), rule.ID)
+		log.Printf("AUTOMATION: Associated rule %s with calendar %s", rule.ID, id)
+	}
+}
+
+// CalendarDependents returns the rules to re-evaluate when an event of a calendar starts or ends
+func CalendarDependents(ctx context.Context, redisClient *redis.Client, calendarID string) []string {
+	ruleIDs, err := redisClient.SMembers(ctx, calendarRulesKey(calendarID)).Result()
+	if err != nil {
+		log.Printf("AUTOMATION: Failed to fetch rules for calendar %s: %v", calendarID, err)
+		return nil
+	}
+	return ruleIDs
+}
+
+// calendarEventActive evaluates a calendar leaf
+func calendarEventActive(redisClient *redis.Client, cond models.Condition) bool {
+	var filter string
+	if len(cond.Value) > 0 {
+		json.Unmarshal(cond.Value, &filter)
+	}
+	now := utils.GetCurrentTime()
+	active := false
+	for _, occ := range calendar.LoadOccurrences(context.Background(), redisClient, cond.CalendarID) {
+		if occ.Active(now) && occ.Matches(filter) {
+			active = true
+			break
+		}
+	}
+	if cond.Op == "!=" {
+		return !active
+	}
+	return active
+}
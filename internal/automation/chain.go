@@ -0,0 +1,149 @@
+package automation
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"time"
+
+	"smarthome/internal/models"
+	"smarthome/internal/utils"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Rules can be chained. The trigger_rule, enable_rule and disable_rule actions act on
+// another rule of the same owner, e.g. {"action": "trigger_rule", "params": {"rule_id": "12",
+// "skip_conditions": true}}. A "rule_fired" condition leaf such as
+// {"type": "rule_fired", "rule_id": "12", "value": 30} is true for value seconds after
+// rule 12 executed its actions, and rule 12 firing re-evaluates the rules using it.
+
+// DefaultRuleFiredWindow is how long a rule_fired leaf stays true without an explicit value
+const DefaultRuleFiredWindow = 10 * time.Second
+
+// Rule chaining actions
+const (
+	ActionTriggerRule = "trigger_rule"
+	ActionEnableRule  = "enable_rule"
+	ActionDisableRule = "disable_rule"
+)
+
+// ChainAction is a rendered rule chaining action
+type ChainAction struct {
+	Action         string
+	RuleID         string
+	SkipConditions bool
+}
+
+// ruleFiredKey holds the Unix time in milliseconds a rule last executed its actions
+func ruleFiredKey(ruleID string) string {
+	return fmt.Sprintf("rule:%s:fired", ruleID)
+}
+
+// ruleTriggersKey is the Redis set of rules with a rule_fired leaf on a rule
+func ruleTriggersKey(ruleID string) string {
+	return fmt.Sprintf("rule:%s:rules", ruleID)
+}
+
+// isChainAction reports whether an action acts on another rule
+func isChainAction(action string) bool {
+	return action == ActionTriggerRule || action == ActionEnableRule || action == ActionDisableRule
+}
+
+// ExtractRuleTriggers returns the rules whose firing a rule's conditions react to
+func ExtractRuleTriggers(conditionsRaw json.RawMessage) []string {
+	var condition models.Condition
+	if err := json.Unmarshal(conditionsRaw, &condition); err != nil {
+		return nil
+	}
+	seen := make(map[string]bool)
+	extractRuleTriggersRecursive(condition, seen)
+
+	ruleIDs := make([]string, 0, len(seen))
+	for id := range seen {
+		ruleIDs = append(ruleIDs, id)
+	}
+	sort.Strings(ruleIDs)
+	return ruleIDs
+}
+
+func extractRuleTriggersRecursive(cond models.Condition, seen map[string]bool) {
+	if cond.Type == "rule_fired" && cond.RuleID != "" {
+		seen[cond.RuleID] = true
+	}
+	for _, child := range cond.Children {
+		extractRuleTriggersRecursive(child, seen)
+	}
+}
+
+// IndexRuleTriggers records which rules a rule reacts to so their firing re-evaluates it
+func IndexRuleTriggers(ctx context.Context, redisClient *redis.Client, rule models.Rule) {
+	for _, id := range ExtractRuleTriggers(rule.Conditions) {
+		redisClient.SAdd(ctx, ruleTriggersKey(id), rule.ID)
+		log.Printf("AUTOMATION: Associated rule %s with firing of rule %s", rule.ID, id)
+	}
+}
+
+// RuleFired records that a rule executed its actions and returns the rules to
+// re-evaluate because they react to it
+func RuleFired(ctx context.Context, redisClient *redis.Client, ruleID string, at time.Time) []string {
+	redisClient.Set(ctx, ruleFiredKey(ruleID), at.UnixMilli(), 24*time.Hour)
+	ruleIDs, err := redisClient.SMembers(ctx, ruleTriggersKey(ruleID)).Result()
+	if err != nil {
+		log.Printf("AUTOMATION: Failed to fetch rules triggered by rule %s: %v", ruleID, err)
+		return nil
+	}
+	return ruleIDs
+}
+
+// ruleFiredWithin evaluates a rule_fired leaf
+func ruleFiredWithin(redisClient *redis.Client, cond models.Condition) bool {
+	if redisClient == nil {
+		return false
+	}
+	window := DefaultRuleFiredWindow
+	var seconds float64
+	if err := json.Unmarshal(cond.Value, &seconds); err == nil && seconds > 0 {
+		window = time.Duration(seconds * float64(time.Second))
+	}
+
+	firedRaw, err := redisClient.Get(context.Background(), ruleFiredKey(cond.RuleID)).Result()
+	if err != nil {
+		return false
+	}
+	firedMillis, err := strconv.ParseInt(firedRaw, 10, 64)
+	if err != nil {
+		return false
+	}
+	return utils.GetCurrentTime().Sub(time.UnixMilli(firedMillis)) <= window
+}
+
+// ChainActions returns a rule's rule chaining actions with their params rendered
+func ChainActions(actionsRaw json.RawMessage, tctx TemplateContext) []ChainAction {
+	var actions []models.Action
+	if err := json.Unmarshal(actionsRaw, &actions); err != nil {
+		return nil
+	}
+
+	var chain []ChainAction
+	for _, action := range actions {
+		if !isChainAction(action.Action) {
+			continue
+		}
+		var params map[string]interface{}
+		if err := json.Unmarshal(action.Params, &params); err != nil {
+			continue
+		}
+		params = RenderParams(params, tctx)
+		ruleID, _ := params["rule_id"].(string)
+		if ruleID == "" {
+			continue
+		}
+		skip, _ := params["skip_conditions"].(bool)
+		chain = append(chain, ChainAction{Action: action.Action, RuleID: ruleID, SkipConditions: skip})
+	}
+	return chain
+}
@@ -0,0 +1,140 @@
+package automation
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"smarthome/internal/models"
+)
+
+// compiledExpressions caches parsed expressions by source
+var compiledExpressions sync.Map
+
+// ValidateConditions checks a rule's condition tree before it is saved
+func ValidateConditions(conditionsRaw json.RawMessage) error {
+	var condition models.Condition
+	if err := json.Unmarshal(conditionsRaw, &condition); err != nil {
+		return fmt.Errorf("invalid conditions: %v", err)
+	}
+	return validateCondition(condition, "conditions")
+}
+
+func validateCondition(cond models.Condition, path string) error {
+	if cond.Operator != "" {
+		if cond.Operator != "AND" && cond.Operator != "OR" {
+			return fmt.Errorf("%s: unknown operator %q", path, cond.Operator)
+		}
+		for i, child := range cond.Children {
+			if err := validateCondition(child, fmt.Sprintf("%s.children[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	switch cond.Type {
+	case "time":
+		switch cond.Op {
+		case "==", "!=", "<", "<=", ">", ">=":
+		default:
+			return fmt.Errorf("%s: time conditions support ==, !=, <, <=, > and >=", path)
+		}
+		if _, err := parseTimeOfDay(cond.Value); err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+	case "expression":
+		if _, err := CompileExpression(cond.Expression); err != nil {
+			return fmt.Errorf("%s: invalid expression: %v", path, err)
+		}
+	case "variable":
+		if !variableNamePattern.MatchString(cond.Key) {
+			return fmt.Errorf("%s: variable conditions need the variable name as key", path)
+		}
+	case "rule_fired":
+		if cond.RuleID == "" {
+			return fmt.Errorf("%s: rule_fired conditions need a rule_id", path)
+		}
+	case "presence":
+		var value string
+		if err := json.Unmarshal(cond.Value, &value); err != nil || !ValidPresenceValue(value) {
+			return fmt.Errorf("%s: presence conditions need a value of home, away, just_left, arrived or left", path)
+		}
+		if cond.Op != "" && cond.Op != "==" && cond.Op != "!=" {
+			return fmt.Errorf("%s: presence conditions support only == and !=", path)
+		}
+	case "zone":
+		if cond.ZoneID == "" {
+			return fmt.Errorf("%s: zone conditions need a zone_id", path)
+		}
+		var value string
+		if len(cond.Value) > 0 && string(cond.Value) != "null" {
+			if err := json.Unmarshal(cond.Value, &value); err != nil || !ValidZoneValue(value) {
+				return fmt.Errorf("%s: zone conditions need a value of inside, outside, entered or left", path)
+			}
+		}
+		if cond.Op != "" && cond.Op != "==" && cond.Op != "!=" {
+			return fmt.Errorf("%s: zone conditions support only == and !=", path)
+		}
+	case "alarm":
+		var value string
+		if err := json.Unmarshal(cond.Value, &value); err != nil || !ValidAlarmValue(value) {
+			return fmt.Errorf("%s: alarm conditions need a value of disarmed, armed, armed_home, armed_away, armed_night, pending or triggered", path)
+		}
+		if cond.Op != "" && cond.Op != "==" && cond.Op != "!=" {
+			return fmt.Errorf("%s: alarm conditions support only == and !=", path)
+		}
+	case "energy":
+		if cond.DeviceID == "" {
+			return fmt.Errorf("%s: energy conditions need a device_id", path)
+		}
+		if cond.Key != "" && cond.Key != EnergyDay && cond.Key != EnergyMonth {
+			return fmt.Errorf("%s: energy conditions need a key of day or month", path)
+		}
+		var value float64
+		if err := json.Unmarshal(cond.Value, &value); err != nil {
+			return fmt.Errorf("%s: energy conditions need a value in kWh", path)
+		}
+		if cond.Op != "<" && cond.Op != ">" && cond.Op != "==" && cond.Op != "!=" {
+			return fmt.Errorf("%s: energy conditions support <, >, == and !=", path)
+		}
+	case "calendar":
+		if cond.CalendarID == "" {
+			return fmt.Errorf("%s: calendar conditions need a calendar_id", path)
+		}
+		if cond.Op != "" && cond.Op != "==" && cond.Op != "!=" {
+			return fmt.Errorf("%s: calendar conditions support only == and !=", path)
+		}
+		if len(cond.Value) > 0 && string(cond.Value) != "null" {
+			var filter string
+			if err := json.Unmarshal(cond.Value, &filter); err != nil {
+				return fmt.Errorf("%s: calendar condition value must be a category or summary text", path)
+			}
+		}
+	}
+	return nil
+}
+
+// ExpressionDeviceIDs returns the devices read by an expression condition
+func ExpressionDeviceIDs(cond models.Condition) []string {
+	if cond.Type != "expression" {
+		return nil
+	}
+	expr, err := compileCached(cond.Expression)
+	if err != nil {
+		return nil
+	}
+	return expr.DeviceIDs()
+}
+
+func compileCached(source string) (*Expression, error) {
+	if cached, ok := compiledExpressions.Load(source); ok {
+		return cached.(*Expression), nil
+	}
+	expr, err := CompileExpression(source)
+	if err != nil {
+		return nil, err
+	}
+	compiledExpressions.Store(source, expr)
+	return expr, nil
+}
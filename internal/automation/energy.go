@@ -0,0 +1,328 @@
+package automation
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"smarthome/internal/clock"
+	"smarthome/internal/db"
+	"smarthome/internal/models"
+	"smarthome/internal/utils"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Devices reporting "energy" (a kWh counter) or "power" (W) are metered on every
+// update: counter increases are added as they are, a counter that went down was
+// reset and counts from zero, and power is integrated over the time since the
+// previous report. An "energy" condition leaf such as
+// {"type": "energy", "device_id": "5", "key": "day", "op": ">", "value": 10} compares
+// the kWh a device consumed today ("day", the default) or this month ("month").
+
+// Energy condition periods
+const (
+	EnergyDay   = "day"
+	EnergyMonth = "month"
+)
+
+// Tariff kinds
+const (
+	TariffFlat      = "flat"
+	TariffTimeOfUse = "time_of_use"
+)
+
+// energyMaxGap is how long without a power report a device is taken to have been offline
+const energyMaxGap = 6 * time.Hour
+
+const (
+	energyDayStamp   = "2006-01-02"
+	energyMonthStamp = "2006-01"
+	energyDayTTL     = 48 * time.Hour
+	energyMonthTTL   = 33 * 24 * time.Hour
+)
+
+// meterRecord is the last power or counter reading of a device
+type meterRecord struct {
+	At         time.Time `json:"at"`
+	Power      float64   `json:"power"`
+	HasPower   bool      `json:"has_power"`
+	Counter    float64   `json:"counter"`
+	HasCounter bool      `json:"has_counter"`
+}
+
+func meterKey(deviceID string) string {
+	return fmt.Sprintf("device:%s:energy_meter", deviceID)
+}
+
+// energyTotalKey holds the kWh a device consumed in the day or month stamp
+func energyTotalKey(deviceID, period, stamp string) string {
+	return fmt.Sprintf("device:%s:energy:%s:%s", deviceID, period, stamp)
+}
+
+func tariffKey(ownerID string) string {
+	return fmt.Sprintf("tariff:%s", ownerID)
+}
+
+// ValidateTariff checks a tariff's kind, rates and periods
+func ValidateTariff(t models.EnergyTariff) error {
+	if t.Kind != TariffFlat && t.Kind != TariffTimeOfUse {
+		return fmt.Errorf("unknown tariff kind %q, use flat or time_of_use", t.Kind)
+	}
+	if t.Rate < 0 {
+		return fmt.Errorf("rate cannot be negative")
+	}
+	if t.Kind == TariffTimeOfUse && len(t.Periods) == 0 {
+		return fmt.Errorf("time_of_use tariffs need periods")
+	}
+	for i, p := range t.Periods {
+		if _, err := time.Parse("15:04", p.Start); err != nil {
+			return fmt.Errorf("periods[%d]: invalid start %q, expected HH:MM", i, p.Start)
+		}
+		if _, err := time.Parse("15:04", p.End); err != nil {
+			return fmt.Errorf("periods[%d]: invalid end %q, expected HH:MM", i, p.End)
+		}
+		if p.Rate < 0 {
+			return fmt.Errorf("periods[%d]: rate cannot be negative", i)
+		}
+		for _, day := range p.Weekdays {
+			if day < 0 || day > 6 {
+				return fmt.Errorf("periods[%d]: weekdays go from 0 (Sunday) to 6", i)
+			}
+		}
+	}
+	return nil
+}
+
+// TariffRate returns the price per kWh of a tariff at a time, in the home timezone
+func TariffRate(t models.EnergyTariff, at time.Time) float64 {
+	if t.Kind != TariffTimeOfUse {
+		return t.Rate
+	}
+	local := at.In(clock.Location())
+	minute := local.Hour()*60 + local.Minute()
+	for _, p := range t.Periods {
+		start, _ := time.Parse("15:04", p.Start)
+		end, _ := time.Parse("15:04", p.End)
+		from, to := start.Hour()*60+start.Minute(), end.Hour()*60+end.Minute()
+
+		// A period past midnight belongs to the weekday it started on
+		day := local.Weekday()
+		inside := minute >= from && minute < to
+		if from >= to {
+			inside = minute >= from || minute < to
+			if minute < to {
+				day = (day + 6) % 7
+			}
+		}
+		if inside && onWeekday(p.Weekdays, day) {
+			return p.Rate
+		}
+	}
+	return t.Rate
+}
+
+func onWeekday(weekdays []int, day time.Weekday) bool {
+	if len(weekdays) == 0 {
+		return true
+	}
+	for _, d := range weekdays {
+		if time.Weekday(d) == day {
+			return true
+		}
+	}
+	return false
+}
+
+// CacheTariff stores a household's tariff for pricing meter readings
+func CacheTariff(ctx context.Context, redisClient *redis.Client, t models.EnergyTariff) error {
+	encoded, _ := json.Marshal(t)
+	return redisClient.Set(ctx, tariffKey(t.OwnerID), encoded, 0).Err()
+}
+
+func loadTariff(ctx context.Context, redisClient *redis.Client, ownerID string) (models.EnergyTariff, bool) {
+	raw, err := redisClient.Get(ctx, tariffKey(ownerID)).Result()
+	if err != nil {
+		return models.EnergyTariff{}, false
+	}
+	var t models.EnergyTariff
+	if err := json.Unmarshal([]byte(raw), &t); err != nil {
+		return models.EnergyTariff{}, false
+	}
+	return t, true
+}
+
+// meterReading reads the counter and power a device reports
+func meterReading(state utils.DeviceState, at time.Time) (meterRecord, bool) {
+	record := meterRecord{At: at}
+	record.Counter, record.HasCounter = toNumber(state["energy"])
+	record.Power, record.HasPower = toNumber(state["power"])
+	return record, record.HasCounter || record.HasPower
+}
+
+// consumed returns the kWh used between two readings. Counters win over power;
+// a counter lower than before was reset, so everything it counts is new.
+func consumed(prev, next meterRecord) float64 {
+	if !next.At.After(prev.At) {
+		return 0 // Out of order update
+	}
+	if next.HasCounter {
+		if !prev.HasCounter {
+			return 0
+		}
+		if next.Counter < prev.Counter {
+			return next.Counter
+		}
+		return next.Counter - prev.Counter
+	}
+	elapsed := next.At.Sub(prev.At)
+	if !prev.HasPower || prev.Power <= 0 || elapsed > energyMaxGap {
+		return 0
+	}
+	// The power last reported held until now
+	return prev.Power * elapsed.Hours() / 1000
+}
+
+// energySlice is the part of a metered interval within one day and tariff rate
+type energySlice struct {
+	Start time.Time // In the home timezone
+	KWh   float64
+	Cost  float64
+}
+
+// splitEnergy spreads kWh consumed evenly between from and to over slices cut at
+// local midnights and, with a tariff, where its time-of-use periods start or end.
+// Each slice is priced at the rate in effect during it.
+func splitEnergy(tariff *models.EnergyTariff, from, to time.Time, kwh float64) []energySlice {
+	from, to = from.In(clock.Location()), to.In(clock.Location())
+	if !to.After(from) {
+		return []energySlice{{Start: to, KWh: kwh, Cost: kwh * sliceRate(tariff, to)}}
+	}
+
+	cuts := []time.Time{from}
+	for day := time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0, from.Location()); day.Before(to); day = day.AddDate(0, 0, 1) {
+		boundaries := []time.Time{day}
+		if tariff != nil && tariff.Kind == TariffTimeOfUse {
+			for _, p := range tariff.Periods {
+				for _, clockTime := range []string{p.Start, p.End} {
+					hm, _ := time.Parse("15:04", clockTime)
+					boundaries = append(boundaries, time.Date(day.Year(), day.Month(), day.Day(), hm.Hour(), hm.Minute(), 0, 0, day.Location()))
+				}
+			}
+		}
+		for _, b := range boundaries {
+			if b.After(from) && b.Before(to) {
+				cuts = append(cuts, b)
+			}
+		}
+	}
+	sort.Slice(cuts, func(i, j int) bool { return cuts[i].Before(cuts[j]) })
+	cuts = append(cuts, to)
+
+	total := to.Sub(from)
+	slices := []energySlice{}
+	for i := 0; i+1 < len(cuts); i++ {
+		start, end := cuts[i], cuts[i+1]
+		if !end.After(start) {
+			continue
+		}
+		part := kwh * float64(end.Sub(start)) / float64(total)
+		cost := part * sliceRate(tariff, start)
+
+		// Merge with the previous slice when neither the day nor the rate changed
+		if n := len(slices); n > 0 && sameDay(slices[n-1].Start, start) && sliceRate(tariff, slices[n-1].Start) == sliceRate(tariff, start) {
+			slices[n-1].KWh += part
+			slices[n-1].Cost += cost
+			continue
+		}
+		slices = append(slices, energySlice{Start: start, KWh: part, Cost: cost})
+	}
+	return slices
+}
+
+func sliceRate(tariff *models.EnergyTariff, at time.Time) float64 {
+	if tariff == nil {
+		return 0
+	}
+	return TariffRate(*tariff, at)
+}
+
+func sameDay(a, b time.Time) bool {
+	return a.Format(energyDayStamp) == b.Format(energyDayStamp)
+}
+
+// RecordEnergy meters a device update, adding what it consumed since the previous
+// reading to the totals of the days it was consumed on and pricing each part with
+// the owner's tariff rate at the time
+func RecordEnergy(ctx context.Context, redisClient *redis.Client, dbConn *db.DB, device models.Device, state utils.DeviceState) {
+	now := clock.Now()
+	next, ok := meterReading(state, now)
+	if !ok {
+		return
+	}
+	var prev meterRecord
+	if raw, err := redisClient.Get(ctx, meterKey(device.ID)).Result(); err == nil {
+		json.Unmarshal([]byte(raw), &prev)
+	}
+	if !next.HasCounter && prev.HasCounter && now.Sub(prev.At) < energyMaxGap {
+		return // Metered by its counter; the next counter reading covers this update
+	}
+	encoded, _ := json.Marshal(next)
+	redisClient.Set(ctx, meterKey(device.ID), encoded, 0)
+
+	kwh := consumed(prev, next)
+	if kwh <= 0 {
+		return
+	}
+	var tariff *models.EnergyTariff
+	if device.OwnerID != nil {
+		if t, ok := loadTariff(ctx, redisClient, *device.OwnerID); ok {
+			tariff = &t
+		}
+	}
+
+	for _, slice := range splitEnergy(tariff, prev.At, now, kwh) {
+		if err := dbConn.AddEnergyUsage(ctx, device.ID, slice.Start, slice.KWh, slice.Cost); err != nil {
+			log.Printf("AUTOMATION: Failed to record energy of device %s: %v", device.ID, err)
+			return
+		}
+		dayKey := energyTotalKey(device.ID, EnergyDay, slice.Start.Format(energyDayStamp))
+		monthKey := energyTotalKey(device.ID, EnergyMonth, slice.Start.Format(energyMonthStamp))
+		redisClient.IncrByFloat(ctx, dayKey, slice.KWh)
+		redisClient.Expire(ctx, dayKey, energyDayTTL)
+		redisClient.IncrByFloat(ctx, monthKey, slice.KWh)
+		redisClient.Expire(ctx, monthKey, energyMonthTTL)
+		log.Printf("AUTOMATION: Device %s consumed %.4f kWh on %s (cost %.4f)", device.ID, slice.KWh, slice.Start.Format(energyDayStamp), slice.Cost)
+	}
+}
+
+// CacheEnergyTotals stores a device's consumption today and this month for energy conditions
+func CacheEnergyTotals(ctx context.Context, redisClient *redis.Client, total db.EnergyTotal, now time.Time) {
+	local := now.In(clock.Location())
+	redisClient.Set(ctx, energyTotalKey(total.DeviceID, EnergyDay, local.Format(energyDayStamp)), total.DayKWh, energyDayTTL)
+	redisClient.Set(ctx, energyTotalKey(total.DeviceID, EnergyMonth, local.Format(energyMonthStamp)), total.MonthKWh, energyMonthTTL)
+}
+
+// energyMatches compares the kWh a device consumed today or this month
+func energyMatches(redisClient *redis.Client, cond models.Condition) bool {
+	if redisClient == nil {
+		return false
+	}
+	var expected interface{}
+	if err := json.Unmarshal(cond.Value, &expected); err != nil {
+		return false
+	}
+	local := clock.Now().In(clock.Location())
+	key := energyTotalKey(cond.DeviceID, EnergyDay, local.Format(energyDayStamp))
+	if cond.Key == EnergyMonth {
+		key = energyTotalKey(cond.DeviceID, EnergyMonth, local.Format(energyMonthStamp))
+	}
+	kwh, err := redisClient.Get(context.Background(), key).Float64()
+	if err != nil {
+		kwh = 0 // Nothing consumed yet
+	}
+	return utils.Compare(kwh, cond.Op, expected)
+}
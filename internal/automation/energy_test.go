@@ -0,0 +1,100 @@
+package automation
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"smarthome/internal/clock"
+	"smarthome/internal/models"
+)
+
+func TestSplitEnergy(t *testing.T) {
+	loc := clock.Location()
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2026, 1, day, hour, minute, 0, 0, loc) // January 14 is a Wednesday
+	}
+	flat := &models.EnergyTariff{Kind: TariffFlat, Rate: 0.30}
+	timeOfUse := &models.EnergyTariff{
+		Kind: TariffTimeOfUse,
+		Rate: 0.30,
+		Periods: []models.TariffPeriod{
+			{Start: "22:00", End: "06:00", Rate: 0.10},
+			{Start: "17:00", End: "20:00", Weekdays: []int{1, 2, 3, 4, 5}, Rate: 0.50},
+		},
+	}
+
+	type slice struct {
+		day  string
+		kwh  float64
+		cost float64
+	}
+	tests := []struct {
+		name     string
+		tariff   *models.EnergyTariff
+		from, to time.Time
+		kwh      float64
+		want     []slice
+	}{
+		{
+			name: "no tariff within a day",
+			from: at(14, 10, 0), to: at(14, 12, 0), kwh: 2,
+			want: []slice{{"2026-01-14", 2, 0}},
+		},
+		{
+			name: "no tariff across midnight",
+			from: at(14, 23, 0), to: at(15, 1, 0), kwh: 2,
+			want: []slice{{"2026-01-14", 1, 0}, {"2026-01-15", 1, 0}},
+		},
+		{
+			name:   "flat tariff across midnight",
+			tariff: flat,
+			from:   at(14, 21, 0), to: at(15, 3, 0), kwh: 6,
+			want: []slice{{"2026-01-14", 3, 0.90}, {"2026-01-15", 3, 0.90}},
+		},
+		{
+			name:   "time of use inside one period",
+			tariff: timeOfUse,
+			from:   at(14, 10, 0), to: at(14, 12, 0), kwh: 2,
+			want: []slice{{"2026-01-14", 2, 0.60}},
+		},
+		{
+			name:   "time of use into the peak",
+			tariff: timeOfUse,
+			from:   at(14, 16, 0), to: at(14, 18, 0), kwh: 2,
+			want: []slice{{"2026-01-14", 1, 0.30}, {"2026-01-14", 1, 0.50}},
+		},
+		{
+			name:   "time of use over a night",
+			tariff: timeOfUse,
+			from:   at(14, 20, 0), to: at(15, 2, 0), kwh: 6,
+			want: []slice{{"2026-01-14", 2, 0.60}, {"2026-01-14", 2, 0.20}, {"2026-01-15", 2, 0.20}},
+		},
+		{
+			name:   "peak only on weekdays",
+			tariff: timeOfUse,
+			from:   at(17, 16, 0), to: at(17, 18, 0), kwh: 2, // A Saturday
+			want: []slice{{"2026-01-17", 2, 0.60}},
+		},
+		{
+			name:   "readings at the same time",
+			tariff: flat,
+			from:   at(14, 10, 0), to: at(14, 10, 0), kwh: 1,
+			want: []slice{{"2026-01-14", 1, 0.30}},
+		},
+	}
+
+	for _, tt := range tests {
+		got := splitEnergy(tt.tariff, tt.from, tt.to, tt.kwh)
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: splitEnergy() returned %d slices %+v, want %d", tt.name, len(got), got, len(tt.want))
+			continue
+		}
+		for i, s := range got {
+			w := tt.want[i]
+			if day := s.Start.Format(energyDayStamp); day != w.day || math.Abs(s.KWh-w.kwh) > 1e-9 || math.Abs(s.Cost-w.cost) > 1e-9 {
+				t.Errorf("%s: slice %d = {%s %.4f %.4f}, want {%s %.4f %.4f}", tt.name, i, day, s.KWh, s.Cost, w.day, w.kwh, w.cost)
+			}
+		}
+	}
+}
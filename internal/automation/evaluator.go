@@ -7,26 +7,94 @@ import (
 	"log"
 	"time"
 
+	"smarthome/internal/clock"
 	"smarthome/internal/models"
 	"smarthome/internal/utils"
 
 	"github.com/redis/go-redis/v9"
 )
 
-// EvaluateConditions evaluates rule conditions
-func EvaluateConditions(redisClient *redis.Client, conditionsRaw json.RawMessage) bool {
+// EvaluateConditions evaluates rule conditions; scope selects the variables the rule sees.
+// firedAt is the fire time of the schedule or calendar event that triggered the
+// evaluation, zero otherwise; time conditions are evaluated at it.
+func EvaluateConditions(redisClient *redis.Client, conditionsRaw json.RawMessage, scope VariableScope, firedAt time.Time) bool {
 	var condition models.Condition
 	if err := json.Unmarshal(conditionsRaw, &condition); err != nil {
 		log.Printf("AUTOMATION: Failed to unmarshal conditions: %v", err)
 		return false
 	}
-	result := evaluateCondition(redisClient, condition)
+	result := evaluateCondition(redisClient, condition, scope, firedAt)
 	log.Printf("AUTOMATION: Condition evaluation completed, result: %t", result)
 	return result
 }
 
+// ConditionTrace is the result of a condition and, for AND/OR groups, of its children
+type ConditionTrace struct {
+	Type       string           `json:"type,omitempty"`
+	DeviceID   string           `json:"device_id,omitempty"`
+	RuleID     string           `json:"rule_id,omitempty"`
+	PersonID   string           `json:"person_id,omitempty"`
+	ZoneID     string           `json:"zone_id,omitempty"`
+	Key        string           `json:"key,omitempty"`
+	Op         string           `json:"op,omitempty"`
+	Value      json.RawMessage  `json:"value,omitempty"`
+	Expression string           `json:"expression,omitempty"`
+	Operator   string           `json:"operator,omitempty"`
+	Result     bool             `json:"result"`
+	Skipped    bool             `json:"skipped,omitempty"` // Not evaluated because the group's result was already decided
+	Children   []ConditionTrace `json:"children,omitempty"`
+}
+
+// TraceConditions evaluates rule conditions like EvaluateConditions and records the result of every condition
+func TraceConditions(redisClient *redis.Client, conditionsRaw json.RawMessage, scope VariableScope, firedAt time.Time) (bool, *ConditionTrace) {
+	var condition models.Condition
+	if err := json.Unmarshal(conditionsRaw, &condition); err != nil {
+		log.Printf("AUTOMATION: Failed to unmarshal conditions: %v", err)
+		return false, nil
+	}
+	trace := traceCondition(redisClient, condition, scope, firedAt)
+	log.Printf("AUTOMATION: Condition evaluation completed, result: %t", trace.Result)
+	return trace.Result, &trace
+}
+
+// traceCondition mirrors evaluateCondition, short-circuiting groups the same way
+func traceCondition(redisClient *redis.Client, cond models.Condition, scope VariableScope, firedAt time.Time) ConditionTrace {
+	trace := ConditionTrace{
+		Type:       cond.Type,
+		DeviceID:   cond.DeviceID,
+		RuleID:     cond.RuleID,
+		PersonID:   cond.PersonID,
+		ZoneID:     cond.ZoneID,
+		Key:        cond.Key,
+		Op:         cond.Op,
+		Value:      cond.Value,
+		Expression: cond.Expression,
+		Operator:   cond.Operator,
+	}
+	if cond.Operator == "" {
+		trace.Result = evaluateCondition(redisClient, cond, scope, firedAt)
+		return trace
+	}
+
+	trace.Result = cond.Operator == "AND"
+	decided := false
+	for _, child := range cond.Children {
+		if decided {
+			trace.Children = append(trace.Children, ConditionTrace{Type: child.Type, DeviceID: child.DeviceID, Key: child.Key, Operator: child.Operator, Skipped: true})
+			continue
+		}
+		childTrace := traceCondition(redisClient, child, scope, firedAt)
+		trace.Children = append(trace.Children, childTrace)
+		if (cond.Operator == "AND" && !childTrace.Result) || (cond.Operator == "OR" && childTrace.Result) {
+			trace.Result = childTrace.Result
+			decided = true
+		}
+	}
+	return trace
+}
+
 // evaluateCondition evaluates a single condition recursively
-func evaluateCondition(redisClient *redis.Client, cond models.Condition) bool {
+func evaluateCondition(redisClient *redis.Client, cond models.Condition, scope VariableScope, firedAt time.Time) bool {
 	if cond.Operator == "" {
 		log.Printf("AUTOMATION: Evaluating leaf condition - Type: %s, Device: %s, Key: %s, Op: %s",
 			cond.Type, cond.DeviceID, cond.Key, cond.Op)
@@ -52,33 +120,63 @@ func evaluateCondition(redisClient *redis.Client, cond models.Condition) bool {
 			log.Printf("AUTOMATION: Device condition result: %t (%v %s %v)", result, actualValue, cond.Op, expectedValue)
 			return result
 		case "time":
-			if redisClient == nil {
-				// Parse the expected value from JSON
-				var expectedValue interface{}
-				if err := json.Unmarshal(cond.Value, &expectedValue); err != nil {
-					log.Printf("AUTOMATION: Failed to parse time condition value: %v", err)
-					return false
-				}
-				result := utils.Compare(utils.GetCurrentTime(), cond.Op, expectedValue)
-				log.Printf("AUTOMATION: Time condition result: %t", result)
-				return result
-			}
-			cacheKey := fmt.Sprintf("time:%s:%v", cond.Op, cond.Value)
-			cached, _ := redisClient.Get(context.Background(), cacheKey).Result()
-			if cached != "" {
-				result := cached == "true"
-				log.Printf("AUTOMATION: Time condition result: %t", result)
-				return result
-			}
-			// Parse the expected value from JSON
+			result := timeConditionHolds(cond, firedAt)
+			log.Printf("AUTOMATION: Time condition result: %t", result)
+			return result
+		case "variable":
 			var expectedValue interface{}
 			if err := json.Unmarshal(cond.Value, &expectedValue); err != nil {
-				log.Printf("AUTOMATION: Failed to parse time condition value: %v", err)
+				log.Printf("AUTOMATION: Failed to parse condition value: %v", err)
 				return false
 			}
-			result := utils.Compare(utils.GetCurrentTime(), cond.Op, expectedValue)
-			redisClient.Set(context.Background(), cacheKey, fmt.Sprintf("%t", result), 60*time.Second)
-			log.Printf("AUTOMATION: Time condition result: %t", result)
+			actualValue, ok := LoadVariables(context.Background(), redisClient, scope)[cond.Key]
+			if !ok {
+				log.Printf("AUTOMATION: Variable %s is not defined", cond.Key)
+				return false
+			}
+			result := utils.Compare(actualValue, cond.Op, expectedValue)
+			log.Printf("AUTOMATION: Variable condition result: %t (%s: %v %s %v)", result, cond.Key, actualValue, cond.Op, expectedValue)
+			return result
+		case "rule_fired":
+			result := ruleFiredWithin(redisClient, cond)
+			log.Printf("AUTOMATION: Rule fired condition result: %t (rule %s)", result, cond.RuleID)
+			return result
+		case "calendar":
+			result := calendarEventActive(redisClient, cond)
+			log.Printf("AUTOMATION: Calendar condition result: %t (calendar %s)", result, cond.CalendarID)
+			return result
+		case "presence":
+			result := presenceMatches(redisClient, cond, scope)
+			log.Printf("AUTOMATION: Presence condition result: %t (person %q)", result, cond.PersonID)
+			return result
+		case "zone":
+			result := zoneMatches(redisClient, cond)
+			log.Printf("AUTOMATION: Zone condition result: %t (zone %s, person %q)", result, cond.ZoneID, cond.PersonID)
+			return result
+		case "alarm":
+			result := alarmMatches(redisClient, cond, scope)
+			log.Printf("AUTOMATION: Alarm condition result: %t", result)
+			return result
+		case "energy":
+			result := energyMatches(redisClient, cond)
+			log.Printf("AUTOMATION: Energy condition result: %t (device %s, %s)", result, cond.DeviceID, cond.Key)
+			return result
+		case "expression":
+			expr, err := compileCached(cond.Expression)
+			if err != nil {
+				log.Printf("AUTOMATION: Invalid expression %q: %v", cond.Expression, err)
+				return false
+			}
+			result, err := expr.Eval(ExpressionEnv{
+				DeviceState: ownedDeviceState(redisClient, scope.OwnerID),
+				Now:         evaluationTime(firedAt),
+				Variables:   LoadVariables(context.Background(), redisClient, scope),
+			})
+			if err != nil {
+				log.Printf("AUTOMATION: Expression %q failed: %v", cond.Expression, err)
+				return false
+			}
+			log.Printf("AUTOMATION: Expression condition result: %t (%s)", result, cond.Expression)
 			return result
 		}
 		log.Printf("AUTOMATION: Unknown condition type: %s", cond.Type)
@@ -87,7 +185,7 @@ func evaluateCondition(redisClient *redis.Client, cond models.Condition) bool {
 
 	log.Printf("AUTOMATION: Evaluating compound condition with operator: %s, %d children", cond.Operator, len(cond.Children))
 	for _, child := range cond.Children {
-		childResult := evaluateCondition(redisClient, child)
+		childResult := evaluateCondition(redisClient, child, scope, firedAt)
 		if cond.Operator == "AND" && !childResult {
 			return false
 		}
@@ -99,3 +197,56 @@ func evaluateCondition(redisClient *redis.Client, cond models.Condition) bool {
 	log.Printf("AUTOMATION: Compound condition final result: %t", finalResult)
 	return finalResult
 }
+
+// evaluationTime is the time conditions are evaluated at
+func evaluationTime(firedAt time.Time) time.Time {
+	if firedAt.IsZero() {
+		return utils.GetCurrentTime()
+	}
+	return firedAt.In(clock.Location())
+}
+
+// timeConditionHolds compares the evaluation time with a "HH:MM" time condition in
+// the home timezone at minute resolution. "<" and ">" are strict, so neither holds
+// during the boundary minute itself; "<=" and ">=" include it, which lets a schedule
+// fired at the boundary see the new side. "==" is a trigger: it holds only when a
+// schedule fired the evaluation in that minute, not on device updates.
+func timeConditionHolds(cond models.Condition, firedAt time.Time) bool {
+	boundary, err := parseTimeOfDay(cond.Value)
+	if err != nil {
+		log.Printf("AUTOMATION: Failed to parse time condition value: %v", err)
+		return false
+	}
+	at := evaluationTime(firedAt)
+	minute := at.Hour()*60 + at.Minute()
+
+	switch cond.Op {
+	case "<":
+		return minute < boundary
+	case "<=":
+		return minute <= boundary
+	case ">":
+		return minute > boundary
+	case ">=":
+		return minute >= boundary
+	case "==":
+		return !firedAt.IsZero() && minute == boundary
+	case "!=":
+		return firedAt.IsZero() || minute != boundary
+	}
+	log.Printf("AUTOMATION: Unsupported time condition operator %q", cond.Op)
+	return false
+}
+
+// parseTimeOfDay reads a "HH:MM" condition value as minutes after midnight
+func parseTimeOfDay(value json.RawMessage) (int, error) {
+	var text string
+	if err := json.Unmarshal(value, &text); err != nil {
+		return 0, fmt.Errorf("time conditions need a \"HH:MM\" value")
+	}
+	t, err := time.Parse("15:04", text)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", text)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
@@ -0,0 +1,109 @@
+package automation
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"smarthome/internal/clock"
+	"smarthome/internal/models"
+)
+
+func TestTimeConditionHolds(t *testing.T) {
+	at := func(hour, minute int) time.Time {
+		return time.Date(2024, 3, 4, hour, minute, 30, 0, clock.Location())
+	}
+	var zero time.Time
+
+	tests := []struct {
+		op      string
+		value   string
+		firedAt time.Time // zero for evaluations caused by device updates
+		now     time.Time // clock time used when firedAt is zero
+		want    bool
+	}{
+		// Strict comparisons exclude the boundary minute
+		{"<", "18:00", at(17, 59), zero, true},
+		{"<", "18:00", at(18, 0), zero, false},
+		{">", "18:00", at(18, 0), zero, false},
+		{">", "18:00", at(18, 1), zero, true},
+		{">", "18:00", at(17, 59), zero, false},
+
+		// Inclusive comparisons include it
+		{"<=", "18:00", at(18, 0), zero, true},
+		{"<=", "18:00", at(18, 1), zero, false},
+		{">=", "18:00", at(18, 0), zero, true},
+		{">=", "18:00", at(17, 59), zero, false},
+
+		// Device updates are compared against the clock
+		{">", "18:00", zero, at(18, 0), false},
+		{">", "18:00", zero, at(19, 0), true},
+		{"<", "06:30", zero, at(6, 29), true},
+
+		// == only holds for the schedule fired in that minute, never on a device update
+		{"==", "18:00", at(18, 0), zero, true},
+		{"==", "18:00", at(18, 1), zero, false},
+		{"==", "18:00", zero, at(18, 0), false},
+		{"!=", "18:00", at(18, 0), zero, false},
+		{"!=", "18:00", at(18, 1), zero, true},
+		{"!=", "18:00", zero, at(18, 0), true},
+
+		// Invalid values and operators never hold
+		{">", "6pm", at(19, 0), zero, false},
+		{"~", "18:00", at(18, 0), zero, false},
+	}
+
+	defer clock.Set(nil)
+	for _, tt := range tests {
+		clock.Set(clock.NewFake(tt.now))
+		value, _ := json.Marshal(tt.value)
+		cond := models.Condition{Type: "time", Op: tt.op, Value: value}
+		if got := timeConditionHolds(cond, tt.firedAt); got != tt.want {
+			t.Errorf("time %s %s (fired %v, now %v) = %v, want %v",
+				tt.op, tt.value, tt.firedAt.Format("15:04"), tt.now.Format("15:04"), got, tt.want)
+		}
+	}
+}
+
+func TestConvertToCronExpression(t *testing.T) {
+	tests := []struct {
+		tc   TimeCondition
+		want string
+	}{
+		{TimeCondition{Hour: 18, Minute: 0, Operator: "=="}, "0 18 * * *"},
+		{TimeCondition{Hour: 18, Minute: 0, Operator: "<"}, "0 18 * * *"},
+		{TimeCondition{Hour: 18, Minute: 0, Operator: ">="}, "0 18 * * *"},
+		// The strict > and <= flip one minute after the boundary
+		{TimeCondition{Hour: 18, Minute: 0, Operator: ">"}, "1 18 * * *"},
+		{TimeCondition{Hour: 18, Minute: 59, Operator: "<="}, "0 19 * * *"},
+		{TimeCondition{Hour: 23, Minute: 59, Operator: ">"}, "0 0 * * *"},
+	}
+
+	for _, tt := range tests {
+		if got := ConvertToCronExpression(tt.tc); got != tt.want {
+			t.Errorf("ConvertToCronExpression(%02d:%02d %s) = %q, want %q", tt.tc.Hour, tt.tc.Minute, tt.tc.Operator, got, tt.want)
+		}
+	}
+}
+
+func TestExtractTimeConditions(t *testing.T) {
+	conditions := json.RawMessage(`{"operator": "AND", "children": [
+		{"type": "time", "op": ">", "value": "18:00"},
+		{"operator": "OR", "children": [
+			{"type": "time", "op": "<=", "value": "06:30"},
+			{"type": "time", "op": "!=", "value": "12:00"},
+			{"type": "device", "device_id": "1", "key": "on", "op": "==", "value": true}
+		]}
+	]}`)
+
+	got := ExtractTimeConditions(conditions)
+	want := []TimeCondition{{Hour: 18, Minute: 0, Operator: ">"}, {Hour: 6, Minute: 30, Operator: "<="}}
+	if len(got) != len(want) {
+		t.Fatalf("ExtractTimeConditions() = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("ExtractTimeConditions()[%d] = %v, want %v", i, got[i], want[i])
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package automation
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"smarthome/internal/models"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// A rule's execution settings decide what happens when it triggers again, e.g.
+// {"mode": "single", "cooldown_seconds": 1800, "max_per_day": 5} notifies at most
+// once per 30 minutes and five times a day.
+
+// Execution modes, applied when a rule triggers while a previous run is still executing
+const (
+	ModeSingle   = "single"   // The new run is dropped
+	ModeRestart  = "restart"  // The new run supersedes the old one, which stops before its next step
+	ModeQueued   = "queued"   // The new run waits for the old one to finish
+	ModeParallel = "parallel" // Both runs execute side by side
+)
+
+// ruleRunTTL releases the run lock of a worker that died mid-run
+const ruleRunTTL = 30 * time.Second
+
+// MaxQueuedRuns caps how many runs of a queued rule wait behind the running one
+const MaxQueuedRuns = 10
+
+// ruleQueueTTL resets the queue counter of a rule whose waiting runs were lost
+const ruleQueueTTL = 10 * time.Minute
+
+// ErrRuleRunning is returned when a single or queued rule is already running
+var ErrRuleRunning = errors.New("rule is already running")
+
+// releaseRunScript deletes a run lock only if it still belongs to the finishing run
+var releaseRunScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`)
+
+// leaveQueueScript decrements a queue counter without taking it below zero
+var leaveQueueScript = redis.NewScript(`
+if tonumber(redis.call("GET", KEYS[1]) or "0") > 0 then
+	return redis.call("DECR", KEYS[1])
+end
+return 0`)
+
+func ruleRunningKey(ruleID string) string {
+	return fmt.Sprintf("rule:%s:running", ruleID)
+}
+
+func ruleQueueKey(ruleID string) string {
+	return fmt.Sprintf("rule:%s:queued", ruleID)
+}
+
+func ruleCooldownKey(ruleID string) string {
+	return fmt.Sprintf("rule:%s:cooldown", ruleID)
+}
+
+func ruleDailyRunsKey(ruleID string, day time.Time) string {
+	return fmt.Sprintf("rule:%s:runs:%s", ruleID, day.Format("2006-01-02"))
+}
+
+// ExecutionMode returns a rule's mode, defaulting to single
+func ExecutionMode(e models.RuleExecution) string {
+	if e.Mode == "" {
+		return ModeSingle
+	}
+	return e.Mode
+}
+
+// ValidateExecution checks a rule's execution settings before it is saved
+func ValidateExecution(e models.RuleExecution) error {
+	switch e.Mode {
+	case "", ModeSingle, ModeRestart, ModeQueued, ModeParallel:
+	default:
+		return fmt.Errorf("unknown execution mode %q", e.Mode)
+	}
+	if e.CooldownSeconds < 0 {
+		return fmt.Errorf("cooldown_seconds cannot be negative")
+	}
+	if e.MaxPerDay < 0 {
+		return fmt.Errorf("max_per_day cannot be negative")
+	}
+	return nil
+}
+
+// RuleRun is one execution of a rule's actions
+type RuleRun struct {
+	redis  *redis.Client
+	ruleID string
+	token  string
+	locked bool
+}
+
+// StartRuleRun claims a rule's run lock according to its execution mode.
+// It returns ErrRuleRunning when a single or queued rule is already running.
+func StartRuleRun(ctx context.Context, redisClient *redis.Client, rule models.Rule) (*RuleRun, error) {
+	run := &RuleRun{redis: redisClient, ruleID: rule.ID}
+	mode := ExecutionMode(rule.Execution)
+	if mode == ModeParallel || redisClient == nil {
+		return run, nil
+	}
+
+	token := make([]byte, 8)
+	rand.Read(token)
+	run.token = hex.EncodeToString(token)
+
+	key := ruleRunningKey(rule.ID)
+	if mode == ModeRestart {
+		if err := redisClient.Set(ctx, key, run.token, ruleRunTTL).Err(); err != nil {
+			return nil, err
+		}
+		run.locked = true
+		return run, nil
+	}
+
+	ok, err := redisClient.SetNX(ctx, key, run.token, ruleRunTTL).Result()
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrRuleRunning
+	}
+	run.locked = true
+	return run, nil
+}
+
+// Superseded reports whether a newer run of a restart rule has taken over
+func (r *RuleRun) Superseded(ctx context.Context) bool {
+	if !r.locked {
+		return false
+	}
+	current, err := r.redis.Get(ctx, ruleRunningKey(r.ruleID)).Result()
+	return err == nil && current != r.token
+}
+
+// Finish releases the run lock unless a newer run holds it
+func (r *RuleRun) Finish(ctx context.Context) {
+	if r.locked {
+		releaseRunScript.Run(ctx, r.redis, []string{ruleRunningKey(r.ruleID)}, r.token)
+	}
+}
+
+// JoinRuleQueue counts a run waiting behind a running queued rule. It returns
+// false and does not count the run when MaxQueuedRuns are already waiting.
+func JoinRuleQueue(ctx context.Context, redisClient *redis.Client, ruleID string) bool {
+	if redisClient == nil {
+		return true
+	}
+	key := ruleQueueKey(ruleID)
+	count, err := redisClient.Incr(ctx, key).Result()
+	if err != nil {
+		return true
+	}
+	redisClient.Expire(ctx, key, ruleQueueTTL)
+	if count > MaxQueuedRuns {
+		redisClient.Decr(ctx, key)
+		return false
+	}
+	return true
+}
+
+// LeaveRuleQueue uncounts a waiting run once it is picked up again
+func LeaveRuleQueue(ctx context.Context, redisClient *redis.Client, ruleID string) {
+	if redisClient != nil {
+		leaveQueueScript.Run(ctx, redisClient, []string{ruleQueueKey(ruleID)})
+	}
+}
+
+// AllowRuleRun applies a rule's cooldown and daily limit at time now and counts
+// the run when it is allowed. The reason explains a refusal.
+func AllowRuleRun(ctx context.Context, redisClient *redis.Client, rule models.Rule, now time.Time) (bool, string) {
+	e := rule.Execution
+	if redisClient == nil || (e.CooldownSeconds <= 0 && e.MaxPerDay <= 0) {
+		return true, ""
+	}
+
+	dailyKey := ruleDailyRunsKey(rule.ID, now)
+	if e.MaxPerDay > 0 {
+		count, err := redisClient.Incr(ctx, dailyKey).Result()
+		if err != nil {
+			return true, ""
+		}
+		if count == 1 {
+			redisClient.Expire(ctx, dailyKey, 48*time.Hour)
+		}
+		if count > int64(e.MaxPerDay) {
+			redisClient.Decr(ctx, dailyKey)
+			return false, fmt.Sprintf("daily limit of %d runs reached", e.MaxPerDay)
+		}
+	}
+
+	if e.CooldownSeconds > 0 {
+		cooldown := time.Duration(e.CooldownSeconds) * time.Second
+		ok, err := redisClient.SetNX(ctx, ruleCooldownKey(rule.ID), now.Unix(), cooldown).Result()
+		if err == nil && !ok {
+			if e.MaxPerDay > 0 {
+				redisClient.Decr(ctx, dailyKey)
+			}
+			remaining, _ := redisClient.TTL(ctx, ruleCooldownKey(rule.ID)).Result()
+			return false, fmt.Sprintf("cooling down for another %s", remaining.Round(time.Second))
+		}
+	}
+	return true, ""
+}
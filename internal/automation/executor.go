@@ -1,17 +1,18 @@
 package automation
 
 import (
+	"context"
 	"encoding/json"
-	"fmt"
 	"log"
 
 	"smarthome/internal/models"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/redis/go-redis/v9"
 )
 
 // ExecuteActions executes rule actions
-func ExecuteActions(mqttClient mqtt.Client, actionsRaw json.RawMessage) {
+func ExecuteActions(mqttClient mqtt.Client, redisClient *redis.Client, actionsRaw json.RawMessage) {
 	log.Printf("AUTOMATION: Starting action execution")
 	var actions []models.Action
 	if err := json.Unmarshal(actionsRaw, &actions); err != nil {
@@ -22,10 +23,12 @@ func ExecuteActions(mqttClient mqtt.Client, actionsRaw json.RawMessage) {
 
 	for _, action := range actions {
 		if action.DeviceID != "" && mqttClient != nil {
-			payload, _ := json.Marshal(action.Params)
-			topic := fmt.Sprintf("devices/%s/commands", action.DeviceID)
-			log.Printf("AUTOMATION: Publishing MQTT command to %s: %s", topic, string(payload))
-			mqttClient.Publish(topic, 1, false, payload)
+			var params map[string]interface{}
+			if err := json.Unmarshal(action.Params, &params); err != nil {
+				log.Printf("AUTOMATION: Invalid params for device %s: %v", action.DeviceID, err)
+				continue
+			}
+			PublishCommand(context.Background(), redisClient, mqttClient, action.DeviceID, params, "rule")
 		}
 		if action.Action == "send_email" {
 			var paramsMap map[string]interface{}
@@ -40,28 +43,59 @@ func ExecuteActions(mqttClient mqtt.Client, actionsRaw json.RawMessage) {
 }
 
 // ExecuteResolvedActions executes conflict-resolved actions
-// resolvedActions is a map of deviceID -> params (attribute -> value)
-func ExecuteResolvedActions(mqttClient mqtt.Client, resolvedActions map[string]map[string]interface{}) {
+// resolvedActions is a map of deviceID -> params (attribute -> value). Params
+// must already be rendered, each with the template context of the rule it came
+// from. The actions that were sent are returned along with the ones interlocks rejected
+func ExecuteResolvedActions(mqttClient mqtt.Client, redisClient *redis.Client, resolvedActions map[string]map[string]interface{}) (map[string]map[string]interface{}, []*InterlockError) {
 	log.Printf("AUTOMATION: Starting resolved action execution for %d devices", len(resolvedActions))
 
+	sent := make(map[string]map[string]interface{}, len(resolvedActions))
+	for deviceID, params := range resolvedActions {
+		sent[deviceID] = params
+	}
+
 	if mqttClient == nil {
 		log.Printf("AUTOMATION: MQTT client not available")
-		return
+		return sent, nil
 	}
 
+	var rejected []*InterlockError
 	for deviceID, params := range resolvedActions {
 		if len(params) > 0 {
-			payload, err := json.Marshal(params)
-			if err != nil {
-				log.Printf("AUTOMATION: Failed to marshal params for device %s: %v", deviceID, err)
-				continue
+			_, err := PublishCommand(context.Background(), redisClient, mqttClient, deviceID, params, "rule")
+			if interlockErr, ok := err.(*InterlockError); ok {
+				rejected = append(rejected, interlockErr)
+				delete(sent, deviceID)
+			} else if err != nil {
+				log.Printf("AUTOMATION: Failed to publish command to device %s: %v", deviceID, err)
 			}
-
-			topic := fmt.Sprintf("devices/%s/commands", deviceID)
-			log.Printf("AUTOMATION: Publishing resolved MQTT command to %s: %s", topic, string(payload))
-			mqttClient.Publish(topic, 1, false, payload)
 		}
 	}
 
 	log.Printf("AUTOMATION: Resolved action execution completed")
+	return sent, rejected
+}
+
+// ExecuteNotifications executes a rule's non-device actions (e.g. send_email),
+// resolving templates in their params against tctx
+func ExecuteNotifications(actionsRaw json.RawMessage, tctx TemplateContext) {
+	var actions []models.Action
+	if err := json.Unmarshal(actionsRaw, &actions); err != nil {
+		log.Printf("AUTOMATION: Failed to unmarshal actions: %v", err)
+		return
+	}
+
+	for _, action := range actions {
+		if action.DeviceID != "" || action.Action != "send_email" {
+			continue
+		}
+		var paramsMap map[string]interface{}
+		if err := json.Unmarshal(action.Params, &paramsMap); err != nil {
+			continue
+		}
+		paramsMap = RenderParams(paramsMap, tctx)
+		if msg, ok := paramsMap["message"].(string); ok {
+			log.Printf("AUTOMATION: Sending notification: %s", msg)
+		}
+	}
 }
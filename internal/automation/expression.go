@@ -0,0 +1,952 @@
+package automation
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"smarthome/internal/clock"
+)
+
+// Expressions are a small, side-effect free language for "expression" condition
+// leaves, e.g. `device.12.temperature > device.7.temperature + 2` or
+// `sum(device.3.power, device.4.power) > 3000`. They can read device state
+// (device.<id>.<key> or device["<id>"]["<key>"]), the current time (time.hour,
+// time.minute, time.weekday, time.now as "HH:MM") and rule variables (vars.<name>).
+// There are no loops or assignments, and source length and nesting depth are capped.
+
+const (
+	maxExpressionLength = 1000
+	maxExpressionDepth  = 64
+)
+
+// Expression roots
+const (
+	exprRootDevice  = "device"
+	exprRootTime    = "time"
+	exprRootVars    = "vars"
+	exprRootTrigger = "trigger"
+)
+
+// ExpressionEnv provides the data an expression is evaluated against
+type ExpressionEnv struct {
+	DeviceState func(deviceID string) map[string]interface{}
+	Now         time.Time
+	Variables   map[string]interface{}
+	Trigger     map[string]interface{} // device_id, key, value and state of the triggering device
+}
+
+// Expression is a parsed and statically checked expression
+type Expression struct {
+	source    string
+	root      exprNode
+	devices   []string
+	variables []string
+	usesTime  bool
+}
+
+// CompileExpression parses an expression and checks it statically: identifiers and
+// functions must be known, device references must be literal, operand types must
+// fit their operators and the result must be a boolean.
+func CompileExpression(source string) (*Expression, error) {
+	expr, kind, err := compileExpression(source, false)
+	if err != nil {
+		return nil, err
+	}
+	if kind != kindBool && kind != kindAny {
+		return nil, fmt.Errorf("expression must evaluate to a boolean, got %s", kind)
+	}
+	return expr, nil
+}
+
+// compileValueExpression compiles an expression of any result type for action
+// templates, where the trigger context is also available
+func compileValueExpression(source string) (*Expression, error) {
+	expr, _, err := compileExpression(source, true)
+	return expr, err
+}
+
+func compileExpression(source string, allowTrigger bool) (*Expression, exprKind, error) {
+	if strings.TrimSpace(source) == "" {
+		return nil, "", fmt.Errorf("expression is empty")
+	}
+	if len(source) > maxExpressionLength {
+		return nil, "", fmt.Errorf("expression is longer than %d characters", maxExpressionLength)
+	}
+
+	tokens, err := lexExpression(source)
+	if err != nil {
+		return nil, "", err
+	}
+	p := &exprParser{tokens: tokens}
+	root, err := p.parseExpr(0)
+	if err != nil {
+		return nil, "", err
+	}
+	if tok := p.peek(); tok.kind != tokEOF {
+		return nil, "", fmt.Errorf("unexpected %q at position %d", tok.text, tok.pos)
+	}
+
+	ck := &exprChecker{devices: make(map[string]bool), variables: make(map[string]bool), allowTrigger: allowTrigger}
+	kind, err := ck.check(root)
+	if err != nil {
+		return nil, "", err
+	}
+
+	expr := &Expression{source: source, root: root, usesTime: ck.usesTime}
+	for id := range ck.devices {
+		expr.devices = append(expr.devices, id)
+	}
+	sort.Strings(expr.devices)
+	for name := range ck.variables {
+		expr.variables = append(expr.variables, name)
+	}
+	sort.Strings(expr.variables)
+	return expr, kind, nil
+}
+
+// DeviceIDs returns the devices the expression reads
+func (x *Expression) DeviceIDs() []string {
+	return x.devices
+}
+
+// VariableNames returns the variables the expression reads
+func (x *Expression) VariableNames() []string {
+	return x.variables
+}
+
+// UsesTime reports whether the expression reads the current time
+func (x *Expression) UsesTime() bool {
+	return x.usesTime
+}
+
+// value evaluates the expression to a value of any type. A panic while
+// evaluating is turned into an error so a bad expression cannot take the
+// worker down.
+func (x *Expression) value(env ExpressionEnv) (v interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			v, err = nil, fmt.Errorf("evaluating %q: %v", x.source, r)
+		}
+	}()
+	return x.root.eval(&env)
+}
+
+// Eval evaluates the expression to a boolean. Missing device values and type
+// mismatches at runtime are reported as errors, so a failing condition holds false.
+func (x *Expression) Eval(env ExpressionEnv) (bool, error) {
+	v, err := x.value(env)
+	if err != nil {
+		return false, err
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return false, fmt.Errorf("expression evaluated to %v, not a boolean", v)
+	}
+	return b, nil
+}
+
+// RewriteExpressionDevices rewrites the literal device IDs referenced by an
+// expression. References the mapping cannot resolve are returned as unresolved.
+func RewriteExpressionDevices(source string, mapping func(string) (string, bool)) (string, []string) {
+	tokens, err := lexExpression(source)
+	if err != nil {
+		return source, nil
+	}
+
+	var out strings.Builder
+	var unresolved []string
+	last := 0
+	replaceQuoted := func(tok exprToken) {
+		newID, ok := mapping(tok.value)
+		if !ok {
+			unresolved = append(unresolved, tok.value)
+			return
+		}
+		out.WriteString(source[last:tok.pos])
+		out.WriteString(strconv.Quote(newID))
+		last = tok.pos + len(tok.text)
+	}
+
+	for i := 0; i+2 < len(tokens); i++ {
+		if tokens[i].kind != tokIdent || tokens[i].text != exprRootDevice {
+			continue
+		}
+		switch {
+		case tokens[i+1].text == "." && (tokens[i+2].kind == tokNumber || tokens[i+2].kind == tokIdent):
+			if isPlainIdentifier(tokens[i+2].value) {
+				// device.<id> form; IDs that need quoting switch to device["<id>"]
+				newID, ok := mapping(tokens[i+2].value)
+				if !ok {
+					unresolved = append(unresolved, tokens[i+2].value)
+					continue
+				}
+				if isPlainIdentifier(newID) {
+					out.WriteString(source[last:tokens[i+2].pos])
+					out.WriteString(newID)
+				} else {
+					out.WriteString(source[last:tokens[i+1].pos])
+					out.WriteString("[" + strconv.Quote(newID) + "]")
+				}
+				last = tokens[i+2].pos + len(tokens[i+2].text)
+			}
+		case tokens[i+1].text == "[" && tokens[i+2].kind == tokString:
+			replaceQuoted(tokens[i+2])
+		}
+	}
+	out.WriteString(source[last:])
+	return out.String(), unresolved
+}
+
+// isPlainIdentifier reports whether a device ID can be written as device.<id>:
+// either all digits or an identifier
+func isPlainIdentifier(s string) bool {
+	if s == "" {
+		return false
+	}
+	digits := true
+	for _, r := range s {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_' {
+			return false
+		}
+		if !unicode.IsDigit(r) {
+			digits = false
+		}
+	}
+	return digits || !unicode.IsDigit(rune(s[0]))
+}
+
+// --- lexer ---
+
+type exprTokenKind int
+
+const (
+	tokEOF exprTokenKind = iota
+	tokNumber
+	tokString
+	tokIdent
+	tokOp
+)
+
+type exprToken struct {
+	kind  exprTokenKind
+	text  string // Source text of the token
+	value string // Unquoted string value or number text
+	pos   int
+}
+
+var exprOperators = []string{"||", "&&", "==", "!=", "<=", ">=", "<", ">", "+", "-", "*", "/", "%", "!", "(", ")", "[", "]", ",", "."}
+
+func lexExpression(src string) ([]exprToken, error) {
+	var tokens []exprToken
+	i := 0
+	for i < len(src) {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c >= '0' && c <= '9':
+			start := i
+			for i < len(src) && src[i] >= '0' && src[i] <= '9' {
+				i++
+			}
+			// A fraction needs a digit after the dot so device.12.temperature lexes as 12
+			if i+1 < len(src) && src[i] == '.' && src[i+1] >= '0' && src[i+1] <= '9' {
+				i++
+				for i < len(src) && src[i] >= '0' && src[i] <= '9' {
+					i++
+				}
+			}
+			tokens = append(tokens, exprToken{kind: tokNumber, text: src[start:i], value: src[start:i], pos: start})
+		case c == '"' || c == '\'':
+			start := i
+			i++
+			var sb strings.Builder
+			for i < len(src) && src[i] != c {
+				if src[i] == '\\' && i+1 < len(src) {
+					i++
+				}
+				sb.WriteByte(src[i])
+				i++
+			}
+			if i >= len(src) {
+				return nil, fmt.Errorf("unterminated string at position %d", start)
+			}
+			i++
+			tokens = append(tokens, exprToken{kind: tokString, text: src[start:i], value: sb.String(), pos: start})
+		case c == '_' || unicode.IsLetter(rune(c)):
+			start := i
+			for i < len(src) && (src[i] == '_' || unicode.IsLetter(rune(src[i])) || (src[i] >= '0' && src[i] <= '9')) {
+				i++
+			}
+			tokens = append(tokens, exprToken{kind: tokIdent, text: src[start:i], value: src[start:i], pos: start})
+		default:
+			matched := false
+			for _, op := range exprOperators {
+				if strings.HasPrefix(src[i:], op) {
+					tokens = append(tokens, exprToken{kind: tokOp, text: op, value: op, pos: i})
+					i += len(op)
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return nil, fmt.Errorf("unexpected character %q at position %d", c, i)
+			}
+		}
+	}
+	return append(tokens, exprToken{kind: tokEOF, pos: len(src)}), nil
+}
+
+// --- parser ---
+
+type exprParser struct {
+	tokens []exprToken
+	pos    int
+}
+
+func (p *exprParser) peek() exprToken {
+	return p.tokens[p.pos]
+}
+
+func (p *exprParser) next() exprToken {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokEOF {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *exprParser) expect(op string) error {
+	tok := p.next()
+	if tok.kind != tokOp || tok.text != op {
+		if tok.kind == tokEOF {
+			return fmt.Errorf("expected %q at end of expression", op)
+		}
+		return fmt.Errorf("expected %q at position %d, got %q", op, tok.pos, tok.text)
+	}
+	return nil
+}
+
+var exprPrecedence = map[string]int{
+	"||": 1,
+	"&&": 2,
+	"==": 3, "!=": 3,
+	"<": 4, "<=": 4, ">": 4, ">=": 4,
+	"+": 5, "-": 5,
+	"*": 6, "/": 6, "%": 6,
+}
+
+// parseExpr parses binary operators by precedence climbing
+func (p *exprParser) parseExpr(depth int) (exprNode, error) {
+	return p.parseBinary(1, depth)
+}
+
+func (p *exprParser) parseBinary(minPrec, depth int) (exprNode, error) {
+	if depth > maxExpressionDepth {
+		return nil, fmt.Errorf("expression is nested too deeply")
+	}
+	left, err := p.parseUnary(depth + 1)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		tok := p.peek()
+		prec, ok := exprPrecedence[tok.text]
+		if tok.kind != tokOp || !ok || prec < minPrec {
+			return left, nil
+		}
+		p.next()
+		right, err := p.parseBinary(prec+1, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryNode{op: tok.text, left: left, right: right}
+	}
+}
+
+func (p *exprParser) parseUnary(depth int) (exprNode, error) {
+	if depth > maxExpressionDepth {
+		return nil, fmt.Errorf("expression is nested too deeply")
+	}
+	tok := p.peek()
+	if tok.kind == tokOp && (tok.text == "!" || tok.text == "-") {
+		p.next()
+		operand, err := p.parseUnary(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		return &unaryNode{op: tok.text, operand: operand}, nil
+	}
+	return p.parsePostfix(depth + 1)
+}
+
+func (p *exprParser) parsePostfix(depth int) (exprNode, error) {
+	node, err := p.parsePrimary(depth)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		tok := p.peek()
+		if tok.kind != tokOp {
+			return node, nil
+		}
+		switch tok.text {
+		case ".":
+			p.next()
+			key := p.next()
+			if key.kind != tokIdent && key.kind != tokNumber {
+				return nil, fmt.Errorf("expected a field name after '.' at position %d", key.pos)
+			}
+			node = &memberNode{object: node, key: &literalNode{value: key.value}}
+		case "[":
+			p.next()
+			key, err := p.parseExpr(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			node = &memberNode{object: node, key: key}
+		default:
+			return node, nil
+		}
+	}
+}
+
+func (p *exprParser) parsePrimary(depth int) (exprNode, error) {
+	tok := p.next()
+	switch tok.kind {
+	case tokNumber:
+		n, err := strconv.ParseFloat(tok.value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q", tok.text)
+		}
+		return &literalNode{value: n}, nil
+	case tokString:
+		return &literalNode{value: tok.value}, nil
+	case tokIdent:
+		switch tok.text {
+		case "true":
+			return &literalNode{value: true}, nil
+		case "false":
+			return &literalNode{value: false}, nil
+		case "null":
+			return &literalNode{value: nil}, nil
+		}
+		if next := p.peek(); next.kind == tokOp && next.text == "(" {
+			p.next()
+			call := &callNode{name: tok.text}
+			if closing := p.peek(); !(closing.kind == tokOp && closing.text == ")") {
+				for {
+					arg, err := p.parseExpr(depth + 1)
+					if err != nil {
+						return nil, err
+					}
+					call.args = append(call.args, arg)
+					if sep := p.peek(); sep.kind == tokOp && sep.text == "," {
+						p.next()
+						continue
+					}
+					break
+				}
+			}
+			if err := p.expect(")"); err != nil {
+				return nil, err
+			}
+			return call, nil
+		}
+		return &identNode{name: tok.text}, nil
+	case tokOp:
+		if tok.text == "(" {
+			inner, err := p.parseExpr(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(")"); err != nil {
+				return nil, err
+			}
+			return inner, nil
+		}
+		return nil, fmt.Errorf("unexpected %q at position %d", tok.text, tok.pos)
+	}
+	return nil, fmt.Errorf("unexpected end of expression")
+}
+
+// --- static checking ---
+
+type exprKind string
+
+const (
+	kindAny    exprKind = "any"
+	kindBool   exprKind = "boolean"
+	kindNumber exprKind = "number"
+	kindString exprKind = "string"
+	kindNull   exprKind = "null"
+	kindObject exprKind = "object"
+)
+
+type exprFunc struct {
+	minArgs, maxArgs int // maxArgs < 0 means variadic
+	result           exprKind
+	args             exprKind
+	call             func(args []interface{}) (interface{}, error)
+}
+
+var exprFunctions = map[string]exprFunc{
+	"sum":     {1, -1, kindNumber, kindNumber, exprSum},
+	"min":     {1, -1, kindNumber, kindNumber, func(a []interface{}) (interface{}, error) { return foldNumbers(a[1:], a[0], math.Min) }},
+	"max":     {1, -1, kindNumber, kindNumber, func(a []interface{}) (interface{}, error) { return foldNumbers(a[1:], a[0], math.Max) }},
+	"avg":     {1, -1, kindNumber, kindNumber, exprAvg},
+	"abs":     {1, 1, kindNumber, kindNumber, func(a []interface{}) (interface{}, error) { return mapNumber(a[0], math.Abs) }},
+	"round":   {1, 1, kindNumber, kindNumber, func(a []interface{}) (interface{}, error) { return mapNumber(a[0], math.Round) }},
+	"floor":   {1, 1, kindNumber, kindNumber, func(a []interface{}) (interface{}, error) { return mapNumber(a[0], math.Floor) }},
+	"ceil":    {1, 1, kindNumber, kindNumber, func(a []interface{}) (interface{}, error) { return mapNumber(a[0], math.Ceil) }},
+	"between": {3, 3, kindBool, kindNumber, exprBetween},
+	"has":     {1, 1, kindBool, kindAny, func(a []interface{}) (interface{}, error) { return a[0] != nil, nil }},
+}
+
+// exprChecker infers the kind of nodes and collects literal device references
+type exprChecker struct {
+	devices      map[string]bool
+	variables    map[string]bool
+	usesTime     bool
+	allowTrigger bool // trigger.* is only available to action templates
+}
+
+func (ck *exprChecker) check(node exprNode) (exprKind, error) {
+	switch n := node.(type) {
+	case *literalNode:
+		switch n.value.(type) {
+		case float64:
+			return kindNumber, nil
+		case string:
+			return kindString, nil
+		case bool:
+			return kindBool, nil
+		}
+		return kindNull, nil
+	case *identNode:
+		switch n.name {
+		case exprRootTime:
+			ck.usesTime = true
+			return kindObject, nil
+		case exprRootDevice, exprRootVars:
+			return kindObject, nil
+		case exprRootTrigger:
+			if ck.allowTrigger {
+				return kindObject, nil
+			}
+		}
+		return "", fmt.Errorf("unknown identifier %q", n.name)
+	case *memberNode:
+		if root, ok := n.object.(*identNode); ok {
+			if _, err := ck.check(root); err != nil {
+				return "", err
+			}
+			key, ok := n.key.(*literalNode)
+			if !ok {
+				return "", fmt.Errorf("%s fields must be literal names", root.name)
+			}
+			name := fmt.Sprint(key.value)
+			switch root.name {
+			case exprRootDevice:
+				ck.devices[name] = true
+				return kindObject, nil
+			case exprRootVars:
+				ck.variables[name] = true
+				return kindAny, nil
+			case exprRootTime:
+				switch name {
+				case "hour", "minute", "weekday":
+					return kindNumber, nil
+				case "now":
+					return kindString, nil
+				}
+				return "", fmt.Errorf("unknown time field %q", name)
+			case exprRootTrigger:
+				switch name {
+				case "device_id", "key":
+					return kindString, nil
+				case "value":
+					return kindAny, nil
+				case "state":
+					return kindObject, nil
+				}
+				return "", fmt.Errorf("unknown trigger field %q", name)
+			}
+			return kindAny, nil
+		}
+		objKind, err := ck.check(n.object)
+		if err != nil {
+			return "", err
+		}
+		if objKind != kindObject {
+			return "", fmt.Errorf("cannot access a field of a %s", objKind)
+		}
+		if _, err := ck.check(n.key); err != nil {
+			return "", err
+		}
+		return kindAny, nil
+	case *unaryNode:
+		kind, err := ck.check(n.operand)
+		if err != nil {
+			return "", err
+		}
+		if n.op == "!" {
+			return kindBool, expectKind(n.op, kind, kindBool)
+		}
+		return kindNumber, expectKind(n.op, kind, kindNumber)
+	case *binaryNode:
+		left, err := ck.check(n.left)
+		if err != nil {
+			return "", err
+		}
+		right, err := ck.check(n.right)
+		if err != nil {
+			return "", err
+		}
+		switch n.op {
+		case "&&", "||":
+			if err := expectKind(n.op, left, kindBool); err != nil {
+				return "", err
+			}
+			return kindBool, expectKind(n.op, right, kindBool)
+		case "==", "!=":
+			if left != kindAny && right != kindAny && left != kindNull && right != kindNull && left != right {
+				return "", fmt.Errorf("cannot compare %s %s %s", left, n.op, right)
+			}
+			return kindBool, nil
+		case "<", "<=", ">", ">=":
+			if left == kindString || right == kindString {
+				if (left != kindString && left != kindAny) || (right != kindString && right != kindAny) {
+					return "", fmt.Errorf("cannot compare %s %s %s", left, n.op, right)
+				}
+				return kindBool, nil
+			}
+			if err := expectKind(n.op, left, kindNumber); err != nil {
+				return "", err
+			}
+			return kindBool, expectKind(n.op, right, kindNumber)
+		default:
+			if err := expectKind(n.op, left, kindNumber); err != nil {
+				return "", err
+			}
+			return kindNumber, expectKind(n.op, right, kindNumber)
+		}
+	case *callNode:
+		fn, ok := exprFunctions[n.name]
+		if !ok {
+			return "", fmt.Errorf("unknown function %q", n.name)
+		}
+		if len(n.args) < fn.minArgs || (fn.maxArgs >= 0 && len(n.args) > fn.maxArgs) {
+			return "", fmt.Errorf("wrong number of arguments for %s()", n.name)
+		}
+		for _, arg := range n.args {
+			kind, err := ck.check(arg)
+			if err != nil {
+				return "", err
+			}
+			if fn.args != kindAny {
+				if err := expectKind(n.name+"()", kind, fn.args); err != nil {
+					return "", err
+				}
+			}
+		}
+		return fn.result, nil
+	}
+	return "", fmt.Errorf("unsupported expression")
+}
+
+func expectKind(op string, got, want exprKind) error {
+	if got == want || got == kindAny {
+		return nil
+	}
+	return fmt.Errorf("%s expects a %s, got %s", op, want, got)
+}
+
+// --- evaluation ---
+
+type exprNode interface {
+	eval(env *ExpressionEnv) (interface{}, error)
+}
+
+type literalNode struct{ value interface{} }
+
+type identNode struct{ name string }
+
+type memberNode struct{ object, key exprNode }
+
+type unaryNode struct {
+	op      string
+	operand exprNode
+}
+
+type binaryNode struct {
+	op          string
+	left, right exprNode
+}
+
+type callNode struct {
+	name string
+	args []exprNode
+}
+
+// deviceRoot is the value of the bare "device" identifier
+type deviceRoot struct{}
+
+func (n *literalNode) eval(env *ExpressionEnv) (interface{}, error) {
+	return n.value, nil
+}
+
+func (n *identNode) eval(env *ExpressionEnv) (interface{}, error) {
+	switch n.name {
+	case exprRootDevice:
+		return deviceRoot{}, nil
+	case exprRootTime:
+		now := env.Now
+		if now.IsZero() {
+			now = clock.Now()
+		}
+		return map[string]interface{}{
+			"hour":    float64(now.Hour()),
+			"minute":  float64(now.Minute()),
+			"weekday": float64(now.Weekday()),
+			"now":     now.Format("15:04"),
+		}, nil
+	case exprRootVars:
+		if env.Variables == nil {
+			return map[string]interface{}{}, nil
+		}
+		return env.Variables, nil
+	case exprRootTrigger:
+		if env.Trigger == nil {
+			return map[string]interface{}{}, nil
+		}
+		return env.Trigger, nil
+	}
+	return nil, fmt.Errorf("unknown identifier %q", n.name)
+}
+
+func (n *memberNode) eval(env *ExpressionEnv) (interface{}, error) {
+	object, err := n.object.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	keyValue, err := n.key.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	key := formatExprKey(keyValue)
+
+	switch obj := object.(type) {
+	case deviceRoot:
+		if env.DeviceState == nil {
+			return map[string]interface{}{}, nil
+		}
+		state := env.DeviceState(key)
+		if state == nil {
+			state = map[string]interface{}{}
+		}
+		return state, nil
+	case map[string]interface{}:
+		return obj[key], nil
+	case nil:
+		return nil, nil
+	}
+	return nil, fmt.Errorf("cannot access field %q of %v", key, object)
+}
+
+func (n *unaryNode) eval(env *ExpressionEnv) (interface{}, error) {
+	v, err := n.operand.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	if n.op == "!" {
+		b, ok := v.(bool)
+		if !ok {
+			return nil, fmt.Errorf("! expects a boolean, got %v", v)
+		}
+		return !b, nil
+	}
+	f, ok := v.(float64)
+	if !ok {
+		return nil, fmt.Errorf("- expects a number, got %v", v)
+	}
+	return -f, nil
+}
+
+func (n *binaryNode) eval(env *ExpressionEnv) (interface{}, error) {
+	left, err := n.left.eval(env)
+	if err != nil {
+		return nil, err
+	}
+
+	// && and || short-circuit
+	if n.op == "&&" || n.op == "||" {
+		lb, ok := left.(bool)
+		if !ok {
+			return nil, fmt.Errorf("%s expects a boolean, got %v", n.op, left)
+		}
+		if (n.op == "&&" && !lb) || (n.op == "||" && lb) {
+			return lb, nil
+		}
+		right, err := n.right.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		rb, ok := right.(bool)
+		if !ok {
+			return nil, fmt.Errorf("%s expects a boolean, got %v", n.op, right)
+		}
+		return rb, nil
+	}
+
+	right, err := n.right.eval(env)
+	if err != nil {
+		return nil, err
+	}
+
+	switch n.op {
+	case "==":
+		return exprEqual(left, right), nil
+	case "!=":
+		return !exprEqual(left, right), nil
+	}
+
+	if ls, ok := left.(string); ok {
+		rs, ok := right.(string)
+		if !ok {
+			return nil, fmt.Errorf("cannot compare %v %s %v", left, n.op, right)
+		}
+		switch n.op {
+		case "<":
+			return ls < rs, nil
+		case "<=":
+			return ls <= rs, nil
+		case ">":
+			return ls > rs, nil
+		case ">=":
+			return ls >= rs, nil
+		}
+		return nil, fmt.Errorf("%s expects numbers, got strings", n.op)
+	}
+
+	l, lok := left.(float64)
+	r, rok := right.(float64)
+	if !lok || !rok {
+		return nil, fmt.Errorf("%s expects numbers, got %v and %v", n.op, left, right)
+	}
+	switch n.op {
+	case "<":
+		return l < r, nil
+	case "<=":
+		return l <= r, nil
+	case ">":
+		return l > r, nil
+	case ">=":
+		return l >= r, nil
+	case "+":
+		return l + r, nil
+	case "-":
+		return l - r, nil
+	case "*":
+		return l * r, nil
+	case "/":
+		if r == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		return l / r, nil
+	case "%":
+		if r == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		return math.Mod(l, r), nil
+	}
+	return nil, fmt.Errorf("unknown operator %s", n.op)
+}
+
+func (n *callNode) eval(env *ExpressionEnv) (interface{}, error) {
+	fn, ok := exprFunctions[n.name]
+	if !ok {
+		return nil, fmt.Errorf("unknown function %q", n.name)
+	}
+	args := make([]interface{}, len(n.args))
+	for i, arg := range n.args {
+		v, err := arg.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = v
+	}
+	return fn.call(args)
+}
+
+// exprEqual compares two values for == and !=. Objects and lists are compared
+// deeply because their Go types are not comparable with ==.
+func exprEqual(left, right interface{}) bool {
+	l, lok := left.(float64)
+	r, rok := right.(float64)
+	if lok && rok {
+		return l == r
+	}
+	return reflect.DeepEqual(left, right)
+}
+
+func formatExprKey(v interface{}) string {
+	if f, ok := v.(float64); ok {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	return fmt.Sprint(v)
+}
+
+func foldNumbers(args []interface{}, initial interface{}, fn func(acc, n float64) float64) (interface{}, error) {
+	acc, ok := initial.(float64)
+	if !ok {
+		return nil, fmt.Errorf("expected a number, got %v", initial)
+	}
+	for _, a := range args {
+		n, ok := a.(float64)
+		if !ok {
+			return nil, fmt.Errorf("expected a number, got %v", a)
+		}
+		acc = fn(acc, n)
+	}
+	return acc, nil
+}
+
+func mapNumber(v interface{}, fn func(float64) float64) (interface{}, error) {
+	n, ok := v.(float64)
+	if !ok {
+		return nil, fmt.Errorf("expected a number, got %v", v)
+	}
+	return fn(n), nil
+}
+
+func exprSum(args []interface{}) (interface{}, error) {
+	return foldNumbers(args, 0.0, func(acc, n float64) float64 { return acc + n })
+}
+
+func exprAvg(args []interface{}) (interface{}, error) {
+	total, err := exprSum(args)
+	if err != nil {
+		return nil, err
+	}
+	return total.(float64) / float64(len(args)), nil
+}
+
+func exprBetween(args []interface{}) (interface{}, error) {
+	v, ok1 := args[0].(float64)
+	lo, ok2 := args[1].(float64)
+	hi, ok3 := args[2].(float64)
+	if !ok1 || !ok2 || !ok3 {
+		return nil, fmt.Errorf("between() expects numbers")
+	}
+	return v >= lo && v <= hi, nil
+}
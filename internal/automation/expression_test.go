@@ -0,0 +1,218 @@
+package automation
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLexExpression(t *testing.T) {
+	tests := []struct {
+		src     string
+		kinds   []exprTokenKind
+		values  []string
+		wantErr bool
+	}{
+		{
+			src:    "device.12.temperature > 2.5",
+			kinds:  []exprTokenKind{tokIdent, tokOp, tokNumber, tokOp, tokIdent, tokOp, tokNumber, tokEOF},
+			values: []string{"device", ".", "12", ".", "temperature", ">", "2.5", ""},
+		},
+		{
+			src:    `device["a b"]['k\'ey']`,
+			kinds:  []exprTokenKind{tokIdent, tokOp, tokString, tokOp, tokOp, tokString, tokOp, tokEOF},
+			values: []string{"device", "[", "a b", "]", "[", "k'ey", "]", ""},
+		},
+		{
+			src:    "a>=b&&!c",
+			kinds:  []exprTokenKind{tokIdent, tokOp, tokIdent, tokOp, tokOp, tokIdent, tokEOF},
+			values: []string{"a", ">=", "b", "&&", "!", "c", ""},
+		},
+		{src: `"open`, wantErr: true},
+		{src: "a # b", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		tokens, err := lexExpression(tt.src)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("lexExpression(%q): expected an error", tt.src)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("lexExpression(%q): %v", tt.src, err)
+			continue
+		}
+		if len(tokens) != len(tt.kinds) {
+			t.Errorf("lexExpression(%q): got %d tokens, want %d", tt.src, len(tokens), len(tt.kinds))
+			continue
+		}
+		for i, tok := range tokens {
+			if tok.kind != tt.kinds[i] || tok.value != tt.values[i] {
+				t.Errorf("lexExpression(%q) token %d = (%d, %q), want (%d, %q)", tt.src, i, tok.kind, tok.value, tt.kinds[i], tt.values[i])
+			}
+		}
+	}
+}
+
+func TestCompileExpressionErrors(t *testing.T) {
+	tests := []struct {
+		src     string
+		wantErr string
+	}{
+		{"", "empty"},
+		{strings.Repeat("1+", maxExpressionLength) + "1 > 0", "longer than"},
+		{strings.Repeat("(", maxExpressionDepth+1) + "true" + strings.Repeat(")", maxExpressionDepth+1), "nested too deeply"},
+		{"1 +", "unexpected end"},
+		{"(true", `expected ")"`},
+		{"true true", "unexpected"},
+		{"foo > 1", "unknown identifier"},
+		{"nope(1) > 1", "unknown function"},
+		{"abs(1, 2) > 1", "wrong number of arguments"},
+		{"time.second > 1", "unknown time field"},
+		{"trigger.value == 1", "unknown identifier"},
+		{"device.1 > 1", "expects a number, got object"},
+		{`1 == "a"`, "cannot compare"},
+		{`"a" + 1 > 0`, "expects a number"},
+		{"1 + 2", "must evaluate to a boolean"},
+		{"device[vars.x].power > 1", "must be literal"},
+	}
+
+	for _, tt := range tests {
+		_, err := CompileExpression(tt.src)
+		if err == nil {
+			t.Errorf("CompileExpression(%.40q): expected an error containing %q", tt.src, tt.wantErr)
+			continue
+		}
+		if !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("CompileExpression(%.40q) = %v, want an error containing %q", tt.src, err, tt.wantErr)
+		}
+	}
+}
+
+func TestCompileExpressionReferences(t *testing.T) {
+	expr, err := CompileExpression(`device.12.temperature > device["7"].temperature + vars.offset && time.hour >= 8`)
+	if err != nil {
+		t.Fatalf("CompileExpression: %v", err)
+	}
+	if got := strings.Join(expr.DeviceIDs(), ","); got != "12,7" {
+		t.Errorf("DeviceIDs() = %s, want 12,7", got)
+	}
+	if got := strings.Join(expr.VariableNames(), ","); got != "offset" {
+		t.Errorf("VariableNames() = %s, want offset", got)
+	}
+	if !expr.UsesTime() {
+		t.Error("UsesTime() = false, want true")
+	}
+}
+
+func TestExpressionEval(t *testing.T) {
+	states := map[string]map[string]interface{}{
+		"1": {"temperature": 21.5, "power": 1200.0, "mode": "heat", "on": true, "color": map[string]interface{}{"r": 255.0}},
+		"2": {"temperature": 18.0, "power": 800.0, "color": map[string]interface{}{"r": 255.0}},
+	}
+	env := ExpressionEnv{
+		DeviceState: func(id string) map[string]interface{} { return states[id] },
+		Now:         time.Date(2024, 3, 4, 7, 30, 0, 0, time.UTC), // Monday
+		Variables:   map[string]interface{}{"offset": 2.0, "label": "night"},
+	}
+
+	tests := []struct {
+		src     string
+		want    bool
+		wantErr bool
+	}{
+		{"device.1.temperature > device.2.temperature + 2", true, false},
+		{"device.1.temperature > device.2.temperature + vars.offset * 2", false, false},
+		{"sum(device.1.power, device.2.power) >= 2000", true, false},
+		{"avg(device.1.power, device.2.power) == 1000", true, false},
+		{"min(3, 1, 2) == 1 && max(3, 1, 2) == 3", true, false},
+		{"round(2.5) == 3 && floor(2.5) == 2 && ceil(2.1) == 3 && abs(-4) == 4", true, false},
+		{"between(device.1.temperature, 20, 22)", true, false},
+		{"7 % 4 == 3 && -device.2.temperature < 0", true, false},
+		{`device.1.mode == "heat" && device["1"]["mode"] != "cool"`, true, false},
+		{`device.1.mode < "z"`, true, false},
+		{"device.1.on && !(device.2.power > 1000)", true, false},
+		{"time.hour == 7 && time.minute == 30 && time.weekday == 1", true, false},
+		{`time.now == "07:30"`, true, false},
+		{`vars.label == "night"`, true, false},
+		{"has(device.1.power) && !has(device.2.mode)", true, false},
+		{"device.2.mode == null", true, false},
+		{"device.9.power == null", true, false},
+		{"false && device.1.power / 0 > 1", false, false},
+		{"true || device.1.power / 0 > 1", true, false},
+		{"device.1.power / 0 > 1", false, true},
+		{"device.1.power % 0 > 1", false, true},
+		{"device.2.mode > 1", false, true},
+		{"vars.label", false, true},
+		// Objects are not comparable with Go's ==; they must compare deeply, not panic
+		{"device.1.color == device.2.color", true, false},
+		{"device.1.color != device.2.color", false, false},
+		{"device.1 == device.2", false, false},
+		{"vars.offset == 2", true, false},
+	}
+
+	for _, tt := range tests {
+		expr, err := CompileExpression(tt.src)
+		if err != nil {
+			t.Errorf("CompileExpression(%q): %v", tt.src, err)
+			continue
+		}
+		got, err := expr.Eval(env)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("Eval(%q) = %v, expected an error", tt.src, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Eval(%q): %v", tt.src, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("Eval(%q) = %v, want %v", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestExpressionEvalRecoversFromPanics(t *testing.T) {
+	expr, err := CompileExpression("device.1.power > 1")
+	if err != nil {
+		t.Fatalf("CompileExpression: %v", err)
+	}
+	env := ExpressionEnv{DeviceState: func(string) map[string]interface{} { panic("state lookup failed") }}
+	got, err := expr.Eval(env)
+	if err == nil || got {
+		t.Errorf("Eval() = %v, %v; want false and an error", got, err)
+	}
+}
+
+func TestRewriteExpressionDevices(t *testing.T) {
+	mapping := map[string]string{"1": "10", "2": "kitchen-light", "3": "lamp_3"}
+	lookup := func(id string) (string, bool) {
+		v, ok := mapping[id]
+		return v, ok
+	}
+
+	tests := []struct {
+		src        string
+		want       string
+		unresolved []string
+	}{
+		{"device.1.power > 0", "device.10.power > 0", nil},
+		{"device.2.power > 0", `device["kitchen-light"].power > 0`, nil},
+		{`device["3"].power > 0`, `device["lamp_3"].power > 0`, nil},
+		{"device.1.power > device.4.power", "device.10.power > device.4.power", []string{"4"}},
+	}
+
+	for _, tt := range tests {
+		got, unresolved := RewriteExpressionDevices(tt.src, lookup)
+		if got != tt.want {
+			t.Errorf("RewriteExpressionDevices(%q) = %q, want %q", tt.src, got, tt.want)
+		}
+		if strings.Join(unresolved, ",") != strings.Join(tt.unresolved, ",") {
+			t.Errorf("RewriteExpressionDevices(%q) unresolved = %v, want %v", tt.src, unresolved, tt.unresolved)
+		}
+	}
+}
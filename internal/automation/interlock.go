@@ -0,0 +1,287 @@
+package automation
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"smarthome/internal/clock"
+	"smarthome/internal/models"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/redis/go-redis/v9"
+)
+
+// Interlock kinds
+const (
+	InterlockForbid     = "forbid"
+	InterlockRange      = "range"
+	InterlockMaxRuntime = "max_runtime"
+)
+
+// InterlockError is a command rejected by an interlock
+type InterlockError struct {
+	InterlockID string `json:"interlock_id"`
+	Name        string `json:"name"`
+	DeviceID    string `json:"device_id"`
+	Reason      string `json:"reason"`
+}
+
+func (e *InterlockError) Error() string {
+	return fmt.Sprintf("interlock %q: %s", e.Name, e.Reason)
+}
+
+// interlockTimer schedules the max runtime check of an interlock
+var interlockTimer func(interlockID, deviceID string, since time.Time, delay time.Duration) error
+
+// SetInterlockTimer registers how max runtime checks are scheduled
+func SetInterlockTimer(schedule func(interlockID, deviceID string, since time.Time, delay time.Duration) error) {
+	interlockTimer = schedule
+}
+
+func deviceInterlocksKey(deviceID string) string {
+	return fmt.Sprintf("device:%s:interlocks", deviceID)
+}
+
+// runtimeKey holds when the device of a max_runtime interlock was turned on
+func runtimeKey(interlockID string) string {
+	return fmt.Sprintf("interlock:%s:on_since", interlockID)
+}
+
+// CacheInterlocks stores the enabled interlocks of a device for the command gate
+func CacheInterlocks(ctx context.Context, redisClient *redis.Client, deviceID string, interlocks []models.Interlock) error {
+	if len(interlocks) == 0 {
+		return redisClient.Del(ctx, deviceInterlocksKey(deviceID)).Err()
+	}
+	encoded, _ := json.Marshal(interlocks)
+	return redisClient.Set(ctx, deviceInterlocksKey(deviceID), encoded, 0).Err()
+}
+
+// loadInterlocks returns the cached interlocks of a device. A device without
+// interlocks has no key; any other failure is returned so the gate fails closed.
+func loadInterlocks(ctx context.Context, redisClient *redis.Client, deviceID string) ([]models.Interlock, error) {
+	raw, err := redisClient.Get(ctx, deviceInterlocksKey(deviceID)).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load interlocks of device %s: %w", deviceID, err)
+	}
+	var interlocks []models.Interlock
+	if err := json.Unmarshal([]byte(raw), &interlocks); err != nil {
+		return nil, fmt.Errorf("failed to decode interlocks of device %s: %w", deviceID, err)
+	}
+	return interlocks, nil
+}
+
+// ValidateInterlock checks an interlock's kind and settings
+func ValidateInterlock(il models.Interlock) error {
+	switch il.Kind {
+	case InterlockForbid:
+		if len(il.Condition) > 0 && string(il.Condition) != "null" {
+			if err := ValidateConditions(il.Condition); err != nil {
+				return err
+			}
+		}
+	case InterlockRange:
+		if il.Key == "" {
+			return fmt.Errorf("range interlocks need a key")
+		}
+		if il.Min == nil && il.Max == nil {
+			return fmt.Errorf("range interlocks need a min or max")
+		}
+		if il.Min != nil && il.Max != nil && *il.Min > *il.Max {
+			return fmt.Errorf("min is above max")
+		}
+	case InterlockMaxRuntime:
+		if il.Key == "" || len(il.Value) == 0 {
+			return fmt.Errorf("max_runtime interlocks need the key and value meaning on")
+		}
+		if il.MaxSeconds <= 0 {
+			return fmt.Errorf("max_runtime interlocks need a positive max_seconds")
+		}
+	default:
+		return fmt.Errorf("unknown interlock kind %q, use forbid, range or max_runtime", il.Kind)
+	}
+	return nil
+}
+
+// interlockRule checks commands and states against an interlock
+type interlockRule struct{ models.Interlock }
+
+// matchesValue reports whether v is the interlock's value, or any value without one
+func (il interlockRule) matchesValue(v interface{}) bool {
+	if len(il.Value) == 0 || string(il.Value) == "null" {
+		return true
+	}
+	encoded, _ := json.Marshal(v)
+	var want, got interface{}
+	json.Unmarshal(il.Value, &want)
+	json.Unmarshal(encoded, &got)
+	return fmt.Sprint(want) == fmt.Sprint(got)
+}
+
+// check returns why a command breaks the interlock, or "" when it does not
+func (il interlockRule) check(redisClient *redis.Client, params map[string]interface{}) string {
+	value, set := params[il.Key]
+	if il.Key != "" && !set {
+		return ""
+	}
+	switch il.Kind {
+	case InterlockForbid:
+		if !il.matchesValue(value) {
+			return ""
+		}
+		if len(il.Condition) > 0 && string(il.Condition) != "null" &&
+			!EvaluateConditions(redisClient, il.Condition, VariableScope{OwnerID: il.OwnerID}, time.Time{}) {
+			return ""
+		}
+		if il.Key == "" {
+			return "commands are not allowed now"
+		}
+		return fmt.Sprintf("%s=%v is not allowed now", il.Key, value)
+	case InterlockRange:
+		n, ok := toNumber(value)
+		if !ok {
+			return fmt.Sprintf("%s must be a number", il.Key)
+		}
+		if il.Min != nil && n < *il.Min {
+			return fmt.Sprintf("%s=%v is below the minimum of %v", il.Key, value, *il.Min)
+		}
+		if il.Max != nil && n > *il.Max {
+			return fmt.Sprintf("%s=%v is above the maximum of %v", il.Key, value, *il.Max)
+		}
+	}
+	return ""
+}
+
+func toNumber(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case int:
+		return float64(n), true
+	case string:
+		f, err := strconv.ParseFloat(n, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// CheckCommand returns an *InterlockError when a command to a device breaks one
+// of its interlocks, or another error when its interlocks cannot be read
+func CheckCommand(ctx context.Context, redisClient *redis.Client, deviceID string, params map[string]interface{}) error {
+	if redisClient == nil {
+		return nil
+	}
+	interlocks, err := loadInterlocks(ctx, redisClient, deviceID)
+	if err != nil {
+		return err
+	}
+	for _, il := range interlocks {
+		if reason := (interlockRule{il}).check(redisClient, params); reason != "" {
+			return &InterlockError{InterlockID: il.ID, Name: il.Name, DeviceID: deviceID, Reason: reason}
+		}
+	}
+	return nil
+}
+
+// PublishCommand publishes a command to a device unless an interlock rejects it.
+// Every command to devices/<id>/commands goes through here; source names the
+// sender in the log.
+func PublishCommand(ctx context.Context, redisClient *redis.Client, mqttClient mqtt.Client, deviceID string, params map[string]interface{}, source string) (mqtt.Token, error) {
+	if err := CheckCommand(ctx, redisClient, deviceID, params); err != nil {
+		log.Printf("INTERLOCK: Rejected command from %s to device %s: %v", source, deviceID, err)
+		return nil, err
+	}
+	payload, err := json.Marshal(params)
+	if err != nil {
+		return nil, err
+	}
+	topic := fmt.Sprintf("devices/%s/commands", deviceID)
+	log.Printf("AUTOMATION: Publishing MQTT command from %s to %s: %s", source, topic, string(payload))
+	token := mqttClient.Publish(topic, 1, false, payload)
+	TrackRuntime(ctx, redisClient, deviceID, params)
+	return token, nil
+}
+
+// TrackRuntime starts the max runtime clock of a device's interlocks when a state
+// or command turns it on, and stops it when it turns off
+func TrackRuntime(ctx context.Context, redisClient *redis.Client, deviceID string, state map[string]interface{}) {
+	if redisClient == nil {
+		return
+	}
+	interlocks, err := loadInterlocks(ctx, redisClient, deviceID)
+	if err != nil {
+		log.Printf("INTERLOCK: Not tracking runtime of device %s: %v", deviceID, err)
+		return
+	}
+	for _, il := range interlocks {
+		if il.Kind != InterlockMaxRuntime {
+			continue
+		}
+		value, set := state[il.Key]
+		if !set {
+			continue
+		}
+		if !(interlockRule{il}).matchesValue(value) {
+			redisClient.Del(ctx, runtimeKey(il.ID))
+			continue
+		}
+		now := clock.Now()
+		started, err := redisClient.SetNX(ctx, runtimeKey(il.ID), now.Format(time.RFC3339Nano), 0).Result()
+		if err != nil || !started {
+			continue
+		}
+		log.Printf("INTERLOCK: Device %s is on, turning it off in %ds unless it goes off (%s)", deviceID, il.MaxSeconds, il.Name)
+		if interlockTimer != nil {
+			if err := interlockTimer(il.ID, deviceID, now, time.Duration(il.MaxSeconds)*time.Second); err != nil {
+				log.Printf("INTERLOCK: Failed to schedule max runtime of device %s: %v", deviceID, err)
+			}
+		}
+	}
+}
+
+// EnforceMaxRuntime turns a device off when it has been on since since, as
+// recorded when its max runtime clock started. It reports whether it did.
+func EnforceMaxRuntime(ctx context.Context, redisClient *redis.Client, mqttClient mqtt.Client, interlockID, deviceID string, since time.Time) (map[string]interface{}, bool) {
+	raw, err := redisClient.Get(ctx, runtimeKey(interlockID)).Result()
+	if err != nil {
+		return nil, false // Turned off in the meantime
+	}
+	started, err := time.Parse(time.RFC3339Nano, raw)
+	if err != nil || !started.Equal(since) {
+		return nil, false // Turned off and on again; a later check covers it
+	}
+	interlocks, err := loadInterlocks(ctx, redisClient, deviceID)
+	if err != nil {
+		log.Printf("INTERLOCK: Failed to check max runtime of device %s: %v", deviceID, err)
+		return nil, false
+	}
+	var il *models.Interlock
+	for _, candidate := range interlocks {
+		if candidate.ID == interlockID && candidate.Kind == InterlockMaxRuntime {
+			il = &candidate
+			break
+		}
+	}
+	if il == nil {
+		redisClient.Del(ctx, runtimeKey(interlockID))
+		return nil, false
+	}
+
+	var off interface{} = false
+	if len(il.OffValue) > 0 && string(il.OffValue) != "null" {
+		json.Unmarshal(il.OffValue, &off)
+	}
+	params := map[string]interface{}{il.Key: off}
+	payload, _ := json.Marshal(params)
+	topic := fmt.Sprintf("devices/%s/commands", deviceID)
+	log.Printf("INTERLOCK: Device %s exceeded its max runtime of %ds (%s), publishing %s to %s", deviceID, il.MaxSeconds, il.Name, payload, topic)
+	mqttClient.Publish(topic, 1, false, payload)
+	redisClient.Del(ctx, runtimeKey(interlockID))
+	return params, true
+}
@@ -0,0 +1,44 @@
+package automation
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"smarthome/internal/utils"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// deviceOwnerKey holds the household an accepted device belongs to, so
+// expressions and templates of a rule only read their own household's devices
+func deviceOwnerKey(deviceID string) string {
+	return fmt.Sprintf("device:%s:owner", deviceID)
+}
+
+// CacheDeviceOwner records the household of an accepted device; an empty
+// owner forgets a device that was deleted or is not accepted
+func CacheDeviceOwner(ctx context.Context, redisClient *redis.Client, deviceID, ownerID string) error {
+	if ownerID == "" {
+		return redisClient.Del(ctx, deviceOwnerKey(deviceID)).Err()
+	}
+	return redisClient.Set(ctx, deviceOwnerKey(deviceID), ownerID, 0).Err()
+}
+
+// ownedDeviceState returns the state reader of an expression environment. It
+// only sees devices of household ownerID; other devices read as missing.
+func ownedDeviceState(redisClient *redis.Client, ownerID string) func(deviceID string) map[string]interface{} {
+	return func(deviceID string) map[string]interface{} {
+		if redisClient == nil || ownerID == "" {
+			return nil
+		}
+		ctx := context.Background()
+		if owner, err := redisClient.Get(ctx, deviceOwnerKey(deviceID)).Result(); err != nil || owner != ownerID {
+			return nil
+		}
+		stateRaw, _ := redisClient.Get(ctx, fmt.Sprintf("device:%s", deviceID)).Result()
+		var state utils.DeviceState
+		json.Unmarshal([]byte(stateRaw), &state)
+		return state
+	}
+}
@@ -0,0 +1,229 @@
+package automation
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"smarthome/internal/models"
+	"smarthome/internal/utils"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// A "presence" condition leaf such as {"type": "presence", "person_id": "4", "value": "home"}
+// reads the presence of person 4; without person_id it reads the household, which is
+// home while anyone is home. Values are "home", "away", "just_left" (away for less
+// than the just-left window), and the triggers "arrived" and "left", true for a few
+// seconds after the change, so {"type": "presence", "value": "left"} reacts to the
+// last person leaving and "arrived" to the first one arriving. "op": "!=" inverts the
+// leaf. Rules using it are re-evaluated whenever someone in the household comes or goes.
+
+// Presence states and condition values
+const (
+	PresenceHome     = "home"
+	PresenceAway     = "away"
+	PresenceJustLeft = "just_left"
+	PresenceArrived  = "arrived"
+	PresenceLeft     = "left"
+)
+
+// DefaultPresenceEventWindow is how long the arrived and left values stay true
+const DefaultPresenceEventWindow = 10 * time.Second
+
+// presenceJustLeftWindow is how long someone who left counts as just_left
+var presenceJustLeftWindow = 10 * time.Minute
+
+// SetPresenceJustLeftWindow sets how long someone who left counts as just_left
+func SetPresenceJustLeftWindow(d time.Duration) {
+	if d > 0 {
+		presenceJustLeftWindow = d
+	}
+}
+
+// PresenceRecord is the cached presence of a person or household
+type PresenceRecord struct {
+	Presence  string    `json:"presence"` // "home" or "away"
+	ChangedAt time.Time `json:"changed_at"`
+}
+
+// State returns "home", "away" or "just_left" at now
+func (r PresenceRecord) State(now time.Time) string {
+	if r.Presence == PresenceHome {
+		return PresenceHome
+	}
+	if !r.ChangedAt.IsZero() && now.Sub(r.ChangedAt) < presenceJustLeftWindow {
+		return PresenceJustLeft
+	}
+	return PresenceAway
+}
+
+// matches reports whether the record satisfies a presence condition value at now
+func (r PresenceRecord) matches(value string, now time.Time) bool {
+	recent := !r.ChangedAt.IsZero() && now.Sub(r.ChangedAt) <= DefaultPresenceEventWindow
+	switch value {
+	case PresenceHome:
+		return r.Presence == PresenceHome
+	case PresenceAway:
+		return r.Presence != PresenceHome
+	case PresenceJustLeft:
+		return r.State(now) == PresenceJustLeft
+	case PresenceArrived:
+		return r.Presence == PresenceHome && recent
+	case PresenceLeft:
+		return r.Presence != PresenceHome && recent
+	}
+	return false
+}
+
+// ValidPresenceValue reports whether value is a presence condition value
+func ValidPresenceValue(value string) bool {
+	switch value {
+	case PresenceHome, PresenceAway, PresenceJustLeft, PresenceArrived, PresenceLeft:
+		return true
+	}
+	return false
+}
+
+// PersonRecord returns the presence record of a person
+func PersonRecord(p models.Person) PresenceRecord {
+	record := PresenceRecord{Presence: p.Presence}
+	if p.PresenceChangedAt != nil {
+		record.ChangedAt = *p.PresenceChangedAt
+	}
+	return record
+}
+
+// HouseholdRecord derives a household's presence from its people: home since the
+// first of those at home arrived, or away since the last one left
+func HouseholdRecord(people []models.Person) PresenceRecord {
+	household := PresenceRecord{Presence: PresenceAway}
+	for _, p := range people {
+		record := PersonRecord(p)
+		switch {
+		case record.Presence == PresenceHome && household.Presence != PresenceHome:
+			household = record
+		case record.Presence == PresenceHome:
+			if record.ChangedAt.Before(household.ChangedAt) {
+				household.ChangedAt = record.ChangedAt
+			}
+		case household.Presence != PresenceHome && record.ChangedAt.After(household.ChangedAt):
+			household.ChangedAt = record.ChangedAt
+		}
+	}
+	return household
+}
+
+func personPresenceKey(personID string) string {
+	return fmt.Sprintf("presence:person:%s", personID)
+}
+
+func householdPresenceKey(ownerID string) string {
+	return fmt.Sprintf("presence:household:%s", ownerID)
+}
+
+// presenceRulesKey is the Redis set of rules with a presence leaf on a household
+func presenceRulesKey(ownerID string) string {
+	return fmt.Sprintf("presence:%s:rules", ownerID)
+}
+
+// CachePresence stores the presence of a household and its people for condition evaluation
+func CachePresence(ctx context.Context, redisClient *redis.Client, ownerID string, people []models.Person) error {
+	pipe := redisClient.TxPipeline()
+	for _, p := range people {
+		encoded, _ := json.Marshal(PersonRecord(p))
+		pipe.Set(ctx, personPresenceKey(p.ID), encoded, 0)
+	}
+	encoded, _ := json.Marshal(HouseholdRecord(people))
+	pipe.Set(ctx, householdPresenceKey(ownerID), encoded, 0)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// UncachePerson removes a deleted person's presence
+func UncachePerson(ctx context.Context, redisClient *redis.Client, personID string) error {
+	return redisClient.Del(ctx, personPresenceKey(personID)).Err()
+}
+
+// LoadPresence returns the cached presence of a person, or of the household without personID
+func LoadPresence(ctx context.Context, redisClient *redis.Client, ownerID, personID string) (PresenceRecord, bool) {
+	key := householdPresenceKey(ownerID)
+	if personID != "" {
+		key = personPresenceKey(personID)
+	}
+	raw, err := redisClient.Get(ctx, key).Result()
+	if err != nil {
+		return PresenceRecord{}, false
+	}
+	var record PresenceRecord
+	if err := json.Unmarshal([]byte(raw), &record); err != nil {
+		return PresenceRecord{}, false
+	}
+	return record, true
+}
+
+// ExtractPresenceRefs returns the people a rule's presence and zone leaves read, with "" for the household
+func ExtractPresenceRefs(conditionsRaw json.RawMessage) []string {
+	var condition models.Condition
+	if err := json.Unmarshal(conditionsRaw, &condition); err != nil {
+		return nil
+	}
+	seen := make(map[string]bool)
+	extractPresenceRefsRecursive(condition, seen)
+
+	personIDs := make([]string, 0, len(seen))
+	for id := range seen {
+		personIDs = append(personIDs, id)
+	}
+	sort.Strings(personIDs)
+	return personIDs
+}
+
+func extractPresenceRefsRecursive(cond models.Condition, seen map[string]bool) {
+	if cond.Type == "presence" || cond.Type == "zone" {
+		seen[cond.PersonID] = true
+	}
+	for _, child := range cond.Children {
+		extractPresenceRefsRecursive(child, seen)
+	}
+}
+
+// IndexRulePresence records that a rule reads its owner's presence so comings and goings re-evaluate it
+func IndexRulePresence(ctx context.Context, redisClient *redis.Client, rule models.Rule) {
+	if len(ExtractPresenceRefs(rule.Conditions)) == 0 {
+		return
+	}
+	redisClient.SAdd(ctx, presenceRulesKey(rule.OwnerID), rule.ID)
+	log.Printf("AUTOMATION: Associated rule %s with presence of household %s", rule.ID, rule.OwnerID)
+}
+
+// PresenceDependents returns the rules to re-evaluate when someone in a household comes or goes
+func PresenceDependents(ctx context.Context, redisClient *redis.Client, ownerID string) []string {
+	ruleIDs, err := redisClient.SMembers(ctx, presenceRulesKey(ownerID)).Result()
+	if err != nil {
+		log.Printf("AUTOMATION: Failed to fetch rules for presence of household %s: %v", ownerID, err)
+		return nil
+	}
+	return ruleIDs
+}
+
+// presenceMatches evaluates a presence leaf for the household of scope
+func presenceMatches(redisClient *redis.Client, cond models.Condition, scope VariableScope) bool {
+	if redisClient == nil {
+		return false
+	}
+	var value string
+	json.Unmarshal(cond.Value, &value)
+	record, ok := LoadPresence(context.Background(), redisClient, scope.OwnerID, cond.PersonID)
+	if !ok {
+		record = PresenceRecord{Presence: PresenceAway}
+	}
+	result := record.matches(value, utils.GetCurrentTime())
+	if cond.Op == "!=" {
+		return !result
+	}
+	return result
+}
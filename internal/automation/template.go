@@ -0,0 +1,421 @@
+package automation
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"strings"
+	"time"
+
+	"smarthome/internal/models"
+	"smarthome/internal/utils"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Action params may contain templates such as "{{ device.3.lux | scale(0,1000,100,0) }}"
+// or "Temperature is {{ trigger.value }}°C". A string that is exactly one template
+// keeps the type of its result (e.g. a number for brightness); otherwise the results
+// are formatted into the surrounding text. Templates use the expression language
+// and can additionally read trigger.device_id, trigger.key, trigger.value and
+// trigger.state. Filters after "|" are applied left to right.
+
+// TemplateContext is the execution context templates are resolved against
+type TemplateContext struct {
+	RedisClient     *redis.Client
+	TriggerDeviceID string // Device whose update caused the evaluation, empty for scheduled runs
+	TriggerKey      string // Attribute of the trigger device the rule's conditions look at
+	Scope           VariableScope
+	Now             time.Time
+}
+
+// templateFilter transforms a value; args are the evaluated filter arguments
+type templateFilter struct {
+	args int
+	call func(v float64, args []float64) float64
+}
+
+var templateFilters = map[string]templateFilter{
+	// scale(in_min, in_max, out_min, out_max) maps a value linearly, clamped to the output range
+	"scale": {4, func(v float64, a []float64) float64 {
+		if a[1] == a[0] {
+			return a[2]
+		}
+		out := a[2] + (v-a[0])*(a[3]-a[2])/(a[1]-a[0])
+		return math.Max(math.Min(out, math.Max(a[2], a[3])), math.Min(a[2], a[3]))
+	}},
+	"clamp": {2, func(v float64, a []float64) float64 { return math.Max(a[0], math.Min(a[1], v)) }},
+	"round": {0, func(v float64, a []float64) float64 { return math.Round(v) }},
+	"abs":   {0, func(v float64, a []float64) float64 { return math.Abs(v) }},
+}
+
+// compiledTemplate is one {{ ... }} block
+type compiledTemplate struct {
+	expr    *Expression
+	filters []compiledFilter
+}
+
+type compiledFilter struct {
+	name string
+	args []*Expression
+	// fallback is the argument of default(), used when the value is missing
+	fallback bool
+}
+
+// TriggerKey returns the attribute of a device that a rule's conditions refer to
+func TriggerKey(conditionsRaw json.RawMessage, deviceID string) string {
+	var condition models.Condition
+	if err := json.Unmarshal(conditionsRaw, &condition); err != nil {
+		return ""
+	}
+	return triggerKeyRecursive(condition, deviceID)
+}
+
+func triggerKeyRecursive(cond models.Condition, deviceID string) string {
+	if cond.Operator == "" && cond.DeviceID == deviceID && cond.Key != "" {
+		return cond.Key
+	}
+	for _, child := range cond.Children {
+		if key := triggerKeyRecursive(child, deviceID); key != "" {
+			return key
+		}
+	}
+	return ""
+}
+
+// ValidateActions statically checks a rule's actions and the templates in their params
+func ValidateActions(actionsRaw json.RawMessage) error {
+	var actions []models.Action
+	if err := json.Unmarshal(actionsRaw, &actions); err != nil {
+		return fmt.Errorf("invalid actions: %v", err)
+	}
+	for i, action := range actions {
+		var params interface{}
+		if len(action.Params) == 0 {
+			continue
+		}
+		if err := json.Unmarshal(action.Params, &params); err != nil {
+			return fmt.Errorf("actions[%d]: invalid params: %v", i, err)
+		}
+		if err := validateTemplates(params); err != nil {
+			return fmt.Errorf("actions[%d]: %v", i, err)
+		}
+		if action.Action == "set_variable" {
+			fields, _ := params.(map[string]interface{})
+			if name, _ := fields["name"].(string); name == "" {
+				return fmt.Errorf("actions[%d]: set_variable needs a variable name", i)
+			}
+			if _, ok := fields["value"]; !ok {
+				return fmt.Errorf("actions[%d]: set_variable needs a value", i)
+			}
+		}
+		if action.Action == "set_vacation" {
+			fields, _ := params.(map[string]interface{})
+			if _, ok := fields["enabled"]; !ok {
+				return fmt.Errorf("actions[%d]: set_vacation needs enabled", i)
+			}
+		}
+		if isChainAction(action.Action) {
+			fields, _ := params.(map[string]interface{})
+			if ruleID, _ := fields["rule_id"].(string); ruleID == "" {
+				return fmt.Errorf("actions[%d]: %s needs a rule_id", i, action.Action)
+			}
+		}
+	}
+	return nil
+}
+
+func validateTemplates(v interface{}) error {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		for _, child := range val {
+			if err := validateTemplates(child); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for _, child := range val {
+			if err := validateTemplates(child); err != nil {
+				return err
+			}
+		}
+	case string:
+		if _, _, err := parseTemplateString(val); err != nil {
+			return fmt.Errorf("invalid template %q: %v", val, err)
+		}
+	}
+	return nil
+}
+
+// RenderParams resolves all templates in an action's params. Params whose
+// templates fail to resolve are dropped so no half-rendered value is sent.
+func RenderParams(params map[string]interface{}, tctx TemplateContext) map[string]interface{} {
+	env := tctx.env()
+	rendered := make(map[string]interface{}, len(params))
+	for key, value := range params {
+		v, err := renderTemplateValue(value, env)
+		if err != nil {
+			log.Printf("AUTOMATION: Failed to render param %s: %v", key, err)
+			continue
+		}
+		rendered[key] = v
+	}
+	return rendered
+}
+
+// env builds the expression environment for the template context
+func (tctx TemplateContext) env() ExpressionEnv {
+	deviceState := ownedDeviceState(tctx.RedisClient, tctx.Scope.OwnerID)
+
+	env := ExpressionEnv{
+		DeviceState: deviceState,
+		Now:         tctx.Now,
+		Variables:   LoadVariables(context.Background(), tctx.RedisClient, tctx.Scope),
+	}
+	if env.Now.IsZero() {
+		env.Now = utils.GetCurrentTime()
+	}
+	if tctx.TriggerDeviceID != "" {
+		state := deviceState(tctx.TriggerDeviceID)
+		env.Trigger = map[string]interface{}{
+			"device_id": tctx.TriggerDeviceID,
+			"key":       tctx.TriggerKey,
+			"value":     state[tctx.TriggerKey],
+			"state":     state,
+		}
+	}
+	return env
+}
+
+func renderTemplateValue(v interface{}, env ExpressionEnv) (interface{}, error) {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(val))
+		for k, child := range val {
+			rendered, err := renderTemplateValue(child, env)
+			if err != nil {
+				return nil, err
+			}
+			out[k] = rendered
+		}
+		return out, nil
+	case []interface{}:
+		out := make([]interface{}, len(val))
+		for i, child := range val {
+			rendered, err := renderTemplateValue(child, env)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = rendered
+		}
+		return out, nil
+	case string:
+		return renderTemplateString(val, env)
+	}
+	return v, nil
+}
+
+func renderTemplateString(s string, env ExpressionEnv) (interface{}, error) {
+	literals, templates, err := parseTemplateString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(templates) == 0 {
+		return s, nil
+	}
+
+	// A string that is exactly one template keeps the result's type
+	if len(templates) == 1 && literals[0] == "" && literals[1] == "" {
+		return templates[0].render(env)
+	}
+
+	var sb strings.Builder
+	for i, tmpl := range templates {
+		sb.WriteString(literals[i])
+		v, err := tmpl.render(env)
+		if err != nil {
+			return nil, err
+		}
+		sb.WriteString(formatTemplateValue(v))
+	}
+	sb.WriteString(literals[len(templates)])
+	return sb.String(), nil
+}
+
+// parseTemplateString splits a string into literal text and compiled templates;
+// literals always has one more element than templates
+func parseTemplateString(s string) ([]string, []compiledTemplate, error) {
+	var literals []string
+	var templates []compiledTemplate
+	for {
+		start := strings.Index(s, "{{")
+		if start < 0 {
+			literals = append(literals, s)
+			return literals, templates, nil
+		}
+		end := strings.Index(s[start:], "}}")
+		if end < 0 {
+			return nil, nil, fmt.Errorf("unterminated {{")
+		}
+		tmpl, err := compileTemplate(s[start+2 : start+end])
+		if err != nil {
+			return nil, nil, err
+		}
+		literals = append(literals, s[:start])
+		templates = append(templates, tmpl)
+		s = s[start+end+2:]
+	}
+}
+
+// RewriteTemplateDevices rewrites the literal device IDs read by the templates
+// in s, including filter arguments, with mapping. Text outside the templates is
+// kept as is; IDs the mapping cannot resolve are left and returned as unresolved.
+func RewriteTemplateDevices(s string, mapping func(string) (string, bool)) (string, []string) {
+	var out strings.Builder
+	var unresolved []string
+	for {
+		start := strings.Index(s, "{{")
+		if start < 0 {
+			break
+		}
+		end := strings.Index(s[start:], "}}")
+		if end < 0 {
+			break
+		}
+		parts := splitTopLevel(s[start+2:start+end], '|')
+		for i, part := range parts {
+			var missing []string
+			parts[i], missing = RewriteExpressionDevices(part, mapping)
+			unresolved = append(unresolved, missing...)
+		}
+		out.WriteString(s[:start+2])
+		out.WriteString(strings.Join(parts, "|"))
+		out.WriteString("}}")
+		s = s[start+end+2:]
+	}
+	out.WriteString(s)
+	return out.String(), unresolved
+}
+
+func compileTemplate(source string) (compiledTemplate, error) {
+	parts := splitTopLevel(source, '|')
+	expr, err := compileValueExpression(parts[0])
+	if err != nil {
+		return compiledTemplate{}, err
+	}
+	tmpl := compiledTemplate{expr: expr}
+
+	for _, part := range parts[1:] {
+		part = strings.TrimSpace(part)
+		name, argSource := part, ""
+		if open := strings.Index(part, "("); open >= 0 {
+			if !strings.HasSuffix(part, ")") {
+				return compiledTemplate{}, fmt.Errorf("malformed filter %q", part)
+			}
+			name, argSource = strings.TrimSpace(part[:open]), part[open+1:len(part)-1]
+		}
+
+		filter := compiledFilter{name: name}
+		if strings.TrimSpace(argSource) != "" {
+			for _, arg := range splitTopLevel(argSource, ',') {
+				argExpr, err := compileValueExpression(arg)
+				if err != nil {
+					return compiledTemplate{}, fmt.Errorf("filter %s: %v", name, err)
+				}
+				filter.args = append(filter.args, argExpr)
+			}
+		}
+
+		if name == "default" {
+			if len(filter.args) != 1 {
+				return compiledTemplate{}, fmt.Errorf("default expects 1 argument")
+			}
+			filter.fallback = true
+		} else if f, ok := templateFilters[name]; !ok {
+			return compiledTemplate{}, fmt.Errorf("unknown filter %q", name)
+		} else if len(filter.args) != f.args {
+			return compiledTemplate{}, fmt.Errorf("%s expects %d arguments", name, f.args)
+		}
+		tmpl.filters = append(tmpl.filters, filter)
+	}
+	return tmpl, nil
+}
+
+func (t compiledTemplate) render(env ExpressionEnv) (interface{}, error) {
+	v, err := t.expr.value(env)
+	if err != nil {
+		return nil, err
+	}
+	for _, filter := range t.filters {
+		if filter.fallback {
+			if v == nil {
+				if v, err = filter.args[0].value(env); err != nil {
+					return nil, err
+				}
+			}
+			continue
+		}
+
+		n, ok := v.(float64)
+		if !ok {
+			return nil, fmt.Errorf("filter %s expects a number, got %v", filter.name, v)
+		}
+		args := make([]float64, len(filter.args))
+		for i, arg := range filter.args {
+			av, err := arg.value(env)
+			if err != nil {
+				return nil, err
+			}
+			if args[i], ok = av.(float64); !ok {
+				return nil, fmt.Errorf("filter %s expects numeric arguments", filter.name)
+			}
+		}
+		v = templateFilters[filter.name].call(n, args)
+	}
+	if v == nil {
+		return nil, fmt.Errorf("template %q has no value", t.expr.source)
+	}
+	return v, nil
+}
+
+// splitTopLevel splits on sep outside of parentheses and quotes. When splitting
+// on filter pipes, the || operator is left intact.
+func splitTopLevel(s string, sep byte) []string {
+	var parts []string
+	var quote byte
+	depth, last := 0, 0
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == '\\' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '(' || c == '[':
+			depth++
+		case c == ')' || c == ']':
+			depth--
+		case c == sep && depth == 0:
+			if sep == '|' && i+1 < len(s) && s[i+1] == '|' {
+				i++
+				continue
+			}
+			parts = append(parts, s[last:i])
+			last = i + 1
+		}
+	}
+	return append(parts, s[last:])
+}
+
+func formatTemplateValue(v interface{}) string {
+	if f, ok := v.(float64); ok {
+		return formatExprKey(math.Round(f*100) / 100)
+	}
+	return fmt.Sprint(v)
+}
@@ -0,0 +1,234 @@
+package automation
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func templateTestEnv() ExpressionEnv {
+	states := map[string]map[string]interface{}{
+		"3": {"lux": 250.0, "name": "hall"},
+		"5": {"temperature": -4.6},
+	}
+	return ExpressionEnv{
+		DeviceState: func(id string) map[string]interface{} { return states[id] },
+		Now:         time.Date(2024, 3, 4, 18, 5, 0, 0, time.UTC),
+		Variables:   map[string]interface{}{"target": 21.0},
+		Trigger: map[string]interface{}{
+			"device_id": "5",
+			"key":       "temperature",
+			"value":     -4.6,
+			"state":     map[string]interface{}{"temperature": -4.6},
+		},
+	}
+}
+
+func TestRenderTemplateString(t *testing.T) {
+	tests := []struct {
+		src     string
+		want    interface{}
+		wantErr string
+	}{
+		// Plain strings and single templates keep their type
+		{"plain text", "plain text", ""},
+		{"{{ device.3.lux }}", 250.0, ""},
+		{"{{ device.3.name }}", "hall", ""},
+		{"{{ device.3.lux > 100 }}", true, ""},
+		{"  {{ device.3.lux }}", "  250", ""},
+
+		// scale maps linearly and clamps to the output range, also when inverted
+		{"{{ device.3.lux | scale(0, 1000, 100, 0) }}", 75.0, ""},
+		{"{{ device.3.lux | scale(0, 100, 0, 10) }}", 10.0, ""},
+		{"{{ device.3.lux | scale(500, 1000, 100, 0) }}", 100.0, ""},
+		{"{{ device.3.lux | scale(0, 0, 7, 9) }}", 7.0, ""},
+
+		{"{{ device.3.lux | clamp(0, 100) }}", 100.0, ""},
+		{"{{ device.5.temperature | clamp(0, 100) }}", 0.0, ""},
+		{"{{ device.5.temperature | clamp(-10, 10) }}", -4.6, ""},
+		{"{{ device.5.temperature | round }}", -5.0, ""},
+		{"{{ device.5.temperature | abs }}", 4.6, ""},
+		{"{{ device.5.temperature | abs | round }}", 5.0, ""},
+		{"{{ device.3.lux / 3 }}", 250.0 / 3, ""},
+
+		// default only replaces missing values
+		{"{{ device.3.missing | default(42) }}", 42.0, ""},
+		{"{{ device.3.lux | default(42) }}", 250.0, ""},
+		{"{{ device.9.power | default(vars.target) | clamp(0, 20) }}", 20.0, ""},
+		{`{{ device.3.missing | default("off") }}`, "off", ""},
+
+		// Missing values without a default fail instead of rendering "<nil>"
+		{"{{ device.3.missing }}", nil, "has no value"},
+		{"{{ device.9.lux | round }}", nil, "expects a number"},
+		{"{{ device.3.name | abs }}", nil, "expects a number"},
+		{"Lux {{ device.3.missing }}", nil, "has no value"},
+
+		// Mixed text formats numbers to two decimals
+		{"Lux {{ device.3.lux / 3 }} in {{ device.3.name }}", "Lux 83.33 in hall", ""},
+		{"Outside is {{ trigger.value }}°C", "Outside is -4.6°C", ""},
+		{"{{ trigger.key }} of {{ trigger.device_id }}", "temperature of 5", ""},
+		{"{{ trigger.state.temperature | abs }}", 4.6, ""},
+		{"{{ vars.target + 0.5 }}", 21.5, ""},
+		{"{{ time.now }}", "18:05", ""},
+		{"{{ device.3.lux > 100 || device.3.lux < 0 }}", true, ""},
+	}
+
+	env := templateTestEnv()
+	for _, tt := range tests {
+		got, err := renderTemplateString(tt.src, env)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("renderTemplateString(%q) = %v, %v; want an error containing %q", tt.src, got, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("renderTemplateString(%q): %v", tt.src, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("renderTemplateString(%q) = %#v, want %#v", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestParseTemplateStringErrors(t *testing.T) {
+	tests := []struct {
+		src     string
+		wantErr string
+	}{
+		{"{{ device.3.lux", "unterminated"},
+		{"{{ device.3.lux | nope }}", "unknown filter"},
+		{"{{ device.3.lux | scale(1, 2) }}", "scale expects 4 arguments"},
+		{"{{ device.3.lux | round(1) }}", "round expects 0 arguments"},
+		{"{{ device.3.lux | default }}", "default expects 1 argument"},
+		{"{{ device.3.lux | clamp(0, 1 }}", "malformed filter"},
+		{"{{ device.3.lux + }}", "unexpected end"},
+		{"{{ bogus.value }}", "unknown identifier"},
+	}
+
+	for _, tt := range tests {
+		_, _, err := parseTemplateString(tt.src)
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("parseTemplateString(%q) = %v, want an error containing %q", tt.src, err, tt.wantErr)
+		}
+	}
+}
+
+func TestSplitTopLevel(t *testing.T) {
+	tests := []struct {
+		src  string
+		sep  byte
+		want []string
+	}{
+		{"a | b | c", '|', []string{"a ", " b ", " c"}},
+		{"a || b | c", '|', []string{"a || b ", " c"}},
+		{`"x|y" | c`, '|', []string{`"x|y" `, " c"}},
+		{"scale(0, 1) | round", '|', []string{"scale(0, 1) ", " round"}},
+		{"min(1, 2), 3", ',', []string{"min(1, 2)", " 3"}},
+		{`device["a,b"].x, 2`, ',', []string{`device["a,b"].x`, " 2"}},
+	}
+
+	for _, tt := range tests {
+		if got := splitTopLevel(tt.src, tt.sep); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("splitTopLevel(%q, %q) = %q, want %q", tt.src, tt.sep, got, tt.want)
+		}
+	}
+}
+
+func TestRenderParamsDropsUnresolved(t *testing.T) {
+	params := map[string]interface{}{
+		"state":      "on",
+		"brightness": "{{ vars.level | default(80) }}",
+		"color":      "{{ trigger.value }}",
+		"nested":     map[string]interface{}{"text": "at {{ time.now }}"},
+	}
+	got := RenderParams(params, TemplateContext{Now: time.Date(2024, 3, 4, 6, 0, 0, 0, time.UTC)})
+	want := map[string]interface{}{
+		"state":      "on",
+		"brightness": 80.0,
+		"nested":     map[string]interface{}{"text": "at 06:00"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("RenderParams() = %#v, want %#v", got, want)
+	}
+}
+
+func TestTriggerKey(t *testing.T) {
+	conditions := json.RawMessage(`{"operator": "AND", "children": [
+		{"device_id": "1", "key": "motion", "op": "==", "value": true},
+		{"operator": "OR", "children": [{"device_id": "2", "key": "lux", "op": "<", "value": 50}]}
+	]}`)
+
+	tests := map[string]string{"1": "motion", "2": "lux", "3": ""}
+	for deviceID, want := range tests {
+		if got := TriggerKey(conditions, deviceID); got != want {
+			t.Errorf("TriggerKey(%s) = %q, want %q", deviceID, got, want)
+		}
+	}
+	if got := TriggerKey(json.RawMessage(`not json`), "1"); got != "" {
+		t.Errorf("TriggerKey(invalid) = %q, want empty", got)
+	}
+}
+
+func TestValidateActions(t *testing.T) {
+	tests := []struct {
+		actions string
+		wantErr string
+	}{
+		{`[{"device_id": "1", "action": "set", "params": {"brightness": "{{ device.2.lux | scale(0, 1000, 100, 0) }}"}}]`, ""},
+		{`[{"action": "send_email", "params": {"message": "Door {{ trigger.device_id }} opened"}}]`, ""},
+		{`[{"action": "set_variable", "params": {"name": "count", "value": "{{ vars.count + 1 }}"}}]`, ""},
+		{`[{"device_id": "1", "params": {"brightness": "{{ device.2.lux | bogus }}"}}]`, "unknown filter"},
+		{`[{"action": "set_variable", "params": {"value": 1}}]`, "needs a variable name"},
+		{`[{"action": "set_variable", "params": {"name": "x"}}]`, "needs a value"},
+		{`[{"action": "set_vacation", "params": {}}]`, "needs enabled"},
+		{`{"action": "set"}`, "invalid actions"},
+	}
+
+	for _, tt := range tests {
+		err := ValidateActions(json.RawMessage(tt.actions))
+		if tt.wantErr == "" {
+			if err != nil {
+				t.Errorf("ValidateActions(%s): %v", tt.actions, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("ValidateActions(%s) = %v, want an error containing %q", tt.actions, err, tt.wantErr)
+		}
+	}
+}
+
+func TestRewriteTemplateDevices(t *testing.T) {
+	mapping := map[string]string{"1": "10", "2": "kitchen-light"}
+	lookup := func(id string) (string, bool) {
+		v, ok := mapping[id]
+		return v, ok
+	}
+
+	tests := []struct {
+		src        string
+		want       string
+		unresolved []string
+	}{
+		{"plain text", "plain text", nil},
+		{"{{ device.1.lux | scale(0, 1000, 100, 0) }}", "{{ device.10.lux | scale(0, 1000, 100, 0) }}", nil},
+		{"Lux {{ device.2.lux }} at {{ time.now }}", `Lux {{ device["kitchen-light"].lux }} at {{ time.now }}`, nil},
+		{"{{ device.3.power | default(device.1.power) }}", "{{ device.3.power | default(device.10.power) }}", []string{"3"}},
+		{"{{ device.1.on || device.2.on }}", `{{ device.10.on || device["kitchen-light"].on }}`, nil},
+		{"{{ device.1.lux", "{{ device.1.lux", nil},
+	}
+
+	for _, tt := range tests {
+		got, unresolved := RewriteTemplateDevices(tt.src, lookup)
+		if got != tt.want {
+			t.Errorf("RewriteTemplateDevices(%q) = %q, want %q", tt.src, got, tt.want)
+		}
+		if strings.Join(unresolved, ",") != strings.Join(tt.unresolved, ",") {
+			t.Errorf("RewriteTemplateDevices(%q) unresolved = %v, want %v", tt.src, unresolved, tt.unresolved)
+		}
+	}
+}
@@ -31,7 +31,7 @@ func ExtractTimeConditions(conditionsRaw json.RawMessage) []TimeCondition {
 // extractTimeConditionsRecursive recursively processes conditions to find time-based ones
 func extractTimeConditionsRecursive(cond models.Condition, timeConditions *[]TimeCondition) {
 	// Check if this is a time condition with supported operators
-	if cond.Type == "time" && (cond.Op == "==" || cond.Op == "<" || cond.Op == ">") {
+	if cond.Type == "time" && (cond.Op == "==" || cond.Op == "<" || cond.Op == "<=" || cond.Op == ">" || cond.Op == ">=") {
 		// Parse the time value (e.g., "18:00")
 		var timeValue string
 		if err := json.Unmarshal(cond.Value, &timeValue); err != nil {
@@ -67,21 +67,26 @@ func extractTimeConditionsRecursive(cond models.Condition, timeConditions *[]Tim
 }
 
 // ConvertToCronExpression converts a time condition to a cron expression
-// Returns a cron expression that triggers at the specified time
-// For '<' and '>' operators, it creates a schedule at the boundary time for evaluation
+// Returns a cron expression that triggers at the first minute the condition's
+// result flips: the boundary for ==, < and >=, and the minute after it for the
+// strict > and for <=, whose boundary minute still belongs to the old side
 func ConvertToCronExpression(tc TimeCondition) string {
 	// Cron format: minute hour day month weekday
-	// For all operators (==, <, >), we trigger at the specified time
 	// The actual condition evaluation will happen in the rule evaluator
-	cronExpr := fmt.Sprintf("%d %d * * *", tc.Minute, tc.Hour)
+	hour, minute := tc.Hour, tc.Minute
+	if tc.Operator == ">" || tc.Operator == "<=" {
+		minute++
+		if minute == 60 {
+			hour, minute = (hour+1)%24, 0
+		}
+	}
+	cronExpr := fmt.Sprintf("%d %d * * *", minute, hour)
 
 	switch tc.Operator {
 	case "==":
 		log.Printf("TIME_EXTRACTOR: Converted time %02d:%02d (==) to cron: %s", tc.Hour, tc.Minute, cronExpr)
-	case "<":
-		log.Printf("TIME_EXTRACTOR: Converted time %02d:%02d (<) to cron: %s (triggers at boundary for evaluation)", tc.Hour, tc.Minute, cronExpr)
-	case ">":
-		log.Printf("TIME_EXTRACTOR: Converted time %02d:%02d (>) to cron: %s (triggers at boundary for evaluation)", tc.Hour, tc.Minute, cronExpr)
+	default:
+		log.Printf("TIME_EXTRACTOR: Converted time %02d:%02d (%s) to cron: %s (triggers when the condition flips)", tc.Hour, tc.Minute, tc.Operator, cronExpr)
 	}
 
 	return cronExpr
@@ -36,6 +36,9 @@ func ProcessDeviceUpdate(ctx context.Context, redisClient *redis.Client, dbConn
 		return nil, nil
 	}
 
+	// Meter power and energy readings, including those too small to be significant
+	RecordEnergy(ctx, redisClient, dbConn, *device, newState)
+
 	// Get last state from Redis
 	lastStateRaw, _ := redisClient.Get(ctx, fmt.Sprintf("device:%s", deviceID)).Result()
 	var lastState utils.DeviceState
@@ -56,6 +59,10 @@ func ProcessDeviceUpdate(ctx context.Context, redisClient *redis.Client, dbConn
 
 	// Update state in database
 	go dbConn.UpdateDeviceState(ctx, deviceID, newStateRaw)
+	go dbConn.RecordDeviceState(ctx, deviceID, newStateRaw)
+
+	// Start or stop max runtime clocks, also for devices switched by hand
+	TrackRuntime(ctx, redisClient, deviceID, newState)
 
 	// Get associated rules
 	ruleIDs, _ := redisClient.SMembers(ctx, fmt.Sprintf("device:%s:rules", deviceID)).Result()
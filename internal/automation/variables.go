@@ -0,0 +1,225 @@
+package automation
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+
+	"smarthome/internal/models"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Variable types
+const (
+	VariableBoolean = "boolean"
+	VariableNumber  = "number"
+	VariableEnum    = "enum"
+)
+
+// Variable names must be usable as vars.<name> in expressions
+var variableNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// VariableScope identifies whose variables a rule sees: the owner's global
+// variables, overlaid by the rule's own
+type VariableScope struct {
+	OwnerID string
+	RuleID  string
+}
+
+// RuleScope returns the variable scope of a rule
+func RuleScope(rule models.Rule) VariableScope {
+	return VariableScope{OwnerID: rule.OwnerID, RuleID: rule.ID}
+}
+
+// ValidateVariable checks a variable definition and its current value
+func ValidateVariable(v models.Variable) error {
+	if !variableNamePattern.MatchString(v.Name) {
+		return fmt.Errorf("invalid variable name %q: use letters, digits and underscores", v.Name)
+	}
+	switch v.Type {
+	case VariableBoolean, VariableNumber:
+	case VariableEnum:
+		if len(v.Options) == 0 {
+			return fmt.Errorf("enum variables need at least one option")
+		}
+	default:
+		return fmt.Errorf("unknown variable type %q", v.Type)
+	}
+	if v.Min != nil && v.Max != nil && *v.Min > *v.Max {
+		return fmt.Errorf("min is greater than max")
+	}
+	var value interface{}
+	if err := json.Unmarshal(v.Value, &value); err != nil {
+		return fmt.Errorf("invalid value")
+	}
+	_, err := CoerceVariableValue(v, value)
+	return err
+}
+
+// DefaultVariableValue returns the initial value of a new variable
+func DefaultVariableValue(v models.Variable) interface{} {
+	switch v.Type {
+	case VariableNumber:
+		if v.Min != nil {
+			return *v.Min
+		}
+		return 0.0
+	case VariableEnum:
+		if len(v.Options) > 0 {
+			return v.Options[0]
+		}
+		return ""
+	}
+	return false
+}
+
+// CoerceVariableValue checks a value against a variable's type and range
+func CoerceVariableValue(v models.Variable, value interface{}) (interface{}, error) {
+	switch v.Type {
+	case VariableBoolean:
+		b, ok := value.(bool)
+		if !ok {
+			return nil, fmt.Errorf("%s expects a boolean", v.Name)
+		}
+		return b, nil
+	case VariableNumber:
+		n, ok := value.(float64)
+		if !ok {
+			return nil, fmt.Errorf("%s expects a number", v.Name)
+		}
+		if v.Min != nil && n < *v.Min {
+			return nil, fmt.Errorf("%s must be at least %v", v.Name, *v.Min)
+		}
+		if v.Max != nil && n > *v.Max {
+			return nil, fmt.Errorf("%s must be at most %v", v.Name, *v.Max)
+		}
+		return n, nil
+	case VariableEnum:
+		s, ok := value.(string)
+		if ok {
+			for _, opt := range v.Options {
+				if s == opt {
+					return s, nil
+				}
+			}
+		}
+		return nil, fmt.Errorf("%s must be one of %v", v.Name, v.Options)
+	}
+	return nil, fmt.Errorf("unknown variable type %q", v.Type)
+}
+
+// variableHashKey is the Redis hash holding a scope's variable values by name
+func variableHashKey(v models.Variable) string {
+	if v.RuleID != nil && *v.RuleID != "" {
+		return fmt.Sprintf("variables:rule:%s", *v.RuleID)
+	}
+	return fmt.Sprintf("variables:%s", v.OwnerID)
+}
+
+// variableRulesKey is the Redis set of rules that read a variable name
+func variableRulesKey(ownerID, name string) string {
+	return fmt.Sprintf("variable:%s:%s:rules", ownerID, name)
+}
+
+// CacheVariable stores a variable's value in Redis for condition evaluation
+func CacheVariable(ctx context.Context, redisClient *redis.Client, v models.Variable) error {
+	return redisClient.HSet(ctx, variableHashKey(v), v.Name, string(v.Value)).Err()
+}
+
+// UncacheVariable removes a variable's value from Redis
+func UncacheVariable(ctx context.Context, redisClient *redis.Client, v models.Variable) error {
+	return redisClient.HDel(ctx, variableHashKey(v), v.Name).Err()
+}
+
+// LoadVariables returns the variable values visible in a scope
+func LoadVariables(ctx context.Context, redisClient *redis.Client, scope VariableScope) map[string]interface{} {
+	values := make(map[string]interface{})
+	if redisClient == nil {
+		return values
+	}
+	keys := []string{}
+	if scope.OwnerID != "" {
+		keys = append(keys, fmt.Sprintf("variables:%s", scope.OwnerID))
+	}
+	if scope.RuleID != "" {
+		keys = append(keys, fmt.Sprintf("variables:rule:%s", scope.RuleID))
+	}
+	// Rule-scoped values are loaded last so they shadow global ones
+	for _, key := range keys {
+		raw, err := redisClient.HGetAll(ctx, key).Result()
+		if err != nil {
+			log.Printf("AUTOMATION: Failed to load variables from %s: %v", key, err)
+			continue
+		}
+		for name, encoded := range raw {
+			var value interface{}
+			if err := json.Unmarshal([]byte(encoded), &value); err == nil {
+				values[name] = value
+			}
+		}
+	}
+	return values
+}
+
+// ExtractVariableNames returns the variables read by a rule's conditions,
+// through variable leaves or vars.<name> in expressions
+func ExtractVariableNames(conditionsRaw json.RawMessage) []string {
+	var condition models.Condition
+	if err := json.Unmarshal(conditionsRaw, &condition); err != nil {
+		return nil
+	}
+	seen := make(map[string]bool)
+	extractVariableNamesRecursive(condition, seen)
+
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func extractVariableNamesRecursive(cond models.Condition, seen map[string]bool) {
+	if cond.Type == "variable" && cond.Key != "" {
+		seen[cond.Key] = true
+	}
+	if cond.Type == "expression" {
+		if expr, err := compileCached(cond.Expression); err == nil {
+			for _, name := range expr.VariableNames() {
+				seen[name] = true
+			}
+		}
+	}
+	for _, child := range cond.Children {
+		extractVariableNamesRecursive(child, seen)
+	}
+}
+
+// IndexRuleVariables records which variables a rule reads so changes re-evaluate it
+func IndexRuleVariables(ctx context.Context, redisClient *redis.Client, rule models.Rule) {
+	if rule.OwnerID == "" {
+		return
+	}
+	for _, name := range ExtractVariableNames(rule.Conditions) {
+		redisClient.SAdd(ctx, variableRulesKey(rule.OwnerID, name), rule.ID)
+		log.Printf("AUTOMATION: Associated rule %s with variable %s", rule.ID, name)
+	}
+}
+
+// VariableDependents returns the rules to re-evaluate after a variable changed
+func VariableDependents(ctx context.Context, redisClient *redis.Client, v models.Variable) []string {
+	// A rule-scoped variable is only visible to its own rule
+	if v.RuleID != nil && *v.RuleID != "" {
+		return []string{*v.RuleID}
+	}
+	ruleIDs, err := redisClient.SMembers(ctx, variableRulesKey(v.OwnerID, v.Name)).Result()
+	if err != nil {
+		log.Printf("AUTOMATION: Failed to fetch rules for variable %s: %v", v.Name, err)
+		return nil
+	}
+	return ruleIDs
+}
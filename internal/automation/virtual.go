@@ -0,0 +1,198 @@
+package automation
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+
+	"smarthome/internal/db"
+	"smarthome/internal/models"
+	"smarthome/internal/utils"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Virtual devices have no hardware behind them. Each attribute of their state is
+// an expression over other devices, e.g. "avg(device.1.temperature, device.2.temperature)"
+// or "device.4.open || device.5.open". Whenever an input reports a new state the
+// virtual state is recomputed and fed through ProcessDeviceUpdate like any other
+// device, so rules, history and the device list treat both kinds the same.
+
+// virtualDevicesKey is the Redis set of virtual devices computed from a device
+func virtualDevicesKey(deviceID string) string {
+	return fmt.Sprintf("device:%s:virtual", deviceID)
+}
+
+// CompileVirtualDevice checks a virtual device definition and compiles its attributes.
+// Attributes may only read other devices, since they are recomputed on device updates.
+func CompileVirtualDevice(vd models.VirtualDevice) (map[string]*Expression, error) {
+	if len(vd.Attributes) == 0 {
+		return nil, fmt.Errorf("a virtual device needs at least one attribute")
+	}
+	compiled := make(map[string]*Expression, len(vd.Attributes))
+	for key, source := range vd.Attributes {
+		if key == "" {
+			return nil, fmt.Errorf("attribute names must not be empty")
+		}
+		expr, _, err := compileExpression(source, false)
+		if err != nil {
+			return nil, fmt.Errorf("attribute %s: %v", key, err)
+		}
+		if expr.UsesTime() || len(expr.VariableNames()) > 0 {
+			return nil, fmt.Errorf("attribute %s may only read devices", key)
+		}
+		if len(expr.DeviceIDs()) == 0 {
+			return nil, fmt.Errorf("attribute %s does not read any device", key)
+		}
+		for _, id := range expr.DeviceIDs() {
+			if id == vd.DeviceID {
+				return nil, fmt.Errorf("attribute %s reads the device itself", key)
+			}
+		}
+		compiled[key] = expr
+	}
+	return compiled, nil
+}
+
+// VirtualDeviceInputs returns the devices a virtual device is computed from
+func VirtualDeviceInputs(vd models.VirtualDevice) []string {
+	seen := make(map[string]bool)
+	for _, source := range vd.Attributes {
+		expr, _, err := compileExpression(source, false)
+		if err != nil {
+			continue
+		}
+		for _, id := range expr.DeviceIDs() {
+			seen[id] = true
+		}
+	}
+	inputs := make([]string, 0, len(seen))
+	for id := range seen {
+		inputs = append(inputs, id)
+	}
+	sort.Strings(inputs)
+	return inputs
+}
+
+// CheckVirtualCycle rejects a virtual device that would, through other virtual
+// devices, be computed from itself. inputsOf returns the inputs of a virtual device
+// and false for real devices.
+func CheckVirtualCycle(deviceID string, inputs []string, inputsOf func(id string) ([]string, bool)) error {
+	visited := make(map[string]bool)
+	var visit func(ids []string) error
+	visit = func(ids []string) error {
+		for _, id := range ids {
+			if id == deviceID {
+				return fmt.Errorf("virtual device %s would be computed from itself", deviceID)
+			}
+			if visited[id] {
+				continue
+			}
+			visited[id] = true
+			if next, ok := inputsOf(id); ok {
+				if err := visit(next); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	return visit(inputs)
+}
+
+// IndexVirtualDevice records the inputs of a virtual device so their updates recompute it
+func IndexVirtualDevice(ctx context.Context, redisClient *redis.Client, vd models.VirtualDevice) {
+	for _, input := range VirtualDeviceInputs(vd) {
+		redisClient.SAdd(ctx, virtualDevicesKey(input), vd.DeviceID)
+		log.Printf("AUTOMATION: Virtual device %s computed from device %s", vd.DeviceID, input)
+	}
+}
+
+// UnindexVirtualDevice removes a virtual device from the input index
+func UnindexVirtualDevice(ctx context.Context, redisClient *redis.Client, deviceID string) error {
+	keys, err := redisClient.Keys(ctx, "device:*:virtual").Result()
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		redisClient.SRem(ctx, key, deviceID)
+	}
+	return nil
+}
+
+// ComputeVirtualState evaluates a virtual device's attributes against the current
+// state of its inputs. Attributes whose inputs are missing are left out.
+func ComputeVirtualState(ctx context.Context, redisClient *redis.Client, dbConn *db.DB, vd models.VirtualDevice) (utils.DeviceState, error) {
+	compiled, err := CompileVirtualDevice(vd)
+	if err != nil {
+		return nil, err
+	}
+
+	env := ExpressionEnv{
+		DeviceState: func(deviceID string) map[string]interface{} {
+			return currentDeviceState(ctx, redisClient, dbConn, deviceID)
+		},
+	}
+	state := utils.DeviceState{}
+	for key, expr := range compiled {
+		v, err := expr.value(env)
+		if err != nil || v == nil {
+			log.Printf("AUTOMATION: Virtual device %s: cannot compute %s: %v", vd.DeviceID, key, err)
+			continue
+		}
+		state[key] = v
+	}
+	if len(state) == 0 {
+		return nil, fmt.Errorf("no attribute of virtual device %s could be computed", vd.DeviceID)
+	}
+	return state, nil
+}
+
+// RecomputeVirtualDevices recomputes the virtual devices depending on an updated
+// device and returns the states that changed, keyed by virtual device ID
+func RecomputeVirtualDevices(ctx context.Context, redisClient *redis.Client, dbConn *db.DB, deviceID string) map[string]utils.DeviceState {
+	ids, err := redisClient.SMembers(ctx, virtualDevicesKey(deviceID)).Result()
+	if err != nil {
+		log.Printf("AUTOMATION: Failed to fetch virtual devices for device %s: %v", deviceID, err)
+		return nil
+	}
+
+	changed := make(map[string]utils.DeviceState)
+	for _, id := range ids {
+		vd, err := dbConn.GetVirtualDevice(ctx, id)
+		if err != nil {
+			log.Printf("AUTOMATION: Failed to fetch virtual device %s: %v", id, err)
+			continue
+		}
+		state, err := ComputeVirtualState(ctx, redisClient, dbConn, *vd)
+		if err != nil {
+			log.Printf("AUTOMATION: %v", err)
+			continue
+		}
+
+		current, _ := json.Marshal(currentDeviceState(ctx, redisClient, dbConn, id))
+		next, _ := json.Marshal(state)
+		if bytes.Equal(current, next) {
+			continue
+		}
+		changed[id] = state
+	}
+	return changed
+}
+
+// currentDeviceState reads a device's state from Redis, falling back to the
+// database once the cached state has expired
+func currentDeviceState(ctx context.Context, redisClient *redis.Client, dbConn *db.DB, deviceID string) map[string]interface{} {
+	var state utils.DeviceState
+	if stateRaw, err := redisClient.Get(ctx, fmt.Sprintf("device:%s", deviceID)).Result(); err == nil {
+		json.Unmarshal([]byte(stateRaw), &state)
+		return state
+	}
+	if device, err := dbConn.GetDeviceByID(ctx, deviceID); err == nil {
+		json.Unmarshal(device.State, &state)
+	}
+	return state
+}
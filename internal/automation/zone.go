@@ -0,0 +1,137 @@
+package automation
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"smarthome/internal/models"
+	"smarthome/internal/utils"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// A "zone" condition leaf such as {"type": "zone", "zone_id": "2", "person_id": "5", "value": "entered"}
+// reads geofence zone membership. Values are "inside" (the default), "outside", and
+// the triggers "entered" and "left", true for a few seconds after the change, so the
+// example reacts to person 5 arriving at zone 2. Without person_id the leaf holds for
+// anyone in the household. "op": "!=" inverts it. Rules using it are re-evaluated on
+// every presence change in the household.
+
+// Zone condition values
+const (
+	ZoneInside  = "inside"
+	ZoneOutside = "outside"
+	ZoneEntered = "entered"
+	ZoneLeft    = "left"
+)
+
+// zonePresenceKey is the Redis hash of a zone's presence records by person ID
+func zonePresenceKey(zoneID string) string {
+	return fmt.Sprintf("zone:%s:people", zoneID)
+}
+
+// ValidZoneValue reports whether value is a zone condition value, empty meaning inside
+func ValidZoneValue(value string) bool {
+	switch value {
+	case "", ZoneInside, ZoneOutside, ZoneEntered, ZoneLeft:
+		return true
+	}
+	return false
+}
+
+// CacheZonePresence stores zone membership for condition evaluation
+func CacheZonePresence(ctx context.Context, redisClient *redis.Client, presence []models.ZonePresence) error {
+	pipe := redisClient.TxPipeline()
+	for _, zp := range presence {
+		encoded, _ := json.Marshal(zp)
+		pipe.HSet(ctx, zonePresenceKey(zp.ZoneID), zp.PersonID, encoded)
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// UncacheZone removes a deleted zone's membership
+func UncacheZone(ctx context.Context, redisClient *redis.Client, zoneID string) error {
+	return redisClient.Del(ctx, zonePresenceKey(zoneID)).Err()
+}
+
+// UncacheZonePerson removes a deleted person from the membership of zones
+func UncacheZonePerson(ctx context.Context, redisClient *redis.Client, zoneIDs []string, personID string) error {
+	pipe := redisClient.TxPipeline()
+	for _, zoneID := range zoneIDs {
+		pipe.HDel(ctx, zonePresenceKey(zoneID), personID)
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// ExtractZoneRefs returns the zones a rule's conditions read
+func ExtractZoneRefs(conditionsRaw json.RawMessage) []string {
+	var condition models.Condition
+	if err := json.Unmarshal(conditionsRaw, &condition); err != nil {
+		return nil
+	}
+	seen := make(map[string]bool)
+	extractZoneRefsRecursive(condition, seen)
+
+	zoneIDs := make([]string, 0, len(seen))
+	for id := range seen {
+		zoneIDs = append(zoneIDs, id)
+	}
+	sort.Strings(zoneIDs)
+	return zoneIDs
+}
+
+func extractZoneRefsRecursive(cond models.Condition, seen map[string]bool) {
+	if cond.Type == "zone" && cond.ZoneID != "" {
+		seen[cond.ZoneID] = true
+	}
+	for _, child := range cond.Children {
+		extractZoneRefsRecursive(child, seen)
+	}
+}
+
+// zoneMatches evaluates a zone leaf
+func zoneMatches(redisClient *redis.Client, cond models.Condition) bool {
+	if redisClient == nil {
+		return false
+	}
+	var value string
+	json.Unmarshal(cond.Value, &value)
+	if value == "" {
+		value = ZoneInside
+	}
+
+	fields, err := redisClient.HGetAll(context.Background(), zonePresenceKey(cond.ZoneID)).Result()
+	if err != nil {
+		return false
+	}
+	now := utils.GetCurrentTime()
+	result := value == ZoneOutside
+	for personID, raw := range fields {
+		if cond.PersonID != "" && personID != cond.PersonID {
+			continue
+		}
+		var zp models.ZonePresence
+		if json.Unmarshal([]byte(raw), &zp) != nil {
+			continue
+		}
+		recent := now.Sub(zp.ChangedAt) <= DefaultPresenceEventWindow
+		switch value {
+		case ZoneInside:
+			result = result || zp.Inside
+		case ZoneOutside:
+			result = result && !zp.Inside
+		case ZoneEntered:
+			result = result || (zp.Inside && recent)
+		case ZoneLeft:
+			result = result || (!zp.Inside && recent)
+		}
+	}
+	if cond.Op == "!=" {
+		return !result
+	}
+	return result
+}
@@ -0,0 +1,286 @@
+package calendar
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Event is a VEVENT of an ICS calendar. Recurring events keep their RRULE,
+// EXDATE and RDATE; Expand turns them into occurrences.
+type Event struct {
+	UID          string
+	Summary      string
+	Categories   []string
+	Start        time.Time
+	End          time.Time
+	AllDay       bool
+	RRule        *RRule
+	RDates       []time.Time
+	ExDates      []time.Time
+	RecurrenceID *time.Time // Set on an event that overrides one occurrence of a recurring event
+}
+
+// property is one unfolded content line, e.g. DTSTART;TZID=Europe/Berlin:20261224T180000
+type property struct {
+	name   string
+	params map[string]string
+	value  string
+}
+
+// Parse reads the events of an ICS document. Times without a zone are read in loc.
+// Cancelled events are skipped.
+func Parse(data []byte, loc *time.Location) ([]Event, error) {
+	lines, err := unfold(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var events []Event
+	var current *Event
+	cancelled := false
+	depth := 0 // Nesting inside the current VEVENT (VALARM)
+	sawCalendar := false
+	for _, line := range lines {
+		prop, ok := parseProperty(line)
+		if !ok {
+			continue
+		}
+		switch {
+		case prop.name == "BEGIN" && strings.EqualFold(prop.value, "VCALENDAR"):
+			sawCalendar = true
+			continue
+		case prop.name == "BEGIN" && strings.EqualFold(prop.value, "VEVENT") && current == nil:
+			current = &Event{}
+			cancelled = false
+			continue
+		case prop.name == "BEGIN" && current != nil:
+			depth++
+			continue
+		case prop.name == "END" && current != nil && depth > 0:
+			depth--
+			continue
+		case prop.name == "END" && strings.EqualFold(prop.value, "VEVENT") && current != nil:
+			if !cancelled && !current.Start.IsZero() {
+				if current.End.IsZero() {
+					current.End = current.Start
+					if current.AllDay {
+						current.End = current.Start.AddDate(0, 0, 1)
+					}
+				}
+				events = append(events, *current)
+			}
+			current = nil
+			continue
+		}
+		if current == nil || depth > 0 {
+			continue
+		}
+
+		switch prop.name {
+		case "UID":
+			current.UID = prop.value
+		case "SUMMARY":
+			current.Summary = unescapeText(prop.value)
+		case "CATEGORIES":
+			for _, category := range splitList(prop.value) {
+				if category = strings.TrimSpace(unescapeText(category)); category != "" {
+					current.Categories = append(current.Categories, category)
+				}
+			}
+		case "STATUS":
+			cancelled = strings.EqualFold(prop.value, "CANCELLED")
+		case "DTSTART":
+			t, allDay, err := parseDateTime(prop, loc)
+			if err != nil {
+				return nil, fmt.Errorf("event %s: DTSTART: %v", current.UID, err)
+			}
+			current.Start, current.AllDay = t, allDay
+		case "DTEND":
+			t, _, err := parseDateTime(prop, loc)
+			if err != nil {
+				return nil, fmt.Errorf("event %s: DTEND: %v", current.UID, err)
+			}
+			current.End = t
+		case "DURATION":
+			d, err := parseDuration(prop.value)
+			if err != nil {
+				return nil, fmt.Errorf("event %s: DURATION: %v", current.UID, err)
+			}
+			if !current.Start.IsZero() {
+				current.End = current.Start.Add(d)
+			}
+		case "RRULE":
+			rule, err := ParseRRule(prop.value, loc)
+			if err != nil {
+				return nil, fmt.Errorf("event %s: RRULE: %v", current.UID, err)
+			}
+			current.RRule = rule
+		case "EXDATE", "RDATE":
+			for _, value := range splitList(prop.value) {
+				t, _, err := parseDateTime(property{name: prop.name, params: prop.params, value: value}, loc)
+				if err != nil {
+					return nil, fmt.Errorf("event %s: %s: %v", current.UID, prop.name, err)
+				}
+				if prop.name == "EXDATE" {
+					current.ExDates = append(current.ExDates, t)
+				} else {
+					current.RDates = append(current.RDates, t)
+				}
+			}
+		case "RECURRENCE-ID":
+			t, _, err := parseDateTime(prop, loc)
+			if err != nil {
+				return nil, fmt.Errorf("event %s: RECURRENCE-ID: %v", current.UID, err)
+			}
+			current.RecurrenceID = &t
+		}
+	}
+	if !sawCalendar {
+		return nil, fmt.Errorf("not an ICS calendar")
+	}
+	return events, nil
+}
+
+// unfold joins continuation lines (starting with a space or tab) to the line before
+func unfold(data []byte) ([]string, error) {
+	var lines []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, scanner.Err()
+}
+
+// parseProperty splits a content line into name, parameters and value.
+// The value starts at the first colon outside a quoted parameter value.
+func parseProperty(line string) (property, bool) {
+	inQuotes := false
+	colon := -1
+	for i, r := range line {
+		if r == '"' {
+			inQuotes = !inQuotes
+		} else if r == ':' && !inQuotes {
+			colon = i
+			break
+		}
+	}
+	if colon < 0 {
+		return property{}, false
+	}
+
+	parts := strings.Split(line[:colon], ";")
+	prop := property{name: strings.ToUpper(parts[0]), params: make(map[string]string), value: line[colon+1:]}
+	for _, param := range parts[1:] {
+		if key, value, ok := strings.Cut(param, "="); ok {
+			prop.params[strings.ToUpper(key)] = strings.Trim(value, `"`)
+		}
+	}
+	return prop, true
+}
+
+// parseDateTime reads a DATE or DATE-TIME value: UTC (Z suffix), in the zone of
+// its TZID parameter, or floating in loc. Unknown TZIDs fall back to loc.
+func parseDateTime(prop property, loc *time.Location) (time.Time, bool, error) {
+	value := strings.TrimSpace(prop.value)
+	if prop.params["VALUE"] == "DATE" || len(value) == 8 {
+		t, err := time.ParseInLocation("20060102", value, loc)
+		return t, true, err
+	}
+	if strings.HasSuffix(value, "Z") {
+		t, err := time.Parse("20060102T150405Z", value)
+		return t, false, err
+	}
+	if tzid := prop.params["TZID"]; tzid != "" {
+		if tz, err := time.LoadLocation(tzid); err == nil {
+			loc = tz
+		}
+	}
+	t, err := time.ParseInLocation("20060102T150405", value, loc)
+	return t, false, err
+}
+
+// parseDuration reads an ISO 8601 duration such as PT1H30M, P1D or P2W
+func parseDuration(value string) (time.Duration, error) {
+	value = strings.TrimSpace(value)
+	sign := time.Duration(1)
+	if strings.HasPrefix(value, "-") {
+		sign = -1
+	}
+	value = strings.TrimLeft(value, "+-")
+	if !strings.HasPrefix(value, "P") {
+		return 0, fmt.Errorf("invalid duration %q", value)
+	}
+
+	var total time.Duration
+	number := ""
+	inTime := false
+	for _, r := range value[1:] {
+		switch {
+		case r >= '0' && r <= '9':
+			number += string(r)
+			continue
+		case r == 'T':
+			inTime = true
+			continue
+		}
+		n, err := strconv.Atoi(number)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", value)
+		}
+		number = ""
+		switch {
+		case r == 'W':
+			total += time.Duration(n) * 7 * 24 * time.Hour
+		case r == 'D':
+			total += time.Duration(n) * 24 * time.Hour
+		case r == 'H' && inTime:
+			total += time.Duration(n) * time.Hour
+		case r == 'M' && inTime:
+			total += time.Duration(n) * time.Minute
+		case r == 'S' && inTime:
+			total += time.Duration(n) * time.Second
+		default:
+			return 0, fmt.Errorf("invalid duration %q", value)
+		}
+	}
+	return sign * total, nil
+}
+
+// splitList splits a comma separated value, keeping escaped commas
+func splitList(value string) []string {
+	var items []string
+	var current strings.Builder
+	escaped := false
+	for _, r := range value {
+		switch {
+		case escaped:
+			current.WriteRune('\\')
+			current.WriteRune(r)
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == ',':
+			items = append(items, current.String())
+			current.Reset()
+		default:
+			current.WriteRune(r)
+		}
+	}
+	return append(items, current.String())
+}
+
+func unescapeText(value string) string {
+	return strings.NewReplacer(`\n`, "\n", `\N`, "\n", `\,`, ",", `\;`, ";", `\\`, `\`).Replace(value)
+}
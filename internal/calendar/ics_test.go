@@ -0,0 +1,218 @@
+package calendar
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testCalendar = "BEGIN:VCALENDAR\r\n" +
+	"VERSION:2.0\r\n" +
+	"BEGIN:VEVENT\r\n" +
+	"UID:cleaning\r\n" +
+	"SUMMARY:Cleaning\\, kitchen\\; and hall\r\n" +
+	"CATEGORIES:Chores,Away\\, all day\r\n" +
+	"DTSTART;TZID=Europe/Berlin:20260302T090000\r\n" +
+	"DURATION:PT2H30M\r\n" +
+	"RRULE:FREQ=WEEKLY;BYDAY=MO;COUNT=4\r\n" +
+	"EXDATE;TZID=Europe/Berlin:20260309T090000,20260316T090000\r\n" +
+	"BEGIN:VALARM\r\n" +
+	"SUMMARY:Reminder\r\n" +
+	"TRIGGER:-PT15M\r\n" +
+	"END:VALARM\r\n" +
+	"END:VEVENT\r\n" +
+	"BEGIN:VEVENT\r\n" +
+	"UID:cleaning\r\n" +
+	"SUMMARY:Cleaning (moved)\r\n" +
+	"RECURRENCE-ID;TZID=Europe/Berlin:20260323T090000\r\n" +
+	"DTSTART;TZID=Europe/Berlin:20260324T100000\r\n" +
+	"DTEND;TZID=Europe/Berlin:20260324T110000\r\n" +
+	"END:VEVENT\r\n" +
+	"BEGIN:VEVENT\r\n" +
+	"UID:holiday\r\n" +
+	"SUMMARY:Publ\r\n" +
+	" ic holiday\r\n" +
+	"DTSTART;VALUE=DATE:20260406\r\n" +
+	"END:VEVENT\r\n" +
+	"BEGIN:VEVENT\r\n" +
+	"UID:flight\r\n" +
+	"SUMMARY:Flight\r\n" +
+	"DTSTART:20260310T060000Z\r\n" +
+	"DTEND:20260310T080000Z\r\n" +
+	"STATUS:CANCELLED\r\n" +
+	"END:VEVENT\r\n" +
+	"END:VCALENDAR\r\n"
+
+func TestParse(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skipf("no tzdata: %v", err)
+	}
+	events, err := Parse([]byte(testCalendar), time.UTC)
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if len(events) != 3 {
+		t.Fatalf("Parse() returned %d events, want 3 (the cancelled one is skipped)", len(events))
+	}
+
+	cleaning := events[0]
+	if cleaning.Summary != "Cleaning, kitchen; and hall" {
+		t.Errorf("SUMMARY = %q, want the unescaped text", cleaning.Summary)
+	}
+	if want := []string{"Chores", "Away, all day"}; !reflect.DeepEqual(cleaning.Categories, want) {
+		t.Errorf("CATEGORIES = %q, want %q", cleaning.Categories, want)
+	}
+	if want := time.Date(2026, 3, 2, 9, 0, 0, 0, berlin); !cleaning.Start.Equal(want) || cleaning.Start.Location().String() != "Europe/Berlin" {
+		t.Errorf("DTSTART = %v, want %v", cleaning.Start, want)
+	}
+	if got := cleaning.End.Sub(cleaning.Start); got != 150*time.Minute {
+		t.Errorf("DURATION = %v, want 2h30m", got)
+	}
+	if cleaning.RRule == nil || cleaning.RRule.Count != 4 {
+		t.Errorf("RRULE = %+v, want a rule with COUNT=4", cleaning.RRule)
+	}
+	if len(cleaning.ExDates) != 2 || !cleaning.ExDates[1].Equal(time.Date(2026, 3, 16, 9, 0, 0, 0, berlin)) {
+		t.Errorf("EXDATE = %v, want both dates of the list", cleaning.ExDates)
+	}
+
+	moved := events[1]
+	if moved.RecurrenceID == nil || !moved.RecurrenceID.Equal(time.Date(2026, 3, 23, 9, 0, 0, 0, berlin)) {
+		t.Errorf("RECURRENCE-ID = %v, want 2026-03-23 09:00 Europe/Berlin", moved.RecurrenceID)
+	}
+
+	holiday := events[2]
+	if holiday.Summary != "Public holiday" {
+		t.Errorf("folded SUMMARY = %q, want %q", holiday.Summary, "Public holiday")
+	}
+	if !holiday.AllDay || !holiday.Start.Equal(time.Date(2026, 4, 6, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("all day DTSTART = %v (all day %v), want 2026-04-06", holiday.Start, holiday.AllDay)
+	}
+	if want := holiday.Start.AddDate(0, 0, 1); !holiday.End.Equal(want) {
+		t.Errorf("all day event without DTEND ends %v, want %v", holiday.End, want)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	event := func(lines ...string) string {
+		return "BEGIN:VCALENDAR\nBEGIN:VEVENT\nUID:x\n" + strings.Join(lines, "\n") + "\nEND:VEVENT\nEND:VCALENDAR\n"
+	}
+	tests := []struct {
+		name    string
+		data    string
+		wantErr string
+	}{
+		{"not a calendar", "<html></html>", "not an ICS calendar"},
+		{"invalid DTSTART", event("DTSTART:2026-03-02"), "DTSTART"},
+		{"invalid DTEND", event("DTSTART:20260302T090000", "DTEND:tomorrow"), "DTEND"},
+		{"invalid DURATION", event("DTSTART:20260302T090000", "DURATION:2 hours"), "DURATION"},
+		{"invalid RRULE", event("DTSTART:20260302T090000", "RRULE:FREQ=SECONDLY"), "RRULE"},
+		{"invalid EXDATE", event("DTSTART:20260302T090000", "EXDATE:20260309T090000,soon"), "EXDATE"},
+	}
+
+	for _, tt := range tests {
+		_, err := Parse([]byte(tt.data), time.UTC)
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: Parse() = %v, want an error containing %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestParseDateTime(t *testing.T) {
+	local := time.FixedZone("local", 3600)
+	tests := []struct {
+		line       string
+		want       time.Time
+		wantAllDay bool
+	}{
+		{"DTSTART:20260302T090000Z", time.Date(2026, 3, 2, 9, 0, 0, 0, time.UTC), false},
+		{"DTSTART:20260302T090000", time.Date(2026, 3, 2, 9, 0, 0, 0, local), false},
+		{"DTSTART;TZID=America/New_York:20260302T090000", time.Date(2026, 3, 2, 14, 0, 0, 0, time.UTC), false},
+		{`DTSTART;TZID="America/New_York":20260302T090000`, time.Date(2026, 3, 2, 14, 0, 0, 0, time.UTC), false},
+		{"DTSTART;TZID=Custom Zone:20260302T090000", time.Date(2026, 3, 2, 9, 0, 0, 0, local), false},
+		{"DTSTART;VALUE=DATE:20260302", time.Date(2026, 3, 2, 0, 0, 0, 0, local), true},
+		{"DTSTART:20260302", time.Date(2026, 3, 2, 0, 0, 0, 0, local), true},
+	}
+
+	for _, tt := range tests {
+		prop, ok := parseProperty(tt.line)
+		if !ok {
+			t.Fatalf("parseProperty(%q) failed", tt.line)
+		}
+		got, allDay, err := parseDateTime(prop, local)
+		if err != nil {
+			t.Errorf("parseDateTime(%q): %v", tt.line, err)
+			continue
+		}
+		if !got.Equal(tt.want) || allDay != tt.wantAllDay {
+			t.Errorf("parseDateTime(%q) = %v (all day %v), want %v (all day %v)", tt.line, got, allDay, tt.want, tt.wantAllDay)
+		}
+	}
+}
+
+func TestParseProperty(t *testing.T) {
+	tests := []struct {
+		line string
+		want property
+	}{
+		{"SUMMARY:Dinner: pasta", property{name: "SUMMARY", params: map[string]string{}, value: "Dinner: pasta"}},
+		{"dtstart;tzid=Europe/Berlin:20260302T090000", property{name: "DTSTART", params: map[string]string{"TZID": "Europe/Berlin"}, value: "20260302T090000"}},
+		{`ATTENDEE;CN="Doe: Jane";ROLE=CHAIR:mailto:jane@example.com`, property{name: "ATTENDEE", params: map[string]string{"CN": "Doe: Jane", "ROLE": "CHAIR"}, value: "mailto:jane@example.com"}},
+	}
+
+	for _, tt := range tests {
+		got, ok := parseProperty(tt.line)
+		if !ok || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseProperty(%q) = %+v, %v, want %+v", tt.line, got, ok, tt.want)
+		}
+	}
+	if _, ok := parseProperty("no colon here"); ok {
+		t.Error("parseProperty without a value: expected failure")
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    time.Duration
+		wantErr bool
+	}{
+		{"PT1H30M", 90 * time.Minute, false},
+		{"PT45S", 45 * time.Second, false},
+		{"P1D", 24 * time.Hour, false},
+		{"P2W", 14 * 24 * time.Hour, false},
+		{"P1DT12H", 36 * time.Hour, false},
+		{"+PT15M", 15 * time.Minute, false},
+		{"-PT15M", -15 * time.Minute, false},
+		{"PT", 0, false},
+		{"1H", 0, true},
+		{"P1M", 0, true}, // Months only exist after the T, as minutes
+		{"PTH", 0, true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseDuration(tt.value)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseDuration(%q) = %v, %v; want %v (error %v)", tt.value, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestSplitList(t *testing.T) {
+	tests := []struct {
+		value string
+		want  []string
+	}{
+		{"a,b,c", []string{"a", "b", "c"}},
+		{`Away\, all day,Chores`, []string{`Away\, all day`, "Chores"}},
+		{"single", []string{"single"}},
+		{"", []string{""}},
+	}
+
+	for _, tt := range tests {
+		if got := splitList(tt.value); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("splitList(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package calendar
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Occurrence is one instance of a calendar event
+type Occurrence struct {
+	UID        string    `json:"uid"`
+	Summary    string    `json:"summary"`
+	Categories []string  `json:"categories,omitempty"`
+	Start      time.Time `json:"start"`
+	End        time.Time `json:"end"`
+	AllDay     bool      `json:"all_day,omitempty"`
+}
+
+// Active reports whether the occurrence is in progress at t
+func (o Occurrence) Active(t time.Time) bool {
+	return !t.Before(o.Start) && t.Before(o.End)
+}
+
+// Matches reports whether the occurrence is tagged with filter (one of its categories)
+// or mentions it in its summary, ignoring case. An empty filter matches every event.
+func (o Occurrence) Matches(filter string) bool {
+	if filter == "" {
+		return true
+	}
+	for _, category := range o.Categories {
+		if strings.EqualFold(category, filter) {
+			return true
+		}
+	}
+	return strings.Contains(strings.ToLower(o.Summary), strings.ToLower(filter))
+}
+
+// Expand returns the occurrences of events overlapping [from, to), ordered by start.
+// Occurrences replaced by a RECURRENCE-ID override or listed in EXDATE are left out.
+func Expand(events []Event, from, to time.Time) []Occurrence {
+	overridden := make(map[string]bool)
+	for _, e := range events {
+		if e.RecurrenceID != nil {
+			overridden[fmt.Sprintf("%s@%d", e.UID, e.RecurrenceID.Unix())] = true
+		}
+	}
+
+	var occurrences []Occurrence
+	for _, e := range events {
+		duration := e.End.Sub(e.Start)
+		starts := []time.Time{e.Start}
+		if e.RRule != nil && e.RecurrenceID == nil {
+			starts = e.RRule.Starts(e.Start, to)
+		}
+		starts = append(starts, e.RDates...)
+
+		excluded := make(map[int64]bool, len(e.ExDates))
+		for _, ex := range e.ExDates {
+			excluded[ex.Unix()] = true
+		}
+
+		for _, start := range starts {
+			if excluded[start.Unix()] {
+				continue
+			}
+			if e.RecurrenceID == nil && overridden[fmt.Sprintf("%s@%d", e.UID, start.Unix())] {
+				continue
+			}
+			end := start.Add(duration)
+			overlaps := start.Before(to) && (end.After(from) || (duration == 0 && !start.Before(from)))
+			if !overlaps {
+				continue
+			}
+			occurrences = append(occurrences, Occurrence{
+				UID:        e.UID,
+				Summary:    e.Summary,
+				Categories: e.Categories,
+				Start:      start,
+				End:        end,
+				AllDay:     e.AllDay,
+			})
+		}
+	}
+
+	sort.Slice(occurrences, func(i, j int) bool { return occurrences[i].Start.Before(occurrences[j].Start) })
+	return occurrences
+}
+
+// occurrencesKey holds the expanded occurrences of a calendar as JSON
+func occurrencesKey(calendarID string) string {
+	return fmt.Sprintf("calendar:%s:occurrences", calendarID)
+}
+
+// StoreOccurrences caches the expanded occurrences of a calendar
+func StoreOccurrences(ctx context.Context, redisClient *redis.Client, calendarID string, occurrences []Occurrence) error {
+	data, err := json.Marshal(occurrences)
+	if err != nil {
+		return err
+	}
+	return redisClient.Set(ctx, occurrencesKey(calendarID), data, 0).Err()
+}
+
+// LoadOccurrences reads the cached occurrences of a calendar
+func LoadOccurrences(ctx context.Context, redisClient *redis.Client, calendarID string) []Occurrence {
+	if redisClient == nil {
+		return nil
+	}
+	data, err := redisClient.Get(ctx, occurrencesKey(calendarID)).Bytes()
+	if err != nil {
+		return nil
+	}
+	var occurrences []Occurrence
+	json.Unmarshal(data, &occurrences)
+	return occurrences
+}
+
+// DeleteOccurrences drops the cache of a deleted calendar
+func DeleteOccurrences(ctx context.Context, redisClient *redis.Client, calendarID string) {
+	redisClient.Del(ctx, occurrencesKey(calendarID))
+}
@@ -0,0 +1,138 @@
+package calendar
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestExpand(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skipf("no tzdata: %v", err)
+	}
+	events, err := Parse([]byte(testCalendar), berlin)
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+
+	starts := func(occurrences []Occurrence) []string {
+		got := []string{}
+		for _, o := range occurrences {
+			got = append(got, o.UID+" "+o.Start.In(berlin).Format("2006-01-02 15:04"))
+		}
+		return got
+	}
+
+	tests := []struct {
+		name     string
+		from, to time.Time
+		want     []string
+	}{
+		{
+			// Two Mondays are excluded and the fourth is moved to Tuesday by its override
+			name: "whole month",
+			from: time.Date(2026, 3, 1, 0, 0, 0, 0, berlin),
+			to:   time.Date(2026, 4, 1, 0, 0, 0, 0, berlin),
+			want: []string{"cleaning 2026-03-02 09:00", "cleaning 2026-03-24 10:00"},
+		},
+		{
+			name: "window inside an occurrence",
+			from: time.Date(2026, 3, 2, 10, 0, 0, 0, berlin),
+			to:   time.Date(2026, 3, 2, 10, 30, 0, 0, berlin),
+			want: []string{"cleaning 2026-03-02 09:00"},
+		},
+		{
+			name: "window starting when an occurrence ends",
+			from: time.Date(2026, 3, 2, 11, 30, 0, 0, berlin),
+			to:   time.Date(2026, 3, 3, 0, 0, 0, 0, berlin),
+			want: []string{},
+		},
+		{
+			name: "window ending when an occurrence starts",
+			from: time.Date(2026, 3, 24, 0, 0, 0, 0, berlin),
+			to:   time.Date(2026, 3, 24, 10, 0, 0, 0, berlin),
+			want: []string{},
+		},
+		{
+			name: "all day event",
+			from: time.Date(2026, 4, 6, 12, 0, 0, 0, berlin),
+			to:   time.Date(2026, 4, 6, 13, 0, 0, 0, berlin),
+			want: []string{"holiday 2026-04-06 00:00"},
+		},
+	}
+
+	for _, tt := range tests {
+		if got := starts(Expand(events, tt.from, tt.to)); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: Expand() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestExpandRDatesAndZeroDuration(t *testing.T) {
+	start := time.Date(2026, 3, 2, 9, 0, 0, 0, time.UTC)
+	events := []Event{{
+		UID:    "reminder",
+		Start:  start,
+		End:    start,
+		RDates: []time.Time{start.AddDate(0, 0, 3)},
+	}}
+
+	tests := []struct {
+		name     string
+		from, to time.Time
+		want     int
+	}{
+		{"instant at the window start", start, start.Add(time.Hour), 1},
+		{"instant at the window end", start.Add(-time.Hour), start, 0},
+		{"extra date from RDATE", start.Add(time.Hour), start.AddDate(0, 0, 4), 1},
+		{"both", start, start.AddDate(0, 0, 4), 2},
+	}
+
+	for _, tt := range tests {
+		if got := Expand(events, tt.from, tt.to); len(got) != tt.want {
+			t.Errorf("%s: Expand() returned %d occurrences, want %d", tt.name, len(got), tt.want)
+		}
+	}
+}
+
+func TestOccurrenceActive(t *testing.T) {
+	o := Occurrence{
+		Start: time.Date(2026, 3, 2, 9, 0, 0, 0, time.UTC),
+		End:   time.Date(2026, 3, 2, 10, 0, 0, 0, time.UTC),
+	}
+	tests := []struct {
+		at   time.Time
+		want bool
+	}{
+		{o.Start.Add(-time.Second), false},
+		{o.Start, true},
+		{o.End.Add(-time.Second), true},
+		{o.End, false},
+	}
+
+	for _, tt := range tests {
+		if got := o.Active(tt.at); got != tt.want {
+			t.Errorf("Active(%v) = %v, want %v", tt.at.Format("15:04:05"), got, tt.want)
+		}
+	}
+}
+
+func TestOccurrenceMatches(t *testing.T) {
+	o := Occurrence{Summary: "Family vacation in Rome", Categories: []string{"Away", "Holiday"}}
+	tests := map[string]bool{
+		"":         true,
+		"away":     true,
+		"HOLIDAY":  true,
+		"vacation": true,
+		"rome":     true,
+		"Work":     false,
+		"Aw":       false,
+	}
+
+	for filter, want := range tests {
+		if got := o.Matches(filter); got != want {
+			t.Errorf("Matches(%q) = %v, want %v", filter, got, want)
+		}
+	}
+}
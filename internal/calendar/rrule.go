@@ -0,0 +1,328 @@
+package calendar
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxPeriods bounds how many frequency periods a recurrence is iterated over
+const maxPeriods = 50000
+
+// RRule is a recurrence rule (RFC 5545) with the DAILY, WEEKLY, MONTHLY and
+// YEARLY frequencies and the BYDAY, BYMONTHDAY, BYMONTH and BYSETPOS parts
+type RRule struct {
+	Freq       string
+	Interval   int
+	Count      int
+	Until      time.Time
+	ByDay      []WeekdayNum
+	ByMonthDay []int
+	ByMonth    []int
+	BySetPos   []int
+	WeekStart  time.Weekday
+}
+
+// WeekdayNum is a BYDAY entry such as MO, 1MO (first Monday) or -1FR (last Friday)
+type WeekdayNum struct {
+	N   int
+	Day time.Weekday
+}
+
+var weekdays = map[string]time.Weekday{
+	"SU": time.Sunday, "MO": time.Monday, "TU": time.Tuesday, "WE": time.Wednesday,
+	"TH": time.Thursday, "FR": time.Friday, "SA": time.Saturday,
+}
+
+// ParseRRule parses the value of an RRULE property; an UNTIL without zone is read in loc
+func ParseRRule(value string, loc *time.Location) (*RRule, error) {
+	r := &RRule{Interval: 1, WeekStart: time.Monday}
+	for _, part := range strings.Split(value, ";") {
+		key, val, ok := strings.Cut(part, "=")
+		if !ok {
+			continue
+		}
+		var err error
+		switch strings.ToUpper(key) {
+		case "FREQ":
+			r.Freq = strings.ToUpper(val)
+		case "INTERVAL":
+			r.Interval, err = strconv.Atoi(val)
+			if err == nil && r.Interval < 1 {
+				err = fmt.Errorf("invalid INTERVAL %q", val)
+			}
+		case "COUNT":
+			r.Count, err = strconv.Atoi(val)
+		case "UNTIL":
+			r.Until, _, err = parseDateTime(property{params: map[string]string{}, value: val}, loc)
+			if err == nil && len(val) == 8 {
+				r.Until = r.Until.AddDate(0, 0, 1).Add(-time.Second) // A date UNTIL includes that day
+			}
+		case "BYDAY":
+			for _, item := range strings.Split(val, ",") {
+				day, err := parseWeekdayNum(item)
+				if err != nil {
+					return nil, err
+				}
+				r.ByDay = append(r.ByDay, day)
+			}
+		case "BYMONTHDAY":
+			r.ByMonthDay, err = parseInts(val, -31, 31)
+		case "BYMONTH":
+			r.ByMonth, err = parseInts(val, 1, 12)
+		case "BYSETPOS":
+			r.BySetPos, err = parseInts(val, -366, 366)
+		case "WKST":
+			day, ok := weekdays[strings.ToUpper(val)]
+			if !ok {
+				err = fmt.Errorf("invalid WKST %q", val)
+			}
+			r.WeekStart = day
+		case "BYSECOND", "BYMINUTE", "BYHOUR", "BYYEARDAY", "BYWEEKNO":
+			err = fmt.Errorf("%s is not supported", strings.ToUpper(key))
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch r.Freq {
+	case "DAILY", "WEEKLY", "MONTHLY", "YEARLY":
+	case "":
+		return nil, fmt.Errorf("missing FREQ")
+	default:
+		return nil, fmt.Errorf("FREQ=%s is not supported", r.Freq)
+	}
+	return r, nil
+}
+
+func parseWeekdayNum(item string) (WeekdayNum, error) {
+	item = strings.ToUpper(strings.TrimSpace(item))
+	if len(item) < 2 {
+		return WeekdayNum{}, fmt.Errorf("invalid BYDAY %q", item)
+	}
+	day, ok := weekdays[item[len(item)-2:]]
+	if !ok {
+		return WeekdayNum{}, fmt.Errorf("invalid BYDAY %q", item)
+	}
+	n := 0
+	if prefix := item[:len(item)-2]; prefix != "" {
+		var err error
+		if n, err = strconv.Atoi(prefix); err != nil || n == 0 {
+			return WeekdayNum{}, fmt.Errorf("invalid BYDAY %q", item)
+		}
+	}
+	return WeekdayNum{N: n, Day: day}, nil
+}
+
+func parseInts(value string, min, max int) ([]int, error) {
+	var ints []int
+	for _, item := range strings.Split(value, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(item))
+		if err != nil || n < min || n > max || n == 0 {
+			return nil, fmt.Errorf("invalid value %q", item)
+		}
+		ints = append(ints, n)
+	}
+	return ints, nil
+}
+
+// Starts returns the start times of the recurrence beginning at dtstart, up to and including to.
+// Occurrences keep dtstart's wall clock time in its location across DST changes.
+func (r *RRule) Starts(dtstart, to time.Time) []time.Time {
+	loc := dtstart.Location()
+	hour, minute, second := dtstart.Clock()
+
+	var starts []time.Time
+	count := 0
+	for period := 0; period < maxPeriods; period++ {
+		for _, day := range r.periodDays(dtstart, period) {
+			t := time.Date(day.Year(), day.Month(), day.Day(), hour, minute, second, 0, loc)
+			if t.Before(dtstart) {
+				continue
+			}
+			if t.After(to) || (!r.Until.IsZero() && t.After(r.Until)) {
+				return starts
+			}
+			count++
+			if r.Count > 0 && count > r.Count {
+				return starts
+			}
+			starts = append(starts, t)
+		}
+	}
+	return starts
+}
+
+// periodDays returns the days of the n-th period of the recurrence in ascending order
+func (r *RRule) periodDays(dtstart time.Time, n int) []time.Time {
+	loc := dtstart.Location()
+	first := time.Date(dtstart.Year(), dtstart.Month(), dtstart.Day(), 0, 0, 0, 0, loc)
+
+	var days []time.Time
+	switch r.Freq {
+	case "DAILY":
+		day := first.AddDate(0, 0, n*r.Interval)
+		if r.matchesMonth(day) && r.matchesMonthDay(day) && r.matchesWeekday(day) {
+			days = append(days, day)
+		}
+	case "WEEKLY":
+		offset := (int(first.Weekday()) - int(r.WeekStart) + 7) % 7
+		weekStart := first.AddDate(0, 0, -offset+n*r.Interval*7)
+		for i := 0; i < 7; i++ {
+			day := weekStart.AddDate(0, 0, i)
+			if !r.matchesMonth(day) {
+				continue
+			}
+			if len(r.ByDay) == 0 && day.Weekday() != first.Weekday() {
+				continue
+			}
+			if len(r.ByDay) > 0 && !r.matchesWeekday(day) {
+				continue
+			}
+			days = append(days, day)
+		}
+	case "MONTHLY":
+		month := time.Date(first.Year(), first.Month(), 1, 0, 0, 0, 0, loc).AddDate(0, n*r.Interval, 0)
+		if r.matchesMonth(month) {
+			days = r.monthDays(month, first.Day())
+		}
+	case "YEARLY":
+		year := first.Year() + n*r.Interval
+		switch {
+		case len(r.ByMonth) > 0:
+			for _, m := range r.ByMonth {
+				days = append(days, r.monthDays(time.Date(year, time.Month(m), 1, 0, 0, 0, 0, loc), first.Day())...)
+			}
+		case len(r.ByDay) > 0 && len(r.ByMonthDay) == 0:
+			start := time.Date(year, 1, 1, 0, 0, 0, 0, loc)
+			days = r.weekdaysIn(start, start.AddDate(1, 0, 0))
+		default:
+			days = r.monthDays(time.Date(year, first.Month(), 1, 0, 0, 0, 0, loc), first.Day())
+		}
+		sort.Slice(days, func(i, j int) bool { return days[i].Before(days[j]) })
+	}
+	return r.applySetPos(days)
+}
+
+// monthDays expands BYMONTHDAY and BYDAY within a month, defaulting to dtstart's day of month
+func (r *RRule) monthDays(month time.Time, defaultDay int) []time.Time {
+	next := month.AddDate(0, 1, 0)
+	length := next.AddDate(0, 0, -1).Day()
+
+	var byMonthDay []time.Time
+	for _, d := range r.ByMonthDay {
+		if d < 0 {
+			d = length + d + 1
+		}
+		if d >= 1 && d <= length {
+			byMonthDay = append(byMonthDay, month.AddDate(0, 0, d-1))
+		}
+	}
+	sort.Slice(byMonthDay, func(i, j int) bool { return byMonthDay[i].Before(byMonthDay[j]) })
+
+	switch {
+	case len(r.ByDay) > 0 && len(r.ByMonthDay) > 0:
+		var days []time.Time
+		for _, day := range byMonthDay {
+			if r.matchesWeekday(day) {
+				days = append(days, day)
+			}
+		}
+		return days
+	case len(r.ByDay) > 0:
+		return r.weekdaysIn(month, next)
+	case len(r.ByMonthDay) > 0:
+		return byMonthDay
+	case defaultDay <= length:
+		return []time.Time{month.AddDate(0, 0, defaultDay-1)}
+	}
+	return nil
+}
+
+// weekdaysIn returns the days in [start, end) matching BYDAY; ordinals count within the span
+func (r *RRule) weekdaysIn(start, end time.Time) []time.Time {
+	selected := make(map[int64]time.Time)
+	for _, wd := range r.ByDay {
+		var matches []time.Time
+		for day := start; day.Before(end); day = day.AddDate(0, 0, 1) {
+			if day.Weekday() == wd.Day {
+				matches = append(matches, day)
+			}
+		}
+		switch {
+		case wd.N == 0:
+			for _, day := range matches {
+				selected[day.Unix()] = day
+			}
+		case wd.N > 0 && wd.N <= len(matches):
+			selected[matches[wd.N-1].Unix()] = matches[wd.N-1]
+		case wd.N < 0 && -wd.N <= len(matches):
+			selected[matches[len(matches)+wd.N].Unix()] = matches[len(matches)+wd.N]
+		}
+	}
+
+	days := make([]time.Time, 0, len(selected))
+	for _, day := range selected {
+		days = append(days, day)
+	}
+	sort.Slice(days, func(i, j int) bool { return days[i].Before(days[j]) })
+	return days
+}
+
+func (r *RRule) applySetPos(days []time.Time) []time.Time {
+	if len(r.BySetPos) == 0 {
+		return days
+	}
+	var selected []time.Time
+	for _, pos := range r.BySetPos {
+		switch {
+		case pos > 0 && pos <= len(days):
+			selected = append(selected, days[pos-1])
+		case pos < 0 && -pos <= len(days):
+			selected = append(selected, days[len(days)+pos])
+		}
+	}
+	sort.Slice(selected, func(i, j int) bool { return selected[i].Before(selected[j]) })
+	return selected
+}
+
+func (r *RRule) matchesMonth(day time.Time) bool {
+	if len(r.ByMonth) == 0 {
+		return true
+	}
+	for _, m := range r.ByMonth {
+		if time.Month(m) == day.Month() {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *RRule) matchesMonthDay(day time.Time) bool {
+	if len(r.ByMonthDay) == 0 {
+		return true
+	}
+	length := time.Date(day.Year(), day.Month()+1, 0, 0, 0, 0, 0, day.Location()).Day()
+	for _, d := range r.ByMonthDay {
+		if d == day.Day() || (d < 0 && length+d+1 == day.Day()) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesWeekday checks BYDAY ignoring ordinals, as used by DAILY and WEEKLY rules
+func (r *RRule) matchesWeekday(day time.Time) bool {
+	if len(r.ByDay) == 0 {
+		return true
+	}
+	for _, wd := range r.ByDay {
+		if wd.Day == day.Weekday() {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,186 @@
+package calendar
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRRule(t *testing.T) {
+	got, err := ParseRRule("FREQ=weekly;INTERVAL=2;BYDAY=1MO,-1fr;WKST=SU;UNTIL=20261231T230000Z", time.UTC)
+	if err != nil {
+		t.Fatalf("ParseRRule: %v", err)
+	}
+	want := &RRule{
+		Freq:      "WEEKLY",
+		Interval:  2,
+		Until:     time.Date(2026, 12, 31, 23, 0, 0, 0, time.UTC),
+		ByDay:     []WeekdayNum{{N: 1, Day: time.Monday}, {N: -1, Day: time.Friday}},
+		WeekStart: time.Sunday,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseRRule() = %+v, want %+v", got, want)
+	}
+
+	// A date UNTIL includes the whole day
+	got, err = ParseRRule("FREQ=DAILY;UNTIL=20260308", time.UTC)
+	if err != nil {
+		t.Fatalf("ParseRRule: %v", err)
+	}
+	if want := time.Date(2026, 3, 8, 23, 59, 59, 0, time.UTC); !got.Until.Equal(want) {
+		t.Errorf("ParseRRule() UNTIL = %v, want %v", got.Until, want)
+	}
+}
+
+func TestParseRRuleErrors(t *testing.T) {
+	tests := []struct {
+		value   string
+		wantErr string
+	}{
+		{"COUNT=3", "missing FREQ"},
+		{"FREQ=HOURLY", "FREQ=HOURLY is not supported"},
+		{"FREQ=DAILY;INTERVAL=0", "invalid INTERVAL"},
+		{"FREQ=DAILY;COUNT=three", "invalid syntax"},
+		{"FREQ=WEEKLY;BYDAY=XX", "invalid BYDAY"},
+		{"FREQ=MONTHLY;BYDAY=0MO", "invalid BYDAY"},
+		{"FREQ=MONTHLY;BYMONTHDAY=32", "invalid value"},
+		{"FREQ=MONTHLY;BYMONTHDAY=0", "invalid value"},
+		{"FREQ=YEARLY;BYMONTH=13", "invalid value"},
+		{"FREQ=WEEKLY;WKST=XY", "invalid WKST"},
+		{"FREQ=DAILY;BYHOUR=8", "BYHOUR is not supported"},
+	}
+
+	for _, tt := range tests {
+		_, err := ParseRRule(tt.value, time.UTC)
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("ParseRRule(%q) = %v, want an error containing %q", tt.value, err, tt.wantErr)
+		}
+	}
+}
+
+func TestRRuleStarts(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skipf("no tzdata: %v", err)
+	}
+	at := func(loc *time.Location, year int, month time.Month, day, hour int) time.Time {
+		return time.Date(year, month, day, hour, 0, 0, 0, loc)
+	}
+
+	tests := []struct {
+		name    string
+		rrule   string
+		dtstart time.Time
+		to      time.Time // zero means a year after dtstart
+		want    []string
+	}{
+		{
+			name:    "daily count",
+			rrule:   "FREQ=DAILY;COUNT=3",
+			dtstart: at(time.UTC, 2026, 3, 2, 8),
+			want:    []string{"2026-03-02 08:00 +0000", "2026-03-03 08:00 +0000", "2026-03-04 08:00 +0000"},
+		},
+		{
+			name:    "daily interval until a date",
+			rrule:   "FREQ=DAILY;INTERVAL=2;UNTIL=20260308",
+			dtstart: at(time.UTC, 2026, 3, 2, 8),
+			want:    []string{"2026-03-02 08:00 +0000", "2026-03-04 08:00 +0000", "2026-03-06 08:00 +0000", "2026-03-08 08:00 +0000"},
+		},
+		{
+			name:    "open ended rule stops at to",
+			rrule:   "FREQ=DAILY",
+			dtstart: at(time.UTC, 2026, 3, 2, 8),
+			to:      at(time.UTC, 2026, 3, 4, 8),
+			want:    []string{"2026-03-02 08:00 +0000", "2026-03-03 08:00 +0000", "2026-03-04 08:00 +0000"},
+		},
+		{
+			name:    "weekly on several days",
+			rrule:   "FREQ=WEEKLY;BYDAY=MO,WE,FR;COUNT=5",
+			dtstart: at(time.UTC, 2026, 3, 2, 8),
+			want: []string{"2026-03-02 08:00 +0000", "2026-03-04 08:00 +0000", "2026-03-06 08:00 +0000",
+				"2026-03-09 08:00 +0000", "2026-03-11 08:00 +0000"},
+		},
+		{
+			name:    "every other week on dtstart's weekday",
+			rrule:   "FREQ=WEEKLY;INTERVAL=2;COUNT=3",
+			dtstart: at(time.UTC, 2026, 3, 2, 8),
+			want:    []string{"2026-03-02 08:00 +0000", "2026-03-16 08:00 +0000", "2026-03-30 08:00 +0000"},
+		},
+		{
+			name:    "days before dtstart are not counted",
+			rrule:   "FREQ=WEEKLY;BYDAY=MO,TU;COUNT=2",
+			dtstart: at(time.UTC, 2026, 3, 3, 8),
+			want:    []string{"2026-03-03 08:00 +0000", "2026-03-09 08:00 +0000"},
+		},
+		{
+			name:    "last friday of the month",
+			rrule:   "FREQ=MONTHLY;BYDAY=-1FR;COUNT=3",
+			dtstart: at(time.UTC, 2026, 1, 30, 18),
+			want:    []string{"2026-01-30 18:00 +0000", "2026-02-27 18:00 +0000", "2026-03-27 18:00 +0000"},
+		},
+		{
+			name:    "months without the 31st are skipped",
+			rrule:   "FREQ=MONTHLY;COUNT=3",
+			dtstart: at(time.UTC, 2026, 1, 31, 9),
+			want:    []string{"2026-01-31 09:00 +0000", "2026-03-31 09:00 +0000", "2026-05-31 09:00 +0000"},
+		},
+		{
+			name:    "last day of the month",
+			rrule:   "FREQ=MONTHLY;BYMONTHDAY=-1;COUNT=3",
+			dtstart: at(time.UTC, 2026, 1, 31, 9),
+			want:    []string{"2026-01-31 09:00 +0000", "2026-02-28 09:00 +0000", "2026-03-31 09:00 +0000"},
+		},
+		{
+			name:    "last weekday of the month",
+			rrule:   "FREQ=MONTHLY;BYDAY=MO,TU,WE,TH,FR;BYSETPOS=-1;COUNT=3",
+			dtstart: at(time.UTC, 2026, 1, 30, 17),
+			want:    []string{"2026-01-30 17:00 +0000", "2026-02-27 17:00 +0000", "2026-03-31 17:00 +0000"},
+		},
+		{
+			name:    "friday the 13th",
+			rrule:   "FREQ=MONTHLY;BYDAY=FR;BYMONTHDAY=13;COUNT=2",
+			dtstart: at(time.UTC, 2026, 1, 1, 0),
+			to:      at(time.UTC, 2028, 1, 1, 0),
+			want:    []string{"2026-02-13 00:00 +0000", "2026-03-13 00:00 +0000"},
+		},
+		{
+			name:    "yearly last sunday of march",
+			rrule:   "FREQ=YEARLY;BYMONTH=3;BYDAY=-1SU;COUNT=2",
+			dtstart: at(berlin, 2026, 3, 29, 10),
+			to:      at(berlin, 2028, 1, 1, 0),
+			want:    []string{"2026-03-29 10:00 +0200", "2027-03-28 10:00 +0200"},
+		},
+		{
+			name:    "yearly leap day",
+			rrule:   "FREQ=YEARLY;COUNT=2",
+			dtstart: at(time.UTC, 2024, 2, 29, 12),
+			to:      at(time.UTC, 2030, 1, 1, 0),
+			want:    []string{"2024-02-29 12:00 +0000", "2028-02-29 12:00 +0000"},
+		},
+		{
+			name:    "wall clock time is kept across DST",
+			rrule:   "FREQ=DAILY;COUNT=3",
+			dtstart: at(berlin, 2026, 3, 28, 8),
+			want:    []string{"2026-03-28 08:00 +0100", "2026-03-29 08:00 +0200", "2026-03-30 08:00 +0200"},
+		},
+	}
+
+	for _, tt := range tests {
+		rule, err := ParseRRule(tt.rrule, tt.dtstart.Location())
+		if err != nil {
+			t.Fatalf("%s: ParseRRule(%q): %v", tt.name, tt.rrule, err)
+		}
+		to := tt.to
+		if to.IsZero() {
+			to = tt.dtstart.AddDate(1, 0, 0)
+		}
+		got := []string{}
+		for _, start := range rule.Starts(tt.dtstart, to) {
+			got = append(got, start.Format("2006-01-02 15:04 -0700"))
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: Starts() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
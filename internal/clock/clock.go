@@ -0,0 +1,96 @@
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is the time source of the engine. The real clock is used unless another
+// one is injected with Set, e.g. a Fake to run rules against a chosen time.
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+var (
+	mu       sync.RWMutex
+	current  Clock = realClock{}
+	location       = time.Local
+)
+
+// Now returns the current time of the engine clock in the home timezone
+func Now() time.Time {
+	mu.RLock()
+	defer mu.RUnlock()
+	return current.Now().In(location)
+}
+
+// Set injects a clock; nil restores the real clock
+func Set(c Clock) {
+	mu.Lock()
+	defer mu.Unlock()
+	if c == nil {
+		c = realClock{}
+	}
+	current = c
+}
+
+// Location returns the home timezone
+func Location() *time.Location {
+	mu.RLock()
+	defer mu.RUnlock()
+	return location
+}
+
+// SetLocation sets the home timezone; call it at startup before other goroutines run.
+// It also becomes time.Local so libraries working in local time (cron, database
+// timestamps, logs) agree with the engine.
+func SetLocation(loc *time.Location) {
+	mu.Lock()
+	defer mu.Unlock()
+	location = loc
+	time.Local = loc
+}
+
+// LoadLocation resolves a configured timezone name; empty keeps the system zone
+func LoadLocation(name string) (*time.Location, error) {
+	if name == "" {
+		return time.Local, nil
+	}
+	return time.LoadLocation(name)
+}
+
+// Fake is a manually driven clock
+type Fake struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+// NewFake returns a fake clock stopped at t
+func NewFake(t time.Time) *Fake {
+	return &Fake{now: t}
+}
+
+// Now returns the fake time
+func (f *Fake) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+// Set moves the fake clock to t
+func (f *Fake) Set(t time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.now = t
+}
+
+// Advance moves the fake clock forward by d
+func (f *Fake) Advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.now = f.now.Add(d)
+}
@@ -8,6 +8,7 @@ import (
 	"log"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 )
@@ -18,9 +19,13 @@ type Config struct {
 	Redis        RedisConfig
 	MQTT         MQTTConfig
 	JWT          JWTConfig
+	Auth         AuthConfig
+	RateLimit    RateLimitConfig
 	App          AppConfig
 	RemoteAccess RemoteAccess
 	MDNS         MDNSConfig
+	Automation   AutomationConfig
+	Presence     PresenceConfig
 }
 
 // DatabaseConfig holds database configuration
@@ -48,10 +53,35 @@ type JWTConfig struct {
 	Secret string
 }
 
+// AuthConfig holds authentication policy configuration
+type AuthConfig struct {
+	TOTPIssuer        string
+	TOTPRequiredRoles []string
+	LockoutThreshold  int
+	LockoutBase       time.Duration
+	LockoutMax        time.Duration
+}
+
+// RateLimitConfig holds request rate limits per route class
+type RateLimitConfig struct {
+	Enabled bool
+	Auth    RateLimitRule
+	Command RateLimitRule
+	API     RateLimitRule
+}
+
+// RateLimitRule limits requests per client IP and per user within a window (0 disables a limit)
+type RateLimitRule struct {
+	PerIP   int
+	PerUser int
+	Window  time.Duration
+}
+
 // AppConfig holds application-level configuration
 type AppConfig struct {
-	Port    int
-	AgentID string
+	Port     int
+	AgentID  string
+	Timezone string // Home timezone for rules and schedules; empty uses the system zone
 }
 
 // BridgeConfig holds internet bridge configuration
@@ -65,6 +95,24 @@ type MDNSConfig struct {
 	LocalName string
 }
 
+// AutomationConfig holds rule engine limits
+type AutomationConfig struct {
+	MaxChainDepth int // Rules triggering rules deeper than this are stopped as a loop
+
+	TraceAllEvaluations bool          // Also trace evaluations whose conditions were not met
+	TraceMaxPerRule     int           // Run traces kept per rule
+	TraceRetention      time.Duration // Run traces older than this are deleted
+
+	SchedulerLeaderLease time.Duration // A replica that stops renewing its scheduler leadership loses it after this long
+}
+
+// PresenceConfig holds presence detection configuration
+type PresenceConfig struct {
+	DHCPLeasesFile   string        // dnsmasq or ISC dhcpd lease file to detect phones on the network, empty to disable
+	DHCPPollInterval time.Duration // How often the lease file is read
+	JustLeftWindow   time.Duration // How long someone who left counts as just_left
+}
+
 // LoadConfig reads configuration from .env file and environment variables
 func LoadConfig() (*Config, error) {
 	// Load .env file if it exists (silent fail is OK)
@@ -88,9 +136,23 @@ func LoadConfig() (*Config, error) {
 		JWT: JWTConfig{
 			Secret: getEnv("JWT_SECRET", ""),
 		},
+		Auth: AuthConfig{
+			TOTPIssuer:        getEnv("TOTP_ISSUER", "SmartHome"),
+			TOTPRequiredRoles: getEnvList("TOTP_REQUIRED_ROLES", nil),
+			LockoutThreshold:  getEnvInt("LOGIN_LOCKOUT_THRESHOLD", 5),
+			LockoutBase:       time.Duration(getEnvInt("LOGIN_LOCKOUT_BASE_SECONDS", 60)) * time.Second,
+			LockoutMax:        time.Duration(getEnvInt("LOGIN_LOCKOUT_MAX_SECONDS", 3600)) * time.Second,
+		},
+		RateLimit: RateLimitConfig{
+			Enabled: getEnvBool("RATE_LIMIT_ENABLED", true),
+			Auth:    getRateLimitRule("AUTH", 10, 0, 60),
+			Command: getRateLimitRule("COMMAND", 120, 30, 60),
+			API:     getRateLimitRule("API", 600, 300, 60),
+		},
 		App: AppConfig{
-			AgentID: getEnv("AGENT_ID", ""),
-			Port:    getEnvInt("SERVER_PORT", 5069),
+			AgentID:  getEnv("AGENT_ID", ""),
+			Port:     getEnvInt("SERVER_PORT", 5069),
+			Timezone: getEnv("HOME_TIMEZONE", ""),
 		},
 		RemoteAccess: RemoteAccess{
 			Enabled:  getEnvBool("REMOTE_ACCESS_ENABLED", true),
@@ -99,6 +161,19 @@ func LoadConfig() (*Config, error) {
 		MDNS: MDNSConfig{
 			LocalName: getEnv("MDNS_URL", "smarthome.local"),
 		},
+		Automation: AutomationConfig{
+			MaxChainDepth:       getEnvInt("RULE_CHAIN_MAX_DEPTH", 8),
+			TraceAllEvaluations: getEnvBool("RULE_TRACE_ALL_EVALUATIONS", false),
+			TraceMaxPerRule:     getEnvInt("RULE_TRACE_MAX_PER_RULE", 100),
+			TraceRetention:      time.Duration(getEnvInt("RULE_TRACE_RETENTION_DAYS", 14)) * 24 * time.Hour,
+
+			SchedulerLeaderLease: time.Duration(getEnvInt("SCHEDULER_LEADER_LEASE_SECONDS", 15)) * time.Second,
+		},
+		Presence: PresenceConfig{
+			DHCPLeasesFile:   getEnv("PRESENCE_DHCP_LEASES_FILE", ""),
+			DHCPPollInterval: time.Duration(getEnvInt("PRESENCE_DHCP_POLL_SECONDS", 30)) * time.Second,
+			JustLeftWindow:   time.Duration(getEnvInt("PRESENCE_JUST_LEFT_MINUTES", 10)) * time.Minute,
+		},
 	}
 
 	// Generate secrets if not provided
@@ -137,6 +212,30 @@ func getEnvBool(key string, defaultValue bool) bool {
 	return defaultValue
 }
 
+// getEnvList gets a comma-separated list environment variable with a default fallback
+func getEnvList(key string, defaultValue []string) []string {
+	if value := os.Getenv(key); value != "" {
+		var list []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		return list
+	}
+	return defaultValue
+}
+
+// getRateLimitRule reads RATE_LIMIT_<CLASS>_PER_IP, _PER_USER and _WINDOW_SECONDS
+func getRateLimitRule(class string, perIP, perUser, windowSeconds int) RateLimitRule {
+	prefix := "RATE_LIMIT_" + class
+	return RateLimitRule{
+		PerIP:   getEnvInt(prefix+"_PER_IP", perIP),
+		PerUser: getEnvInt(prefix+"_PER_USER", perUser),
+		Window:  time.Duration(getEnvInt(prefix+"_WINDOW_SECONDS", windowSeconds)) * time.Second,
+	}
+}
+
 // generateSecrets generates missing secrets and saves them to .env file
 func generateSecrets(cfg *Config) error {
 	envFile := ".env"
@@ -3,13 +3,31 @@ package db
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"time"
 
 	"smarthome/internal/models"
+
+	"github.com/jackc/pgx/v5"
 )
 
+// ScheduleColumns lists the schedule columns read by ScanSchedule
+const ScheduleColumns = "id, rule_id, cron_expression, run_at, COALESCE(calendar_id::text, ''), calendar_filter, timezone, exclude_dates, enabled, auto, last_fired_at, catch_up, catch_up_grace_seconds"
+
+// ScanSchedule reads a schedule selected with ScheduleColumns
+func ScanSchedule(row pgx.Row) (*models.Schedule, error) {
+	var s models.Schedule
+	err := row.Scan(&s.ID, &s.RuleID, &s.CronExpression, &s.RunAt, &s.CalendarID, &s.CalendarFilter, &s.Timezone, &s.ExcludeDates, &s.Enabled, &s.Auto,
+		&s.LastFiredAt, &s.CatchUp, &s.CatchUpGrace)
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
 // GetAllSchedules fetches all schedules
 func (d *DB) GetAllSchedules(ctx context.Context) ([]models.Schedule, error) {
-	rows, err := d.pool.Query(ctx, "SELECT id, rule_id, cron_expression, enabled FROM schedules")
+	rows, err := d.pool.Query(ctx, "SELECT "+ScheduleColumns+" FROM schedules")
 	if err != nil {
 		return nil, err
 	}
@@ -17,11 +35,11 @@ func (d *DB) GetAllSchedules(ctx context.Context) ([]models.Schedule, error) {
 
 	var schedules []models.Schedule
 	for rows.Next() {
-		var s models.Schedule
-		if err := rows.Scan(&s.ID, &s.RuleID, &s.CronExpression, &s.Enabled); err != nil {
+		s, err := ScanSchedule(rows)
+		if err != nil {
 			return nil, err
 		}
-		schedules = append(schedules, s)
+		schedules = append(schedules, *s)
 	}
 	return schedules, nil
 }
@@ -29,14 +47,20 @@ func (d *DB) GetAllSchedules(ctx context.Context) ([]models.Schedule, error) {
 // GetRuleByID fetches a rule
 func (d *DB) GetRuleByID(ctx context.Context, id string) (*models.Rule, error) {
 	var r models.Rule
-	err := d.pool.QueryRow(ctx, "SELECT id, name, conditions, actions, enabled FROM rules WHERE id = $1", id).
-		Scan(&r.ID, &r.Name, &r.Conditions, &r.Actions, &r.Enabled)
+	err := d.pool.QueryRow(ctx, "SELECT id, name, conditions, actions, enabled, COALESCE(owner_id::text, ''), execution FROM rules WHERE id = $1", id).
+		Scan(&r.ID, &r.Name, &r.Conditions, &r.Actions, &r.Enabled, &r.OwnerID, &r.Execution)
 	if err != nil {
 		return nil, err
 	}
 	return &r, nil
 }
 
+// SetRuleEnabled enables or disables a rule
+func (d *DB) SetRuleEnabled(ctx context.Context, id string, enabled bool) error {
+	_, err := d.pool.Exec(ctx, "UPDATE rules SET enabled = $1 WHERE id = $2", enabled, id)
+	return err
+}
+
 // UpdateDeviceState updates device state
 func (d *DB) UpdateDeviceState(ctx context.Context, id string, state json.RawMessage) error {
 	_, err := d.pool.Exec(ctx, "UPDATE devices SET state = $1 WHERE id = $2", state, id)
@@ -45,13 +69,72 @@ func (d *DB) UpdateDeviceState(ctx context.Context, id string, state json.RawMes
 
 // LogAction logs to history
 func (d *DB) LogAction(ctx context.Context, ruleID, deviceID string, state json.RawMessage) error {
-	_, err := d.pool.Exec(ctx, "INSERT INTO device_states_history (rule_id, id, timestamp, state) VALUES ($1, $2, NOW(), $3)", ruleID, deviceID, state)
+	_, err := d.pool.Exec(ctx, "INSERT INTO device_states_history (rule_id, device_id, timestamp, state) VALUES ($1, $2, NOW(), $3)", ruleID, deviceID, state)
+	return err
+}
+
+// RecordDeviceState appends a reported device state to history
+func (d *DB) RecordDeviceState(ctx context.Context, deviceID string, state json.RawMessage) error {
+	_, err := d.pool.Exec(ctx, "INSERT INTO device_states_history (device_id, timestamp, state) VALUES ($1, NOW(), $2)", deviceID, state)
+	return err
+}
+
+// GetDeviceStatesBetween fetches the recorded states of a device in [from, to), oldest first
+func (d *DB) GetDeviceStatesBetween(ctx context.Context, deviceID string, from, to time.Time) ([]models.DeviceStateHistory, error) {
+	rows, err := d.pool.Query(ctx,
+		`SELECT id, device_id, timestamp, state FROM device_states_history
+		WHERE device_id = $1 AND timestamp >= $2 AND timestamp < $3 AND state IS NOT NULL ORDER BY timestamp, id`,
+		deviceID, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var states []models.DeviceStateHistory
+	for rows.Next() {
+		var h models.DeviceStateHistory
+		if err := rows.Scan(&h.ID, &h.DeviceID, &h.Timestamp, &h.State); err != nil {
+			return nil, err
+		}
+		states = append(states, h)
+	}
+	return states, rows.Err()
+}
+
+// GetDeviceStateAt fetches the last state a device recorded before at
+func (d *DB) GetDeviceStateAt(ctx context.Context, deviceID string, at time.Time) (*models.DeviceStateHistory, error) {
+	var h models.DeviceStateHistory
+	err := d.pool.QueryRow(ctx,
+		`SELECT id, device_id, timestamp, state FROM device_states_history
+		WHERE device_id = $1 AND timestamp < $2 AND state IS NOT NULL ORDER BY timestamp DESC, id DESC LIMIT 1`,
+		deviceID, at).Scan(&h.ID, &h.DeviceID, &h.Timestamp, &h.State)
+	if err != nil {
+		return nil, err
+	}
+	return &h, nil
+}
+
+// RecordRuleRun stores the trace of a rule evaluation
+func (d *DB) RecordRuleRun(ctx context.Context, run models.RuleRun) error {
+	_, err := d.pool.Exec(ctx,
+		`INSERT INTO rule_runs (rule_id, triggered_by, outcome, reason, conditions, conflicts, actions, errors, started_at, duration_ms)
+		 VALUES ($1, $2, $3, NULLIF($4, ''), $5, $6, $7, $8, $9, $10)`,
+		run.RuleID, run.TriggeredBy, run.Outcome, run.Reason, run.Conditions, run.Conflicts, run.Actions, run.Errors, run.StartedAt, run.DurationMs)
+	return err
+}
+
+// PruneRuleRuns keeps the newest keep traces of a rule and deletes traces older than maxAge
+func (d *DB) PruneRuleRuns(ctx context.Context, ruleID string, keep int, maxAge time.Duration) error {
+	_, err := d.pool.Exec(ctx,
+		`DELETE FROM rule_runs WHERE rule_id = $1 AND (started_at < $2 OR id NOT IN (
+		   SELECT id FROM rule_runs WHERE rule_id = $1 ORDER BY started_at DESC, id DESC LIMIT $3))`,
+		ruleID, time.Now().Add(-maxAge), keep)
 	return err
 }
 
 // GetAllRules fetches all rules
 func (d *DB) GetAllRules(ctx context.Context) ([]models.Rule, error) {
-	rows, err := d.pool.Query(ctx, "SELECT id, name, conditions, actions, enabled FROM rules")
+	rows, err := d.pool.Query(ctx, "SELECT id, name, conditions, actions, enabled, COALESCE(owner_id::text, ''), execution FROM rules")
 	if err != nil {
 		return nil, err
 	}
@@ -60,7 +143,7 @@ func (d *DB) GetAllRules(ctx context.Context) ([]models.Rule, error) {
 	var rules []models.Rule
 	for rows.Next() {
 		var r models.Rule
-		if err := rows.Scan(&r.ID, &r.Name, &r.Conditions, &r.Actions, &r.Enabled); err != nil {
+		if err := rows.Scan(&r.ID, &r.Name, &r.Conditions, &r.Actions, &r.Enabled, &r.OwnerID, &r.Execution); err != nil {
 			return nil, err
 		}
 		rules = append(rules, r)
@@ -70,7 +153,7 @@ func (d *DB) GetAllRules(ctx context.Context) ([]models.Rule, error) {
 
 // GetSchedulesByRuleID fetches schedules for a specific rule
 func (d *DB) GetSchedulesByRuleID(ctx context.Context, ruleID string) ([]models.Schedule, error) {
-	rows, err := d.pool.Query(ctx, "SELECT id, rule_id, cron_expression, enabled FROM schedules WHERE rule_id = $1", ruleID)
+	rows, err := d.pool.Query(ctx, "SELECT "+ScheduleColumns+" FROM schedules WHERE rule_id = $1", ruleID)
 	if err != nil {
 		return nil, err
 	}
@@ -78,11 +161,11 @@ func (d *DB) GetSchedulesByRuleID(ctx context.Context, ruleID string) ([]models.
 
 	var schedules []models.Schedule
 	for rows.Next() {
-		var s models.Schedule
-		if err := rows.Scan(&s.ID, &s.RuleID, &s.CronExpression, &s.Enabled); err != nil {
+		s, err := ScanSchedule(rows)
+		if err != nil {
 			return nil, err
 		}
-		schedules = append(schedules, s)
+		schedules = append(schedules, *s)
 	}
 	return schedules, nil
 }
@@ -90,14 +173,33 @@ func (d *DB) GetSchedulesByRuleID(ctx context.Context, ruleID string) ([]models.
 // GetDeviceByID fetches a device by ID
 func (d *DB) GetDeviceByID(ctx context.Context, id string) (*models.Device, error) {
 	var device models.Device
-	err := d.pool.QueryRow(ctx, "SELECT id, name, type, state, mqtt_topic, accepted, owner_id FROM devices WHERE id = $1", id).
-		Scan(&device.ID, &device.Name, &device.Type, &device.State, &device.MQTTTopic, &device.Accepted, &device.OwnerID)
+	err := d.pool.QueryRow(ctx, "SELECT id, name, type, state, mqtt_topic, accepted, owner_id, room FROM devices WHERE id = $1", id).
+		Scan(&device.ID, &device.Name, &device.Type, &device.State, &device.MQTTTopic, &device.Accepted, &device.OwnerID, &device.Room)
 	if err != nil {
 		return nil, err
 	}
 	return &device, nil
 }
 
+// GetDeviceOwners maps every accepted device with an owner to its owner's ID
+func (d *DB) GetDeviceOwners(ctx context.Context) (map[string]string, error) {
+	rows, err := d.pool.Query(ctx, "SELECT id, owner_id FROM devices WHERE accepted = true AND owner_id IS NOT NULL")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	owners := make(map[string]string)
+	for rows.Next() {
+		var id, ownerID string
+		if err := rows.Scan(&id, &ownerID); err != nil {
+			return nil, err
+		}
+		owners[id] = ownerID
+	}
+	return owners, rows.Err()
+}
+
 // InsertDevice creates a new device with accepted=false
 func (d *DB) InsertDevice(ctx context.Context, id, name, deviceType, mqttTopic string, state json.RawMessage) error {
 	_, err := d.pool.Exec(ctx,
@@ -142,14 +244,30 @@ func (d *DB) DeleteDevice(ctx context.Context, id string) error {
 }
 
 // CreateSchedule creates a new schedule and returns the generated ID
-func (d *DB) CreateSchedule(ctx context.Context, ruleID, cronExpression string, enabled bool) (string, error) {
+func (d *DB) CreateSchedule(ctx context.Context, s models.Schedule) (string, error) {
+	if s.ExcludeDates == nil {
+		s.ExcludeDates = []string{}
+	}
 	var id string
 	err := d.pool.QueryRow(ctx,
-		"INSERT INTO schedules (rule_id, cron_expression, enabled) VALUES ($1, $2, $3) RETURNING id",
-		ruleID, cronExpression, enabled).Scan(&id)
+		`INSERT INTO schedules (rule_id, cron_expression, run_at, calendar_id, calendar_filter, timezone, exclude_dates, enabled, auto, catch_up, catch_up_grace_seconds)
+		 VALUES ($1, $2, $3, NULLIF($4, '')::integer, $5, $6, $7, $8, $9, $10, $11) RETURNING id`,
+		s.RuleID, s.CronExpression, s.RunAt, s.CalendarID, s.CalendarFilter, s.Timezone, s.ExcludeDates, s.Enabled, s.Auto, s.CatchUp, s.CatchUpGrace).Scan(&id)
 	return id, err
 }
 
+// SetScheduleFired records when a schedule last fired so missed fires can be caught up
+func (d *DB) SetScheduleFired(ctx context.Context, id string, firedAt time.Time) error {
+	_, err := d.pool.Exec(ctx, "UPDATE schedules SET last_fired_at = $1 WHERE id = $2", firedAt, id)
+	return err
+}
+
+// SetScheduleEnabled pauses or resumes a schedule
+func (d *DB) SetScheduleEnabled(ctx context.Context, id string, enabled bool) error {
+	_, err := d.pool.Exec(ctx, "UPDATE schedules SET enabled = $1 WHERE id = $2", enabled, id)
+	return err
+}
+
 // UpdateSchedule updates an existing schedule
 func (d *DB) UpdateSchedule(ctx context.Context, id, cronExpression string, enabled bool) error {
 	_, err := d.pool.Exec(ctx,
@@ -172,22 +290,495 @@ func (d *DB) DeleteSchedulesByRuleID(ctx context.Context, ruleID string) error {
 
 // GetScheduleByID fetches a specific schedule by ID
 func (d *DB) GetScheduleByID(ctx context.Context, id string) (*models.Schedule, error) {
-	var s models.Schedule
-	err := d.pool.QueryRow(ctx, "SELECT id, rule_id, cron_expression, enabled FROM schedules WHERE id = $1", id).
-		Scan(&s.ID, &s.RuleID, &s.CronExpression, &s.Enabled)
+	return ScanSchedule(d.pool.QueryRow(ctx, "SELECT "+ScheduleColumns+" FROM schedules WHERE id = $1", id))
+}
+
+// GetScheduleByRuleAndCron fetches the auto-generated schedule of a rule with a cron expression
+func (d *DB) GetScheduleByRuleAndCron(ctx context.Context, ruleID, cronExpression string) (*models.Schedule, error) {
+	return ScanSchedule(d.pool.QueryRow(ctx, "SELECT "+ScheduleColumns+" FROM schedules WHERE rule_id = $1 AND cron_expression = $2 AND auto", ruleID, cronExpression))
+}
+
+// calendarColumns lists the calendar columns read by scanCalendar
+const calendarColumns = "id, owner_id, name, url, content, timezone, refresh_minutes, refreshed_at, last_error"
+
+func scanCalendar(row pgx.Row) (*models.Calendar, error) {
+	var c models.Calendar
+	err := row.Scan(&c.ID, &c.OwnerID, &c.Name, &c.URL, &c.Content, &c.Timezone, &c.RefreshMinutes, &c.RefreshedAt, &c.LastError)
 	if err != nil {
 		return nil, err
 	}
-	return &s, nil
+	return &c, nil
 }
 
-// GetScheduleByRuleAndCron fetches a schedule by rule ID and cron expression
-func (d *DB) GetScheduleByRuleAndCron(ctx context.Context, ruleID, cronExpression string) (*models.Schedule, error) {
-	var s models.Schedule
-	err := d.pool.QueryRow(ctx, "SELECT id, rule_id, cron_expression, enabled FROM schedules WHERE rule_id = $1 AND cron_expression = $2", ruleID, cronExpression).
-		Scan(&s.ID, &s.RuleID, &s.CronExpression, &s.Enabled)
+// GetAllCalendars fetches all calendars
+func (d *DB) GetAllCalendars(ctx context.Context) ([]models.Calendar, error) {
+	rows, err := d.pool.Query(ctx, "SELECT "+calendarColumns+" FROM calendars")
 	if err != nil {
 		return nil, err
 	}
-	return &s, nil
+	defer rows.Close()
+
+	var calendars []models.Calendar
+	for rows.Next() {
+		c, err := scanCalendar(rows)
+		if err != nil {
+			return nil, err
+		}
+		calendars = append(calendars, *c)
+	}
+	return calendars, rows.Err()
+}
+
+// GetCalendarByID fetches a specific calendar by ID
+func (d *DB) GetCalendarByID(ctx context.Context, id string) (*models.Calendar, error) {
+	return scanCalendar(d.pool.QueryRow(ctx, "SELECT "+calendarColumns+" FROM calendars WHERE id = $1", id))
+}
+
+// SetCalendarRefreshed records the outcome of a calendar refresh
+func (d *DB) SetCalendarRefreshed(ctx context.Context, id string, refreshedAt time.Time, lastError string) error {
+	_, err := d.pool.Exec(ctx, "UPDATE calendars SET refreshed_at = $1, last_error = $2 WHERE id = $3", refreshedAt, lastError, id)
+	return err
+}
+
+// GetAllVariables fetches all user-defined variables
+func (d *DB) GetAllVariables(ctx context.Context) ([]models.Variable, error) {
+	rows, err := d.pool.Query(ctx, "SELECT id, name, type, options, min, max, value, rule_id, owner_id, updated_at FROM variables")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var variables []models.Variable
+	for rows.Next() {
+		v, err := scanVariable(rows)
+		if err != nil {
+			return nil, err
+		}
+		variables = append(variables, *v)
+	}
+	return variables, nil
+}
+
+// GetVariableByName fetches the variable a rule sees under a name: its own
+// rule-scoped variable if it has one, otherwise the owner's global variable
+func (d *DB) GetVariableByName(ctx context.Context, ownerID, ruleID, name string) (*models.Variable, error) {
+	row := d.pool.QueryRow(ctx,
+		`SELECT id, name, type, options, min, max, value, rule_id, owner_id, updated_at FROM variables
+		 WHERE owner_id = $1 AND name = $2 AND (rule_id IS NULL OR rule_id = $3)
+		 ORDER BY rule_id NULLS LAST LIMIT 1`, ownerID, name, ruleID)
+	return scanVariable(row)
+}
+
+// SetVariableValue stores a new value for a variable
+func (d *DB) SetVariableValue(ctx context.Context, id string, value json.RawMessage) error {
+	_, err := d.pool.Exec(ctx, "UPDATE variables SET value = $1, updated_at = NOW() WHERE id = $2", value, id)
+	return err
+}
+
+func scanVariable(row pgx.Row) (*models.Variable, error) {
+	var v models.Variable
+	var options json.RawMessage
+	if err := row.Scan(&v.ID, &v.Name, &v.Type, &options, &v.Min, &v.Max, &v.Value, &v.RuleID, &v.OwnerID, &v.UpdatedAt); err != nil {
+		return nil, err
+	}
+	json.Unmarshal(options, &v.Options)
+	return &v, nil
+}
+
+// GetAllVirtualDevices fetches all virtual device definitions
+func (d *DB) GetAllVirtualDevices(ctx context.Context) ([]models.VirtualDevice, error) {
+	rows, err := d.pool.Query(ctx, "SELECT device_id, attributes FROM virtual_devices")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var virtualDevices []models.VirtualDevice
+	for rows.Next() {
+		var vd models.VirtualDevice
+		if err := rows.Scan(&vd.DeviceID, &vd.Attributes); err != nil {
+			return nil, err
+		}
+		virtualDevices = append(virtualDevices, vd)
+	}
+	return virtualDevices, nil
+}
+
+// GetVirtualDevice fetches the definition of a virtual device
+func (d *DB) GetVirtualDevice(ctx context.Context, deviceID string) (*models.VirtualDevice, error) {
+	var vd models.VirtualDevice
+	err := d.pool.QueryRow(ctx, "SELECT device_id, attributes FROM virtual_devices WHERE device_id = $1", deviceID).
+		Scan(&vd.DeviceID, &vd.Attributes)
+	if err != nil {
+		return nil, err
+	}
+	return &vd, nil
+}
+
+// personColumns lists the person columns read by scanPerson
+const personColumns = "id, owner_id, name, user_id, mqtt_topic, mac_addresses, presence, presence_source, presence_changed_at"
+
+func scanPerson(row pgx.Row) (*models.Person, error) {
+	var p models.Person
+	err := row.Scan(&p.ID, &p.OwnerID, &p.Name, &p.UserID, &p.MQTTTopic, &p.MACAddresses, &p.Presence, &p.PresenceSource, &p.PresenceChangedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func (d *DB) queryPeople(ctx context.Context, query string, args ...interface{}) ([]models.Person, error) {
+	rows, err := d.pool.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var people []models.Person
+	for rows.Next() {
+		p, err := scanPerson(rows)
+		if err != nil {
+			return nil, err
+		}
+		people = append(people, *p)
+	}
+	return people, rows.Err()
+}
+
+// GetAllPeople fetches the people of all households
+func (d *DB) GetAllPeople(ctx context.Context) ([]models.Person, error) {
+	return d.queryPeople(ctx, "SELECT "+personColumns+" FROM people")
+}
+
+// GetPeopleByOwner fetches the people of a household
+func (d *DB) GetPeopleByOwner(ctx context.Context, ownerID string) ([]models.Person, error) {
+	return d.queryPeople(ctx, "SELECT "+personColumns+" FROM people WHERE owner_id = $1 ORDER BY name, id", ownerID)
+}
+
+// GetPersonByID fetches a specific person by ID
+func (d *DB) GetPersonByID(ctx context.Context, id string) (*models.Person, error) {
+	return scanPerson(d.pool.QueryRow(ctx, "SELECT "+personColumns+" FROM people WHERE id = $1", id))
+}
+
+// SetPersonPresence records a presence change. It reports false when the person
+// already had that presence, so concurrent reports of the same change apply once.
+func (d *DB) SetPersonPresence(ctx context.Context, id, presence, source string, at time.Time) (bool, error) {
+	tag, err := d.pool.Exec(ctx,
+		"UPDATE people SET presence = $1, presence_source = $2, presence_changed_at = $3 WHERE id = $4 AND presence <> $1",
+		presence, source, at, id)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+// zoneColumns lists the zone columns read by scanZone
+const zoneColumns = "id, owner_id, name, latitude, longitude, radius_meters, home"
+
+func scanZone(row pgx.Row) (*models.Zone, error) {
+	var z models.Zone
+	if err := row.Scan(&z.ID, &z.OwnerID, &z.Name, &z.Latitude, &z.Longitude, &z.Radius, &z.Home); err != nil {
+		return nil, err
+	}
+	return &z, nil
+}
+
+// GetZonesByOwner fetches the zones of a household
+func (d *DB) GetZonesByOwner(ctx context.Context, ownerID string) ([]models.Zone, error) {
+	rows, err := d.pool.Query(ctx, "SELECT "+zoneColumns+" FROM zones WHERE owner_id = $1 ORDER BY name, id", ownerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var zones []models.Zone
+	for rows.Next() {
+		z, err := scanZone(rows)
+		if err != nil {
+			return nil, err
+		}
+		zones = append(zones, *z)
+	}
+	return zones, rows.Err()
+}
+
+// GetZonePresence fetches who is or was in the zones of a household, or of all households without ownerID
+func (d *DB) GetZonePresence(ctx context.Context, ownerID string) ([]models.ZonePresence, error) {
+	query := "SELECT zp.zone_id, zp.person_id, zp.inside, zp.changed_at FROM zone_presence zp JOIN zones z ON z.id = zp.zone_id"
+	var args []interface{}
+	if ownerID != "" {
+		query += " WHERE z.owner_id = $1"
+		args = append(args, ownerID)
+	}
+	rows, err := d.pool.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var presence []models.ZonePresence
+	for rows.Next() {
+		var zp models.ZonePresence
+		if err := rows.Scan(&zp.ZoneID, &zp.PersonID, &zp.Inside, &zp.ChangedAt); err != nil {
+			return nil, err
+		}
+		presence = append(presence, zp)
+	}
+	return presence, rows.Err()
+}
+
+// SetZonePresence records a person entering or leaving a zone. It reports false
+// when nothing changed; leaving a zone the person was never in is no change.
+func (d *DB) SetZonePresence(ctx context.Context, zoneID, personID string, inside bool, at time.Time) (bool, error) {
+	query := `INSERT INTO zone_presence (zone_id, person_id, inside, changed_at) VALUES ($1, $2, true, $3)
+		ON CONFLICT (zone_id, person_id) DO UPDATE SET inside = true, changed_at = $3 WHERE NOT zone_presence.inside`
+	if !inside {
+		query = "UPDATE zone_presence SET inside = false, changed_at = $3 WHERE zone_id = $1 AND person_id = $2 AND inside"
+	}
+	tag, err := d.pool.Exec(ctx, query, zoneID, personID, at)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+// alarmPanelColumns lists the alarm panel columns read by scanAlarmPanel
+const alarmPanelColumns = `id, owner_id, name, pin_hash, arm_requires_pin, entry_delay_seconds, exit_delay_seconds, trigger_seconds,
+	sensors, siren_actions, siren_off_actions, state, armed_mode, triggered_by, state_changed_at`
+
+func scanAlarmPanel(row pgx.Row) (*models.AlarmPanel, error) {
+	var p models.AlarmPanel
+	err := row.Scan(&p.ID, &p.OwnerID, &p.Name, &p.PINHash, &p.ArmRequiresPIN, &p.EntryDelay, &p.ExitDelay, &p.TriggerDuration,
+		&p.Sensors, &p.SirenActions, &p.SirenOffActions, &p.State, &p.ArmedMode, &p.TriggeredBy, &p.StateChangedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func (d *DB) queryAlarmPanels(ctx context.Context, query string, args ...interface{}) ([]models.AlarmPanel, error) {
+	rows, err := d.pool.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var panels []models.AlarmPanel
+	for rows.Next() {
+		p, err := scanAlarmPanel(rows)
+		if err != nil {
+			return nil, err
+		}
+		panels = append(panels, *p)
+	}
+	return panels, rows.Err()
+}
+
+// GetAllAlarmPanels fetches the alarm panels of all households
+func (d *DB) GetAllAlarmPanels(ctx context.Context) ([]models.AlarmPanel, error) {
+	return d.queryAlarmPanels(ctx, "SELECT "+alarmPanelColumns+" FROM alarm_panels")
+}
+
+// GetArmedAlarmPanelsWatching fetches the armed panels that watch a sensor in their current mode
+func (d *DB) GetArmedAlarmPanelsWatching(ctx context.Context, deviceID string) ([]models.AlarmPanel, error) {
+	return d.queryAlarmPanels(ctx,
+		"SELECT "+alarmPanelColumns+" FROM alarm_panels WHERE state IN ('armed_home', 'armed_away', 'armed_night') AND sensors -> state ? $1", deviceID)
+}
+
+// GetAlarmPanelByID fetches a specific alarm panel by ID
+func (d *DB) GetAlarmPanelByID(ctx context.Context, id string) (*models.AlarmPanel, error) {
+	return scanAlarmPanel(d.pool.QueryRow(ctx, "SELECT "+alarmPanelColumns+" FROM alarm_panels WHERE id = $1", id))
+}
+
+// SetAlarmState moves a panel to a new state. It reports false when the panel
+// changed state since prev, so a stale timer or concurrent trip applies once.
+func (d *DB) SetAlarmState(ctx context.Context, id string, prev time.Time, state, armedMode, triggeredBy string, at time.Time) (bool, error) {
+	tag, err := d.pool.Exec(ctx,
+		`UPDATE alarm_panels SET state = $1, armed_mode = $2, triggered_by = $3, state_changed_at = $4
+		WHERE id = $5 AND state_changed_at = $6`,
+		state, armedMode, triggeredBy, at, id, prev)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+// interlockColumns lists the interlock columns read by scanInterlock
+const interlockColumns = "id, owner_id, name, device_id, kind, key, value, condition, min_value, max_value, max_seconds, off_value, enabled"
+
+func scanInterlock(row pgx.Row) (*models.Interlock, error) {
+	var il models.Interlock
+	err := row.Scan(&il.ID, &il.OwnerID, &il.Name, &il.DeviceID, &il.Kind, &il.Key, &il.Value, &il.Condition,
+		&il.Min, &il.Max, &il.MaxSeconds, &il.OffValue, &il.Enabled)
+	if err != nil {
+		return nil, err
+	}
+	return &il, nil
+}
+
+func (d *DB) queryInterlocks(ctx context.Context, query string, args ...interface{}) ([]models.Interlock, error) {
+	rows, err := d.pool.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var interlocks []models.Interlock
+	for rows.Next() {
+		il, err := scanInterlock(rows)
+		if err != nil {
+			return nil, err
+		}
+		interlocks = append(interlocks, *il)
+	}
+	return interlocks, rows.Err()
+}
+
+// GetAllInterlocks fetches the enabled interlocks of all devices
+func (d *DB) GetAllInterlocks(ctx context.Context) ([]models.Interlock, error) {
+	return d.queryInterlocks(ctx, "SELECT "+interlockColumns+" FROM interlocks WHERE enabled ORDER BY id")
+}
+
+// GetInterlocksByDevice fetches the enabled interlocks of a device
+func (d *DB) GetInterlocksByDevice(ctx context.Context, deviceID string) ([]models.Interlock, error) {
+	return d.queryInterlocks(ctx, "SELECT "+interlockColumns+" FROM interlocks WHERE device_id = $1 AND enabled ORDER BY id", deviceID)
+}
+
+// vacationModeColumns lists the vacation mode columns read by scanVacationMode
+const vacationModeColumns = "id, owner_id, devices, weeks, jitter_minutes, enabled, enabled_at, saved_states"
+
+func scanVacationMode(row pgx.Row) (*models.VacationMode, error) {
+	var v models.VacationMode
+	err := row.Scan(&v.ID, &v.OwnerID, &v.Devices, &v.Weeks, &v.JitterMinutes, &v.Enabled, &v.EnabledAt, &v.SavedStates)
+	if err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// GetEnabledVacationModes fetches the households in vacation mode
+func (d *DB) GetEnabledVacationModes(ctx context.Context) ([]models.VacationMode, error) {
+	rows, err := d.pool.Query(ctx, "SELECT "+vacationModeColumns+" FROM vacation_modes WHERE enabled")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var modes []models.VacationMode
+	for rows.Next() {
+		v, err := scanVacationMode(rows)
+		if err != nil {
+			return nil, err
+		}
+		modes = append(modes, *v)
+	}
+	return modes, rows.Err()
+}
+
+// GetVacationMode fetches the vacation mode of a household
+func (d *DB) GetVacationMode(ctx context.Context, ownerID string) (*models.VacationMode, error) {
+	return scanVacationMode(d.pool.QueryRow(ctx, "SELECT "+vacationModeColumns+" FROM vacation_modes WHERE owner_id = $1", ownerID))
+}
+
+// EnableVacationMode turns on a household's vacation mode, keeping the states to
+// restore. It reports false when it was already on.
+func (d *DB) EnableVacationMode(ctx context.Context, ownerID string, at time.Time, savedStates map[string]json.RawMessage) (bool, error) {
+	encoded, _ := json.Marshal(savedStates)
+	tag, err := d.pool.Exec(ctx,
+		"UPDATE vacation_modes SET enabled = true, enabled_at = $1, saved_states = $2 WHERE owner_id = $3 AND NOT enabled",
+		at, encoded, ownerID)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+// DisableVacationMode turns off a household's vacation mode and returns the states
+// to restore. It reports false when it was already off, so only one caller restores.
+func (d *DB) DisableVacationMode(ctx context.Context, ownerID string) (map[string]json.RawMessage, bool, error) {
+	var saved map[string]json.RawMessage
+	err := d.pool.QueryRow(ctx,
+		`UPDATE vacation_modes v SET enabled = false, enabled_at = NULL, saved_states = NULL
+		FROM (SELECT id, saved_states FROM vacation_modes WHERE owner_id = $1 AND enabled FOR UPDATE) old
+		WHERE v.id = old.id RETURNING old.saved_states`, ownerID).Scan(&saved)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return saved, true, nil
+}
+
+// AddEnergyUsage adds consumed energy and its cost to a device's total for a day
+func (d *DB) AddEnergyUsage(ctx context.Context, deviceID string, day time.Time, kwh, cost float64) error {
+	_, err := d.pool.Exec(ctx,
+		`INSERT INTO energy_daily (device_id, day, kwh, cost) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (device_id, day) DO UPDATE SET kwh = energy_daily.kwh + EXCLUDED.kwh, cost = energy_daily.cost + EXCLUDED.cost`,
+		deviceID, day.Format("2006-01-02"), kwh, cost)
+	return err
+}
+
+// EnergyTotal is the energy a device consumed on a day and in its month
+type EnergyTotal struct {
+	DeviceID string
+	DayKWh   float64
+	MonthKWh float64
+}
+
+// GetEnergyTotals fetches the consumption of every device on day and in the month starting at monthStart
+func (d *DB) GetEnergyTotals(ctx context.Context, day, monthStart time.Time) ([]EnergyTotal, error) {
+	rows, err := d.pool.Query(ctx,
+		`SELECT device_id, COALESCE(SUM(kwh) FILTER (WHERE day = $1), 0), SUM(kwh)
+		FROM energy_daily WHERE day >= $2 GROUP BY device_id`,
+		day.Format("2006-01-02"), monthStart.Format("2006-01-02"))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var totals []EnergyTotal
+	for rows.Next() {
+		var t EnergyTotal
+		if err := rows.Scan(&t.DeviceID, &t.DayKWh, &t.MonthKWh); err != nil {
+			return nil, err
+		}
+		totals = append(totals, t)
+	}
+	return totals, rows.Err()
+}
+
+// energyTariffColumns lists the tariff columns read by scanEnergyTariff
+const energyTariffColumns = "id, owner_id, kind, currency, rate, periods"
+
+func scanEnergyTariff(row pgx.Row) (*models.EnergyTariff, error) {
+	var t models.EnergyTariff
+	if err := row.Scan(&t.ID, &t.OwnerID, &t.Kind, &t.Currency, &t.Rate, &t.Periods); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// GetAllEnergyTariffs fetches the tariffs of all households
+func (d *DB) GetAllEnergyTariffs(ctx context.Context) ([]models.EnergyTariff, error) {
+	rows, err := d.pool.Query(ctx, "SELECT "+energyTariffColumns+" FROM energy_tariffs")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tariffs []models.EnergyTariff
+	for rows.Next() {
+		t, err := scanEnergyTariff(rows)
+		if err != nil {
+			return nil, err
+		}
+		tariffs = append(tariffs, *t)
+	}
+	return tariffs, rows.Err()
+}
+
+// GetEnergyTariff fetches the tariff of a household
+func (d *DB) GetEnergyTariff(ctx context.Context, ownerID string) (*models.EnergyTariff, error) {
+	return scanEnergyTariff(d.pool.QueryRow(ctx, "SELECT "+energyTariffColumns+" FROM energy_tariffs WHERE owner_id = $1", ownerID))
 }
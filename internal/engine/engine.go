@@ -3,17 +3,26 @@ package engine
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"strings"
+	"time"
 
+	"smarthome/internal/alarm"
 	"smarthome/internal/automation"
+	"smarthome/internal/calendar"
+	"smarthome/internal/clock"
 	"smarthome/internal/db"
 	"smarthome/internal/models"
+	"smarthome/internal/presence"
 	"smarthome/internal/scheduler"
 	"smarthome/internal/taskqueue"
 	"smarthome/internal/utils"
+	"smarthome/internal/vacation"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/jackc/pgx/v5"
 	"github.com/redis/go-redis/v9"
 )
 
@@ -23,21 +32,31 @@ type Engine struct {
 	redisClient *redis.Client
 	db          *db.DB
 	scheduler   *scheduler.Scheduler
+	presence    *presence.Tracker
+	alarm       *alarm.Manager
+	vacation    *vacation.Manager
 	// Add channels or interfaces for expansion (e.g., event bus)
 }
 
 // NewEngine creates a new engine instance
-func NewEngine(mqttClient mqtt.Client, redisClient *redis.Client, dbConn *db.DB, sched *scheduler.Scheduler) *Engine {
+func NewEngine(mqttClient mqtt.Client, redisClient *redis.Client, dbConn *db.DB, sched *scheduler.Scheduler, tracker *presence.Tracker, alarms *alarm.Manager, vacations *vacation.Manager) *Engine {
 	return &Engine{
 		mqttClient:  mqttClient,
 		redisClient: redisClient,
 		db:          dbConn,
 		scheduler:   sched,
+		presence:    tracker,
+		alarm:       alarms,
+		vacation:    vacations,
 	}
 }
 
 // Start starts the engine
 func (e *Engine) Start() error {
+	// Rules enabled or disabled by other rules are re-indexed like API changes
+	taskqueue.SetRuleChangeHandler(e.RefreshRuleAssociations)
+	automation.SetInterlockTimer(taskqueue.EnqueueInterlockTimer)
+
 	// Setup MQTT handlers
 	log.Println("Subscribing to MQTT topic: devices/+/state")
 	e.mqttClient.Subscribe("devices/+/state", 1, e.onDeviceUpdate)
@@ -49,6 +68,62 @@ func (e *Engine) Start() error {
 		return err
 	}
 
+	// Cache variable values in Redis for condition evaluation
+	log.Println("Loading variables")
+	if err := e.loadVariables(); err != nil {
+		log.Printf("Error loading variables: %v", err)
+		return err
+	}
+
+	// Cache device owners so rules only read their own household's devices
+	log.Println("Loading device owners")
+	if err := e.loadDeviceOwners(); err != nil {
+		log.Printf("Error loading device owners: %v", err)
+		return err
+	}
+
+	// Index virtual devices by the devices they are computed from
+	log.Println("Loading virtual devices")
+	if err := e.loadVirtualDevices(); err != nil {
+		log.Printf("Error loading virtual devices: %v", err)
+		return err
+	}
+
+	// Cache interlocks for the command gate
+	log.Println("Loading interlocks")
+	if err := e.loadInterlocks(); err != nil {
+		log.Printf("Error loading interlocks: %v", err)
+		return err
+	}
+
+	// Cache tariffs and today's energy totals for energy conditions
+	log.Println("Loading energy totals")
+	if err := e.loadEnergy(); err != nil {
+		log.Printf("Error loading energy totals: %v", err)
+		return err
+	}
+
+	// Cache the presence of every household and start the presence sources
+	log.Println("Starting presence tracking")
+	if err := e.presence.Start(); err != nil {
+		log.Printf("Error starting presence tracking: %v", err)
+		return err
+	}
+
+	// Cache alarm states and watch sensors
+	log.Println("Loading alarm panels")
+	if err := e.alarm.Start(); err != nil {
+		log.Printf("Error loading alarm panels: %v", err)
+		return err
+	}
+
+	// Resume replaying lighting history of households on vacation
+	log.Println("Resuming vacation mode")
+	if err := e.vacation.Start(); err != nil {
+		log.Printf("Error resuming vacation mode: %v", err)
+		return err
+	}
+
 	// Populate device-rule associations in Redis
 	log.Println("Populating device-rule associations")
 	if err := e.populateDeviceRuleAssociations(); err != nil {
@@ -62,6 +137,7 @@ func (e *Engine) Start() error {
 
 // Stop stops the engine
 func (e *Engine) Stop() {
+	e.presence.Stop()
 	e.mqttClient.Disconnect(250)
 	// Add cleanup for Redis, etc.
 	log.Println("Engine stopped")
@@ -96,7 +172,7 @@ func (e *Engine) populateDeviceRuleAssociations() error {
 	log.Printf("Found %d rules to process for associations", len(rules))
 
 	// Clear existing associations
-	keys, err := e.redisClient.Keys(context.Background(), "device:*:rules").Result()
+	keys, err := e.ruleAssociationKeys()
 	if err != nil {
 		return err
 	}
@@ -126,11 +202,30 @@ func (e *Engine) populateDeviceRuleAssociations() error {
 			e.redisClient.SAdd(context.Background(), key, rule.ID)
 			log.Printf("Associated rule %s with device %s", rule.ID, deviceID)
 		}
+
+		automation.IndexRuleVariables(context.Background(), e.redisClient, rule)
+		automation.IndexRuleTriggers(context.Background(), e.redisClient, rule)
+		automation.IndexRuleCalendars(context.Background(), e.redisClient, rule)
+		automation.IndexRulePresence(context.Background(), e.redisClient, rule)
+		automation.IndexRuleAlarm(context.Background(), e.redisClient, rule)
 	}
 
 	return nil
 }
 
+// ruleAssociationKeys returns the Redis sets mapping devices, variables, fired rules, calendars, households and alarms to rules
+func (e *Engine) ruleAssociationKeys() ([]string, error) {
+	var keys []string
+	for _, pattern := range []string{"device:*:rules", "variable:*:rules", "rule:*:rules", "calendar:*:rules", "presence:*:rules", "alarm:*:rules"} {
+		matched, err := e.redisClient.Keys(context.Background(), pattern).Result()
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, matched...)
+	}
+	return keys, nil
+}
+
 // extractDeviceIDsFromConditionTree extracts device IDs from a condition tree
 func (e *Engine) extractDeviceIDsFromConditionTree(condition models.Condition) []string {
 	deviceIDs := make(map[string]bool)
@@ -139,6 +234,9 @@ func (e *Engine) extractDeviceIDsFromConditionTree(condition models.Condition) [
 	if condition.DeviceID != "" {
 		deviceIDs[condition.DeviceID] = true
 	}
+	for _, id := range automation.ExpressionDeviceIDs(condition) {
+		deviceIDs[id] = true
+	}
 
 	// Recursively check children
 	if len(condition.Children) > 0 {
@@ -165,6 +263,9 @@ func (e *Engine) extractDeviceIDsFromConditions(conditions []models.Condition) [
 		if condition.DeviceID != "" {
 			deviceIDs[condition.DeviceID] = true
 		}
+		for _, id := range automation.ExpressionDeviceIDs(condition) {
+			deviceIDs[id] = true
+		}
 
 		// Recursively check nested conditions
 		if len(condition.Children) > 0 {
@@ -195,8 +296,8 @@ func (e *Engine) RefreshRuleAssociations(ruleID string) error {
 		return err
 	}
 
-	// Remove this rule from all existing device associations
-	keys, err := e.redisClient.Keys(context.Background(), "device:*:rules").Result()
+	// Remove this rule from all existing device and variable associations
+	keys, err := e.ruleAssociationKeys()
 	if err != nil {
 		log.Printf("Error getting device rule keys: %v", err)
 		return err
@@ -225,6 +326,12 @@ func (e *Engine) RefreshRuleAssociations(ruleID string) error {
 			log.Printf("Associated rule %s with device %s", rule.ID, deviceID)
 		}
 
+		automation.IndexRuleVariables(context.Background(), e.redisClient, *rule)
+		automation.IndexRuleTriggers(context.Background(), e.redisClient, *rule)
+		automation.IndexRuleCalendars(context.Background(), e.redisClient, *rule)
+		automation.IndexRulePresence(context.Background(), e.redisClient, *rule)
+		automation.IndexRuleAlarm(context.Background(), e.redisClient, *rule)
+
 		// Refresh schedules for this rule
 		e.refreshSchedulesForRule(ruleID)
 	}
@@ -234,45 +341,52 @@ func (e *Engine) RefreshRuleAssociations(ruleID string) error {
 }
 
 // createSchedulesFromTimeConditions creates schedule records for time-based conditions in a rule
+// and deletes auto-generated schedules whose time condition was removed
 func (e *Engine) createSchedulesFromTimeConditions(ruleID string, conditionsRaw json.RawMessage, enabled bool) {
 	timeConditions := automation.ExtractTimeConditions(conditionsRaw)
-
-	if len(timeConditions) == 0 {
-		log.Printf("No time conditions found for rule %s", ruleID)
-		return
-	}
-
 	log.Printf("Creating %d schedules from time conditions for rule %s", len(timeConditions), ruleID)
 
+	wanted := make(map[string]bool)
 	for _, tc := range timeConditions {
 		// Generate cron expression
 		cronExpr := automation.ConvertToCronExpression(tc)
+		wanted[cronExpr] = true
 
-		// Check if schedule already exists for this rule and cron expression
+		// Existing schedules keep their enabled flag so a paused schedule stays paused
 		existingSchedule, err := e.db.GetScheduleByRuleAndCron(context.Background(), ruleID, cronExpr)
+		if err == nil && existingSchedule != nil {
+			continue
+		}
 
-		var scheduleID string
-		if err != nil || existingSchedule == nil {
-			// Schedule doesn't exist, create it
-			scheduleID, err = e.db.CreateSchedule(context.Background(), ruleID, cronExpr, enabled)
-			if err != nil {
-				log.Printf("Failed to create schedule for rule %s: %v", ruleID, err)
-				continue
-			}
-			log.Printf("Created schedule %s for rule %s: %s", scheduleID, ruleID, cronExpr)
-		} else {
-			// Schedule exists, update it
-			scheduleID = existingSchedule.ID
-			if err := e.db.UpdateSchedule(context.Background(), scheduleID, cronExpr, enabled); err != nil {
-				log.Printf("Failed to update schedule %s for rule %s: %v", scheduleID, ruleID, err)
-				continue
-			}
-			log.Printf("Updated schedule %s for rule %s: %s", scheduleID, ruleID, cronExpr)
+		schedule := models.Schedule{
+			RuleID:         ruleID,
+			CronExpression: cronExpr,
+			Enabled:        enabled,
+			Auto:           true,
+			CatchUp:        scheduler.CatchUpSkip,
+			CatchUpGrace:   scheduler.DefaultCatchUpGrace,
 		}
+		schedule.ID, err = e.db.CreateSchedule(context.Background(), schedule)
+		if err != nil {
+			log.Printf("Failed to create schedule for rule %s: %v", ruleID, err)
+			continue
+		}
+		log.Printf("Created schedule %s for rule %s: %s", schedule.ID, ruleID, cronExpr)
+	}
 
-		// Add schedule to the scheduler
-		if err := e.scheduler.AddOrUpdateSchedule(scheduleID, ruleID, cronExpr, enabled); err != nil {
-			log.Printf("Failed to add schedule %s to scheduler: %v", scheduleID, err)
+	schedules, err := e.db.GetSchedulesByRuleID(context.Background(), ruleID)
+	if err != nil {
+		log.Printf("Error getting schedules for rule %s: %v", ruleID, err)
+		return
+	}
+	for _, s := range schedules {
+		if s.Auto && !wanted[s.CronExpression] {
+			e.scheduler.RemoveSchedule(s.ID)
+			if err := e.db.DeleteSchedule(context.Background(), s.ID); err != nil {
+				log.Printf("Error deleting schedule %s from database: %v", s.ID, err)
+				continue
+			}
+			log.Printf("Deleted stale schedule %s for rule %s: %s", s.ID, ruleID, s.CronExpression)
 		}
 	}
 }
@@ -281,8 +395,8 @@ func (e *Engine) createSchedulesFromTimeConditions(ruleID string, conditionsRaw
 func (e *Engine) RemoveRuleAssociations(ruleID string) error {
 	log.Printf("Removing associations for rule %s", ruleID)
 
-	// Remove this rule from all device associations
-	keys, err := e.redisClient.Keys(context.Background(), "device:*:rules").Result()
+	// Remove this rule from all device and variable associations
+	keys, err := e.ruleAssociationKeys()
 	if err != nil {
 		log.Printf("Error getting device rule keys: %v", err)
 		return err
@@ -311,11 +425,8 @@ func (e *Engine) refreshSchedulesForRule(ruleID string) {
 		return
 	}
 
-	// Check if rule has time conditions and auto-create schedules
-	if automation.HasTimeConditions(rule.Conditions) {
-		log.Printf("Rule %s has time conditions, auto-creating schedules", ruleID)
-		e.createSchedulesFromTimeConditions(ruleID, rule.Conditions, rule.Enabled)
-	}
+	// Sync auto-generated schedules with the rule's time conditions
+	e.createSchedulesFromTimeConditions(ruleID, rule.Conditions, rule.Enabled)
 
 	// Get existing schedules for this rule
 	schedules, err := e.db.GetSchedulesByRuleID(context.Background(), ruleID)
@@ -326,7 +437,7 @@ func (e *Engine) refreshSchedulesForRule(ruleID string) {
 
 	// Add or update each schedule in the scheduler
 	for _, s := range schedules {
-		if err := e.scheduler.AddOrUpdateSchedule(s.ID, s.RuleID, s.CronExpression, s.Enabled); err != nil {
+		if err := e.scheduler.AddOrUpdateSchedule(s); err != nil {
 			log.Printf("Error adding/updating schedule %s for rule %s: %v", s.ID, ruleID, err)
 		}
 	}
@@ -334,7 +445,8 @@ func (e *Engine) refreshSchedulesForRule(ruleID string) {
 	log.Printf("Refreshed %d schedules for rule %s", len(schedules), ruleID)
 }
 
-// removeSchedulesForRule removes schedules for a specific rule from both scheduler and database
+// removeSchedulesForRule removes schedules for a specific rule from the scheduler and deletes the
+// auto-generated ones. Manual schedules are left to the user; they are deleted with the rule.
 func (e *Engine) removeSchedulesForRule(ruleID string) {
 	log.Printf("Removing schedules for rule %s", ruleID)
 
@@ -349,6 +461,9 @@ func (e *Engine) removeSchedulesForRule(ruleID string) {
 	for _, s := range schedules {
 		// Remove from scheduler
 		e.scheduler.RemoveSchedule(s.ID)
+		if !s.Auto {
+			continue
+		}
 
 		// Remove from database
 		if err := e.db.DeleteSchedule(context.Background(), s.ID); err != nil {
@@ -365,6 +480,41 @@ func (e *Engine) RefreshAllRuleAssociations() error {
 	return e.populateDeviceRuleAssociations()
 }
 
+// RefreshSchedule (re)loads a single schedule into the scheduler
+func (e *Engine) RefreshSchedule(scheduleID string) error {
+	schedule, err := e.db.GetScheduleByID(context.Background(), scheduleID)
+	if err != nil {
+		log.Printf("Error getting schedule %s: %v", scheduleID, err)
+		return err
+	}
+	return e.scheduler.AddOrUpdateSchedule(*schedule)
+}
+
+// RemoveSchedule stops a schedule; the caller deletes it from the database
+func (e *Engine) RemoveSchedule(scheduleID string) {
+	e.scheduler.RemoveSchedule(scheduleID)
+}
+
+// ScheduleFireTimes returns the next n times a schedule fires
+func (e *Engine) ScheduleFireTimes(schedule models.Schedule, n int) []time.Time {
+	return e.scheduler.NextFireTimes(schedule, n)
+}
+
+// RefreshCalendar fetches and re-expands a calendar and re-arms what depends on it
+func (e *Engine) RefreshCalendar(calendarID string) error {
+	return e.scheduler.RefreshCalendar(calendarID)
+}
+
+// RemoveCalendar stops the timers of a deleted calendar
+func (e *Engine) RemoveCalendar(calendarID string) {
+	e.scheduler.RemoveCalendar(calendarID)
+}
+
+// CalendarOccurrences returns the cached occurrences of a calendar
+func (e *Engine) CalendarOccurrences(calendarID string) []calendar.Occurrence {
+	return calendar.LoadOccurrences(context.Background(), e.redisClient, calendarID)
+}
+
 // ReloadAllSchedules reloads all schedules from the database
 func (e *Engine) ReloadAllSchedules() error {
 	log.Println("Reloading all schedules")
@@ -376,3 +526,263 @@ func (e *Engine) TriggerRuleEvaluation(ruleID string) {
 	log.Printf("Triggering immediate evaluation for rule %s", ruleID)
 	taskqueue.EnqueueEvaluation(ruleID, "")
 }
+
+// RunRule runs a rule on request; with skipConditions its actions execute unconditionally
+func (e *Engine) RunRule(ruleID string, skipConditions bool) error {
+	log.Printf("Running rule %s (skip conditions: %t)", ruleID, skipConditions)
+	return taskqueue.EnqueueRuleRun(ruleID, skipConditions)
+}
+
+// loadVariables caches all variable values in Redis
+func (e *Engine) loadVariables() error {
+	variables, err := e.db.GetAllVariables(context.Background())
+	if err != nil {
+		return err
+	}
+	for _, v := range variables {
+		if err := automation.CacheVariable(context.Background(), e.redisClient, v); err != nil {
+			log.Printf("Error caching variable %s: %v", v.Name, err)
+		}
+	}
+	log.Printf("Loaded %d variables", len(variables))
+	return nil
+}
+
+// RefreshVariable caches a created or changed variable and re-evaluates the rules reading it
+func (e *Engine) RefreshVariable(v models.Variable) error {
+	if err := automation.CacheVariable(context.Background(), e.redisClient, v); err != nil {
+		log.Printf("Error caching variable %s: %v", v.Name, err)
+		return err
+	}
+	for _, ruleID := range automation.VariableDependents(context.Background(), e.redisClient, v) {
+		taskqueue.EnqueueEvaluation(ruleID, "")
+	}
+	return nil
+}
+
+// RemoveVariable drops a deleted variable from the cache
+func (e *Engine) RemoveVariable(v models.Variable) error {
+	return automation.UncacheVariable(context.Background(), e.redisClient, v)
+}
+
+// loadDeviceOwners caches the household of every accepted device
+func (e *Engine) loadDeviceOwners() error {
+	owners, err := e.db.GetDeviceOwners(context.Background())
+	if err != nil {
+		return err
+	}
+	for deviceID, ownerID := range owners {
+		if err := automation.CacheDeviceOwner(context.Background(), e.redisClient, deviceID, ownerID); err != nil {
+			return err
+		}
+	}
+	log.Printf("Loaded owners of %d devices", len(owners))
+	return nil
+}
+
+// RefreshDeviceOwner re-caches the household of a device after it was accepted,
+// given to another user, created or deleted
+func (e *Engine) RefreshDeviceOwner(deviceID string) error {
+	device, err := e.db.GetDeviceByID(context.Background(), deviceID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return automation.CacheDeviceOwner(context.Background(), e.redisClient, deviceID, "")
+	}
+	if err != nil {
+		return err
+	}
+	ownerID := ""
+	if device.Accepted && device.OwnerID != nil {
+		ownerID = *device.OwnerID
+	}
+	return automation.CacheDeviceOwner(context.Background(), e.redisClient, deviceID, ownerID)
+}
+
+// loadVirtualDevices rebuilds the index of virtual device inputs in Redis
+func (e *Engine) loadVirtualDevices() error {
+	virtualDevices, err := e.db.GetAllVirtualDevices(context.Background())
+	if err != nil {
+		return err
+	}
+	keys, err := e.redisClient.Keys(context.Background(), "device:*:virtual").Result()
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		e.redisClient.Del(context.Background(), key)
+	}
+	for _, vd := range virtualDevices {
+		automation.IndexVirtualDevice(context.Background(), e.redisClient, vd)
+	}
+	log.Printf("Loaded %d virtual devices", len(virtualDevices))
+	return nil
+}
+
+// RefreshVirtualDevice re-indexes a created or changed virtual device and computes its state
+func (e *Engine) RefreshVirtualDevice(deviceID string) error {
+	vd, err := e.db.GetVirtualDevice(context.Background(), deviceID)
+	if err != nil {
+		return err
+	}
+	if err := automation.UnindexVirtualDevice(context.Background(), e.redisClient, deviceID); err != nil {
+		return err
+	}
+	automation.IndexVirtualDevice(context.Background(), e.redisClient, *vd)
+
+	state, err := automation.ComputeVirtualState(context.Background(), e.redisClient, e.db, *vd)
+	if err != nil {
+		// Inputs without a state yet; the first input update computes it
+		log.Printf("Virtual device %s has no state yet: %v", deviceID, err)
+		return nil
+	}
+	return taskqueue.EnqueueDeviceUpdate(deviceID, state)
+}
+
+// RemoveVirtualDevice drops a deleted virtual device from the input index and state cache
+func (e *Engine) RemoveVirtualDevice(deviceID string) error {
+	e.redisClient.Del(context.Background(), fmt.Sprintf("device:%s", deviceID))
+	return automation.UnindexVirtualDevice(context.Background(), e.redisClient, deviceID)
+}
+
+// ReportPresence records a person's presence reported through the API
+func (e *Engine) ReportPresence(personID, presence, source string) error {
+	return e.presence.Report(personID, presence, source)
+}
+
+// RefreshPerson picks up a created or changed person
+func (e *Engine) RefreshPerson(personID string) error {
+	return e.presence.Refresh(personID)
+}
+
+// RemovePerson forgets a deleted person
+func (e *Engine) RemovePerson(person models.Person) error {
+	return e.presence.Remove(person)
+}
+
+// ReportGeofence applies a geofence event from one of a person's devices
+func (e *Engine) ReportGeofence(personID string, ev presence.GeofenceEvent) error {
+	return e.presence.ReportGeofence(personID, ev)
+}
+
+// RemoveZone forgets a deleted zone
+func (e *Engine) RemoveZone(zone models.Zone) error {
+	return e.presence.RemoveZone(zone)
+}
+
+// ArmAlarm arms a household's alarm panel in mode
+func (e *Engine) ArmAlarm(panel *models.AlarmPanel, mode string) error {
+	return e.alarm.Arm(panel, mode)
+}
+
+// DisarmAlarm disarms a household's alarm panel
+func (e *Engine) DisarmAlarm(panel *models.AlarmPanel) error {
+	return e.alarm.Disarm(panel)
+}
+
+// TriggerAlarm sets off a household's alarm by hand
+func (e *Engine) TriggerAlarm(panel *models.AlarmPanel) error {
+	return e.alarm.Trigger(panel, alarm.TriggeredByPanic)
+}
+
+// RefreshAlarm picks up a created or changed alarm panel
+func (e *Engine) RefreshAlarm(panelID string) error {
+	return e.alarm.Refresh(panelID)
+}
+
+// RemoveAlarm forgets a deleted alarm panel
+func (e *Engine) RemoveAlarm(panel models.AlarmPanel) error {
+	return e.alarm.Remove(panel)
+}
+
+// SetVacation turns a household's vacation mode on or off, reporting whether it changed
+func (e *Engine) SetVacation(ownerID string, enabled bool) (bool, error) {
+	return e.vacation.Set(ownerID, enabled)
+}
+
+// loadInterlocks caches the enabled interlocks of every device. Each device's
+// entry is overwritten in place and only devices left without interlocks are
+// cleared afterwards, so the command gate never sees a device unprotected.
+func (e *Engine) loadInterlocks() error {
+	interlocks, err := e.db.GetAllInterlocks(context.Background())
+	if err != nil {
+		return err
+	}
+	byDevice := make(map[string][]models.Interlock)
+	for _, il := range interlocks {
+		byDevice[il.DeviceID] = append(byDevice[il.DeviceID], il)
+	}
+	for deviceID, deviceInterlocks := range byDevice {
+		if err := automation.CacheInterlocks(context.Background(), e.redisClient, deviceID, deviceInterlocks); err != nil {
+			log.Printf("Failed to cache interlocks of device %s: %v", deviceID, err)
+		}
+	}
+
+	keys, err := e.redisClient.Keys(context.Background(), "device:*:interlocks").Result()
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		deviceID := strings.TrimSuffix(strings.TrimPrefix(key, "device:"), ":interlocks")
+		if _, ok := byDevice[deviceID]; ok {
+			continue
+		}
+		if err := automation.CacheInterlocks(context.Background(), e.redisClient, deviceID, nil); err != nil {
+			log.Printf("Failed to clear interlocks of device %s: %v", deviceID, err)
+		}
+	}
+	log.Printf("Loaded %d interlocks", len(interlocks))
+	return nil
+}
+
+// RefreshInterlocks re-caches the interlocks of a device after one was created, changed or deleted
+func (e *Engine) RefreshInterlocks(deviceID string) error {
+	interlocks, err := e.db.GetInterlocksByDevice(context.Background(), deviceID)
+	if err != nil {
+		return err
+	}
+	return automation.CacheInterlocks(context.Background(), e.redisClient, deviceID, interlocks)
+}
+
+// SendCommand publishes a command from the API to a device, returning an
+// *automation.InterlockError when an interlock rejects it
+func (e *Engine) SendCommand(deviceID string, params map[string]interface{}) error {
+	token, err := automation.PublishCommand(context.Background(), e.redisClient, e.mqttClient, deviceID, params, "api")
+	if err != nil {
+		return err
+	}
+	token.Wait()
+	return token.Error()
+}
+
+// loadEnergy caches every tariff and the consumption of every device today and this month
+func (e *Engine) loadEnergy() error {
+	tariffs, err := e.db.GetAllEnergyTariffs(context.Background())
+	if err != nil {
+		return err
+	}
+	for _, t := range tariffs {
+		if err := automation.CacheTariff(context.Background(), e.redisClient, t); err != nil {
+			log.Printf("Failed to cache tariff of household %s: %v", t.OwnerID, err)
+		}
+	}
+
+	now := clock.Now().In(clock.Location())
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	totals, err := e.db.GetEnergyTotals(context.Background(), day, day.AddDate(0, 0, 1-day.Day()))
+	if err != nil {
+		return err
+	}
+	for _, total := range totals {
+		automation.CacheEnergyTotals(context.Background(), e.redisClient, total, now)
+	}
+	log.Printf("Loaded %d tariffs and energy totals of %d devices", len(tariffs), len(totals))
+	return nil
+}
+
+// RefreshTariff re-caches a household's tariff after it changed
+func (e *Engine) RefreshTariff(ownerID string) error {
+	tariff, err := e.db.GetEnergyTariff(context.Background(), ownerID)
+	if err != nil {
+		return err
+	}
+	return automation.CacheTariff(context.Background(), e.redisClient, *tariff)
+}
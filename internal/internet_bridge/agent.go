@@ -8,6 +8,8 @@ import (
 	"net/http"
 	"time"
 
+	"smarthome/internal/audit"
+
 	"github.com/gorilla/websocket"
 )
 
@@ -19,12 +21,13 @@ type Config struct {
 }
 
 type requestMsg struct {
-	Type    string            `json:"type"`
-	ReqId   string            `json:"reqId"`
-	Method  string            `json:"method"`
-	Path    string            `json:"path"`
-	Headers map[string]string `json:"headers"`
-	Body    interface{}       `json:"body"`
+	Type     string            `json:"type"`
+	ReqId    string            `json:"reqId"`
+	Method   string            `json:"method"`
+	Path     string            `json:"path"`
+	Headers  map[string]string `json:"headers"`
+	Body     interface{}       `json:"body"`
+	ClientIP string            `json:"clientIp"`
 }
 
 type responseMsg struct {
@@ -97,6 +100,14 @@ func doLocalRequest(base string, req requestMsg) (interface{}, int) {
 	for key, value := range req.Headers {
 		httpReq.Header.Set(key, value)
 	}
+	// Mark the request as proxied so the server can attribute it to the bridge
+	httpReq.Header.Set(audit.RemoteBridgeHeader, "1")
+	// Forward the client IP the public server saw, never one sent by the client
+	if req.ClientIP != "" {
+		httpReq.Header.Set(audit.RemoteClientIPHeader, req.ClientIP)
+	} else {
+		httpReq.Header.Del(audit.RemoteClientIPHeader)
+	}
 
 	client := &http.Client{Timeout: 5 * time.Second}
 
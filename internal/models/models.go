@@ -1,6 +1,9 @@
 package models
 
-import "encoding/json"
+import (
+	"encoding/json"
+	"time"
+)
 
 // Device represents a device model
 type Device struct {
@@ -11,18 +14,32 @@ type Device struct {
 	MQTTTopic string          `json:"mqtt_topic"`
 	Accepted  bool            `json:"accepted"`
 	OwnerID   *string         `json:"owner_id"`
+	Virtual   bool            `json:"virtual"`
+	Room      string          `json:"room"`
+}
+
+// VirtualDevice defines the state of a virtual device: each attribute is an
+// expression over other devices, e.g. {"temperature": "avg(device.1.temperature, device.2.temperature)"}
+type VirtualDevice struct {
+	DeviceID   string            `json:"device_id"`
+	Attributes map[string]string `json:"attributes"`
 }
 
 // Condition represents a condition in a rule
 type Condition struct {
-	Type      string          `json:"type"`       // "sensor", "device", "time"
-	DeviceID  string          `json:"device_id"`  // For sensor/device conditions
-	Key       string          `json:"key"`        // e.g., "temperature", "on"
-	Op        string          `json:"op"`         // ">", "<", "==", "!="
-	Value     json.RawMessage `json:"value"`      // e.g., 22.5, true, "18:00"
-	MinChange float64         `json:"min_change"` // Minimum change to trigger (e.g., 0.1 for temperature)
-	Operator  string          `json:"operator"`   // "AND", "OR" for nested conditions
-	Children  []Condition     `json:"children"`   // For nested AND/OR logic
+	Type       string          `json:"type"`                  // "sensor", "device", "time", "expression", "variable", "rule_fired", "calendar", "presence", "zone", "alarm", "energy"
+	DeviceID   string          `json:"device_id"`             // For sensor/device/energy conditions
+	RuleID     string          `json:"rule_id,omitempty"`     // For rule_fired conditions
+	CalendarID string          `json:"calendar_id,omitempty"` // For calendar conditions
+	PersonID   string          `json:"person_id,omitempty"`   // For presence and zone conditions, empty for the whole household
+	ZoneID     string          `json:"zone_id,omitempty"`     // For zone conditions
+	Key        string          `json:"key"`                   // e.g., "temperature", "on"
+	Op         string          `json:"op"`                    // ">", "<", "==", "!="
+	Value      json.RawMessage `json:"value"`                 // e.g., 22.5, true, "18:00"
+	Expression string          `json:"expression,omitempty"`  // For expression conditions, e.g. "device.1.temperature > device.2.temperature + 2"
+	MinChange  float64         `json:"min_change"`            // Minimum change to trigger (e.g., 0.1 for temperature)
+	Operator   string          `json:"operator"`              // "AND", "OR" for nested conditions
+	Children   []Condition     `json:"children"`              // For nested AND/OR logic
 }
 
 // Action represents an action in a rule
@@ -40,21 +57,210 @@ type Rule struct {
 	Actions    json.RawMessage `json:"actions"`
 	Enabled    bool            `json:"enabled"`
 	OwnerID    string          `json:"owner_id"`
+	Execution  RuleExecution   `json:"execution"`
+}
+
+// RuleExecution limits how a rule's actions run
+type RuleExecution struct {
+	Mode            string `json:"mode,omitempty"`             // "single" (default), "restart", "queued" or "parallel"
+	CooldownSeconds int    `json:"cooldown_seconds,omitempty"` // Minimum time between two runs
+	MaxPerDay       int    `json:"max_per_day,omitempty"`      // Maximum runs per day, 0 = unlimited
+}
+
+// Variable is a user-defined value (flag, number or mode) that rules can read and set
+type Variable struct {
+	ID        string          `json:"id"`
+	Name      string          `json:"name"`
+	Type      string          `json:"type"` // "boolean", "number", "enum"
+	Options   []string        `json:"options,omitempty"`
+	Min       *float64        `json:"min,omitempty"`
+	Max       *float64        `json:"max,omitempty"`
+	Value     json.RawMessage `json:"value"`
+	RuleID    *string         `json:"rule_id"` // Set for variables private to a single rule
+	OwnerID   string          `json:"owner_id"`
+	UpdatedAt time.Time       `json:"updated_at"`
+}
+
+// RuleRevision is a stored version of a rule
+type RuleRevision struct {
+	RuleID       string          `json:"rule_id"`
+	Revision     int             `json:"revision"`
+	Name         string          `json:"name"`
+	Conditions   json.RawMessage `json:"conditions"`
+	Actions      json.RawMessage `json:"actions"`
+	Enabled      bool            `json:"enabled"`
+	Execution    RuleExecution   `json:"execution"`
+	AuthorID     *string         `json:"author_id"`
+	RestoredFrom *int            `json:"restored_from,omitempty"`
+	CreatedAt    time.Time       `json:"created_at"`
+}
+
+// RuleRun is the trace of one rule evaluation
+type RuleRun struct {
+	ID          string          `json:"id"`
+	RuleID      string          `json:"rule_id"`
+	TriggeredBy string          `json:"triggered_by"` // "device:<id>", "schedule:<id>", "catch_up:<id>", "calendar:<id>", "rule:<id>", "api" or "engine"
+	Outcome     string          `json:"outcome"`      // "executed", "conditions_not_met", "skipped" or "failed"
+	Reason      string          `json:"reason,omitempty"`
+	Conditions  json.RawMessage `json:"conditions,omitempty"` // Result of every condition leaf and group
+	Conflicts   json.RawMessage `json:"conflicts,omitempty"`  // Pending actions of all rules and the resolved outcome
+	Actions     json.RawMessage `json:"actions,omitempty"`    // Commands published per device
+	Errors      []string        `json:"errors"`
+	StartedAt   time.Time       `json:"started_at"`
+	DurationMs  int             `json:"duration_ms"`
 }
 
 // Schedule represents a schedule model
 type Schedule struct {
-	ID             string `json:"id"`
-	RuleID         string `json:"rule_id"`
-	CronExpression string `json:"cron_expression"`
-	Enabled        bool   `json:"enabled"`
+	ID             string     `json:"id"`
+	RuleID         string     `json:"rule_id"`
+	CronExpression string     `json:"cron_expression"`           // 5 fields, or 6 with leading seconds
+	RunAt          *time.Time `json:"run_at,omitempty"`          // One-shot schedules fire once at this time
+	CalendarID     string     `json:"calendar_id,omitempty"`     // Calendar schedules fire when matching events start
+	CalendarFilter string     `json:"calendar_filter,omitempty"` // Event category or summary text, empty for all events
+	Timezone       string     `json:"timezone"`                  // IANA zone the expression is read in, empty for local time
+	ExcludeDates   []string   `json:"exclude_dates"`             // Days (YYYY-MM-DD) the schedule does not fire
+	Enabled        bool       `json:"enabled"`
+	Auto           bool       `json:"auto"` // Generated from the rule's time conditions
+	LastFiredAt    *time.Time `json:"last_fired_at"`
+	CatchUp        string     `json:"catch_up"`               // "skip", "once" or "all": what to do with fires missed while the engine was down
+	CatchUpGrace   int        `json:"catch_up_grace_seconds"` // Only fires missed within this many seconds are caught up
+}
+
+// Calendar is an ICS calendar fetched from a URL or imported as a file
+type Calendar struct {
+	ID             string     `json:"id"`
+	OwnerID        string     `json:"owner_id"`
+	Name           string     `json:"name"`
+	URL            string     `json:"url,omitempty"`
+	Content        string     `json:"-"`
+	Timezone       string     `json:"timezone"` // Zone of event times without one, empty for local time
+	RefreshMinutes int        `json:"refresh_minutes"`
+	RefreshedAt    *time.Time `json:"refreshed_at"`
+	LastError      string     `json:"last_error,omitempty"`
+}
+
+// Person is a member of a household whose presence is tracked. Presence is "home"
+// or "away" as last reported by one of the person's sources.
+type Person struct {
+	ID                string     `json:"id"`
+	OwnerID           string     `json:"owner_id"`
+	Name              string     `json:"name"`
+	UserID            *string    `json:"user_id"`       // User whose app checks in for this person
+	MQTTTopic         string     `json:"mqtt_topic"`    // Topic a presence sensor publishes home/away to
+	MACAddresses      []string   `json:"mac_addresses"` // Devices whose DHCP lease means the person is home
+	Presence          string     `json:"presence"`
+	PresenceSource    string     `json:"presence_source"` // Source of the last change: checkin, mqtt, dhcp, geofence or manual
+	PresenceChangedAt *time.Time `json:"presence_changed_at"`
+}
+
+// Zone is a circular area such as home, work or school that geofence events report entering and leaving
+type Zone struct {
+	ID        string  `json:"id"`
+	OwnerID   string  `json:"owner_id"`
+	Name      string  `json:"name"`
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	Radius    float64 `json:"radius_meters"`
+	Home      bool    `json:"home"` // Entering and leaving the zone sets the person's presence
+}
+
+// ZonePresence is whether a person is inside a zone
+type ZonePresence struct {
+	ZoneID    string    `json:"zone_id"`
+	PersonID  string    `json:"person_id"`
+	Inside    bool      `json:"inside"`
+	ChangedAt time.Time `json:"changed_at"`
+}
+
+// GeofenceDevice is a phone whose geofence webhooks report a person's zone changes
+type GeofenceDevice struct {
+	ID         string     `json:"id"`
+	PersonID   string     `json:"person_id"`
+	Name       string     `json:"name"`
+	LastSeenAt *time.Time `json:"last_seen_at"`
+}
+
+// AlarmPanel is a household's alarm. Sensors lists the door, window and motion
+// devices watched in each armed mode, e.g. {"armed_night": ["3", "4"]}.
+type AlarmPanel struct {
+	ID              string              `json:"id"`
+	OwnerID         string              `json:"owner_id"`
+	Name            string              `json:"name"`
+	PINHash         string              `json:"-"`
+	ArmRequiresPIN  bool                `json:"arm_requires_pin"`
+	EntryDelay      int                 `json:"entry_delay_seconds"`
+	ExitDelay       int                 `json:"exit_delay_seconds"`
+	TriggerDuration int                 `json:"trigger_seconds"` // How long the siren sounds, 0 until disarmed
+	Sensors         map[string][]string `json:"sensors"`
+	SirenActions    json.RawMessage     `json:"siren_actions"`     // Actions run when the alarm goes off
+	SirenOffActions json.RawMessage     `json:"siren_off_actions"` // Actions run when it is disarmed or the trigger time is over
+	State           string              `json:"state"`
+	ArmedMode       string              `json:"armed_mode"`   // Mode armed or being armed, empty while disarmed
+	TriggeredBy     string              `json:"triggered_by"` // Sensor that set off the alarm, or "panic"
+	StateChangedAt  time.Time           `json:"state_changed_at"`
+}
+
+// Interlock is a safety constraint checked before every command to a device.
+// Kind "forbid" rejects setting key (to value, if given) while condition holds,
+// or always without one; "range" rejects numeric values of key outside min and
+// max; "max_runtime" sends off_value once key has had value for max_seconds.
+type Interlock struct {
+	ID         string          `json:"id"`
+	OwnerID    string          `json:"owner_id"`
+	Name       string          `json:"name"`
+	DeviceID   string          `json:"device_id"`
+	Kind       string          `json:"kind"`
+	Key        string          `json:"key"`
+	Value      json.RawMessage `json:"value,omitempty"`
+	Condition  json.RawMessage `json:"condition,omitempty"`
+	Min        *float64        `json:"min,omitempty"`
+	Max        *float64        `json:"max,omitempty"`
+	MaxSeconds int             `json:"max_seconds,omitempty"`
+	OffValue   json.RawMessage `json:"off_value,omitempty"`
+	Enabled    bool            `json:"enabled"`
+}
+
+// VacationMode replays a household's recent lighting history on the selected
+// devices while nobody is home. SavedStates holds the states of the devices when
+// it was enabled, restored when it is disabled.
+type VacationMode struct {
+	ID            string                     `json:"id"`
+	OwnerID       string                     `json:"owner_id"`
+	Devices       []string                   `json:"devices"`
+	Weeks         int                        `json:"weeks"` // How many past weeks to pick the replayed day from
+	JitterMinutes int                        `json:"jitter_minutes"`
+	Enabled       bool                       `json:"enabled"`
+	EnabledAt     *time.Time                 `json:"enabled_at"`
+	SavedStates   map[string]json.RawMessage `json:"saved_states,omitempty"`
+}
+
+// EnergyTariff prices a household's electricity. A "flat" tariff charges rate per
+// kWh; a "time_of_use" tariff charges the rate of the first period covering the time,
+// and rate outside all periods.
+type EnergyTariff struct {
+	ID       string         `json:"id"`
+	OwnerID  string         `json:"owner_id"`
+	Kind     string         `json:"kind"`
+	Currency string         `json:"currency"`
+	Rate     float64        `json:"rate"`
+	Periods  []TariffPeriod `json:"periods"`
+}
+
+// TariffPeriod is a time-of-use price from start to end ("HH:MM", end may be past
+// midnight), on the given weekdays (0 = Sunday) or every day
+type TariffPeriod struct {
+	Start    string  `json:"start"`
+	End      string  `json:"end"`
+	Weekdays []int   `json:"weekdays,omitempty"`
+	Rate     float64 `json:"rate"`
 }
 
 // DeviceStateHistory for logging
 type DeviceStateHistory struct {
 	ID        string          `json:"id"`
 	DeviceID  string          `json:"device_id"`
-	Timestamp string          `json:"timestamp"`
+	Timestamp time.Time       `json:"timestamp"`
 	State     json.RawMessage `json:"state"`
 }
 
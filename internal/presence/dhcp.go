@@ -0,0 +1,158 @@
+package presence
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"smarthome/internal/automation"
+	"smarthome/internal/clock"
+)
+
+// DefaultDHCPPollInterval is how often the lease file is read without a configured interval
+const DefaultDHCPPollInterval = 30 * time.Second
+
+// NormalizeMAC returns a MAC address in lowercase colon notation
+func NormalizeMAC(mac string) (string, error) {
+	hw, err := net.ParseMAC(strings.TrimSpace(mac))
+	if err != nil {
+		return "", err
+	}
+	return hw.String(), nil
+}
+
+// ActiveLeases returns the MAC addresses holding an unexpired lease in a dnsmasq or
+// ISC dhcpd lease file
+func ActiveLeases(data []byte, now time.Time) map[string]bool {
+	if bytes.Contains(data, []byte("lease ")) && bytes.Contains(data, []byte("{")) {
+		return activeDhcpdLeases(data, now)
+	}
+
+	// dnsmasq: "<expiry> <mac> <ip> <hostname> <client id>", an expiry of 0 never expires
+	active := make(map[string]bool)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 {
+			continue
+		}
+		expiry, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		mac, err := NormalizeMAC(fields[1])
+		if err != nil {
+			continue
+		}
+		if expiry == 0 || time.Unix(expiry, 0).After(now) {
+			active[mac] = true
+		}
+	}
+	return active
+}
+
+// activeDhcpdLeases reads an ISC dhcpd lease file, where a later block for the same
+// address supersedes earlier ones
+func activeDhcpdLeases(data []byte, now time.Time) map[string]bool {
+	leases := make(map[string]bool)
+	var mac, binding string
+	var ends time.Time
+	never := false
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSuffix(strings.TrimSpace(scanner.Text()), ";")
+		switch {
+		case strings.HasPrefix(line, "lease "):
+			mac, binding, ends, never = "", "", time.Time{}, false
+		case line == "ends never":
+			never = true
+		case strings.HasPrefix(line, "ends "):
+			// "ends <weekday> YYYY/MM/DD HH:MM:SS" in UTC
+			if fields := strings.Fields(line); len(fields) == 4 {
+				ends, _ = time.Parse("2006/01/02 15:04:05", fields[2]+" "+fields[3])
+			}
+		case strings.HasPrefix(line, "binding state "):
+			binding = strings.TrimPrefix(line, "binding state ")
+		case strings.HasPrefix(line, "hardware ethernet "):
+			mac, _ = NormalizeMAC(strings.TrimPrefix(line, "hardware ethernet "))
+		case line == "}":
+			if mac != "" {
+				leases[mac] = (binding == "" || binding == "active") && (never || ends.After(now))
+			}
+			mac = ""
+		}
+	}
+
+	active := make(map[string]bool)
+	for mac, ok := range leases {
+		if ok {
+			active[mac] = true
+		}
+	}
+	return active
+}
+
+// runDHCP polls the lease file until the tracker stops
+func (t *Tracker) runDHCP() {
+	interval := t.dhcpInterval
+	if interval <= 0 {
+		interval = DefaultDHCPPollInterval
+	}
+	t.pollDHCP()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.stop:
+			return
+		case <-ticker.C:
+			t.pollDHCP()
+		}
+	}
+}
+
+// pollDHCP reports people as home while one of their devices holds a lease. Only
+// changes of what the lease file shows are reported, and a missing lease right
+// after startup is not taken as leaving, so other sources are not overridden.
+func (t *Tracker) pollDHCP() {
+	data, err := os.ReadFile(t.dhcpFile)
+	if err != nil {
+		log.Printf("PRESENCE: Failed to read DHCP leases %s: %v", t.dhcpFile, err)
+		return
+	}
+	leases := ActiveLeases(data, clock.Now())
+
+	people, err := t.db.GetAllPeople(context.Background())
+	if err != nil {
+		log.Printf("PRESENCE: Failed to load people: %v", err)
+		return
+	}
+	for _, p := range people {
+		if len(p.MACAddresses) == 0 {
+			continue
+		}
+		presence := automation.PresenceAway
+		for _, mac := range p.MACAddresses {
+			if normalized, err := NormalizeMAC(mac); err == nil && leases[normalized] {
+				presence = automation.PresenceHome
+				break
+			}
+		}
+
+		seen, known := t.dhcpSeen[p.ID]
+		t.dhcpSeen[p.ID] = presence
+		if seen == presence || (!known && presence == automation.PresenceAway) {
+			continue
+		}
+		if err := t.Report(p.ID, presence, SourceDHCP); err != nil {
+			log.Printf("PRESENCE: Failed to record presence of person %s: %v", p.ID, err)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package presence
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+
+	"smarthome/internal/automation"
+	"smarthome/internal/clock"
+	"smarthome/internal/models"
+)
+
+// ErrUnknownZone is returned for a geofence event naming a zone the household does not have
+var ErrUnknownZone = errors.New("unknown zone")
+
+// GeofenceEvent is a zone change or location reported by a phone's geofence webhook
+type GeofenceEvent struct {
+	Zone      string   // Zone name or ID as the app reports it, empty for a plain location update
+	Presence  string   // "home" on entering the zone, "away" on leaving it, empty for a location update
+	Latitude  *float64 // Reported position, if any
+	Longitude *float64
+}
+
+// ParseGeofence reads the fields of a geofence webhook as sent by Locative
+// (trigger, id), Geofency (entry, name) or OwnTracks (event, desc, lat, lon)
+func ParseGeofence(fields map[string]string) (GeofenceEvent, error) {
+	get := func(keys ...string) string {
+		for _, key := range keys {
+			if value := strings.TrimSpace(fields[key]); value != "" {
+				return value
+			}
+		}
+		return ""
+	}
+
+	var ev GeofenceEvent
+	if word := get("trigger", "entry", "event"); word != "" {
+		presence, ok := ParseWord(word)
+		if !ok {
+			return ev, fmt.Errorf("unknown geofence event %q", word)
+		}
+		ev.Presence = presence
+	}
+	ev.Zone = get("zone", "location", "desc", "name", "id")
+
+	lat, lon := get("latitude", "lat"), get("longitude", "lon", "lng")
+	if lat != "" && lon != "" {
+		latitude, err := strconv.ParseFloat(lat, 64)
+		if err != nil || latitude < -90 || latitude > 90 {
+			return ev, fmt.Errorf("invalid latitude %q", lat)
+		}
+		longitude, err := strconv.ParseFloat(lon, 64)
+		if err != nil || longitude < -180 || longitude > 180 {
+			return ev, fmt.Errorf("invalid longitude %q", lon)
+		}
+		ev.Latitude, ev.Longitude = &latitude, &longitude
+	}
+
+	if ev.Presence != "" && ev.Zone == "" && ev.Latitude == nil {
+		return ev, errors.New("geofence event without a zone or position")
+	}
+	if ev.Presence == "" && ev.Latitude == nil {
+		return ev, errors.New("geofence event without an event or position")
+	}
+	return ev, nil
+}
+
+// IgnoredGeofence reports whether a webhook carries nothing to apply, such as
+// Locative's test trigger or OwnTracks messages other than locations and transitions
+func IgnoredGeofence(fields map[string]string) bool {
+	if strings.EqualFold(fields["trigger"], "test") {
+		return true
+	}
+	kind := fields["_type"]
+	return kind != "" && kind != "location" && kind != "transition"
+}
+
+// DistanceMeters returns the great-circle distance between two points
+func DistanceMeters(lat1, lon1, lat2, lon2 float64) float64 {
+	const earthRadius = 6371000.0
+	rad := math.Pi / 180
+	dLat := (lat2 - lat1) * rad
+	dLon := (lon2 - lon1) * rad
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(a))
+}
+
+// NewDeviceToken returns a random geofence device token and the hash stored for it
+func NewDeviceToken() (string, string) {
+	raw := make([]byte, 24)
+	rand.Read(raw)
+	token := hex.EncodeToString(raw)
+	return token, HashDeviceToken(token)
+}
+
+// HashDeviceToken returns the stored hash of a geofence device token
+func HashDeviceToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// ReportGeofence applies a geofence event of one of a person's devices. An event
+// naming a zone enters or leaves it; a position alone updates every zone of the
+// household by distance. Entering or leaving a home zone also sets the person's
+// presence.
+func (t *Tracker) ReportGeofence(personID string, ev GeofenceEvent) error {
+	ctx := context.Background()
+	person, err := t.db.GetPersonByID(ctx, personID)
+	if err != nil {
+		return err
+	}
+	zones, err := t.db.GetZonesByOwner(ctx, person.OwnerID)
+	if err != nil {
+		return err
+	}
+
+	if ev.Presence != "" && ev.Zone != "" {
+		for _, z := range zones {
+			if z.ID == ev.Zone || strings.EqualFold(z.Name, ev.Zone) {
+				return t.setZone(ctx, *person, z, ev.Presence == automation.PresenceHome)
+			}
+		}
+		if ev.Latitude == nil {
+			return ErrUnknownZone
+		}
+	}
+
+	// Apps reporting their own region names fall back to the reported position
+	for _, z := range zones {
+		inside := DistanceMeters(*ev.Latitude, *ev.Longitude, z.Latitude, z.Longitude) <= z.Radius
+		if err := t.setZone(ctx, *person, z, inside); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setZone records a person entering or leaving a zone and re-evaluates the rules
+// of the household when it changed
+func (t *Tracker) setZone(ctx context.Context, person models.Person, zone models.Zone, inside bool) error {
+	changed, err := t.db.SetZonePresence(ctx, zone.ID, person.ID, inside, clock.Now())
+	if err != nil || !changed {
+		return err
+	}
+	verb := "left"
+	if inside {
+		verb = "entered"
+	}
+	log.Printf("PRESENCE: %s (person %s) %s zone %s (%s)", person.Name, person.ID, verb, zone.Name, zone.ID)
+
+	t.cacheZones(ctx, person.OwnerID)
+	if zone.Home {
+		presence := automation.PresenceAway
+		if inside {
+			presence = automation.PresenceHome
+		}
+		changed, err := t.db.SetPersonPresence(ctx, person.ID, presence, SourceGeofence, clock.Now())
+		if err != nil {
+			return err
+		}
+		if changed {
+			log.Printf("PRESENCE: %s (person %s) is %s, reported by %s", person.Name, person.ID, presence, SourceGeofence)
+			t.cacheHousehold(ctx, person.OwnerID)
+		}
+	}
+	t.evaluate(ctx, person.OwnerID, person.ID)
+	return nil
+}
+
+// RemoveZone forgets a deleted zone's membership
+func (t *Tracker) RemoveZone(zone models.Zone) error {
+	return automation.UncacheZone(context.Background(), t.redis, zone.ID)
+}
+
+func (t *Tracker) cacheZones(ctx context.Context, ownerID string) {
+	presence, err := t.db.GetZonePresence(ctx, ownerID)
+	if err != nil {
+		log.Printf("PRESENCE: Failed to load zones of household %s: %v", ownerID, err)
+		return
+	}
+	if err := automation.CacheZonePresence(ctx, t.redis, presence); err != nil {
+		log.Printf("PRESENCE: Failed to cache zones of household %s: %v", ownerID, err)
+	}
+}
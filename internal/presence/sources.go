@@ -0,0 +1,74 @@
+package presence
+
+import (
+	"encoding/json"
+	"strings"
+
+	"smarthome/internal/automation"
+)
+
+// presenceWords maps the words presence sensors and phone apps publish to a presence
+var presenceWords = map[string]string{
+	"home":     automation.PresenceHome,
+	"present":  automation.PresenceHome,
+	"on":       automation.PresenceHome,
+	"true":     automation.PresenceHome,
+	"1":        automation.PresenceHome,
+	"enter":    automation.PresenceHome,
+	"entered":  automation.PresenceHome,
+	"arrived":  automation.PresenceHome,
+	"away":     automation.PresenceAway,
+	"not_home": automation.PresenceAway,
+	"absent":   automation.PresenceAway,
+	"off":      automation.PresenceAway,
+	"false":    automation.PresenceAway,
+	"0":        automation.PresenceAway,
+	"leave":    automation.PresenceAway,
+	"exit":     automation.PresenceAway,
+	"left":     automation.PresenceAway,
+}
+
+// ParseWord reads a presence word such as "home", "not_home" or "leave"
+func ParseWord(word string) (string, bool) {
+	presence, ok := presenceWords[strings.ToLower(strings.TrimSpace(word))]
+	return presence, ok
+}
+
+// ParsePayload reads a presence message: a plain word, or JSON with a "state",
+// "presence" or "event" field such as an OwnTracks transition {"event": "leave"}
+func ParsePayload(payload []byte) (string, bool) {
+	var fields map[string]interface{}
+	if err := json.Unmarshal(payload, &fields); err != nil {
+		var word interface{}
+		if json.Unmarshal(payload, &word) == nil {
+			return parseValue(word)
+		}
+		return ParseWord(string(payload))
+	}
+	for _, key := range []string{"state", "presence", "event"} {
+		if value, ok := fields[key]; ok {
+			return parseValue(value)
+		}
+	}
+	return "", false
+}
+
+func parseValue(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case string:
+		return ParseWord(v)
+	case bool:
+		if v {
+			return automation.PresenceHome, true
+		}
+		return automation.PresenceAway, true
+	case float64:
+		switch v {
+		case 1:
+			return automation.PresenceHome, true
+		case 0:
+			return automation.PresenceAway, true
+		}
+	}
+	return "", false
+}
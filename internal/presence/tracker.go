@@ -0,0 +1,216 @@
+package presence
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"smarthome/internal/automation"
+	"smarthome/internal/clock"
+	"smarthome/internal/db"
+	"smarthome/internal/models"
+	"smarthome/internal/taskqueue"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/redis/go-redis/v9"
+)
+
+// Presence sources
+const (
+	SourceCheckin  = "checkin"  // The person's phone app checking in through the API
+	SourceMQTT     = "mqtt"     // A presence sensor publishing to the person's topic
+	SourceDHCP     = "dhcp"     // A DHCP lease of one of the person's devices
+	SourceGeofence = "geofence" // A mobile app's geofence webhook
+	SourceManual   = "manual"   // Set by hand in the API
+)
+
+// Tracker keeps the presence of people and households. Every source reports
+// changes; the latest report wins. Presence is stored in the database and cached
+// in Redis for condition evaluation.
+type Tracker struct {
+	db    *db.DB
+	redis *redis.Client
+	mqtt  mqtt.Client
+
+	mu     sync.Mutex
+	topics map[string]string // MQTT topic by person ID
+
+	dhcpFile     string
+	dhcpInterval time.Duration
+	dhcpSeen     map[string]string // Presence last seen in the lease file by person ID
+
+	stop chan struct{}
+}
+
+// NewTracker creates a presence tracker
+func NewTracker(dbConn *db.DB, redisClient *redis.Client, mqttClient mqtt.Client) *Tracker {
+	return &Tracker{
+		db:       dbConn,
+		redis:    redisClient,
+		mqtt:     mqttClient,
+		topics:   make(map[string]string),
+		dhcpSeen: make(map[string]string),
+		stop:     make(chan struct{}),
+	}
+}
+
+// SetDHCP makes the tracker poll a dnsmasq or ISC dhcpd lease file every interval
+func (t *Tracker) SetDHCP(leasesFile string, interval time.Duration) {
+	t.dhcpFile = leasesFile
+	if interval > 0 {
+		t.dhcpInterval = interval
+	}
+}
+
+// Start caches the presence of every household and zone, subscribes to presence
+// topics and starts polling the DHCP lease file
+func (t *Tracker) Start() error {
+	people, err := t.db.GetAllPeople(context.Background())
+	if err != nil {
+		return err
+	}
+	households := make(map[string][]models.Person)
+	for _, p := range people {
+		households[p.OwnerID] = append(households[p.OwnerID], p)
+		t.subscribe(p)
+	}
+	for ownerID, members := range households {
+		if err := automation.CachePresence(context.Background(), t.redis, ownerID, members); err != nil {
+			log.Printf("PRESENCE: Failed to cache presence of household %s: %v", ownerID, err)
+		}
+	}
+	zones, err := t.db.GetZonePresence(context.Background(), "")
+	if err != nil {
+		return err
+	}
+	if err := automation.CacheZonePresence(context.Background(), t.redis, zones); err != nil {
+		log.Printf("PRESENCE: Failed to cache zone presence: %v", err)
+	}
+
+	if t.dhcpFile != "" {
+		go t.runDHCP()
+	}
+	log.Printf("PRESENCE: Tracking %d people in %d households", len(people), len(households))
+	return nil
+}
+
+// Stop stops polling the DHCP lease file
+func (t *Tracker) Stop() {
+	close(t.stop)
+}
+
+// Report records a person's presence reported by a source and re-evaluates the
+// rules of the household when it changed
+func (t *Tracker) Report(personID, presence, source string) error {
+	if presence != automation.PresenceHome && presence != automation.PresenceAway {
+		return fmt.Errorf("unknown presence %q", presence)
+	}
+	ctx := context.Background()
+	changed, err := t.db.SetPersonPresence(ctx, personID, presence, source, clock.Now())
+	if err != nil || !changed {
+		return err
+	}
+	person, err := t.db.GetPersonByID(ctx, personID)
+	if err != nil {
+		return err
+	}
+	log.Printf("PRESENCE: %s (person %s) is %s, reported by %s", person.Name, person.ID, presence, source)
+
+	t.cacheHousehold(ctx, person.OwnerID)
+	t.evaluate(ctx, person.OwnerID, person.ID)
+	return nil
+}
+
+// Refresh re-reads a created or changed person
+func (t *Tracker) Refresh(personID string) error {
+	ctx := context.Background()
+	person, err := t.db.GetPersonByID(ctx, personID)
+	if err != nil {
+		return err
+	}
+	t.subscribe(*person)
+	t.cacheHousehold(ctx, person.OwnerID)
+	return nil
+}
+
+// Remove forgets a deleted person, which may leave the household empty
+func (t *Tracker) Remove(person models.Person) error {
+	ctx := context.Background()
+	t.unsubscribe(person.ID)
+	if err := automation.UncachePerson(ctx, t.redis, person.ID); err != nil {
+		return err
+	}
+	if zones, err := t.db.GetZonesByOwner(ctx, person.OwnerID); err == nil && len(zones) > 0 {
+		zoneIDs := make([]string, len(zones))
+		for i, z := range zones {
+			zoneIDs[i] = z.ID
+		}
+		if err := automation.UncacheZonePerson(ctx, t.redis, zoneIDs, person.ID); err != nil {
+			return err
+		}
+	}
+	t.cacheHousehold(ctx, person.OwnerID)
+	t.evaluate(ctx, person.OwnerID, person.ID)
+	return nil
+}
+
+func (t *Tracker) cacheHousehold(ctx context.Context, ownerID string) {
+	people, err := t.db.GetPeopleByOwner(ctx, ownerID)
+	if err != nil {
+		log.Printf("PRESENCE: Failed to load household %s: %v", ownerID, err)
+		return
+	}
+	if err := automation.CachePresence(ctx, t.redis, ownerID, people); err != nil {
+		log.Printf("PRESENCE: Failed to cache presence of household %s: %v", ownerID, err)
+	}
+}
+
+// evaluate re-evaluates the rules reading a household's presence
+func (t *Tracker) evaluate(ctx context.Context, ownerID, personID string) {
+	for _, ruleID := range automation.PresenceDependents(ctx, t.redis, ownerID) {
+		if err := taskqueue.EnqueuePresenceEvaluation(ruleID, personID); err != nil {
+			log.Printf("PRESENCE: Failed to enqueue evaluation for rule %s: %v", ruleID, err)
+		}
+	}
+}
+
+// subscribe follows a person's presence topic, replacing a previous one
+func (t *Tracker) subscribe(p models.Person) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if old, ok := t.topics[p.ID]; ok {
+		if old == p.MQTTTopic {
+			return
+		}
+		t.mqtt.Unsubscribe(old)
+		delete(t.topics, p.ID)
+	}
+	if p.MQTTTopic == "" {
+		return
+	}
+
+	personID := p.ID
+	t.mqtt.Subscribe(p.MQTTTopic, 1, func(_ mqtt.Client, msg mqtt.Message) {
+		presence, ok := ParsePayload(msg.Payload())
+		if !ok {
+			log.Printf("PRESENCE: Ignoring unrecognized payload on %s: %s", msg.Topic(), msg.Payload())
+			return
+		}
+		if err := t.Report(personID, presence, SourceMQTT); err != nil {
+			log.Printf("PRESENCE: Failed to record presence of person %s: %v", personID, err)
+		}
+	})
+	t.topics[p.ID] = p.MQTTTopic
+	log.Printf("PRESENCE: Subscribed to %s for person %s", p.MQTTTopic, p.ID)
+}
+
+func (t *Tracker) unsubscribe(personID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if topic, ok := t.topics[personID]; ok {
+		t.mqtt.Unsubscribe(topic)
+		delete(t.topics, personID)
+	}
+}
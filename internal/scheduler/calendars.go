@@ -0,0 +1,215 @@
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"smarthome/internal/automation"
+	"smarthome/internal/calendar"
+	"smarthome/internal/clock"
+	"smarthome/internal/models"
+	"smarthome/internal/taskqueue"
+)
+
+const (
+	// calendarCheckInterval is how often calendars are checked for a due refresh
+	calendarCheckInterval = time.Minute
+	// calendarLookback and calendarHorizon bound the expanded occurrences around now
+	calendarLookback = 24 * time.Hour
+	calendarHorizon  = 30 * 24 * time.Hour
+	// maxCalendarSize caps a fetched ICS document
+	maxCalendarSize = 5 << 20
+)
+
+var calendarHTTPClient = &http.Client{Timeout: 30 * time.Second}
+
+// runCalendars refreshes calendars when due while this replica is the leader
+func (s *Scheduler) runCalendars() {
+	ticker := time.NewTicker(calendarCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			if s.IsLeader() {
+				s.checkCalendars(false)
+			}
+		}
+	}
+}
+
+// checkCalendars refreshes due calendars. With armAll, calendars that are not due
+// are armed from their cached occurrences, as after an election.
+func (s *Scheduler) checkCalendars(armAll bool) {
+	calendars, err := s.db.GetAllCalendars(context.Background())
+	if err != nil {
+		log.Printf("SCHEDULER: Failed to load calendars: %v", err)
+		return
+	}
+	for _, cal := range calendars {
+		interval := time.Duration(cal.RefreshMinutes) * time.Minute
+		if cal.RefreshedAt == nil || clock.Now().Sub(*cal.RefreshedAt) >= interval {
+			s.RefreshCalendar(cal.ID)
+			continue
+		}
+		if armAll {
+			s.armCalendar(cal.ID)
+		}
+	}
+}
+
+// RefreshCalendar fetches or re-reads a calendar, caches its occurrences and re-arms
+// its schedules and rules. On failure the previous occurrences are kept.
+func (s *Scheduler) RefreshCalendar(calendarID string) error {
+	ctx := context.Background()
+	cal, err := s.db.GetCalendarByID(ctx, calendarID)
+	if err != nil {
+		log.Printf("SCHEDULER: Failed to get calendar %s: %v", calendarID, err)
+		return err
+	}
+
+	now := clock.Now()
+	occurrences, err := LoadCalendar(ctx, *cal, now)
+	if err == nil {
+		err = calendar.StoreOccurrences(ctx, s.redis, cal.ID, occurrences)
+	}
+	lastError := ""
+	if err != nil {
+		lastError = err.Error()
+		log.Printf("SCHEDULER: Failed to refresh calendar %s: %v", cal.ID, err)
+	}
+	if dbErr := s.db.SetCalendarRefreshed(ctx, cal.ID, now, lastError); dbErr != nil {
+		log.Printf("SCHEDULER: Failed to record refresh of calendar %s: %v", cal.ID, dbErr)
+	}
+	if err != nil {
+		return err
+	}
+
+	s.armCalendar(cal.ID)
+	s.publish(changeCalendar, cal.ID)
+	log.Printf("SCHEDULER: Refreshed calendar %s with %d occurrences", cal.ID, len(occurrences))
+	return nil
+}
+
+// armCalendar re-arms a calendar's schedules and rules from its cached occurrences
+func (s *Scheduler) armCalendar(calendarID string) {
+	occurrences := calendar.LoadOccurrences(context.Background(), s.redis, calendarID)
+	s.armCalendarRules(calendarID, occurrences)
+	for _, sch := range s.calendarSchedules(calendarID) {
+		s.armCalendarSchedule(sch, occurrences)
+	}
+}
+
+// RemoveCalendar stops the timers of a deleted calendar on every replica and drops its cache
+func (s *Scheduler) RemoveCalendar(calendarID string) {
+	s.removeCalendar(calendarID)
+	calendar.DeleteOccurrences(context.Background(), s.redis, calendarID)
+	s.publish(changeCalendarRemoved, calendarID)
+}
+
+func (s *Scheduler) removeCalendar(calendarID string) {
+	for _, sch := range s.calendarSchedules(calendarID) {
+		s.removeSchedule(sch.ID)
+	}
+	s.jobMapMux.Lock()
+	stopTimers(s.calendarTimers[calendarID])
+	delete(s.calendarTimers, calendarID)
+	s.jobMapMux.Unlock()
+	log.Printf("SCHEDULER: Removed calendar %s", calendarID)
+}
+
+// calendarSchedules returns the enabled schedules firing on a calendar's events
+func (s *Scheduler) calendarSchedules(calendarID string) []models.Schedule {
+	s.jobMapMux.RLock()
+	defer s.jobMapMux.RUnlock()
+	var schedules []models.Schedule
+	for _, sch := range s.schedules {
+		if sch.CalendarID == calendarID {
+			schedules = append(schedules, sch)
+		}
+	}
+	return schedules
+}
+
+// armCalendarRules re-evaluates the rules with a condition on a calendar whenever
+// one of its events starts or ends
+func (s *Scheduler) armCalendarRules(calendarID string, occurrences []calendar.Occurrence) {
+	now := clock.Now()
+	boundaries := make(map[int64]time.Time)
+	for _, occ := range occurrences {
+		for _, t := range []time.Time{occ.Start, occ.End} {
+			if t.After(now) {
+				boundaries[t.Unix()] = t
+			}
+		}
+	}
+
+	timers := make([]*time.Timer, 0, len(boundaries))
+	for _, t := range boundaries {
+		timers = append(timers, time.AfterFunc(t.Sub(now), func() {
+			if !s.IsLeader() || !s.claimFire("calendar:"+calendarID, t) {
+				return
+			}
+			for _, ruleID := range automation.CalendarDependents(context.Background(), s.redis, calendarID) {
+				if err := taskqueue.EnqueueCalendarEvaluation(ruleID, calendarID, t); err != nil {
+					log.Printf("SCHEDULER: Failed to enqueue evaluation for rule %s: %v", ruleID, err)
+				}
+			}
+		}))
+	}
+
+	s.jobMapMux.Lock()
+	stopTimers(s.calendarTimers[calendarID])
+	s.calendarTimers[calendarID] = timers
+	s.jobMapMux.Unlock()
+}
+
+// LoadCalendar reads a calendar from its URL or imported content and expands its
+// events from a day before now to the refresh horizon
+func LoadCalendar(ctx context.Context, cal models.Calendar, now time.Time) ([]calendar.Occurrence, error) {
+	data := []byte(cal.Content)
+	if cal.URL != "" {
+		var err error
+		if data, err = fetchCalendar(ctx, cal.URL); err != nil {
+			return nil, err
+		}
+	}
+
+	loc := time.Local
+	if cal.Timezone != "" {
+		var err error
+		if loc, err = time.LoadLocation(cal.Timezone); err != nil {
+			return nil, fmt.Errorf("unknown timezone %q", cal.Timezone)
+		}
+	}
+	events, err := calendar.Parse(data, loc)
+	if err != nil {
+		return nil, err
+	}
+	return calendar.Expand(events, now.Add(-calendarLookback), now.Add(calendarHorizon)), nil
+}
+
+func fetchCalendar(ctx context.Context, url string) ([]byte, error) {
+	if strings.HasPrefix(url, "webcal://") {
+		url = "https://" + strings.TrimPrefix(url, "webcal://")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := calendarHTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching calendar: %s", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxCalendarSize))
+}
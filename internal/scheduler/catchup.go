@@ -0,0 +1,129 @@
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"smarthome/internal/calendar"
+	"smarthome/internal/clock"
+	"smarthome/internal/models"
+	"smarthome/internal/taskqueue"
+)
+
+// Catch-up policies for fires missed while the engine was down
+const (
+	CatchUpSkip = "skip" // Missed fires are dropped
+	CatchUpOnce = "once" // The rule runs once if any fire was missed
+	CatchUpAll  = "all"  // The rule runs for every missed fire
+)
+
+const (
+	// DefaultCatchUpGrace is the catch-up window in seconds of new schedules
+	DefaultCatchUpGrace = 3600
+	// maxCatchUpGrace bounds the catch-up window to a week
+	maxCatchUpGrace = 7 * 24 * 3600
+	// maxCatchUpRuns caps the runs of an "all" catch-up
+	maxCatchUpRuns = 100
+	// catchUpSpacing orders the runs of an "all" catch-up
+	catchUpSpacing = time.Second
+)
+
+// validateCatchUp checks a schedule's catch-up policy and window
+func validateCatchUp(sch models.Schedule) error {
+	switch sch.CatchUp {
+	case "", CatchUpSkip, CatchUpOnce, CatchUpAll:
+	default:
+		return fmt.Errorf("unknown catch_up %q, expected skip, once or all", sch.CatchUp)
+	}
+	if sch.CatchUpGrace < 0 || sch.CatchUpGrace > maxCatchUpGrace {
+		return fmt.Errorf("catch_up_grace_seconds must be between 0 and %d", maxCatchUpGrace)
+	}
+	return nil
+}
+
+// MissedFireTimes returns the fires of a schedule after its last fire that were
+// missed before now, limited to its catch-up window. A recurring schedule that
+// never fired has nothing to catch up; an enabled one-shot has not fired yet.
+func MissedFireTimes(sch models.Schedule, occurrences []calendar.Occurrence, now time.Time) []time.Time {
+	if sch.LastFiredAt == nil && sch.RunAt == nil {
+		return nil
+	}
+	from := now.Add(-time.Duration(sch.CatchUpGrace) * time.Second)
+	if sch.LastFiredAt != nil && sch.LastFiredAt.After(from) {
+		from = *sch.LastFiredAt
+	}
+
+	times, err := NextFireTimes(sch, occurrences, from, maxCatchUpRuns+1)
+	if err != nil {
+		return nil
+	}
+	var missed []time.Time
+	for _, t := range times {
+		if t.After(now) {
+			break
+		}
+		missed = append(missed, t)
+	}
+	return missed
+}
+
+// catchUpAll catches up the missed fires of every schedule
+func (s *Scheduler) catchUpAll() {
+	schedules, err := s.db.GetAllSchedules(context.Background())
+	if err != nil {
+		log.Printf("SCHEDULER: Failed to load schedules for catch-up: %v", err)
+		return
+	}
+	now := clock.Now()
+	for _, sch := range schedules {
+		s.catchUp(sch, now)
+	}
+}
+
+// catchUp runs a schedule's rule for fires missed while the engine was down,
+// following the schedule's policy
+func (s *Scheduler) catchUp(sch models.Schedule, now time.Time) {
+	if !s.IsLeader() || !sch.Enabled || sch.CatchUp == "" || sch.CatchUp == CatchUpSkip {
+		return
+	}
+	var occurrences []calendar.Occurrence
+	if sch.CalendarID != "" {
+		occurrences = calendar.LoadOccurrences(context.Background(), s.redis, sch.CalendarID)
+	}
+	missed := MissedFireTimes(sch, occurrences, now)
+	if len(missed) == 0 {
+		return
+	}
+
+	// Runs are evaluated at the missed fire times; "once" runs for the latest
+	runs := 1
+	if sch.CatchUp == CatchUpAll {
+		runs = min(len(missed), maxCatchUpRuns)
+	}
+	log.Printf("SCHEDULER: Schedule %s missed %d fires, catching up with %d runs (policy %s)",
+		sch.ID, len(missed), runs, sch.CatchUp)
+	for i, missedAt := range missed[len(missed)-runs:] {
+		if err := taskqueue.EnqueueCatchUpEvaluation(sch.RuleID, sch.ID, missedAt, time.Duration(i)*catchUpSpacing); err != nil {
+			log.Printf("SCHEDULER: Failed to enqueue catch-up for rule %s: %v", sch.RuleID, err)
+			return
+		}
+	}
+	s.recordFired(sch, now)
+
+	// A caught up one-shot schedule is done
+	if sch.RunAt != nil {
+		if err := s.db.SetScheduleEnabled(context.Background(), sch.ID, false); err != nil {
+			log.Printf("SCHEDULER: Failed to disable one-shot schedule %s: %v", sch.ID, err)
+		}
+		s.publish(changeSchedule, sch.ID)
+	}
+}
+
+// recordFired persists the last fire time of a schedule
+func (s *Scheduler) recordFired(sch models.Schedule, at time.Time) {
+	if err := s.db.SetScheduleFired(context.Background(), sch.ID, at); err != nil {
+		log.Printf("SCHEDULER: Failed to record fire of schedule %s: %v", sch.ID, err)
+	}
+}
@@ -0,0 +1,191 @@
+package scheduler
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Engine replicas share one Redis. Each keeps every schedule armed, but only the
+// replica holding the leader lease fires them, refreshes calendars and catches up
+// missed fires. Schedule and calendar changes made through one replica are
+// published so the others stay in sync and can take over at any time.
+
+const (
+	leaderKey      = "scheduler:leader"
+	changesChannel = "scheduler:changes"
+	// fireDedupeTTL keeps a fire's dedupe key long enough to cover a leadership handover
+	fireDedupeTTL = time.Minute
+)
+
+var (
+	// renewLeaseScript extends the lease only while this replica still holds it
+	renewLeaseScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0`)
+	// releaseLeaseScript gives up the lease only while this replica still holds it
+	releaseLeaseScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`)
+)
+
+// newInstanceID identifies this replica in the leader lease and change messages
+func newInstanceID() string {
+	host, _ := os.Hostname()
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	return fmt.Sprintf("%s-%d-%s", host, os.Getpid(), hex.EncodeToString(suffix))
+}
+
+// SetLeaderLease sets how long leadership outlives a replica that stopped renewing it
+func (s *Scheduler) SetLeaderLease(lease time.Duration) {
+	if lease >= 3*time.Second {
+		s.leaderLease = lease
+	}
+}
+
+// IsLeader reports whether this replica is the active scheduler
+func (s *Scheduler) IsLeader() bool {
+	return s.leader.Load()
+}
+
+// runElection acquires or renews the leader lease a few times per lease period
+func (s *Scheduler) runElection() {
+	s.campaign()
+	ticker := time.NewTicker(s.leaderLease / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			s.campaign()
+		}
+	}
+}
+
+func (s *Scheduler) campaign() {
+	ctx := context.Background()
+	var leading bool
+	if s.IsLeader() {
+		renewed, err := renewLeaseScript.Run(ctx, s.redis, []string{leaderKey}, s.instanceID, s.leaderLease.Milliseconds()).Int()
+		leading = err == nil && renewed == 1
+		if err != nil {
+			log.Printf("SCHEDULER: Failed to renew leadership: %v", err)
+		}
+	} else {
+		acquired, err := s.redis.SetNX(ctx, leaderKey, s.instanceID, s.leaderLease).Result()
+		leading = err == nil && acquired
+	}
+
+	switch {
+	case leading && !s.IsLeader():
+		s.leader.Store(true)
+		log.Printf("SCHEDULER: Instance %s is now the active scheduler", s.instanceID)
+		s.onElected()
+	case !leading && s.IsLeader():
+		s.leader.Store(false)
+		log.Printf("SCHEDULER: Instance %s lost scheduler leadership", s.instanceID)
+	}
+}
+
+// onElected reloads all schedules from the database, since fires and changes may
+// have happened while another replica led, then catches up missed fires and
+// refreshes due calendars
+func (s *Scheduler) onElected() {
+	if err := s.ReloadSchedules(); err != nil {
+		log.Printf("SCHEDULER: Failed to reload schedules after election: %v", err)
+	}
+	s.catchUpAll()
+	s.checkCalendars(true)
+}
+
+// resign gives up leadership on shutdown so another replica takes over at once
+func (s *Scheduler) resign() {
+	if !s.IsLeader() {
+		return
+	}
+	s.leader.Store(false)
+	releaseLeaseScript.Run(context.Background(), s.redis, []string{leaderKey}, s.instanceID)
+	log.Printf("SCHEDULER: Instance %s resigned scheduler leadership", s.instanceID)
+}
+
+// claimFire makes sure a fire at a given second is enqueued once even if two
+// replicas briefly both believe they lead
+func (s *Scheduler) claimFire(name string, at time.Time) bool {
+	key := fmt.Sprintf("scheduler:fired:%s:%d", name, at.Round(time.Second).Unix())
+	claimed, err := s.redis.SetNX(context.Background(), key, s.instanceID, fireDedupeTTL).Result()
+	if err != nil {
+		log.Printf("SCHEDULER: Failed to claim fire of %s: %v", name, err)
+		return true // Firing twice beats not firing when Redis hiccups
+	}
+	return claimed
+}
+
+// Change messages are "<instance>|<kind>|<id>"
+const (
+	changeSchedule        = "schedule"
+	changeScheduleRemoved = "schedule_removed"
+	changeCalendar        = "calendar"
+	changeCalendarRemoved = "calendar_removed"
+)
+
+// publish tells the other replicas that a schedule or calendar changed
+func (s *Scheduler) publish(kind, id string) {
+	message := strings.Join([]string{s.instanceID, kind, id}, "|")
+	if err := s.redis.Publish(context.Background(), changesChannel, message).Err(); err != nil {
+		log.Printf("SCHEDULER: Failed to publish %s change of %s: %v", kind, id, err)
+	}
+}
+
+// runChanges applies schedule and calendar changes published by other replicas
+func (s *Scheduler) runChanges() {
+	pubsub := s.redis.Subscribe(context.Background(), changesChannel)
+	defer pubsub.Close()
+	messages := pubsub.Channel()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case msg, ok := <-messages:
+			if !ok {
+				return
+			}
+			parts := strings.SplitN(msg.Payload, "|", 3)
+			if len(parts) != 3 || parts[0] == s.instanceID {
+				continue
+			}
+			s.applyChange(parts[1], parts[2])
+		}
+	}
+}
+
+func (s *Scheduler) applyChange(kind, id string) {
+	ctx := context.Background()
+	switch kind {
+	case changeSchedule:
+		sch, err := s.db.GetScheduleByID(ctx, id)
+		if err != nil {
+			s.removeSchedule(id)
+			return
+		}
+		s.addOrUpdateSchedule(*sch)
+	case changeScheduleRemoved:
+		s.removeSchedule(id)
+	case changeCalendar:
+		s.armCalendar(id)
+	case changeCalendarRemoved:
+		s.removeCalendar(id)
+	}
+}
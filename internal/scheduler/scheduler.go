@@ -3,40 +3,78 @@ package scheduler
 import (
 	"context"
 	"log"
+	"smarthome/internal/calendar"
+	"smarthome/internal/clock"
 	"smarthome/internal/db"
+	"smarthome/internal/models"
 	"smarthome/internal/taskqueue"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/redis/go-redis/v9"
 	"github.com/robfig/cron/v3"
 )
 
-// Scheduler manages time-based triggers
+// Scheduler manages time-based triggers. Cron schedules run as cron jobs; one-shot
+// and calendar schedules, and calendar event boundaries, run on timers. Only the
+// elected leader among engine replicas fires them.
 type Scheduler struct {
-	cron      *cron.Cron
-	db        *db.DB
-	jobMap    map[string]cron.EntryID // Maps schedule ID to cron entry ID
-	jobMapMux sync.RWMutex            // Protects jobMap
+	cron           *cron.Cron
+	db             *db.DB
+	redis          *redis.Client
+	jobMap         map[string]cron.EntryID    // Maps schedule ID to cron entry ID
+	timers         map[string][]*time.Timer   // Timers of one-shot and calendar schedules by schedule ID
+	schedules      map[string]models.Schedule // Enabled schedules by ID
+	calendarTimers map[string][]*time.Timer   // Event start and end timers by calendar ID
+	jobMapMux      sync.RWMutex               // Protects jobMap, timers, schedules and calendarTimers
+	stop           chan struct{}
+
+	instanceID  string
+	leaderLease time.Duration
+	leader      atomic.Bool
 }
 
 // NewScheduler creates a scheduler
-func NewScheduler(dbConn *db.DB) *Scheduler {
+func NewScheduler(dbConn *db.DB, redisClient *redis.Client) *Scheduler {
 	return &Scheduler{
-		cron:   cron.New(),
-		db:     dbConn,
-		jobMap: make(map[string]cron.EntryID),
+		cron:           cron.New(cron.WithParser(cronParser), cron.WithLocation(clock.Location())),
+		db:             dbConn,
+		redis:          redisClient,
+		jobMap:         make(map[string]cron.EntryID),
+		timers:         make(map[string][]*time.Timer),
+		schedules:      make(map[string]models.Schedule),
+		calendarTimers: make(map[string][]*time.Timer),
+		stop:           make(chan struct{}),
+		instanceID:     newInstanceID(),
+		leaderLease:    15 * time.Second,
 	}
 }
 
 // Start starts the scheduler
 func (s *Scheduler) Start() {
 	s.cron.Start()
-	log.Println("SCHEDULER: Cron scheduler started")
+	go s.runElection()
+	go s.runChanges()
+	go s.runCalendars()
+	log.Printf("SCHEDULER: Cron scheduler started (instance %s)", s.instanceID)
 }
 
 // Stop stops the scheduler
 func (s *Scheduler) Stop() {
+	close(s.stop)
+	s.resign()
 	ctx := s.cron.Stop()
 	<-ctx.Done()
+
+	s.jobMapMux.Lock()
+	for _, timers := range s.timers {
+		stopTimers(timers)
+	}
+	for _, timers := range s.calendarTimers {
+		stopTimers(timers)
+	}
+	s.jobMapMux.Unlock()
 	log.Println("SCHEDULER: Cron scheduler stopped")
 }
 
@@ -57,33 +95,11 @@ func (s *Scheduler) LoadSchedules() error {
 	log.Printf("SCHEDULER: Loading %d schedules from database", len(schedules))
 
 	for _, sch := range schedules {
-		if sch.Enabled {
-			ruleID := sch.RuleID // Capture the variable to avoid closure issue
-			scheduleID := sch.ID
-
-			entryID, err := s.AddJob(sch.CronExpression, func() {
-				log.Printf("SCHEDULER: Cron job triggered for rule %s (schedule %s)", ruleID, scheduleID)
-				if err := taskqueue.EnqueueEvaluation(ruleID, ""); err != nil {
-					log.Printf("SCHEDULER: Failed to enqueue evaluation for rule %s: %v", ruleID, err)
-				}
-			})
-
-			if err != nil {
-				log.Printf("SCHEDULER: Failed to schedule rule %s with cron '%s': %v", ruleID, sch.CronExpression, err)
-				continue
-			}
-
-			s.jobMapMux.Lock()
-			s.jobMap[scheduleID] = entryID
-			s.jobMapMux.Unlock()
-
-			log.Printf("SCHEDULER: Scheduled rule %s with cron '%s' (entry ID: %d)", ruleID, sch.CronExpression, entryID)
-		} else {
-			log.Printf("SCHEDULER: Skipping disabled schedule %s for rule %s", sch.ID, sch.RuleID)
-		}
+		// Failures are logged; the remaining schedules still load
+		s.addOrUpdateSchedule(sch)
 	}
 
-	log.Printf("SCHEDULER: Successfully loaded %d enabled schedules", len(s.jobMap))
+	log.Printf("SCHEDULER: Successfully loaded %d enabled schedules", s.GetScheduledJobCount())
 	return nil
 }
 
@@ -98,15 +114,33 @@ func (s *Scheduler) ReloadSchedules() error {
 		s.cron.Remove(entryID)
 		log.Printf("SCHEDULER: Removed schedule %s (entry ID: %d)", schedID, entryID)
 	}
+	for _, timers := range s.timers {
+		stopTimers(timers)
+	}
 	s.jobMap = make(map[string]cron.EntryID)
+	s.timers = make(map[string][]*time.Timer)
+	s.schedules = make(map[string]models.Schedule)
 	s.jobMapMux.Unlock()
 
 	// Reload schedules from database
 	return s.LoadSchedules()
 }
 
-// RemoveSchedule removes a specific schedule by its ID
+// RemoveSchedule removes a specific schedule by its ID on every replica
 func (s *Scheduler) RemoveSchedule(scheduleID string) {
+	s.removeSchedule(scheduleID)
+	s.publish(changeScheduleRemoved, scheduleID)
+}
+
+// AddOrUpdateSchedule adds or updates a single schedule on every replica. The
+// schedule must be saved first; other replicas reload it from the database.
+func (s *Scheduler) AddOrUpdateSchedule(sch models.Schedule) error {
+	err := s.addOrUpdateSchedule(sch)
+	s.publish(changeSchedule, sch.ID)
+	return err
+}
+
+func (s *Scheduler) removeSchedule(scheduleID string) {
 	s.jobMapMux.Lock()
 	defer s.jobMapMux.Unlock()
 
@@ -115,24 +149,49 @@ func (s *Scheduler) RemoveSchedule(scheduleID string) {
 		delete(s.jobMap, scheduleID)
 		log.Printf("SCHEDULER: Removed schedule %s (entry ID: %d)", scheduleID, entryID)
 	}
+	if timers, exists := s.timers[scheduleID]; exists {
+		stopTimers(timers)
+		delete(s.timers, scheduleID)
+		log.Printf("SCHEDULER: Removed schedule %s (%d timers)", scheduleID, len(timers))
+	}
+	delete(s.schedules, scheduleID)
 }
 
-// AddOrUpdateSchedule adds or updates a single schedule
-func (s *Scheduler) AddOrUpdateSchedule(scheduleID, ruleID, cronExpression string, enabled bool) error {
+func (s *Scheduler) addOrUpdateSchedule(sch models.Schedule) error {
+	scheduleID, ruleID := sch.ID, sch.RuleID
+
 	// Remove existing schedule if it exists
-	s.RemoveSchedule(scheduleID)
+	s.removeSchedule(scheduleID)
 
-	if !enabled {
+	if !sch.Enabled {
 		log.Printf("SCHEDULER: Schedule %s is disabled, not adding", scheduleID)
 		return nil
 	}
+	if err := ValidateSchedule(sch); err != nil {
+		log.Printf("SCHEDULER: Failed to add/update schedule %s: %v", scheduleID, err)
+		return err
+	}
+
+	switch {
+	case sch.RunAt != nil:
+		s.armOnce(sch)
+		return nil
+	case sch.CalendarID != "":
+		s.armCalendarSchedule(sch, calendar.LoadOccurrences(context.Background(), s.redis, sch.CalendarID))
+		return nil
+	}
+
+	cronExpression, err := scheduleSpec(sch.CronExpression, sch.Timezone)
+	if err != nil {
+		log.Printf("SCHEDULER: Failed to add/update schedule %s: %v", scheduleID, err)
+		return err
+	}
 
 	// Add new schedule
 	entryID, err := s.AddJob(cronExpression, func() {
 		log.Printf("SCHEDULER: Cron job triggered for rule %s (schedule %s)", ruleID, scheduleID)
-		if err := taskqueue.EnqueueEvaluation(ruleID, ""); err != nil {
-			log.Printf("SCHEDULER: Failed to enqueue evaluation for rule %s: %v", ruleID, err)
-		}
+		// Cron runs a job on the second it is due, a moment after that second started
+		s.fire(sch, clock.Now().Truncate(time.Second))
 	})
 
 	if err != nil {
@@ -142,15 +201,108 @@ func (s *Scheduler) AddOrUpdateSchedule(scheduleID, ruleID, cronExpression strin
 
 	s.jobMapMux.Lock()
 	s.jobMap[scheduleID] = entryID
+	s.schedules[scheduleID] = sch
 	s.jobMapMux.Unlock()
 
 	log.Printf("SCHEDULER: Added/updated schedule %s for rule %s with cron '%s' (entry ID: %d)", scheduleID, ruleID, cronExpression, entryID)
 	return nil
 }
 
+// fire evaluates a schedule's rule for its fire time at, unless that day is one of
+// its exclusion dates. Replicas that are not the leader do nothing.
+func (s *Scheduler) fire(sch models.Schedule, at time.Time) {
+	if !s.IsLeader() {
+		return
+	}
+	if excluded(sch, at) {
+		log.Printf("SCHEDULER: Schedule %s skipped, today is excluded", sch.ID)
+		return
+	}
+	if !s.claimFire("schedule:"+sch.ID, at) {
+		log.Printf("SCHEDULER: Schedule %s already fired by another instance", sch.ID)
+		return
+	}
+	if err := taskqueue.EnqueueScheduledEvaluation(sch.RuleID, sch.ID, at); err != nil {
+		log.Printf("SCHEDULER: Failed to enqueue evaluation for rule %s: %v", sch.RuleID, err)
+		return
+	}
+	s.recordFired(sch, at)
+}
+
+// armOnce starts the timer of a one-shot schedule, which is disabled after it fired
+func (s *Scheduler) armOnce(sch models.Schedule) {
+	delay := sch.RunAt.Sub(clock.Now())
+	if delay < 0 {
+		log.Printf("SCHEDULER: One-shot schedule %s was due at %s, not adding", sch.ID, sch.RunAt.Format(time.RFC3339))
+		return
+	}
+
+	timer := time.AfterFunc(delay, func() {
+		log.Printf("SCHEDULER: One-shot schedule %s triggered for rule %s", sch.ID, sch.RuleID)
+		s.fire(sch, *sch.RunAt)
+		s.removeSchedule(sch.ID)
+		if s.IsLeader() {
+			if err := s.db.SetScheduleEnabled(context.Background(), sch.ID, false); err != nil {
+				log.Printf("SCHEDULER: Failed to disable one-shot schedule %s: %v", sch.ID, err)
+			}
+			s.publish(changeSchedule, sch.ID)
+		}
+	})
+
+	s.jobMapMux.Lock()
+	s.timers[sch.ID] = []*time.Timer{timer}
+	s.schedules[sch.ID] = sch
+	s.jobMapMux.Unlock()
+	log.Printf("SCHEDULER: Added/updated one-shot schedule %s for rule %s at %s", sch.ID, sch.RuleID, sch.RunAt.Format(time.RFC3339))
+}
+
+// armCalendarSchedule starts a timer at the start of each upcoming matching event
+func (s *Scheduler) armCalendarSchedule(sch models.Schedule, occurrences []calendar.Occurrence) {
+	now := clock.Now()
+	var timers []*time.Timer
+	for _, occ := range occurrences {
+		if !occ.Start.After(now) || !occ.Matches(sch.CalendarFilter) {
+			continue
+		}
+		summary, start := occ.Summary, occ.Start
+		timers = append(timers, time.AfterFunc(start.Sub(now), func() {
+			log.Printf("SCHEDULER: Calendar event %q triggered rule %s (schedule %s)", summary, sch.RuleID, sch.ID)
+			s.fire(sch, start)
+		}))
+	}
+
+	s.jobMapMux.Lock()
+	if old, exists := s.timers[sch.ID]; exists {
+		stopTimers(old)
+	}
+	s.timers[sch.ID] = timers
+	s.schedules[sch.ID] = sch
+	s.jobMapMux.Unlock()
+	log.Printf("SCHEDULER: Added/updated calendar schedule %s for rule %s with %d upcoming events", sch.ID, sch.RuleID, len(timers))
+}
+
+// NextFireTimes returns the next n times a schedule fires
+func (s *Scheduler) NextFireTimes(sch models.Schedule, n int) []time.Time {
+	var occurrences []calendar.Occurrence
+	if sch.CalendarID != "" {
+		occurrences = calendar.LoadOccurrences(context.Background(), s.redis, sch.CalendarID)
+	}
+	times, err := NextFireTimes(sch, occurrences, clock.Now(), n)
+	if err != nil {
+		return []time.Time{}
+	}
+	return times
+}
+
 // GetScheduledJobCount returns the number of currently scheduled jobs
 func (s *Scheduler) GetScheduledJobCount() int {
 	s.jobMapMux.RLock()
 	defer s.jobMapMux.RUnlock()
-	return len(s.jobMap)
+	return len(s.schedules)
+}
+
+func stopTimers(timers []*time.Timer) {
+	for _, timer := range timers {
+		timer.Stop()
+	}
 }
@@ -0,0 +1,135 @@
+package scheduler
+
+import (
+	"fmt"
+	"time"
+
+	"smarthome/internal/calendar"
+	"smarthome/internal/models"
+
+	"github.com/robfig/cron/v3"
+)
+
+// cronParser accepts standard 5-field expressions, an optional leading seconds
+// field, weekday names (MON-FRI) and descriptors such as @daily
+var cronParser = cron.NewParser(cron.SecondOptional | cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor)
+
+// excludeDateLayout is the format of a schedule's exclusion dates
+const excludeDateLayout = "2006-01-02"
+
+// scheduleSpec builds the cron spec of an expression read in timezone
+func scheduleSpec(expression, timezone string) (string, error) {
+	if timezone == "" {
+		return expression, nil
+	}
+	if _, err := time.LoadLocation(timezone); err != nil {
+		return "", fmt.Errorf("unknown timezone %q", timezone)
+	}
+	return fmt.Sprintf("CRON_TZ=%s %s", timezone, expression), nil
+}
+
+// ParseSchedule validates a cron expression and timezone
+func ParseSchedule(expression, timezone string) (cron.Schedule, error) {
+	spec, err := scheduleSpec(expression, timezone)
+	if err != nil {
+		return nil, err
+	}
+	return cronParser.Parse(spec)
+}
+
+// ValidateSchedule checks that a schedule has exactly one of a cron expression,
+// a run_at time or a calendar, and that its timezone, catch-up policy and
+// exclusion dates are valid
+func ValidateSchedule(sch models.Schedule) error {
+	kinds := 0
+	for _, set := range []bool{sch.CronExpression != "", sch.RunAt != nil, sch.CalendarID != ""} {
+		if set {
+			kinds++
+		}
+	}
+	if kinds != 1 {
+		return fmt.Errorf("exactly one of cron_expression, run_at or calendar_id is required")
+	}
+	if sch.CronExpression != "" {
+		if _, err := ParseSchedule(sch.CronExpression, sch.Timezone); err != nil {
+			return err
+		}
+	} else if sch.Timezone != "" {
+		if _, err := time.LoadLocation(sch.Timezone); err != nil {
+			return fmt.Errorf("unknown timezone %q", sch.Timezone)
+		}
+	}
+	if err := validateCatchUp(sch); err != nil {
+		return err
+	}
+	if sch.CalendarID == "" && sch.CalendarFilter != "" {
+		return fmt.Errorf("calendar_filter requires calendar_id")
+	}
+	for _, date := range sch.ExcludeDates {
+		if _, err := time.Parse(excludeDateLayout, date); err != nil {
+			return fmt.Errorf("invalid exclude date %q, expected YYYY-MM-DD", date)
+		}
+	}
+	return nil
+}
+
+// scheduleLocation is the zone a schedule's exclusion dates are read in
+func scheduleLocation(sch models.Schedule) *time.Location {
+	if sch.Timezone != "" {
+		if loc, err := time.LoadLocation(sch.Timezone); err == nil {
+			return loc
+		}
+	}
+	return time.Local
+}
+
+// excluded reports whether t falls on one of the schedule's exclusion dates
+func excluded(sch models.Schedule, t time.Time) bool {
+	if len(sch.ExcludeDates) == 0 {
+		return false
+	}
+	day := t.In(scheduleLocation(sch)).Format(excludeDateLayout)
+	for _, date := range sch.ExcludeDates {
+		if date == day {
+			return true
+		}
+	}
+	return false
+}
+
+// NextFireTimes returns the next n times a schedule fires after from, skipping
+// excluded dates. Calendar schedules fire at the start of matching occurrences.
+func NextFireTimes(sch models.Schedule, occurrences []calendar.Occurrence, from time.Time, n int) ([]time.Time, error) {
+	times := make([]time.Time, 0, n)
+	switch {
+	case sch.RunAt != nil:
+		if sch.RunAt.After(from) && !excluded(sch, *sch.RunAt) {
+			times = append(times, *sch.RunAt)
+		}
+	case sch.CalendarID != "":
+		for _, occ := range occurrences {
+			if len(times) == n {
+				break
+			}
+			if occ.Start.After(from) && occ.Matches(sch.CalendarFilter) && !excluded(sch, occ.Start) {
+				times = append(times, occ.Start)
+			}
+		}
+	default:
+		schedule, err := ParseSchedule(sch.CronExpression, sch.Timezone)
+		if err != nil {
+			return nil, err
+		}
+		// Exclusion dates are finite, the bound only guards against skipping forever
+		for next, tries := from, 0; len(times) < n && tries < n+10000; tries++ {
+			next = schedule.Next(next)
+			if next.IsZero() {
+				break
+			}
+			if !excluded(sch, next) {
+				times = append(times, next)
+			}
+		}
+	}
+	return times, nil
+}
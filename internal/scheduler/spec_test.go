@@ -0,0 +1,170 @@
+package scheduler
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"smarthome/internal/calendar"
+	"smarthome/internal/models"
+)
+
+func TestParseSchedule(t *testing.T) {
+	// Expressions depending on the hour are read in UTC so the expected times
+	// do not depend on the zone of the machine running the tests
+	from := time.Date(2026, 3, 2, 8, 0, 0, 0, time.UTC) // A Monday
+	tests := []struct {
+		expression string
+		timezone   string
+		want       string // Next fire time after from, in UTC
+		wantErr    string
+	}{
+		// Five fields fire on the minute
+		{"30 8 * * *", "UTC", "2026-03-02 08:30:00", ""},
+		{"*/15 * * * *", "", "2026-03-02 08:15:00", ""},
+		{"0 9 * * MON-FRI", "UTC", "2026-03-02 09:00:00", ""},
+		{"0 9 * * SAT", "UTC", "2026-03-07 09:00:00", ""},
+
+		// A sixth, leading field is seconds
+		{"30 * * * * *", "", "2026-03-02 08:00:30", ""},
+		{"*/10 * * * * *", "", "2026-03-02 08:00:10", ""},
+		{"15 30 8 * * *", "UTC", "2026-03-02 08:30:15", ""},
+		{"0 0 9 * * MON-FRI", "UTC", "2026-03-02 09:00:00", ""},
+
+		// Descriptors
+		{"@daily", "UTC", "2026-03-03 00:00:00", ""},
+		{"@every 90s", "", "2026-03-02 08:01:30", ""},
+
+		// The expression is read in the schedule's timezone
+		{"0 9 * * *", "Europe/Berlin", "2026-03-03 08:00:00", ""},
+		{"0 0 9 * * *", "America/New_York", "2026-03-02 14:00:00", ""},
+
+		{"0 9 * *", "", "", "expected 5 to 6 fields"},
+		{"0 0 0 9 * * *", "", "", "expected 5 to 6 fields"},
+		{"60 * * * * *", "", "", "end of range (60) above maximum (59)"},
+		{"0 25 * * *", "", "", "end of range (25) above maximum (23)"},
+		{"0 9 * * FUNDAY", "", "", "failed to parse"},
+		{"0 9 * * *", "Mars/Olympus", "", "unknown timezone"},
+	}
+
+	for _, tt := range tests {
+		schedule, err := ParseSchedule(tt.expression, tt.timezone)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("ParseSchedule(%q, %q) = %v, want an error containing %q", tt.expression, tt.timezone, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseSchedule(%q, %q): %v", tt.expression, tt.timezone, err)
+			continue
+		}
+		if got := schedule.Next(from).UTC().Format("2006-01-02 15:04:05"); got != tt.want {
+			t.Errorf("ParseSchedule(%q, %q).Next() = %s, want %s", tt.expression, tt.timezone, got, tt.want)
+		}
+	}
+}
+
+func TestValidateSchedule(t *testing.T) {
+	runAt := time.Date(2026, 3, 2, 8, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		sch     models.Schedule
+		wantErr string
+	}{
+		{"cron with seconds", models.Schedule{CronExpression: "*/30 * * * * *"}, ""},
+		{"run at", models.Schedule{RunAt: &runAt, Timezone: "Europe/Berlin"}, ""},
+		{"calendar", models.Schedule{CalendarID: "1", CalendarFilter: "away"}, ""},
+		{"exclusion dates and catch up", models.Schedule{CronExpression: "0 9 * * *", ExcludeDates: []string{"2026-12-24"}, CatchUp: CatchUpOnce, CatchUpGrace: 600}, ""},
+
+		{"nothing to fire on", models.Schedule{}, "exactly one of"},
+		{"cron and run at", models.Schedule{CronExpression: "0 9 * * *", RunAt: &runAt}, "exactly one of"},
+		{"invalid cron", models.Schedule{CronExpression: "every day"}, "expected 5 to 6 fields"},
+		{"invalid timezone", models.Schedule{RunAt: &runAt, Timezone: "Nowhere"}, "unknown timezone"},
+		{"filter without calendar", models.Schedule{CronExpression: "0 9 * * *", CalendarFilter: "away"}, "calendar_filter requires calendar_id"},
+		{"invalid exclusion date", models.Schedule{CronExpression: "0 9 * * *", ExcludeDates: []string{"24.12.2026"}}, "invalid exclude date"},
+		{"unknown catch up", models.Schedule{CronExpression: "0 9 * * *", CatchUp: "later"}, "unknown catch_up"},
+		{"negative grace", models.Schedule{CronExpression: "0 9 * * *", CatchUpGrace: -1}, "catch_up_grace_seconds"},
+	}
+
+	for _, tt := range tests {
+		err := ValidateSchedule(tt.sch)
+		if tt.wantErr == "" {
+			if err != nil {
+				t.Errorf("%s: ValidateSchedule(): %v", tt.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: ValidateSchedule() = %v, want an error containing %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestNextFireTimes(t *testing.T) {
+	from := time.Date(2026, 12, 23, 12, 0, 0, 0, time.UTC)
+	runAt := from.Add(time.Hour)
+	past := from.Add(-time.Hour)
+	occurrences := []calendar.Occurrence{
+		{Summary: "Office", Start: from.Add(-time.Hour)},
+		{Summary: "Trip", Categories: []string{"Away"}, Start: from.Add(2 * time.Hour)},
+		{Summary: "Office", Start: from.Add(3 * time.Hour)},
+		{Summary: "Away weekend", Start: from.Add(48 * time.Hour)},
+	}
+
+	tests := []struct {
+		name string
+		sch  models.Schedule
+		n    int
+		want []time.Time
+	}{
+		{
+			name: "seconds field",
+			sch:  models.Schedule{CronExpression: "*/20 * * * * *"},
+			n:    3,
+			want: []time.Time{from.Add(20 * time.Second), from.Add(40 * time.Second), from.Add(time.Minute)},
+		},
+		{
+			name: "excluded dates are skipped",
+			sch:  models.Schedule{CronExpression: "0 0 18 * * *", Timezone: "UTC", ExcludeDates: []string{"2026-12-24"}},
+			n:    2,
+			want: []time.Time{from.Add(6 * time.Hour), from.Add(54 * time.Hour)},
+		},
+		{
+			name: "one shot in the future",
+			sch:  models.Schedule{RunAt: &runAt},
+			n:    3,
+			want: []time.Time{runAt},
+		},
+		{
+			name: "one shot in the past",
+			sch:  models.Schedule{RunAt: &past},
+			n:    3,
+			want: []time.Time{},
+		},
+		{
+			name: "calendar events matching the filter",
+			sch:  models.Schedule{CalendarID: "1", CalendarFilter: "away"},
+			n:    5,
+			want: []time.Time{from.Add(2 * time.Hour), from.Add(48 * time.Hour)},
+		},
+		{
+			name: "calendar events up to n",
+			sch:  models.Schedule{CalendarID: "1"},
+			n:    1,
+			want: []time.Time{from.Add(2 * time.Hour)},
+		},
+	}
+
+	for _, tt := range tests {
+		got, err := NextFireTimes(tt.sch, occurrences, from, tt.n)
+		if err != nil {
+			t.Errorf("%s: NextFireTimes(): %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: NextFireTimes() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package taskqueue
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"smarthome/internal/utils"
+
+	"github.com/hibiken/asynq"
+)
+
+var (
+	// sensorHandler lets the alarm watch device updates for tripped sensors
+	sensorHandler func(deviceID string, state utils.DeviceState)
+	// alarmTimerHandler ends an alarm's entry, exit or trigger time
+	alarmTimerHandler func(panelID string, changedAt time.Time) error
+)
+
+// SetAlarmHandlers registers the callbacks run for every device update and when an alarm timer expires
+func SetAlarmHandlers(onSensor func(deviceID string, state utils.DeviceState), onTimer func(panelID string, changedAt time.Time) error) {
+	sensorHandler = onSensor
+	alarmTimerHandler = onTimer
+}
+
+type AlarmTimerTaskPayload struct {
+	PanelID   string
+	ChangedAt time.Time // State change the timer belongs to; a panel that changed state since ignores it
+}
+
+// EnqueueAlarmTimer ends the current state of an alarm panel after delay
+func EnqueueAlarmTimer(panelID string, changedAt time.Time, delay time.Duration) error {
+	payload, _ := json.Marshal(AlarmTimerTaskPayload{PanelID: panelID, ChangedAt: changedAt})
+	task := asynq.NewTask("alarm_timer", payload)
+	_, err := asynqClient.Enqueue(task, asynq.MaxRetry(3), asynq.Timeout(10*time.Second), asynq.ProcessIn(delay))
+	if err != nil {
+		log.Printf("TASKQUEUE: Failed to enqueue alarm timer for panel %s: %v", panelID, err)
+	}
+	return err
+}
+
+// EnqueueAlarmEvaluation evaluates a rule when the alarm of its household changes state
+func EnqueueAlarmEvaluation(ruleID, panelID string) error {
+	return enqueueEvaluation(EvaluationTaskPayload{RuleID: ruleID, TriggeredBy: "alarm:" + panelID})
+}
+
+func processAlarmTimerTask(ctx context.Context, t *asynq.Task) error {
+	var payload AlarmTimerTaskPayload
+	if err := json.Unmarshal(t.Payload(), &payload); err != nil {
+		return err
+	}
+	if alarmTimerHandler == nil {
+		return nil
+	}
+	return alarmTimerHandler(payload.PanelID, payload.ChangedAt)
+}
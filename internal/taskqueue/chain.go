@@ -0,0 +1,68 @@
+package taskqueue
+
+import (
+	"context"
+	"log"
+
+	"smarthome/internal/audit"
+	"smarthome/internal/automation"
+	"smarthome/internal/models"
+)
+
+// executeChainActions applies a rule's trigger_rule, enable_rule and disable_rule actions.
+// Only rules of the same owner can be targeted; triggered rules run one level deeper.
+func executeChainActions(ctx context.Context, rule *models.Rule, tctx automation.TemplateContext, depth int) {
+	for _, action := range automation.ChainActions(rule.Actions, tctx) {
+		target, err := dbConn.GetRuleByID(ctx, action.RuleID)
+		if err != nil || target.OwnerID != rule.OwnerID {
+			log.Printf("TASKQUEUE: Rule %s targets unknown rule %s", rule.ID, action.RuleID)
+			continue
+		}
+
+		switch action.Action {
+		case automation.ActionTriggerRule:
+			if target.ID == rule.ID {
+				log.Printf("TASKQUEUE: Rule %s cannot trigger itself", rule.ID)
+				continue
+			}
+			log.Printf("TASKQUEUE: Rule %s triggers rule %s", rule.ID, target.ID)
+			enqueueEvaluation(EvaluationTaskPayload{
+				RuleID:         target.ID,
+				Depth:          depth + 1,
+				SkipConditions: action.SkipConditions,
+				TriggeredBy:    "rule:" + rule.ID,
+			})
+
+		case automation.ActionEnableRule, automation.ActionDisableRule:
+			enabled := action.Action == automation.ActionEnableRule
+			if target.Enabled == enabled {
+				continue
+			}
+			if err := dbConn.SetRuleEnabled(ctx, target.ID, enabled); err != nil {
+				log.Printf("TASKQUEUE: Rule %s failed to update rule %s: %v", rule.ID, target.ID, err)
+				continue
+			}
+			log.Printf("TASKQUEUE: Rule %s set rule %s enabled=%t", rule.ID, target.ID, enabled)
+
+			auditLog.Record(ctx, audit.Entry{
+				Actor:   "rule:" + rule.ID,
+				Action:  audit.ActionRuleUpdate,
+				Source:  audit.SourceEngine,
+				RuleID:  target.ID,
+				Details: audit.Marshal(map[string]interface{}{"changed": []string{"enabled"}, "by_rule": rule.ID}),
+				Before:  audit.Marshal(map[string]interface{}{"enabled": target.Enabled}),
+				After:   audit.Marshal(map[string]interface{}{"enabled": enabled}),
+			})
+
+			if ruleChangeHandler != nil {
+				if err := ruleChangeHandler(target.ID); err != nil {
+					log.Printf("TASKQUEUE: Failed to refresh rule %s: %v", target.ID, err)
+				}
+			}
+			// A freshly enabled rule is evaluated right away, like one enabled through the API
+			if enabled && target.ID != rule.ID {
+				enqueueEvaluation(EvaluationTaskPayload{RuleID: target.ID, Depth: depth + 1, TriggeredBy: "rule:" + rule.ID})
+			}
+		}
+	}
+}
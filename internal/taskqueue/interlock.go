@@ -0,0 +1,48 @@
+package taskqueue
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"smarthome/internal/audit"
+	"smarthome/internal/automation"
+
+	"github.com/hibiken/asynq"
+)
+
+type InterlockTimerTaskPayload struct {
+	InterlockID string
+	DeviceID    string
+	Since       time.Time // When the device was turned on; a device turned off since ignores the timer
+}
+
+// EnqueueInterlockTimer checks a device's max runtime after delay
+func EnqueueInterlockTimer(interlockID, deviceID string, since time.Time, delay time.Duration) error {
+	payload, _ := json.Marshal(InterlockTimerTaskPayload{InterlockID: interlockID, DeviceID: deviceID, Since: since})
+	task := asynq.NewTask("interlock_timer", payload)
+	_, err := asynqClient.Enqueue(task, asynq.MaxRetry(3), asynq.Timeout(10*time.Second), asynq.ProcessIn(delay))
+	if err != nil {
+		log.Printf("TASKQUEUE: Failed to enqueue interlock timer for device %s: %v", deviceID, err)
+	}
+	return err
+}
+
+func processInterlockTimerTask(ctx context.Context, t *asynq.Task) error {
+	var payload InterlockTimerTaskPayload
+	if err := json.Unmarshal(t.Payload(), &payload); err != nil {
+		return err
+	}
+	params, turnedOff := automation.EnforceMaxRuntime(ctx, redisClient, mqttClient, payload.InterlockID, payload.DeviceID, payload.Since)
+	if turnedOff {
+		auditLog.Record(ctx, audit.Entry{
+			Actor:    "interlock:" + payload.InterlockID,
+			Action:   audit.ActionInterlockOff,
+			Source:   audit.SourceEngine,
+			DeviceID: payload.DeviceID,
+			Details:  audit.Marshal(map[string]interface{}{"params": params, "on_since": payload.Since}),
+		})
+	}
+	return nil
+}
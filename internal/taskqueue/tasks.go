@@ -7,6 +7,7 @@ import (
 	"log"
 	"time"
 
+	"smarthome/internal/audit"
 	"smarthome/internal/automation"
 	"smarthome/internal/db"
 	"smarthome/internal/utils"
@@ -20,12 +21,31 @@ var (
 	dbConn      *db.DB
 	redisClient *redis.Client
 	mqttClient  mqtt.Client
+	auditLog    *audit.Logger
+
+	// maxChainDepth stops rules triggering each other in a loop
+	maxChainDepth = 8
+	// queuedRunDelay is how long a queued rule waits before retrying while its previous run executes
+	queuedRunDelay = time.Second
+	// ruleChangeHandler lets the engine re-index a rule enabled or disabled by another rule
+	ruleChangeHandler func(ruleID string) error
 )
 
 func SetGlobalInstances(database *db.DB, redis *redis.Client, mqtt mqtt.Client) {
 	dbConn = database
 	redisClient = redis
 	mqttClient = mqtt
+	auditLog = audit.NewLogger(database.Pool())
+}
+
+// SetMaxChainDepth sets how deep rules may trigger other rules
+func SetMaxChainDepth(depth int) {
+	maxChainDepth = depth
+}
+
+// SetRuleChangeHandler registers the callback run after a rule action enabled or disabled a rule
+func SetRuleChangeHandler(handler func(ruleID string) error) {
+	ruleChangeHandler = handler
 }
 
 type DeviceUpdateTaskPayload struct {
@@ -36,12 +56,17 @@ type DeviceUpdateTaskPayload struct {
 type EvaluationTaskPayload struct {
 	RuleID          string
 	UpdatedDeviceID string
+	Depth           int       // Number of rules that triggered each other before this evaluation
+	SkipConditions  bool      // Execute the actions without evaluating the conditions
+	TriggeredBy     string    // "rule:<id>", "schedule:<id>", "catch_up:<id>", "calendar:<id>", "presence:<person id>", "alarm:<panel id>" or "api" for chained, scheduled, caught up, calendar, presence, alarm and manual runs
+	FiredAt         time.Time // Fire time of the triggering schedule or calendar event; time conditions are evaluated at it
+	Queued          bool      // Counted in the rule's queue while waiting behind its running run
 }
 
 type PendingAction struct {
-	RuleID   string
-	DeviceID string
-	Params   map[string]interface{}
+	RuleID   string                 `json:"rule_id"`
+	DeviceID string                 `json:"device_id"`
+	Params   map[string]interface{} `json:"params"`
 }
 
 type ActionTarget struct {
@@ -62,14 +87,45 @@ func EnqueueDeviceUpdate(deviceID string, state utils.DeviceState) error {
 }
 
 func EnqueueEvaluation(ruleID, updatedDeviceID string) error {
-	payload, _ := json.Marshal(EvaluationTaskPayload{RuleID: ruleID, UpdatedDeviceID: updatedDeviceID})
+	return enqueueEvaluation(EvaluationTaskPayload{RuleID: ruleID, UpdatedDeviceID: updatedDeviceID})
+}
+
+// EnqueueScheduledEvaluation evaluates a rule fired by one of its schedules at firedAt
+func EnqueueScheduledEvaluation(ruleID, scheduleID string, firedAt time.Time) error {
+	return enqueueEvaluation(EvaluationTaskPayload{RuleID: ruleID, TriggeredBy: "schedule:" + scheduleID, FiredAt: firedAt})
+}
+
+// EnqueueCatchUpEvaluation evaluates a rule for a schedule fire at missedAt that was missed
+// while the engine was down. delay spaces out the runs when several missed fires are caught up.
+func EnqueueCatchUpEvaluation(ruleID, scheduleID string, missedAt time.Time, delay time.Duration) error {
+	return enqueueEvaluation(EvaluationTaskPayload{RuleID: ruleID, TriggeredBy: "catch_up:" + scheduleID, FiredAt: missedAt}, asynq.ProcessIn(delay))
+}
+
+// EnqueueCalendarEvaluation evaluates a rule when an event of a calendar it reads starts or ends;
+// at is the event boundary
+func EnqueueCalendarEvaluation(ruleID, calendarID string, at time.Time) error {
+	return enqueueEvaluation(EvaluationTaskPayload{RuleID: ruleID, TriggeredBy: "calendar:" + calendarID, FiredAt: at})
+}
+
+// EnqueuePresenceEvaluation evaluates a rule when a person of its household comes or goes
+func EnqueuePresenceEvaluation(ruleID, personID string) error {
+	return enqueueEvaluation(EvaluationTaskPayload{RuleID: ruleID, TriggeredBy: "presence:" + personID})
+}
+
+// EnqueueRuleRun runs a rule on request, optionally without checking its conditions
+func EnqueueRuleRun(ruleID string, skipConditions bool) error {
+	return enqueueEvaluation(EvaluationTaskPayload{RuleID: ruleID, SkipConditions: skipConditions, TriggeredBy: "api"})
+}
+
+func enqueueEvaluation(p EvaluationTaskPayload, opts ...asynq.Option) error {
+	payload, _ := json.Marshal(p)
 	task := asynq.NewTask("evaluate_rule", payload)
-	info, err := asynqClient.Enqueue(task, asynq.MaxRetry(3), asynq.Timeout(10*time.Second))
+	info, err := asynqClient.Enqueue(task, append([]asynq.Option{asynq.MaxRetry(3), asynq.Timeout(10 * time.Second)}, opts...)...)
 	if err != nil {
-		log.Printf("TASKQUEUE: Failed to enqueue rule %s: %v", ruleID, err)
+		log.Printf("TASKQUEUE: Failed to enqueue rule %s: %v", p.RuleID, err)
 		return err
 	}
-	log.Printf("TASKQUEUE: Evaluation successfully enqueued task %s for rule %s", info.ID, ruleID)
+	log.Printf("TASKQUEUE: Evaluation successfully enqueued task %s for rule %s", info.ID, p.RuleID)
 	return nil
 }
 
@@ -84,10 +140,19 @@ func processDeviceUpdateTask(ctx context.Context, t *asynq.Task) error {
 		return err
 	}
 
+	if sensorHandler != nil {
+		sensorHandler(payload.DeviceID, payload.State)
+	}
+
 	for _, ruleID := range ruleIDs {
 		EnqueueEvaluation(ruleID, payload.DeviceID)
 	}
 
+	// Virtual devices computed from this device go through the same pipeline
+	for virtualID, state := range automation.RecomputeVirtualDevices(ctx, redisClient, dbConn, payload.DeviceID) {
+		EnqueueDeviceUpdate(virtualID, state)
+	}
+
 	return nil
 }
 
@@ -169,6 +234,15 @@ func collectPendingActions(ruleID string, actionsJSON json.RawMessage) []Pending
 	return pendingActions
 }
 
+// renderPendingActions resolves the templates in pending actions with the context
+// of the rule they belong to, before they compete in conflict resolution
+func renderPendingActions(actions []PendingAction, tctx automation.TemplateContext) []PendingAction {
+	for i := range actions {
+		actions[i].Params = automation.RenderParams(actions[i].Params, tctx)
+	}
+	return actions
+}
+
 // extractActionTargets identifies all device-attribute pairs affected by pending actions
 func extractActionTargets(actions []PendingAction) []ActionTarget {
 	targetMap := make(map[ActionTarget]bool)
@@ -257,6 +331,14 @@ func evaluateAndExecuteTask(ctx context.Context, t *asynq.Task) error {
 		return err
 	}
 
+	// A waiting run leaves its rule's queue when it is picked up, unless it is queued again below
+	waiting := payload.Queued
+	defer func() {
+		if waiting {
+			automation.LeaveRuleQueue(ctx, redisClient, payload.RuleID)
+		}
+	}()
+
 	rule, err := dbConn.GetRuleByID(ctx, payload.RuleID)
 	if err != nil {
 		log.Printf("TASKQUEUE: Failed to fetch rule %s: %v", payload.RuleID, err)
@@ -267,17 +349,83 @@ func evaluateAndExecuteTask(ctx context.Context, t *asynq.Task) error {
 		return nil
 	}
 
-	if areAllActionsRedundant(ctx, rule.Actions) {
+	trace := newRunTrace(rule.ID, payload)
+	defer trace.save(ctx)
+
+	if payload.Depth > maxChainDepth {
+		log.Printf("TASKQUEUE: Rule %s (%s) stopped after %d chained rules, possible trigger loop (triggered by %s)",
+			rule.ID, rule.Name, payload.Depth, payload.TriggeredBy)
+		trace.finish(outcomeSkipped, fmt.Sprintf("stopped after %d chained rules", payload.Depth))
+		return nil
+	}
+
+	if !payload.SkipConditions && areAllActionsRedundant(ctx, rule.Actions) {
+		trace.run.Outcome, trace.run.Reason = outcomeSkipped, "actions already applied"
 		return nil
 	}
 
-	result := automation.EvaluateConditions(redisClient, rule.Conditions)
+	result := payload.SkipConditions
+	if !result {
+		var conditions *automation.ConditionTrace
+		result, conditions = automation.TraceConditions(redisClient, rule.Conditions, automation.RuleScope(*rule), payload.FiredAt)
+		trace.encode(&trace.run.Conditions, conditions)
+	}
+	if !result {
+		trace.finish(outcomeConditionsNotMet, "")
+	}
 
 	if result {
+		trace.record = true
+		run, err := automation.StartRuleRun(ctx, redisClient, *rule)
+		if err == automation.ErrRuleRunning {
+			if automation.ExecutionMode(rule.Execution) == automation.ModeQueued {
+				if !waiting && !automation.JoinRuleQueue(ctx, redisClient, rule.ID) {
+					log.Printf("TASKQUEUE: Rule %s (%s) already has %d runs queued, dropping this run", rule.ID, rule.Name, automation.MaxQueuedRuns)
+					trace.finish(outcomeSkipped, "queue full")
+					return nil
+				}
+				log.Printf("TASKQUEUE: Rule %s (%s) is running, queueing this run", rule.ID, rule.Name)
+				trace.finish(outcomeSkipped, "queued behind the running run")
+				payload.Queued = true
+				if err := enqueueEvaluation(payload, asynq.ProcessIn(queuedRunDelay)); err != nil {
+					waiting = true
+					return err
+				}
+				waiting = false
+				return nil
+			}
+			log.Printf("TASKQUEUE: Rule %s (%s) is already running, skipping", rule.ID, rule.Name)
+			trace.finish(outcomeSkipped, "already running")
+			return nil
+		}
+		if err != nil {
+			trace.finish(outcomeFailed, "")
+			trace.addError("start run: %v", err)
+			return err
+		}
+		defer run.Finish(ctx)
+
+		// Manual runs bypass the cooldown and daily limit
+		if payload.TriggeredBy != "api" {
+			if ok, reason := automation.AllowRuleRun(ctx, redisClient, *rule, utils.GetCurrentTime()); !ok {
+				log.Printf("TASKQUEUE: Rule %s (%s) not run: %s", rule.ID, rule.Name, reason)
+				trace.finish(outcomeSkipped, reason)
+				return nil
+			}
+		}
+
 		log.Printf("TASKQUEUE: Rule %s (%s) conditions met, collecting pending actions", payload.RuleID, rule.Name)
 
+		// Templated params are resolved against the device update that triggered this evaluation
+		tctx := automation.TemplateContext{
+			RedisClient:     redisClient,
+			TriggerDeviceID: payload.UpdatedDeviceID,
+			TriggerKey:      automation.TriggerKey(rule.Conditions, payload.UpdatedDeviceID),
+			Scope:           automation.RuleScope(*rule),
+		}
+
 		// Collect pending actions from this rule
-		pendingActions := collectPendingActions(rule.ID, rule.Actions)
+		pendingActions := renderPendingActions(collectPendingActions(rule.ID, rule.Actions), tctx)
 
 		// Find all affected device-attribute targets
 		affectedTargets := extractActionTargets(pendingActions)
@@ -286,6 +434,8 @@ func evaluateAndExecuteTask(ctx context.Context, t *asynq.Task) error {
 		allRules, err := dbConn.GetAllRules(ctx)
 		if err != nil {
 			log.Printf("TASKQUEUE: Failed to fetch all rules: %v", err)
+			trace.finish(outcomeFailed, "")
+			trace.addError("fetch rules for conflict resolution: %v", err)
 			return err
 		}
 
@@ -297,10 +447,16 @@ func evaluateAndExecuteTask(ctx context.Context, t *asynq.Task) error {
 				continue
 			}
 
-			// Evaluate this rule's conditions
-			if automation.EvaluateConditions(redisClient, r.Conditions) {
+			// Evaluate this rule's conditions at the same time as the triggering rule
+			if automation.EvaluateConditions(redisClient, r.Conditions, automation.RuleScope(r), payload.FiredAt) {
 				log.Printf("TASKQUEUE: Rule %s (%s) also triggered", r.ID, r.Name)
-				ruleActions := collectPendingActions(r.ID, r.Actions)
+				// Each rule's templates see its own trigger key and variable scope
+				ruleActions := renderPendingActions(collectPendingActions(r.ID, r.Actions), automation.TemplateContext{
+					RedisClient:     redisClient,
+					TriggerDeviceID: payload.UpdatedDeviceID,
+					TriggerKey:      automation.TriggerKey(r.Conditions, payload.UpdatedDeviceID),
+					Scope:           automation.RuleScope(r),
+				})
 
 				// Only include actions that affect the same targets
 				for _, action := range ruleActions {
@@ -320,11 +476,61 @@ func evaluateAndExecuteTask(ctx context.Context, t *asynq.Task) error {
 		// Add this rule's actions to the collection
 		allPendingActions = append(allPendingActions, pendingActions...)
 
+		// A restart rule stops here when it was triggered again in the meantime
+		if run.Superseded(ctx) {
+			log.Printf("TASKQUEUE: Rule %s (%s) restarted by a newer run", rule.ID, rule.Name)
+			trace.finish(outcomeSkipped, "restarted by a newer run")
+			return nil
+		}
+
 		// Resolve conflicts and execute final actions
 		resolvedActions := resolveConflicts(allPendingActions, affectedTargets)
+		trace.encode(&trace.run.Conflicts, map[string]interface{}{"pending": allPendingActions, "resolved": resolvedActions})
 		if len(resolvedActions) > 0 {
 			log.Printf("TASKQUEUE: Executing %d resolved actions after conflict resolution", len(resolvedActions))
-			automation.ExecuteResolvedActions(mqttClient, resolvedActions)
+			executedActions, rejected := automation.ExecuteResolvedActions(mqttClient, redisClient, resolvedActions)
+			trace.encode(&trace.run.Actions, executedActions)
+
+			for _, rejection := range rejected {
+				trace.addError("device %s: %v", rejection.DeviceID, rejection)
+				auditLog.Record(ctx, audit.Entry{
+					Actor:    "rule:" + rule.ID,
+					Action:   audit.ActionCommandRejected,
+					Source:   audit.SourceEngine,
+					DeviceID: rejection.DeviceID,
+					RuleID:   rule.ID,
+					Details:  audit.Marshal(map[string]interface{}{"params": resolvedActions[rejection.DeviceID], "interlock": rejection}),
+				})
+			}
+
+			for deviceID, params := range executedActions {
+				auditLog.Record(ctx, audit.Entry{
+					Actor:    "rule:" + rule.ID,
+					Action:   audit.ActionRuleCommand,
+					Source:   audit.SourceEngine,
+					DeviceID: deviceID,
+					RuleID:   rule.ID,
+					Details:  audit.Marshal(map[string]interface{}{"params": params, "trigger_device_id": payload.UpdatedDeviceID}),
+				})
+			}
+		}
+
+		if run.Superseded(ctx) {
+			log.Printf("TASKQUEUE: Rule %s (%s) restarted by a newer run", rule.ID, rule.Name)
+			trace.finish(outcomeSkipped, "restarted by a newer run")
+			return nil
+		}
+
+		automation.ExecuteNotifications(rule.Actions, tctx)
+		executeVariableActions(ctx, rule, tctx, payload.Depth)
+		executeVacationActions(ctx, rule, tctx)
+		executeChainActions(ctx, rule, tctx, payload.Depth)
+
+		// Rules reacting to this rule firing run one level deeper in the chain
+		for _, ruleID := range automation.RuleFired(ctx, redisClient, rule.ID, utils.GetCurrentTime()) {
+			if ruleID != rule.ID {
+				enqueueEvaluation(EvaluationTaskPayload{RuleID: ruleID, Depth: payload.Depth + 1, TriggeredBy: "rule:" + rule.ID})
+			}
 		}
 	}
 
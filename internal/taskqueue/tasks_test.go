@@ -0,0 +1,81 @@
+package taskqueue
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"smarthome/internal/automation"
+)
+
+func TestResolveConflictsUsesEachRulesTemplateContext(t *testing.T) {
+	actions := json.RawMessage(`[{"device_id": "10", "action": "set", "params": {"label": "{{ trigger.key }}"}}]`)
+	contextFor := func(ruleID, key string) automation.TemplateContext {
+		return automation.TemplateContext{
+			TriggerDeviceID: "1",
+			TriggerKey:      key,
+			Scope:           automation.VariableScope{RuleID: ruleID},
+		}
+	}
+
+	// Rule "b" triggered the evaluation, rule "a" wins the conflict; the winning
+	// value has to be rendered with rule "a"'s trigger key, not "b"'s
+	pending := renderPendingActions(collectPendingActions("b", actions), contextFor("b", "motion"))
+	pending = append(pending, renderPendingActions(collectPendingActions("a", actions), contextFor("a", "lux"))...)
+
+	got := resolveConflicts(pending, extractActionTargets(pending))
+	want := map[string]map[string]interface{}{"10": {"label": "lux"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("resolveConflicts() = %v, want %v", got, want)
+	}
+}
+
+func TestResolveConflicts(t *testing.T) {
+	tests := []struct {
+		name    string
+		pending []PendingAction
+		want    map[string]map[string]interface{}
+	}{
+		{
+			name: "lower rule ID wins per attribute",
+			pending: []PendingAction{
+				{RuleID: "7", DeviceID: "1", Params: map[string]interface{}{"on": true, "brightness": 40.0}},
+				{RuleID: "3", DeviceID: "1", Params: map[string]interface{}{"brightness": 90.0}},
+			},
+			want: map[string]map[string]interface{}{"1": {"on": true, "brightness": 90.0}},
+		},
+		{
+			name: "devices are resolved independently",
+			pending: []PendingAction{
+				{RuleID: "2", DeviceID: "1", Params: map[string]interface{}{"on": false}},
+				{RuleID: "1", DeviceID: "2", Params: map[string]interface{}{"on": true}},
+			},
+			want: map[string]map[string]interface{}{"1": {"on": false}, "2": {"on": true}},
+		},
+		{
+			name:    "nothing pending",
+			pending: nil,
+			want:    map[string]map[string]interface{}{},
+		},
+	}
+
+	for _, tt := range tests {
+		got := resolveConflicts(tt.pending, extractActionTargets(tt.pending))
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: resolveConflicts() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCollectPendingActions(t *testing.T) {
+	actions := json.RawMessage(`[
+		{"device_id": "1", "action": "set", "params": {"on": true}},
+		{"action": "send_email", "params": {"message": "hi"}},
+		{"device_id": "2", "action": "set", "params": "not an object"}
+	]`)
+	got := collectPendingActions("5", actions)
+	want := []PendingAction{{RuleID: "5", DeviceID: "1", Params: map[string]interface{}{"on": true}}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("collectPendingActions() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,102 @@
+package taskqueue
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"smarthome/internal/models"
+	"smarthome/internal/utils"
+)
+
+// Run trace outcomes
+const (
+	outcomeExecuted         = "executed"
+	outcomeConditionsNotMet = "conditions_not_met"
+	outcomeSkipped          = "skipped"
+	outcomeFailed           = "failed"
+)
+
+var (
+	// traceAllEvaluations also stores evaluations whose conditions were not met
+	traceAllEvaluations = false
+	traceMaxPerRule     = 100
+	traceRetention      = 14 * 24 * time.Hour
+)
+
+// SetTracing configures which rule evaluations are traced and how long traces are kept
+func SetTracing(all bool, maxPerRule int, retention time.Duration) {
+	traceAllEvaluations = all
+	traceMaxPerRule = maxPerRule
+	traceRetention = retention
+}
+
+// runTrace collects what happened during one evaluation of a rule
+type runTrace struct {
+	run    models.RuleRun
+	start  time.Time
+	record bool // The evaluation got past its conditions, or otherwise deserves a trace
+}
+
+func newRunTrace(ruleID string, p EvaluationTaskPayload) *runTrace {
+	return &runTrace{
+		run: models.RuleRun{
+			RuleID:      ruleID,
+			TriggeredBy: triggerSource(p),
+			Outcome:     outcomeExecuted,
+			Errors:      []string{},
+			StartedAt:   utils.GetCurrentTime(),
+		},
+		start: time.Now(),
+	}
+}
+
+// triggerSource describes what caused an evaluation
+func triggerSource(p EvaluationTaskPayload) string {
+	switch {
+	case p.TriggeredBy != "":
+		return p.TriggeredBy
+	case p.UpdatedDeviceID != "":
+		return "device:" + p.UpdatedDeviceID
+	default:
+		return "engine"
+	}
+}
+
+// finish sets the outcome of the evaluation; reason explains skips and failures
+func (t *runTrace) finish(outcome, reason string) {
+	t.run.Outcome = outcome
+	t.run.Reason = reason
+	if outcome == outcomeSkipped || outcome == outcomeFailed {
+		t.record = true
+	}
+}
+
+func (t *runTrace) addError(format string, args ...interface{}) {
+	t.run.Errors = append(t.run.Errors, fmt.Sprintf(format, args...))
+	t.record = true
+}
+
+// encode marshals v into one of the trace's JSON fields
+func (t *runTrace) encode(field *json.RawMessage, v interface{}) {
+	if data, err := json.Marshal(v); err == nil {
+		*field = data
+	}
+}
+
+// save stores the trace and applies the retention limits of the rule's traces
+func (t *runTrace) save(ctx context.Context) {
+	if !t.record && !traceAllEvaluations {
+		return
+	}
+	t.run.DurationMs = int(time.Since(t.start).Milliseconds())
+	if err := dbConn.RecordRuleRun(ctx, t.run); err != nil {
+		log.Printf("TASKQUEUE: Failed to store run trace for rule %s: %v", t.run.RuleID, err)
+		return
+	}
+	if err := dbConn.PruneRuleRuns(ctx, t.run.RuleID, traceMaxPerRule, traceRetention); err != nil {
+		log.Printf("TASKQUEUE: Failed to prune run traces for rule %s: %v", t.run.RuleID, err)
+	}
+}
@@ -0,0 +1,145 @@
+package taskqueue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"smarthome/internal/audit"
+	"smarthome/internal/automation"
+	"smarthome/internal/models"
+
+	"github.com/hibiken/asynq"
+)
+
+var (
+	// vacationHandler turns a household's vacation mode on or off, reporting whether it changed
+	vacationHandler func(ownerID string, enabled bool) (bool, error)
+	// vacationPlanHandler schedules the replay of one hour of lighting history
+	vacationPlanHandler func(ownerID string, enabledAt, hour time.Time) error
+	// vacationStepHandler replays one recorded lighting change
+	vacationStepHandler func(ownerID string, enabledAt time.Time, deviceID string, params map[string]interface{}) error
+)
+
+// SetVacationHandlers registers the callbacks toggling vacation mode and replaying its history
+func SetVacationHandlers(onToggle func(ownerID string, enabled bool) (bool, error),
+	onPlan func(ownerID string, enabledAt, hour time.Time) error,
+	onStep func(ownerID string, enabledAt time.Time, deviceID string, params map[string]interface{}) error) {
+	vacationHandler = onToggle
+	vacationPlanHandler = onPlan
+	vacationStepHandler = onStep
+}
+
+type VacationPlanTaskPayload struct {
+	OwnerID   string
+	EnabledAt time.Time // When vacation mode was turned on; a mode turned off since ignores the task
+	Hour      time.Time
+}
+
+type VacationStepTaskPayload struct {
+	OwnerID   string
+	EnabledAt time.Time
+	DeviceID  string
+	Params    map[string]interface{}
+}
+
+// EnqueueVacationPlan plans the replay of the hour starting at hour, at processAt.
+// Each hour is planned once, even when several replicas or a restart enqueue it.
+func EnqueueVacationPlan(ownerID string, enabledAt, hour, processAt time.Time) error {
+	payload, _ := json.Marshal(VacationPlanTaskPayload{OwnerID: ownerID, EnabledAt: enabledAt, Hour: hour})
+	task := asynq.NewTask("vacation_plan", payload)
+	taskID := fmt.Sprintf("vacation_plan:%s:%d:%d", ownerID, enabledAt.UnixNano(), hour.Unix())
+	_, err := asynqClient.Enqueue(task, asynq.TaskID(taskID), asynq.Retention(2*time.Hour),
+		asynq.MaxRetry(3), asynq.Timeout(30*time.Second), asynq.ProcessAt(processAt))
+	if errors.Is(err, asynq.ErrTaskIDConflict) {
+		return nil
+	}
+	if err != nil {
+		log.Printf("TASKQUEUE: Failed to enqueue vacation plan for household %s: %v", ownerID, err)
+	}
+	return err
+}
+
+// EnqueueVacationStep replays a lighting change at processAt
+func EnqueueVacationStep(ownerID string, enabledAt time.Time, deviceID string, params map[string]interface{}, processAt time.Time) error {
+	payload, _ := json.Marshal(VacationStepTaskPayload{OwnerID: ownerID, EnabledAt: enabledAt, DeviceID: deviceID, Params: params})
+	task := asynq.NewTask("vacation_step", payload)
+	_, err := asynqClient.Enqueue(task, asynq.MaxRetry(1), asynq.Timeout(10*time.Second), asynq.ProcessAt(processAt))
+	if err != nil {
+		log.Printf("TASKQUEUE: Failed to enqueue vacation step for device %s: %v", deviceID, err)
+	}
+	return err
+}
+
+func processVacationPlanTask(ctx context.Context, t *asynq.Task) error {
+	var payload VacationPlanTaskPayload
+	if err := json.Unmarshal(t.Payload(), &payload); err != nil {
+		return err
+	}
+	if vacationPlanHandler == nil {
+		return nil
+	}
+	return vacationPlanHandler(payload.OwnerID, payload.EnabledAt, payload.Hour)
+}
+
+func processVacationStepTask(ctx context.Context, t *asynq.Task) error {
+	var payload VacationStepTaskPayload
+	if err := json.Unmarshal(t.Payload(), &payload); err != nil {
+		return err
+	}
+	if vacationStepHandler == nil {
+		return nil
+	}
+	return vacationStepHandler(payload.OwnerID, payload.EnabledAt, payload.DeviceID, payload.Params)
+}
+
+// executeVacationActions applies a rule's set_vacation actions, e.g.
+// {"action": "set_vacation", "params": {"enabled": true}}
+func executeVacationActions(ctx context.Context, rule *models.Rule, tctx automation.TemplateContext) {
+	var actions []models.Action
+	if err := json.Unmarshal(rule.Actions, &actions); err != nil {
+		return
+	}
+
+	for _, action := range actions {
+		if action.Action != "set_vacation" || vacationHandler == nil {
+			continue
+		}
+		var params map[string]interface{}
+		if err := json.Unmarshal(action.Params, &params); err != nil {
+			log.Printf("TASKQUEUE: Invalid set_vacation params in rule %s: %v", rule.ID, err)
+			continue
+		}
+		params = automation.RenderParams(params, tctx)
+		enabled, ok := params["enabled"].(bool)
+		if !ok {
+			log.Printf("TASKQUEUE: Rule %s sets vacation mode without a boolean enabled", rule.ID)
+			continue
+		}
+
+		changed, err := vacationHandler(rule.OwnerID, enabled)
+		if err != nil {
+			log.Printf("TASKQUEUE: Rule %s failed to set vacation mode: %v", rule.ID, err)
+			continue
+		}
+		if !changed {
+			continue
+		}
+		log.Printf("TASKQUEUE: Rule %s set vacation mode enabled=%t", rule.ID, enabled)
+
+		auditAction := audit.ActionVacationDisable
+		if enabled {
+			auditAction = audit.ActionVacationEnable
+		}
+		auditLog.Record(ctx, audit.Entry{
+			Actor:   "rule:" + rule.ID,
+			Action:  auditAction,
+			Source:  audit.SourceEngine,
+			RuleID:  rule.ID,
+			Details: audit.Marshal(map[string]interface{}{"owner_id": rule.OwnerID}),
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package taskqueue
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+
+	"smarthome/internal/audit"
+	"smarthome/internal/automation"
+	"smarthome/internal/models"
+)
+
+// executeVariableActions applies a rule's set_variable actions, e.g.
+// {"action": "set_variable", "params": {"name": "house_mode", "value": "away"}}
+func executeVariableActions(ctx context.Context, rule *models.Rule, tctx automation.TemplateContext, depth int) {
+	var actions []models.Action
+	if err := json.Unmarshal(rule.Actions, &actions); err != nil {
+		return
+	}
+
+	for _, action := range actions {
+		if action.Action != "set_variable" {
+			continue
+		}
+		var params map[string]interface{}
+		if err := json.Unmarshal(action.Params, &params); err != nil {
+			log.Printf("TASKQUEUE: Invalid set_variable params in rule %s: %v", rule.ID, err)
+			continue
+		}
+		params = automation.RenderParams(params, tctx)
+		name, _ := params["name"].(string)
+
+		variable, err := dbConn.GetVariableByName(ctx, rule.OwnerID, rule.ID, name)
+		if err != nil {
+			log.Printf("TASKQUEUE: Rule %s sets unknown variable %s", rule.ID, name)
+			continue
+		}
+		value, err := automation.CoerceVariableValue(*variable, params["value"])
+		if err != nil {
+			log.Printf("TASKQUEUE: Rule %s cannot set variable %s: %v", rule.ID, name, err)
+			continue
+		}
+		encoded, _ := json.Marshal(value)
+
+		var current interface{}
+		json.Unmarshal(variable.Value, &current)
+		if current == value {
+			continue
+		}
+
+		if err := dbConn.SetVariableValue(ctx, variable.ID, encoded); err != nil {
+			log.Printf("TASKQUEUE: Failed to store variable %s: %v", name, err)
+			continue
+		}
+		before := variable.Value
+		variable.Value = encoded
+		if err := automation.CacheVariable(ctx, redisClient, *variable); err != nil {
+			log.Printf("TASKQUEUE: Failed to cache variable %s: %v", name, err)
+		}
+		log.Printf("TASKQUEUE: Rule %s set variable %s to %s", rule.ID, name, string(encoded))
+
+		auditLog.Record(ctx, audit.Entry{
+			Actor:   "rule:" + rule.ID,
+			Action:  audit.ActionVariableSet,
+			Source:  audit.SourceEngine,
+			RuleID:  rule.ID,
+			Details: audit.Marshal(map[string]interface{}{"variable_id": variable.ID, "name": name}),
+			Before:  before,
+			After:   encoded,
+		})
+
+		// Re-evaluate rules reading the variable; the rule that set it is skipped so it cannot retrigger itself
+		for _, ruleID := range automation.VariableDependents(ctx, redisClient, *variable) {
+			if ruleID != rule.ID {
+				enqueueEvaluation(EvaluationTaskPayload{RuleID: ruleID, Depth: depth + 1, TriggeredBy: "rule:" + rule.ID})
+			}
+		}
+	}
+}
@@ -18,6 +18,10 @@ func StartWorkers(redisAddr string) {
 	asynqClient = asynq.NewClient(asynq.RedisClientOpt{Addr: redisAddr})
 	asynqMux.HandleFunc("device_update", processDeviceUpdateTask)
 	asynqMux.HandleFunc("evaluate_rule", evaluateAndExecuteTask)
+	asynqMux.HandleFunc("alarm_timer", processAlarmTimerTask)
+	asynqMux.HandleFunc("interlock_timer", processInterlockTimerTask)
+	asynqMux.HandleFunc("vacation_plan", processVacationPlanTask)
+	asynqMux.HandleFunc("vacation_step", processVacationStepTask)
 	asynqSrv = asynq.NewServer(asynq.RedisClientOpt{Addr: redisAddr}, asynq.Config{Concurrency: 10})
 	log.Printf("TASKQUEUE: Workers started, waiting for tasks...")
 	if err := asynqSrv.Run(asynqMux); err != nil {
@@ -6,6 +6,7 @@ import (
 	"strings"
 	"time"
 
+	"smarthome/internal/clock"
 	"smarthome/internal/db"
 
 	"github.com/redis/go-redis/v9"
@@ -92,9 +93,9 @@ func Abs(x float64) float64 {
 	return math.Abs(x)
 }
 
-// GetCurrentTime gets current time
+// GetCurrentTime gets the current time of the engine clock in the home timezone
 func GetCurrentTime() time.Time {
-	return time.Now()
+	return clock.Now()
 }
 
 // IsSignificantChange checks changes
@@ -0,0 +1,82 @@
+package utils
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+// JSONChange describes a single difference between two decoded JSON documents
+type JSONChange struct {
+	Path string      `json:"path"`
+	Op   string      `json:"op"` // "added", "removed", "changed"
+	From interface{} `json:"from,omitempty"`
+	To   interface{} `json:"to,omitempty"`
+}
+
+// DiffJSON returns the leaf-level differences between two decoded JSON values
+// (as produced by json.Unmarshal into interface{}). Paths use dot notation for
+// object keys and [i] for array indices.
+func DiffJSON(from, to interface{}) []JSONChange {
+	changes := []JSONChange{}
+	diffJSONRecursive("", from, to, &changes)
+	return changes
+}
+
+func diffJSONRecursive(path string, from, to interface{}, changes *[]JSONChange) {
+	fromMap, fromIsMap := from.(map[string]interface{})
+	toMap, toIsMap := to.(map[string]interface{})
+	if fromIsMap && toIsMap {
+		keys := make(map[string]bool)
+		for k := range fromMap {
+			keys[k] = true
+		}
+		for k := range toMap {
+			keys[k] = true
+		}
+		sorted := make([]string, 0, len(keys))
+		for k := range keys {
+			sorted = append(sorted, k)
+		}
+		sort.Strings(sorted)
+
+		for _, k := range sorted {
+			childPath := k
+			if path != "" {
+				childPath = path + "." + k
+			}
+			fromVal, inFrom := fromMap[k]
+			toVal, inTo := toMap[k]
+			switch {
+			case !inFrom:
+				*changes = append(*changes, JSONChange{Path: childPath, Op: "added", To: toVal})
+			case !inTo:
+				*changes = append(*changes, JSONChange{Path: childPath, Op: "removed", From: fromVal})
+			default:
+				diffJSONRecursive(childPath, fromVal, toVal, changes)
+			}
+		}
+		return
+	}
+
+	fromList, fromIsList := from.([]interface{})
+	toList, toIsList := to.([]interface{})
+	if fromIsList && toIsList {
+		for i := 0; i < len(fromList) || i < len(toList); i++ {
+			childPath := fmt.Sprintf("%s[%d]", path, i)
+			switch {
+			case i >= len(fromList):
+				*changes = append(*changes, JSONChange{Path: childPath, Op: "added", To: toList[i]})
+			case i >= len(toList):
+				*changes = append(*changes, JSONChange{Path: childPath, Op: "removed", From: fromList[i]})
+			default:
+				diffJSONRecursive(childPath, fromList[i], toList[i], changes)
+			}
+		}
+		return
+	}
+
+	if !reflect.DeepEqual(from, to) {
+		*changes = append(*changes, JSONChange{Path: path, Op: "changed", From: from, To: to})
+	}
+}
@@ -0,0 +1,92 @@
+package utils
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestDiffJSON(t *testing.T) {
+	tests := []struct {
+		name     string
+		from, to string
+		want     []JSONChange
+	}{
+		{
+			name: "identical documents",
+			from: `{"a": 1, "b": [true, "x"], "c": {"d": null}}`,
+			to:   `{"c": {"d": null}, "b": [true, "x"], "a": 1}`,
+			want: []JSONChange{},
+		},
+		{
+			name: "changed leaf",
+			from: `{"threshold": 20}`,
+			to:   `{"threshold": 22.5}`,
+			want: []JSONChange{{Path: "threshold", Op: "changed", From: 20.0, To: 22.5}},
+		},
+		{
+			name: "added and removed keys are sorted by path",
+			from: `{"b": 1, "c": 2}`,
+			to:   `{"a": 0, "b": 1}`,
+			want: []JSONChange{
+				{Path: "a", Op: "added", To: 0.0},
+				{Path: "c", Op: "removed", From: 2.0},
+			},
+		},
+		{
+			name: "nested objects use dot paths",
+			from: `{"execution": {"mode": "single", "cooldown": 10}}`,
+			to:   `{"execution": {"mode": "queued", "cooldown": 10}}`,
+			want: []JSONChange{{Path: "execution.mode", Op: "changed", From: "single", To: "queued"}},
+		},
+		{
+			name: "arrays are compared by index",
+			from: `{"children": [{"key": "lux"}, {"key": "motion"}]}`,
+			to:   `{"children": [{"key": "lux"}, {"key": "presence"}, {"key": "door"}]}`,
+			want: []JSONChange{
+				{Path: "children[1].key", Op: "changed", From: "motion", To: "presence"},
+				{Path: "children[2]", Op: "added", To: map[string]interface{}{"key": "door"}},
+			},
+		},
+		{
+			name: "shortened array",
+			from: `[1, 2, 3]`,
+			to:   `[1]`,
+			want: []JSONChange{
+				{Path: "[1]", Op: "removed", From: 2.0},
+				{Path: "[2]", Op: "removed", From: 3.0},
+			},
+		},
+		{
+			name: "type change replaces the whole value",
+			from: `{"value": {"on": true}}`,
+			to:   `{"value": [true]}`,
+			want: []JSONChange{{Path: "value", Op: "changed", From: map[string]interface{}{"on": true}, To: []interface{}{true}}},
+		},
+		{
+			name: "null to value",
+			from: `{"value": null}`,
+			to:   `{"value": "on"}`,
+			want: []JSONChange{{Path: "value", Op: "changed", From: nil, To: "on"}},
+		},
+		{
+			name: "scalar documents",
+			from: `"a"`,
+			to:   `"b"`,
+			want: []JSONChange{{Path: "", Op: "changed", From: "a", To: "b"}},
+		},
+	}
+
+	for _, tt := range tests {
+		var from, to interface{}
+		if err := json.Unmarshal([]byte(tt.from), &from); err != nil {
+			t.Fatalf("%s: invalid from document: %v", tt.name, err)
+		}
+		if err := json.Unmarshal([]byte(tt.to), &to); err != nil {
+			t.Fatalf("%s: invalid to document: %v", tt.name, err)
+		}
+		if got := DiffJSON(from, to); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: DiffJSON() = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,298 @@
+package vacation
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"math/rand"
+	"time"
+
+	"smarthome/internal/automation"
+	"smarthome/internal/clock"
+	"smarthome/internal/db"
+	"smarthome/internal/models"
+	"smarthome/internal/taskqueue"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/jackc/pgx/v5"
+	"github.com/redis/go-redis/v9"
+)
+
+// replayKeys are the lighting attributes replayed from device history and restored afterwards
+var replayKeys = []string{"on", "state", "brightness", "color_temp", "color"}
+
+// planLead is how long before an hour starts its replay is planned
+const planLead = time.Minute
+
+// ErrNotConfigured is returned when enabling vacation mode before choosing its devices
+var ErrNotConfigured = errors.New("vacation mode has no devices")
+
+// Manager runs the vacation mode of all households. While it is on, every hour
+// replays the lighting changes recorded on the selected devices during the same
+// hour of a past week, picked per day among the last weeks, with each change moved
+// by up to the jitter. Turning it off restores the states the devices had when it
+// was turned on. Hours are planned as queued tasks keyed by household and hour, so
+// several engine replicas plan each once.
+type Manager struct {
+	db    *db.DB
+	redis *redis.Client
+	mqtt  mqtt.Client
+}
+
+// NewManager creates a vacation mode manager
+func NewManager(dbConn *db.DB, redisClient *redis.Client, mqttClient mqtt.Client) *Manager {
+	return &Manager{db: dbConn, redis: redisClient, mqtt: mqttClient}
+}
+
+// Start resumes the replay of every household in vacation mode
+func (m *Manager) Start() error {
+	taskqueue.SetVacationHandlers(m.Set, m.plan, m.step)
+	modes, err := m.db.GetEnabledVacationModes(context.Background())
+	if err != nil {
+		return err
+	}
+	now := clock.Now()
+	for _, mode := range modes {
+		if err := taskqueue.EnqueueVacationPlan(mode.OwnerID, *mode.EnabledAt, now.Truncate(time.Hour), now); err != nil {
+			log.Printf("VACATION: Failed to resume household %s: %v", mode.OwnerID, err)
+		}
+	}
+	log.Printf("VACATION: Resumed %d households in vacation mode", len(modes))
+	return nil
+}
+
+// Set turns vacation mode on or off, reporting whether it changed
+func (m *Manager) Set(ownerID string, enabled bool) (bool, error) {
+	if enabled {
+		return m.Enable(ownerID)
+	}
+	return m.Disable(ownerID)
+}
+
+// Enable saves the lighting state of the selected devices and starts the replay
+func (m *Manager) Enable(ownerID string) (bool, error) {
+	ctx := context.Background()
+	mode, err := m.db.GetVacationMode(ctx, ownerID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false, ErrNotConfigured
+	}
+	if err != nil {
+		return false, err
+	}
+	if mode.Enabled {
+		return false, nil
+	}
+	if len(mode.Devices) == 0 {
+		return false, ErrNotConfigured
+	}
+
+	saved := make(map[string]json.RawMessage)
+	for _, deviceID := range mode.Devices {
+		device, err := m.db.GetDeviceByID(ctx, deviceID)
+		if err != nil {
+			continue
+		}
+		if params := lightingParams(device.State); len(params) > 0 {
+			saved[deviceID], _ = json.Marshal(params)
+		}
+	}
+
+	// Postgres keeps microseconds; tasks compare against the stored time
+	at := clock.Now().Truncate(time.Microsecond)
+	changed, err := m.db.EnableVacationMode(ctx, ownerID, at, saved)
+	if err != nil || !changed {
+		return false, err
+	}
+	log.Printf("VACATION: Household %s on vacation, replaying %d devices from the last %d weeks", ownerID, len(mode.Devices), mode.Weeks)
+	return true, taskqueue.EnqueueVacationPlan(ownerID, at, at.Truncate(time.Hour), at)
+}
+
+// Disable stops the replay and restores the states saved when it was enabled
+func (m *Manager) Disable(ownerID string) (bool, error) {
+	ctx := context.Background()
+	saved, changed, err := m.db.DisableVacationMode(ctx, ownerID)
+	if err != nil || !changed {
+		return false, err
+	}
+	log.Printf("VACATION: Household %s back from vacation, restoring %d devices", ownerID, len(saved))
+	for deviceID, raw := range saved {
+		var params map[string]interface{}
+		if err := json.Unmarshal(raw, &params); err != nil || len(params) == 0 {
+			continue
+		}
+		m.publish(ownerID, deviceID, params)
+	}
+	return true, nil
+}
+
+// active reports whether mode is still the vacation that started at enabledAt
+func active(mode *models.VacationMode, enabledAt time.Time) bool {
+	return mode.Enabled && mode.EnabledAt != nil && mode.EnabledAt.Equal(enabledAt)
+}
+
+// plan schedules the lighting changes of the hour starting at hour and the
+// planning of the next one. An hour planned late, as when vacation mode was just
+// turned on, first sets each device to its state at that point of the replayed hour.
+func (m *Manager) plan(ownerID string, enabledAt, hour time.Time) error {
+	ctx := context.Background()
+	mode, err := m.db.GetVacationMode(ctx, ownerID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !active(mode, enabledAt) {
+		return nil
+	}
+
+	now := clock.Now()
+	if !now.Before(hour.Add(time.Hour)) {
+		// The queue was stopped past this hour; pick up at the current one
+		current := now.Truncate(time.Hour)
+		return taskqueue.EnqueueVacationPlan(ownerID, enabledAt, current, now)
+	}
+
+	local := hour.In(clock.Location())
+	source := local.AddDate(0, 0, -7*sourceWeek(ownerID, local, mode.Weeks))
+	from := now.Sub(hour)
+	if from < 0 {
+		from = 0
+	}
+	for _, deviceID := range mode.Devices {
+		if err := m.planDevice(ctx, *mode, deviceID, source, hour, from, now); err != nil {
+			log.Printf("VACATION: Failed to plan device %s: %v", deviceID, err)
+		}
+	}
+
+	next := hour.Add(time.Hour)
+	return taskqueue.EnqueueVacationPlan(ownerID, enabledAt, next, next.Add(-planLead))
+}
+
+// planDevice schedules the lighting changes a device recorded from source+from to
+// the end of the source hour, moved to hour and jittered without reordering them
+func (m *Manager) planDevice(ctx context.Context, mode models.VacationMode, deviceID string, source, hour time.Time, from time.Duration, now time.Time) error {
+	start := source.Add(from)
+	var last map[string]interface{}
+	if prev, err := m.db.GetDeviceStateAt(ctx, deviceID, start); err == nil {
+		last = lightingParams(prev.State)
+	}
+	notBefore := now
+	if from > 0 && len(last) > 0 {
+		if err := taskqueue.EnqueueVacationStep(mode.OwnerID, *mode.EnabledAt, deviceID, last, now); err != nil {
+			return err
+		}
+		notBefore = now.Add(time.Second)
+	}
+
+	states, err := m.db.GetDeviceStatesBetween(ctx, deviceID, start, source.Add(time.Hour))
+	if err != nil {
+		return err
+	}
+	for _, h := range states {
+		next := lightingParams(h.State)
+		params := changedParams(last, next)
+		for key, value := range next {
+			if last == nil {
+				last = make(map[string]interface{})
+			}
+			last[key] = value
+		}
+		if len(params) == 0 {
+			continue
+		}
+		at := hour.Add(h.Timestamp.Sub(source)).Add(jitter(mode.JitterMinutes))
+		if at.Before(notBefore) {
+			at = notBefore
+		}
+		if err := taskqueue.EnqueueVacationStep(mode.OwnerID, *mode.EnabledAt, deviceID, params, at); err != nil {
+			return err
+		}
+		notBefore = at.Add(time.Second)
+	}
+	return nil
+}
+
+// step replays a lighting change unless vacation mode was turned off since it was planned
+func (m *Manager) step(ownerID string, enabledAt time.Time, deviceID string, params map[string]interface{}) error {
+	mode, err := m.db.GetVacationMode(context.Background(), ownerID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !active(mode, enabledAt) || !contains(mode.Devices, deviceID) {
+		return nil
+	}
+	m.publish(ownerID, deviceID, params)
+	return nil
+}
+
+// publish sends a command through the interlock gate
+func (m *Manager) publish(ownerID, deviceID string, params map[string]interface{}) {
+	if m.mqtt == nil {
+		return
+	}
+	if _, err := automation.PublishCommand(context.Background(), m.redis, m.mqtt, deviceID, params, "vacation:"+ownerID); err != nil {
+		log.Printf("VACATION: Command to device %s not sent: %v", deviceID, err)
+	}
+}
+
+// sourceWeek picks how many weeks back the replayed day is; it is the same for
+// every hour of a day so the evening plays out as one recorded evening
+func sourceWeek(ownerID string, day time.Time, weeks int) int {
+	if weeks < 1 {
+		return 1
+	}
+	h := fnv.New32a()
+	fmt.Fprintf(h, "%s:%s", ownerID, day.Format("2006-01-02"))
+	return 1 + int(h.Sum32()%uint32(weeks))
+}
+
+// jitter returns a random shift of up to minutes either way
+func jitter(minutes int) time.Duration {
+	if minutes <= 0 {
+		return 0
+	}
+	span := 2 * time.Duration(minutes) * time.Minute
+	return time.Duration(rand.Int63n(int64(span)+1)) - span/2
+}
+
+// lightingParams extracts the replayed attributes of a recorded state
+func lightingParams(state json.RawMessage) map[string]interface{} {
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(state, &decoded); err != nil {
+		return nil
+	}
+	params := make(map[string]interface{})
+	for _, key := range replayKeys {
+		if value, ok := decoded[key]; ok {
+			params[key] = value
+		}
+	}
+	return params
+}
+
+// changedParams returns the attributes of next that differ from last
+func changedParams(last, next map[string]interface{}) map[string]interface{} {
+	changed := make(map[string]interface{})
+	for key, value := range next {
+		if previous, ok := last[key]; !ok || fmt.Sprint(previous) != fmt.Sprint(value) {
+			changed[key] = value
+		}
+	}
+	return changed
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
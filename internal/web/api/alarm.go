@@ -0,0 +1,363 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"smarthome/internal/alarm"
+	"smarthome/internal/audit"
+	"smarthome/internal/automation"
+	"smarthome/internal/models"
+	"smarthome/internal/web/middleware"
+	webModels "smarthome/internal/web/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const alarmColumns = `id, owner_id, name, pin_hash, arm_requires_pin, entry_delay_seconds, exit_delay_seconds, trigger_seconds,
+	sensors, siren_actions, siren_off_actions, state, armed_mode, triggered_by, state_changed_at`
+
+func scanAlarmRow(row pgx.Row) (*models.AlarmPanel, error) {
+	var p models.AlarmPanel
+	err := row.Scan(&p.ID, &p.OwnerID, &p.Name, &p.PINHash, &p.ArmRequiresPIN, &p.EntryDelay, &p.ExitDelay, &p.TriggerDuration,
+		&p.Sensors, &p.SirenActions, &p.SirenOffActions, &p.State, &p.ArmedMode, &p.TriggeredBy, &p.StateChangedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// getUserAlarm fetches the alarm panel of the user's household
+func getUserAlarm(c *gin.Context, dbConn *pgxpool.Pool, userID string) (*models.AlarmPanel, error) {
+	return scanAlarmRow(dbConn.QueryRow(c, "SELECT "+alarmColumns+" FROM alarm_panels WHERE owner_id=$1", userID))
+}
+
+func alarmResponse(p models.AlarmPanel) webModels.AlarmPanelResponse {
+	return webModels.AlarmPanelResponse{AlarmPanel: p, HasPIN: p.PINHash != ""}
+}
+
+// checkAlarmPIN answers 403 and audits the attempt when pin is not the panel's PIN
+func checkAlarmPIN(c *gin.Context, auditLog *audit.Logger, userID string, panel models.AlarmPanel, pin string) bool {
+	if alarm.CheckPIN(panel, pin) {
+		return true
+	}
+	auditLog.Record(c, audit.Entry{
+		ActorID: userID,
+		Action:  audit.ActionAlarmPINFailed,
+		Source:  audit.RequestSource(c.Request),
+		Details: audit.Marshal(gin.H{"panel_id": panel.ID, "state": panel.State}),
+	})
+	c.JSON(403, gin.H{"error": "Invalid PIN"})
+	return false
+}
+
+// validateAlarm checks a panel's delays, sensors and siren actions, which may only
+// use the user's devices
+func validateAlarm(c *gin.Context, dbConn *pgxpool.Pool, userID string, p models.AlarmPanel) (int, string) {
+	if strings.TrimSpace(p.Name) == "" {
+		return 400, "Name is required"
+	}
+	if p.EntryDelay < 0 || p.ExitDelay < 0 || p.TriggerDuration < 0 {
+		return 400, "Delays and trigger time cannot be negative"
+	}
+
+	deviceIDs := make(map[string]bool)
+	for mode, sensors := range p.Sensors {
+		if !automation.ValidAlarmMode(mode) {
+			return 400, fmt.Sprintf("Unknown alarm mode %s, use armed_home, armed_away or armed_night", mode)
+		}
+		for _, id := range sensors {
+			deviceIDs[id] = true
+		}
+	}
+	for field, raw := range map[string]json.RawMessage{"siren_actions": p.SirenActions, "siren_off_actions": p.SirenOffActions} {
+		if err := automation.ValidateActions(raw); err != nil {
+			return 400, fmt.Sprintf("%s: %v", field, err)
+		}
+		var actions []models.Action
+		json.Unmarshal(raw, &actions)
+		for _, action := range actions {
+			if action.DeviceID != "" {
+				deviceIDs[action.DeviceID] = true
+			}
+		}
+	}
+	for id := range deviceIDs {
+		var exists bool
+		err := dbConn.QueryRow(c, "SELECT EXISTS(SELECT 1 FROM devices WHERE id=$1 AND owner_id=$2)", id, userID).Scan(&exists)
+		if err != nil {
+			return 500, "Failed to check devices"
+		}
+		if !exists {
+			return 404, "Device not found: " + id
+		}
+	}
+	return 0, ""
+}
+
+// alarmChangeResponse answers an arm, disarm or trigger request with the panel
+func alarmChangeResponse(c *gin.Context, panel *models.AlarmPanel, err error) {
+	switch {
+	case errors.Is(err, alarm.ErrStateChanged):
+		c.JSON(409, gin.H{"error": "The alarm changed state, try again"})
+	case errors.Is(err, alarm.ErrNotDisarmed):
+		c.JSON(409, gin.H{"error": "The alarm must be disarmed first"})
+	case err != nil:
+		log.Printf("Error changing alarm %s: %v", panel.ID, err)
+		c.JSON(500, gin.H{"error": "Failed to change alarm state"})
+	default:
+		c.JSON(200, alarmResponse(*panel))
+	}
+}
+
+func RegisterAlarmRoutes(r *gin.Engine, middlewareManager *middleware.MiddlewareManager, dbConn *pgxpool.Pool, engine EngineInterface, auditLog *audit.Logger) {
+	alarmRoutes := r.Group("/alarm")
+	alarmRoutes.Use(middlewareManager.RequireAuth(), middlewareManager.RateLimit(middleware.RouteClassAPI))
+	{
+		alarmRoutes.GET("", func(c *gin.Context) {
+			panel, err := getUserAlarm(c, dbConn, c.GetString("user_id"))
+			if err != nil {
+				c.JSON(404, gin.H{"error": "No alarm panel configured"})
+				return
+			}
+			c.JSON(200, alarmResponse(*panel))
+		})
+
+		// Create or configure the household's panel
+		alarmRoutes.PUT("", middlewareManager.RateLimit(middleware.RouteClassAuth), func(c *gin.Context) {
+			userID := c.GetString("user_id")
+			var req webModels.AlarmPanelRequest
+			if err := c.ShouldBindJSON(&req); err != nil {
+				println("Error binding JSON:", err.Error())
+				c.JSON(400, gin.H{"error": "Invalid request"})
+				return
+			}
+
+			panel, err := getUserAlarm(c, dbConn, userID)
+			created := errors.Is(err, pgx.ErrNoRows)
+			switch {
+			case created:
+				panel = &models.AlarmPanel{OwnerID: userID, Name: "Alarm", EntryDelay: 30, ExitDelay: 60, TriggerDuration: 600,
+					Sensors: map[string][]string{}, SirenActions: json.RawMessage("[]"), SirenOffActions: json.RawMessage("[]")}
+			case err != nil:
+				println("Error fetching alarm panel:", err.Error())
+				c.JSON(500, gin.H{"error": "Failed to fetch alarm panel"})
+				return
+			case !checkAlarmPIN(c, auditLog, userID, *panel, req.PIN):
+				return
+			}
+			before := *panel
+
+			if req.Name != nil {
+				panel.Name = *req.Name
+			}
+			if req.NewPIN != nil {
+				if *req.NewPIN == "" {
+					panel.PINHash = ""
+				} else if len(*req.NewPIN) < 4 {
+					c.JSON(400, gin.H{"error": "The PIN needs at least 4 characters"})
+					return
+				} else if panel.PINHash, err = alarm.HashPIN(*req.NewPIN); err != nil {
+					c.JSON(500, gin.H{"error": "Failed to set PIN"})
+					return
+				}
+			}
+			if req.ArmRequiresPIN != nil {
+				panel.ArmRequiresPIN = *req.ArmRequiresPIN
+			}
+			if req.EntryDelay != nil {
+				panel.EntryDelay = *req.EntryDelay
+			}
+			if req.ExitDelay != nil {
+				panel.ExitDelay = *req.ExitDelay
+			}
+			if req.TriggerDuration != nil {
+				panel.TriggerDuration = *req.TriggerDuration
+			}
+			if req.Sensors != nil {
+				panel.Sensors = *req.Sensors
+			}
+			if req.SirenActions != nil {
+				panel.SirenActions = req.SirenActions
+			}
+			if req.SirenOffActions != nil {
+				panel.SirenOffActions = req.SirenOffActions
+			}
+			if status, msg := validateAlarm(c, dbConn, userID, *panel); msg != "" {
+				c.JSON(status, gin.H{"error": msg})
+				return
+			}
+
+			if created {
+				err = dbConn.QueryRow(c, `INSERT INTO alarm_panels (owner_id, name, pin_hash, arm_requires_pin, entry_delay_seconds, exit_delay_seconds,
+					trigger_seconds, sensors, siren_actions, siren_off_actions) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+					RETURNING id, state, state_changed_at`,
+					userID, panel.Name, panel.PINHash, panel.ArmRequiresPIN, panel.EntryDelay, panel.ExitDelay,
+					panel.TriggerDuration, panel.Sensors, panel.SirenActions, panel.SirenOffActions).Scan(&panel.ID, &panel.State, &panel.StateChangedAt)
+			} else {
+				_, err = dbConn.Exec(c, `UPDATE alarm_panels SET name=$1, pin_hash=$2, arm_requires_pin=$3, entry_delay_seconds=$4, exit_delay_seconds=$5,
+					trigger_seconds=$6, sensors=$7, siren_actions=$8, siren_off_actions=$9 WHERE id=$10 AND owner_id=$11`,
+					panel.Name, panel.PINHash, panel.ArmRequiresPIN, panel.EntryDelay, panel.ExitDelay,
+					panel.TriggerDuration, panel.Sensors, panel.SirenActions, panel.SirenOffActions, panel.ID, userID)
+			}
+			if err != nil {
+				println("Error saving alarm panel:", err.Error())
+				c.JSON(500, gin.H{"error": "Failed to save alarm panel"})
+				return
+			}
+			entry := audit.Entry{
+				ActorID: userID,
+				Action:  audit.ActionAlarmSave,
+				Source:  audit.RequestSource(c.Request),
+				Details: audit.Marshal(gin.H{"panel_id": panel.ID, "pin_changed": req.NewPIN != nil}),
+				After:   audit.Marshal(panel),
+			}
+			if !created {
+				entry.Before = audit.Marshal(before)
+			}
+			auditLog.Record(c, entry)
+
+			if err := engine.RefreshAlarm(panel.ID); err != nil {
+				log.Printf("Error refreshing alarm panel %s: %v", panel.ID, err)
+			}
+			status := 200
+			if created {
+				status = 201
+			}
+			c.JSON(status, alarmResponse(*panel))
+		})
+
+		alarmRoutes.DELETE("", middlewareManager.RateLimit(middleware.RouteClassAuth), func(c *gin.Context) {
+			userID := c.GetString("user_id")
+			var req webModels.AlarmPINRequest
+			c.ShouldBindJSON(&req)
+			panel, err := getUserAlarm(c, dbConn, userID)
+			if err != nil {
+				c.JSON(404, gin.H{"error": "No alarm panel configured"})
+				return
+			}
+			if !checkAlarmPIN(c, auditLog, userID, *panel, req.PIN) {
+				return
+			}
+			if panel.State != automation.AlarmDisarmed {
+				c.JSON(409, gin.H{"error": "The alarm must be disarmed first"})
+				return
+			}
+
+			if _, err := dbConn.Exec(c, "DELETE FROM alarm_panels WHERE id=$1 AND owner_id=$2", panel.ID, userID); err != nil {
+				println("Error deleting alarm panel:", err.Error())
+				c.JSON(500, gin.H{"error": "Failed to delete alarm panel"})
+				return
+			}
+			auditLog.Record(c, audit.Entry{
+				ActorID: userID,
+				Action:  audit.ActionAlarmDelete,
+				Source:  audit.RequestSource(c.Request),
+				Details: audit.Marshal(gin.H{"panel_id": panel.ID}),
+				Before:  audit.Marshal(panel),
+			})
+
+			if err := engine.RemoveAlarm(*panel); err != nil {
+				log.Printf("Error removing alarm panel %s: %v", panel.ID, err)
+			}
+			c.JSON(200, gin.H{"status": "Alarm panel deleted successfully"})
+		})
+
+		alarmRoutes.POST("/arm", middlewareManager.RateLimit(middleware.RouteClassAuth), func(c *gin.Context) {
+			userID := c.GetString("user_id")
+			var req webModels.AlarmArmRequest
+			if err := c.ShouldBindJSON(&req); err != nil {
+				println("Error binding JSON:", err.Error())
+				c.JSON(400, gin.H{"error": "Invalid request"})
+				return
+			}
+			if !automation.ValidAlarmMode(req.Mode) {
+				c.JSON(400, gin.H{"error": "Mode must be armed_home, armed_away or armed_night"})
+				return
+			}
+			panel, err := getUserAlarm(c, dbConn, userID)
+			if err != nil {
+				c.JSON(404, gin.H{"error": "No alarm panel configured"})
+				return
+			}
+			if panel.ArmRequiresPIN && !checkAlarmPIN(c, auditLog, userID, *panel, req.PIN) {
+				return
+			}
+
+			before := panel.State
+			err = engine.ArmAlarm(panel, req.Mode)
+			if err == nil {
+				auditLog.Record(c, audit.Entry{
+					ActorID: userID,
+					Action:  audit.ActionAlarmArm,
+					Source:  audit.RequestSource(c.Request),
+					Details: audit.Marshal(gin.H{"panel_id": panel.ID, "mode": req.Mode}),
+					Before:  audit.Marshal(before),
+					After:   audit.Marshal(panel.State),
+				})
+			}
+			alarmChangeResponse(c, panel, err)
+		})
+
+		alarmRoutes.POST("/disarm", middlewareManager.RateLimit(middleware.RouteClassAuth), func(c *gin.Context) {
+			userID := c.GetString("user_id")
+			var req webModels.AlarmPINRequest
+			if err := c.ShouldBindJSON(&req); err != nil {
+				println("Error binding JSON:", err.Error())
+				c.JSON(400, gin.H{"error": "Invalid request"})
+				return
+			}
+			panel, err := getUserAlarm(c, dbConn, userID)
+			if err != nil {
+				c.JSON(404, gin.H{"error": "No alarm panel configured"})
+				return
+			}
+			if !checkAlarmPIN(c, auditLog, userID, *panel, req.PIN) {
+				return
+			}
+
+			before := panel.State
+			err = engine.DisarmAlarm(panel)
+			if err == nil && before != panel.State {
+				auditLog.Record(c, audit.Entry{
+					ActorID: userID,
+					Action:  audit.ActionAlarmDisarm,
+					Source:  audit.RequestSource(c.Request),
+					Details: audit.Marshal(gin.H{"panel_id": panel.ID}),
+					Before:  audit.Marshal(before),
+					After:   audit.Marshal(panel.State),
+				})
+			}
+			alarmChangeResponse(c, panel, err)
+		})
+
+		// Panic button: sets off the alarm right away, armed or not
+		alarmRoutes.POST("/trigger", func(c *gin.Context) {
+			userID := c.GetString("user_id")
+			panel, err := getUserAlarm(c, dbConn, userID)
+			if err != nil {
+				c.JSON(404, gin.H{"error": "No alarm panel configured"})
+				return
+			}
+
+			before := panel.State
+			err = engine.TriggerAlarm(panel)
+			if err == nil {
+				auditLog.Record(c, audit.Entry{
+					ActorID: userID,
+					Action:  audit.ActionAlarmTrigger,
+					Source:  audit.RequestSource(c.Request),
+					Details: audit.Marshal(gin.H{"panel_id": panel.ID}),
+					Before:  audit.Marshal(before),
+					After:   audit.Marshal(panel.State),
+				})
+			}
+			alarmChangeResponse(c, panel, err)
+		})
+	}
+}
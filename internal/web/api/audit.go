@@ -0,0 +1,76 @@
+package api
+
+import (
+	"strconv"
+	"time"
+
+	"smarthome/internal/audit"
+	"smarthome/internal/web/middleware"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+func RegisterAuditRoutes(r *gin.Engine, middlewareManager *middleware.MiddlewareManager, dbConn *pgxpool.Pool, auditLog *audit.Logger) {
+	auditGroup := r.Group("/audit")
+	auditGroup.Use(middlewareManager.RequireAuth(), middlewareManager.RateLimit(middleware.RouteClassAPI))
+	{
+		auditGroup.GET("", func(c *gin.Context) {
+			userID := c.GetString("user_id")
+
+			filter := audit.Filter{
+				ActorID:  c.Query("user_id"),
+				DeviceID: c.Query("device_id"),
+				RuleID:   c.Query("rule_id"),
+				Action:   c.Query("action"),
+			}
+			if from := c.Query("from"); from != "" {
+				t, err := time.Parse(time.RFC3339, from)
+				if err != nil {
+					c.JSON(400, gin.H{"error": "Invalid 'from' timestamp, expected RFC3339"})
+					return
+				}
+				filter.From = &t
+			}
+			if to := c.Query("to"); to != "" {
+				t, err := time.Parse(time.RFC3339, to)
+				if err != nil {
+					c.JSON(400, gin.H{"error": "Invalid 'to' timestamp, expected RFC3339"})
+					return
+				}
+				filter.To = &t
+			}
+			if limit := c.Query("limit"); limit != "" {
+				n, err := strconv.Atoi(limit)
+				if err != nil {
+					c.JSON(400, gin.H{"error": "Invalid limit"})
+					return
+				}
+				filter.Limit = n
+			}
+
+			// Only admins may read other users' entries. Everyone else sees what they
+			// did and what happened to their own rules and devices, including engine actions.
+			var role string
+			if err := dbConn.QueryRow(c, "SELECT role FROM users WHERE id=$1", userID).Scan(&role); err != nil {
+				c.JSON(404, gin.H{"error": "User not found"})
+				return
+			}
+			if role != "admin" {
+				if filter.ActorID != "" && filter.ActorID != userID {
+					c.JSON(403, gin.H{"error": "Unauthorized: You can only view your own audit entries"})
+					return
+				}
+				filter.OwnerID = userID
+			}
+
+			entries, err := auditLog.Query(c, filter)
+			if err != nil {
+				println("Error fetching audit log:", err.Error())
+				c.JSON(500, gin.H{"error": "Failed to fetch audit log"})
+				return
+			}
+			c.JSON(200, entries)
+		})
+	}
+}
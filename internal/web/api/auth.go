@@ -1,15 +1,20 @@
 package api
 
 import (
+	"errors"
+	"strconv"
+
 	"smarthome/auth"
+	"smarthome/internal/audit"
 	"smarthome/internal/web/middleware"
 	"smarthome/internal/web/models"
 
 	"github.com/gin-gonic/gin"
 )
 
-func RegisterAuthRoutes(router *gin.Engine, authModule *auth.AuthModule, middlewareManager *middleware.MiddlewareManager, agentID string) {
+func RegisterAuthRoutes(router *gin.Engine, authModule *auth.AuthModule, middlewareManager *middleware.MiddlewareManager, agentID string, auditLog *audit.Logger) {
 	r := router.Group("/auth")
+	r.Use(middlewareManager.RateLimit(middleware.RouteClassAuth))
 	{
 		r.POST("/login", func(c *gin.Context) {
 			var loginRequest models.LoginRequest
@@ -17,12 +22,87 @@ func RegisterAuthRoutes(router *gin.Engine, authModule *auth.AuthModule, middlew
 				c.JSON(400, gin.H{"error": "Invalid request"})
 				return
 			}
-			token, err := authModule.LoginWithJWT(c, loginRequest.Username, loginRequest.Password)
+			result, err := authModule.LoginWithJWT(c, loginRequest.Username, loginRequest.Password, audit.ClientIP(c.Request))
 			if err != nil {
+				auditLog.Record(c, audit.Entry{
+					Actor:   loginRequest.Username,
+					Action:  audit.ActionLoginFailed,
+					Source:  audit.RequestSource(c.Request),
+					Details: audit.Marshal(gin.H{"reason": err.Error()}),
+				})
+				var lockoutErr *auth.LockoutError
+				if errors.As(err, &lockoutErr) {
+					middleware.RejectTooManyRequests(c, lockoutErr.RetryAfter, err.Error())
+					return
+				}
 				c.JSON(401, gin.H{"error": err.Error()})
 				return
 			}
-			c.JSON(200, gin.H{"token": token, "agent_id": agentID})
+			if result.ChallengeToken != "" {
+				c.JSON(200, gin.H{
+					"two_factor_required":       result.TwoFactorRequired,
+					"two_factor_setup_required": result.TwoFactorSetupRequired,
+					"challenge_token":           result.ChallengeToken,
+					"agent_id":                  agentID,
+				})
+				return
+			}
+			auditLog.Record(c, audit.Entry{
+				ActorID: strconv.Itoa(result.UserID),
+				Actor:   loginRequest.Username,
+				Action:  audit.ActionLogin,
+				Source:  audit.RequestSource(c.Request),
+			})
+			c.JSON(200, gin.H{"token": result.Token, "agent_id": agentID})
+		})
+		r.POST("/login/2fa", func(c *gin.Context) {
+			var req models.TwoFactorLoginRequest
+			if err := c.ShouldBindJSON(&req); err != nil || req.ChallengeToken == "" || req.Code == "" {
+				c.JSON(400, gin.H{"error": "Invalid request"})
+				return
+			}
+			result, recoveryCodes, err := authModule.CompleteLoginTwoFactor(c, req.ChallengeToken, req.Code)
+			if err != nil {
+				if result != nil {
+					auditLog.Record(c, audit.Entry{
+						ActorID: strconv.Itoa(result.UserID),
+						Action:  audit.ActionLoginFailed,
+						Source:  audit.RequestSource(c.Request),
+						Details: audit.Marshal(gin.H{"reason": err.Error(), "step": "2fa"}),
+					})
+				}
+				var lockoutErr *auth.LockoutError
+				if errors.As(err, &lockoutErr) {
+					middleware.RejectTooManyRequests(c, lockoutErr.RetryAfter, err.Error())
+					return
+				}
+				c.JSON(401, gin.H{"error": err.Error()})
+				return
+			}
+			auditLog.Record(c, audit.Entry{
+				ActorID: strconv.Itoa(result.UserID),
+				Action:  audit.ActionLogin,
+				Source:  audit.RequestSource(c.Request),
+				Details: audit.Marshal(gin.H{"step": "2fa"}),
+			})
+			response := gin.H{"token": result.Token, "agent_id": agentID}
+			if len(recoveryCodes) > 0 {
+				response["recovery_codes"] = recoveryCodes
+			}
+			c.JSON(200, response)
+		})
+		r.POST("/login/2fa/setup", func(c *gin.Context) {
+			var req models.TwoFactorLoginRequest
+			if err := c.ShouldBindJSON(&req); err != nil || req.ChallengeToken == "" {
+				c.JSON(400, gin.H{"error": "Invalid request"})
+				return
+			}
+			enrollment, err := authModule.BeginLoginTwoFactorSetup(c, req.ChallengeToken)
+			if err != nil {
+				c.JSON(401, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(200, enrollment)
 		})
 		r.POST("/register", func(c *gin.Context) {
 			var registerRequest models.RegisterRequest
@@ -30,12 +110,95 @@ func RegisterAuthRoutes(router *gin.Engine, authModule *auth.AuthModule, middlew
 				c.JSON(400, gin.H{"error": "Invalid request"})
 				return
 			}
-			token, err := authModule.RegisterWithJWT(c, registerRequest.Username, registerRequest.Password, registerRequest.Email)
+			result, err := authModule.RegisterWithJWT(c, registerRequest.Username, registerRequest.Password, registerRequest.Email)
 			if err != nil {
 				c.JSON(400, gin.H{"error": err.Error()})
 				return
 			}
-			c.JSON(201, gin.H{"token": token, "agent_id": agentID})
+			if result.ChallengeToken != "" {
+				c.JSON(201, gin.H{
+					"two_factor_required":       result.TwoFactorRequired,
+					"two_factor_setup_required": result.TwoFactorSetupRequired,
+					"challenge_token":           result.ChallengeToken,
+					"agent_id":                  agentID,
+				})
+				return
+			}
+			c.JSON(201, gin.H{"token": result.Token, "agent_id": agentID})
+		})
+	}
+
+	twoFactor := router.Group("/auth/2fa")
+	twoFactor.Use(middlewareManager.RequireAuth(), middlewareManager.RateLimit(middleware.RouteClassAuth))
+	{
+		twoFactor.GET("", func(c *gin.Context) {
+			userID, _ := strconv.Atoi(c.GetString("user_id"))
+			status, err := authModule.GetTwoFactorStatus(c, userID)
+			if err != nil {
+				c.JSON(500, gin.H{"error": "Failed to fetch two-factor status"})
+				return
+			}
+			c.JSON(200, status)
+		})
+		twoFactor.POST("/setup", func(c *gin.Context) {
+			userID, _ := strconv.Atoi(c.GetString("user_id"))
+			enrollment, err := authModule.BeginTOTPEnrollment(c, userID)
+			if err != nil {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(200, enrollment)
+		})
+		twoFactor.POST("/verify", func(c *gin.Context) {
+			userID, _ := strconv.Atoi(c.GetString("user_id"))
+			var req models.TwoFactorCodeRequest
+			if err := c.ShouldBindJSON(&req); err != nil || req.Code == "" {
+				c.JSON(400, gin.H{"error": "Invalid request"})
+				return
+			}
+			recoveryCodes, err := authModule.ConfirmTOTPEnrollment(c, userID, req.Code)
+			if err != nil {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+			auditLog.Record(c, audit.Entry{
+				ActorID: c.GetString("user_id"),
+				Action:  audit.ActionTwoFactorEnable,
+				Source:  audit.RequestSource(c.Request),
+			})
+			c.JSON(200, gin.H{"status": "Two-factor authentication enabled", "recovery_codes": recoveryCodes})
+		})
+		twoFactor.POST("/recovery-codes", func(c *gin.Context) {
+			userID, _ := strconv.Atoi(c.GetString("user_id"))
+			var req models.TwoFactorCodeRequest
+			if err := c.ShouldBindJSON(&req); err != nil || req.Code == "" {
+				c.JSON(400, gin.H{"error": "Invalid request"})
+				return
+			}
+			recoveryCodes, err := authModule.RegenerateRecoveryCodes(c, userID, req.Code)
+			if err != nil {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(200, gin.H{"recovery_codes": recoveryCodes})
+		})
+		twoFactor.POST("/disable", func(c *gin.Context) {
+			userID, _ := strconv.Atoi(c.GetString("user_id"))
+			var req models.DisableTwoFactorRequest
+			if err := c.ShouldBindJSON(&req); err != nil || req.Password == "" || req.Code == "" {
+				c.JSON(400, gin.H{"error": "Invalid request"})
+				return
+			}
+			if err := authModule.DisableTOTP(c, userID, req.Password, req.Code); err != nil {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+			auditLog.Record(c, audit.Entry{
+				ActorID: c.GetString("user_id"),
+				Action:  audit.ActionTwoFactorDisable,
+				Source:  audit.RequestSource(c.Request),
+			})
+			c.JSON(200, gin.H{"status": "Two-factor authentication disabled"})
 		})
 	}
 }
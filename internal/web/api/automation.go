@@ -2,9 +2,13 @@ package api
 
 import (
 	"log"
+	"smarthome/internal/audit"
+	"smarthome/internal/calendar"
 	"smarthome/internal/models"
+	"smarthome/internal/presence"
 	"smarthome/internal/web/middleware"
 	webModels "smarthome/internal/web/models"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/jackc/pgx/v5/pgxpool"
@@ -15,16 +19,42 @@ type EngineInterface interface {
 	RefreshRuleAssociations(ruleID string) error
 	RemoveRuleAssociations(ruleID string) error
 	TriggerRuleEvaluation(ruleID string)
+	RunRule(ruleID string, skipConditions bool) error
+	RefreshVariable(v models.Variable) error
+	RemoveVariable(v models.Variable) error
+	RefreshDeviceOwner(deviceID string) error
+	RefreshVirtualDevice(deviceID string) error
+	RemoveVirtualDevice(deviceID string) error
+	RefreshSchedule(scheduleID string) error
+	RemoveSchedule(scheduleID string)
+	ScheduleFireTimes(schedule models.Schedule, n int) []time.Time
+	RefreshCalendar(calendarID string) error
+	RemoveCalendar(calendarID string)
+	CalendarOccurrences(calendarID string) []calendar.Occurrence
+	ReportPresence(personID, presence, source string) error
+	RefreshPerson(personID string) error
+	RemovePerson(person models.Person) error
+	ReportGeofence(personID string, ev presence.GeofenceEvent) error
+	RemoveZone(zone models.Zone) error
+	ArmAlarm(panel *models.AlarmPanel, mode string) error
+	DisarmAlarm(panel *models.AlarmPanel) error
+	TriggerAlarm(panel *models.AlarmPanel) error
+	RefreshAlarm(panelID string) error
+	RemoveAlarm(panel models.AlarmPanel) error
+	RefreshInterlocks(deviceID string) error
+	SendCommand(deviceID string, params map[string]interface{}) error
+	SetVacation(ownerID string, enabled bool) (bool, error)
+	RefreshTariff(ownerID string) error
 }
 
-func RegisterAutomationRoutes(r *gin.Engine, middleware *middleware.MiddlewareManager, dbConn *pgxpool.Pool, engine EngineInterface) {
+func RegisterAutomationRoutes(r *gin.Engine, middlewareManager *middleware.MiddlewareManager, dbConn *pgxpool.Pool, engine EngineInterface, auditLog *audit.Logger) {
 	automations := r.Group("/automations")
-	automations.Use(middleware.RequireAuth())
+	automations.Use(middlewareManager.RequireAuth(), middlewareManager.RateLimit(middleware.RouteClassAPI))
 	{
 		automations.GET("/rules", func(c *gin.Context) {
 			userID := c.GetString("user_id")
 			println("User ID from context:", userID)
-			rows, err := dbConn.Query(c, "SELECT id, name, conditions, actions, enabled, owner_id FROM rules WHERE owner_id=$1", userID)
+			rows, err := dbConn.Query(c, "SELECT id, name, conditions, actions, enabled, owner_id, execution FROM rules WHERE owner_id=$1", userID)
 			if err != nil {
 				println("Error fetching rules:", err.Error())
 				c.JSON(500, gin.H{"error": "Failed to fetch rules"})
@@ -35,7 +65,7 @@ func RegisterAutomationRoutes(r *gin.Engine, middleware *middleware.MiddlewareMa
 			automations := []models.Rule{}
 			for rows.Next() {
 				var a models.Rule
-				if err := rows.Scan(&a.ID, &a.Name, &a.Conditions, &a.Actions, &a.Enabled, &a.OwnerID); err != nil {
+				if err := rows.Scan(&a.ID, &a.Name, &a.Conditions, &a.Actions, &a.Enabled, &a.OwnerID, &a.Execution); err != nil {
 					println("Error scanning rule:", err.Error())
 					continue
 				}
@@ -52,36 +82,12 @@ func RegisterAutomationRoutes(r *gin.Engine, middleware *middleware.MiddlewareMa
 				c.JSON(400, gin.H{"error": "Invalid request"})
 				return
 			}
-			_, err := dbConn.Exec(c, "INSERT INTO rules (name, conditions, actions, enabled, owner_id) VALUES ($1, $2, $3, $4, $5)",
-				newRuleReq.Name, newRuleReq.Conditions, newRuleReq.Actions, newRuleReq.Enabled, userID)
+			createdRule, err := createRule(c, dbConn, engine, auditLog, userID, newRuleReq, nil)
 			if err != nil {
-				println("Error creating rule:", err.Error())
-				c.JSON(500, gin.H{"error": "Failed to create rule"})
+				respondRuleSaveError(c, err, "Failed to create rule")
 				return
 			}
 
-			var createdRule models.Rule
-			err = dbConn.QueryRow(c, "SELECT id, name, conditions, actions, enabled, owner_id FROM rules WHERE name=$1 AND owner_id=$2 ORDER BY id DESC LIMIT 1",
-				newRuleReq.Name, userID).Scan(&createdRule.ID, &createdRule.Name, &createdRule.Conditions, &createdRule.Actions, &createdRule.Enabled, &createdRule.OwnerID)
-			if err != nil {
-				println("Error fetching created rule:", err.Error())
-				c.JSON(500, gin.H{"error": "Failed to fetch created rule"})
-				return
-			}
-
-			// Refresh engine associations for the new rule
-			if err := engine.RefreshRuleAssociations(createdRule.ID); err != nil {
-				log.Printf("Error refreshing rule associations for rule %s: %v", createdRule.ID, err)
-				// Don't fail the request, just log the error
-			} else {
-				log.Printf("Successfully refreshed rule associations for new rule %s", createdRule.ID)
-				// Trigger immediate evaluation of the new rule if it's enabled
-				if createdRule.Enabled {
-					engine.TriggerRuleEvaluation(createdRule.ID)
-					log.Printf("Triggered immediate evaluation for new rule %s", createdRule.ID)
-				}
-			}
-
 			c.JSON(201, createdRule)
 		})
 
@@ -89,6 +95,14 @@ func RegisterAutomationRoutes(r *gin.Engine, middleware *middleware.MiddlewareMa
 			userID := c.GetString("user_id")
 			ruleID := c.Param("id")
 
+			var existingRule models.Rule
+			row := dbConn.QueryRow(c, "SELECT id, name, conditions, actions, enabled, owner_id, execution FROM rules WHERE id=$1 AND owner_id=$2", ruleID, userID)
+			if err := row.Scan(&existingRule.ID, &existingRule.Name, &existingRule.Conditions, &existingRule.Actions, &existingRule.Enabled, &existingRule.OwnerID, &existingRule.Execution); err != nil {
+				println("Error fetching existing rule:", err.Error())
+				c.JSON(404, gin.H{"error": "Rule not found"})
+				return
+			}
+
 			// Remove engine associations before deleting the rule
 			if err := engine.RemoveRuleAssociations(ruleID); err != nil {
 				log.Printf("Error removing rule associations for rule %s: %v", ruleID, err)
@@ -100,9 +114,20 @@ func RegisterAutomationRoutes(r *gin.Engine, middleware *middleware.MiddlewareMa
 			_, err := dbConn.Exec(c, "DELETE FROM rules WHERE id=$1 AND owner_id=$2", ruleID, userID)
 			if err != nil {
 				println("Error deleting rule:", err.Error())
+				// The rule still exists, load it back into the engine
+				if err := engine.RefreshRuleAssociations(ruleID); err != nil {
+					log.Printf("Error restoring rule associations for rule %s: %v", ruleID, err)
+				}
 				c.JSON(500, gin.H{"error": "Failed to delete rule"})
 				return
 			}
+			auditLog.Record(c, audit.Entry{
+				ActorID: userID,
+				Action:  audit.ActionRuleDelete,
+				Source:  audit.RequestSource(c.Request),
+				RuleID:  ruleID,
+				Before:  audit.Marshal(existingRule),
+			})
 			c.JSON(200, gin.H{"status": "Rule deleted successfully"})
 		})
 
@@ -118,13 +143,15 @@ func RegisterAutomationRoutes(r *gin.Engine, middleware *middleware.MiddlewareMa
 
 			// First get the existing rule
 			var existingRule models.Rule
-			row := dbConn.QueryRow(c, "SELECT id, name, conditions, actions, enabled, owner_id FROM rules WHERE id=$1 AND owner_id=$2", ruleID, userID)
-			if err := row.Scan(&existingRule.ID, &existingRule.Name, &existingRule.Conditions, &existingRule.Actions, &existingRule.Enabled, &existingRule.OwnerID); err != nil {
+			row := dbConn.QueryRow(c, "SELECT id, name, conditions, actions, enabled, owner_id, execution FROM rules WHERE id=$1 AND owner_id=$2", ruleID, userID)
+			if err := row.Scan(&existingRule.ID, &existingRule.Name, &existingRule.Conditions, &existingRule.Actions, &existingRule.Enabled, &existingRule.OwnerID, &existingRule.Execution); err != nil {
 				println("Error fetching existing rule:", err.Error())
 				c.JSON(404, gin.H{"error": "Rule not found"})
 				return
 			}
 
+			before := existingRule
+
 			// Update only the fields that were provided
 			if updateRuleReq.Name != nil {
 				existingRule.Name = *updateRuleReq.Name
@@ -138,29 +165,62 @@ func RegisterAutomationRoutes(r *gin.Engine, middleware *middleware.MiddlewareMa
 			if updateRuleReq.Enabled != nil {
 				existingRule.Enabled = *updateRuleReq.Enabled
 			}
+			if updateRuleReq.Execution != nil {
+				existingRule.Execution = *updateRuleReq.Execution
+			}
 
-			_, err := dbConn.Exec(c, "UPDATE rules SET name=$1, conditions=$2, actions=$3, enabled=$4 WHERE id=$5 AND owner_id=$6",
-				existingRule.Name, existingRule.Conditions, existingRule.Actions, existingRule.Enabled, existingRule.ID, existingRule.OwnerID)
-			if err != nil {
-				println("Error updating rule:", err.Error())
-				c.JSON(500, gin.H{"error": "Failed to update rule"})
+			if err := updateRule(c, dbConn, engine, auditLog, userID, before, existingRule, nil); err != nil {
+				respondRuleSaveError(c, err, "Failed to update rule")
 				return
 			}
 
-			// Refresh engine associations for the updated rule
-			if err := engine.RefreshRuleAssociations(existingRule.ID); err != nil {
-				log.Printf("Error refreshing rule associations for rule %s: %v", existingRule.ID, err)
-				// Don't fail the request, just log the error
-			} else {
-				log.Printf("Successfully refreshed rule associations for updated rule %s", existingRule.ID)
-				// Trigger immediate evaluation of the updated rule if it's enabled
-				if existingRule.Enabled {
-					engine.TriggerRuleEvaluation(existingRule.ID)
-					log.Printf("Triggered immediate evaluation for updated rule %s", existingRule.ID)
+			c.JSON(200, existingRule)
+		})
+
+		// Run a rule now; {"skip_conditions": true} executes its actions unconditionally
+		automations.POST("/rules/:id/run", func(c *gin.Context) {
+			userID := c.GetString("user_id")
+			ruleID := c.Param("id")
+			var req webModels.RunRuleRequest
+			if c.Request.ContentLength > 0 {
+				if err := c.ShouldBindJSON(&req); err != nil {
+					println("Error binding JSON:", err.Error())
+					c.JSON(400, gin.H{"error": "Invalid request"})
+					return
 				}
 			}
 
-			c.JSON(200, existingRule)
+			var enabled bool
+			if err := dbConn.QueryRow(c, "SELECT enabled FROM rules WHERE id=$1 AND owner_id=$2", ruleID, userID).Scan(&enabled); err != nil {
+				c.JSON(404, gin.H{"error": "Rule not found"})
+				return
+			}
+			if !enabled {
+				c.JSON(409, gin.H{"error": "Rule is disabled"})
+				return
+			}
+
+			if err := engine.RunRule(ruleID, req.SkipConditions); err != nil {
+				println("Error running rule:", err.Error())
+				c.JSON(500, gin.H{"error": "Failed to run rule"})
+				return
+			}
+			auditLog.Record(c, audit.Entry{
+				ActorID: userID,
+				Action:  audit.ActionRuleRun,
+				Source:  audit.RequestSource(c.Request),
+				RuleID:  ruleID,
+				Details: audit.Marshal(gin.H{"skip_conditions": req.SkipConditions}),
+			})
+			c.JSON(202, gin.H{"status": "Rule run queued", "skip_conditions": req.SkipConditions})
 		})
+
+		registerRuleRevisionRoutes(automations, dbConn, engine, auditLog)
+		registerRuleRunRoutes(automations, dbConn)
+		registerBundleRoutes(automations, dbConn, engine, auditLog)
+		registerBlueprintRoutes(automations, dbConn, engine, auditLog)
+		registerVariableRoutes(automations, dbConn, engine, auditLog)
+		registerScheduleRoutes(automations, dbConn, engine, auditLog)
+		registerCalendarRoutes(automations, dbConn, engine, auditLog)
 	}
 }
@@ -0,0 +1,571 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"smarthome/internal/audit"
+	"smarthome/internal/automation"
+	"smarthome/internal/models"
+	"smarthome/internal/scheduler"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"gopkg.in/yaml.v3"
+)
+
+// importRulePlan describes what an import does with a single bundle rule
+type importRulePlan struct {
+	Name    string `json:"name"`
+	Action  string `json:"action"` // "create", "update", "skip"
+	NewName string `json:"new_name,omitempty"`
+	RuleID  string `json:"rule_id,omitempty"`
+
+	conditions json.RawMessage
+	actions    json.RawMessage
+	enabled    bool
+	execution  models.RuleExecution
+	ruleRefs   bool // References other rules by name, resolved once all rules have IDs
+}
+
+// bundleFormat picks yaml or json from the ?format= query or the request content type
+func bundleFormat(c *gin.Context) string {
+	if format := strings.ToLower(c.Query("format")); format == "json" || format == "yaml" {
+		return format
+	}
+	if strings.Contains(c.ContentType(), "json") {
+		return "json"
+	}
+	return "yaml"
+}
+
+func registerBundleRoutes(automations *gin.RouterGroup, dbConn *pgxpool.Pool, engine EngineInterface, auditLog *audit.Logger) {
+	// Export the user's rules as a bundle. Query parameters:
+	//   format=yaml|json   body format (default yaml)
+	//   timestamp=true     include exported_at; without it repeated exports are byte-identical
+	automations.GET("/export", func(c *gin.Context) {
+		userID := c.GetString("user_id")
+		format := c.DefaultQuery("format", "yaml")
+
+		rows, err := dbConn.Query(c, "SELECT id, name, conditions, actions, enabled, execution FROM rules WHERE owner_id=$1 ORDER BY id", userID)
+		if err != nil {
+			println("Error fetching rules:", err.Error())
+			c.JSON(500, gin.H{"error": "Failed to fetch rules"})
+			return
+		}
+		var rules []models.Rule
+		for rows.Next() {
+			var r models.Rule
+			if err := rows.Scan(&r.ID, &r.Name, &r.Conditions, &r.Actions, &r.Enabled, &r.Execution); err != nil {
+				println("Error scanning rule:", err.Error())
+				continue
+			}
+			rules = append(rules, r)
+		}
+		rows.Close()
+
+		// Collect every device referenced by the exported rules
+		ruleNames := make(map[string]string)
+		referenced := make(map[string]bool)
+		for _, r := range rules {
+			ruleNames[r.ID] = r.Name
+			for _, id := range automation.CollectDeviceIDs(automation.DecodeJSONValue(r.Conditions)) {
+				referenced[id] = true
+			}
+			for _, id := range automation.CollectDeviceIDs(automation.DecodeJSONValue(r.Actions)) {
+				referenced[id] = true
+			}
+		}
+
+		now := time.Now().UTC()
+		bundle := automation.Bundle{
+			Version: automation.BundleVersion,
+			Devices: []automation.BundleDevice{},
+			Rules:   []automation.BundleRule{},
+		}
+		if c.Query("timestamp") == "true" {
+			bundle.ExportedAt = &now
+		}
+
+		// Devices are referenced by name; duplicate names are disambiguated with the ID.
+		// IDs are visited in order so the same rules always export the same refs.
+		deviceIDs := make([]string, 0, len(referenced))
+		for deviceID := range referenced {
+			deviceIDs = append(deviceIDs, deviceID)
+		}
+		sort.Strings(deviceIDs)
+
+		refs := make(map[string]string)
+		usedRefs := make(map[string]bool)
+		for _, deviceID := range deviceIDs {
+			var device models.Device
+			err := dbConn.QueryRow(c, "SELECT id, name, type FROM devices WHERE id=$1 AND owner_id=$2", deviceID, userID).Scan(&device.ID, &device.Name, &device.Type)
+			if err != nil {
+				device = models.Device{ID: deviceID, Name: deviceID, Type: "unknown"}
+			}
+			ref := device.Name
+			if usedRefs[ref] {
+				ref = fmt.Sprintf("%s (%s)", device.Name, device.ID)
+			}
+			usedRefs[ref] = true
+			refs[deviceID] = ref
+			bundle.Devices = append(bundle.Devices, automation.BundleDevice{Ref: ref, ID: device.ID, Name: device.Name, Type: device.Type})
+		}
+
+		toRef := func(id string) (string, bool) {
+			ref, ok := refs[id]
+			return ref, ok
+		}
+		toRuleName := func(id string) (string, bool) {
+			name, ok := ruleNames[id]
+			return name, ok
+		}
+		for _, r := range rules {
+			conditions, _ := automation.RemapDeviceIDs(automation.DecodeJSONValue(r.Conditions), toRef)
+			actions, _ := automation.RemapDeviceIDs(automation.DecodeJSONValue(r.Actions), toRef)
+			conditions, _ = automation.RemapRuleRefs(conditions, toRuleName)
+			actions, _ = automation.RemapRuleRefs(actions, toRuleName)
+			bundle.Rules = append(bundle.Rules, automation.BundleRule{
+				Name:       r.Name,
+				Enabled:    r.Enabled,
+				Conditions: conditions,
+				Actions:    actions,
+				Execution:  r.Execution,
+			})
+		}
+
+		scheduleRows, err := dbConn.Query(c,
+			"SELECT s.rule_id, s.cron_expression, s.run_at, s.timezone, s.exclude_dates, s.catch_up, s.catch_up_grace_seconds, s.enabled FROM schedules s JOIN rules r ON r.id = s.rule_id WHERE r.owner_id=$1 AND NOT s.auto AND s.calendar_id IS NULL ORDER BY s.id", userID)
+		if err != nil {
+			println("Error fetching schedules:", err.Error())
+			c.JSON(500, gin.H{"error": "Failed to fetch schedules"})
+			return
+		}
+		for scheduleRows.Next() {
+			var s models.Schedule
+			if err := scheduleRows.Scan(&s.RuleID, &s.CronExpression, &s.RunAt, &s.Timezone, &s.ExcludeDates, &s.CatchUp, &s.CatchUpGrace, &s.Enabled); err != nil {
+				continue
+			}
+			bundle.Schedules = append(bundle.Schedules, automation.BundleSchedule{
+				Rule:           ruleNames[s.RuleID],
+				CronExpression: s.CronExpression,
+				RunAt:          s.RunAt,
+				Timezone:       s.Timezone,
+				ExcludeDates:   s.ExcludeDates,
+				CatchUp:        s.CatchUp,
+				CatchUpGrace:   s.CatchUpGrace,
+				Enabled:        s.Enabled,
+			})
+		}
+		scheduleRows.Close()
+
+		filename := fmt.Sprintf("automations-%s", now.Format("20060102-150405"))
+		if format == "json" {
+			c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%s.json", filename))
+			c.JSON(200, bundle)
+			return
+		}
+
+		out, err := yaml.Marshal(bundle)
+		if err != nil {
+			c.JSON(500, gin.H{"error": "Failed to encode bundle"})
+			return
+		}
+		c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%s.yaml", filename))
+		c.Data(200, "application/x-yaml", out)
+	})
+
+	// Import a bundle. Query parameters:
+	//   dry_run=true          only report what would happen
+	//   on_conflict=fail|skip|overwrite|rename   handling of rules whose name already exists (default fail)
+	//   format=yaml|json      body format (defaults to the Content-Type)
+	automations.POST("/import", func(c *gin.Context) {
+		userID := c.GetString("user_id")
+		dryRun := c.Query("dry_run") == "true"
+		onConflict := c.DefaultQuery("on_conflict", "fail")
+		if onConflict != "fail" && onConflict != "skip" && onConflict != "overwrite" && onConflict != "rename" {
+			c.JSON(400, gin.H{"error": "on_conflict must be one of fail, skip, overwrite, rename"})
+			return
+		}
+
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.JSON(400, gin.H{"error": "Invalid request"})
+			return
+		}
+		var bundle automation.Bundle
+		if bundleFormat(c) == "json" {
+			err = json.Unmarshal(body, &bundle)
+		} else {
+			err = yaml.Unmarshal(body, &bundle)
+		}
+		if err != nil {
+			c.JSON(400, gin.H{"error": "Invalid bundle: " + err.Error()})
+			return
+		}
+		if bundle.Version > automation.BundleVersion {
+			c.JSON(400, gin.H{"error": fmt.Sprintf("Unsupported bundle version %d", bundle.Version)})
+			return
+		}
+
+		// Resolve device refs to local devices owned by the importing user:
+		// explicit device_map first, then a device with the same name, then the original ID.
+		// A ref in device_map only resolves to its mapped device, so a mistyped mapping is
+		// reported instead of silently matching something else.
+		// Refs used by rules but missing from the devices list are treated as names/IDs.
+		bundleDevices := append([]automation.BundleDevice{}, bundle.Devices...)
+		listed := make(map[string]bool)
+		for _, d := range bundleDevices {
+			listed[d.Ref] = true
+		}
+		for _, br := range bundle.Rules {
+			refs := append(automation.CollectDeviceIDs(br.Conditions), automation.CollectDeviceIDs(br.Actions)...)
+			for _, ref := range refs {
+				if !listed[ref] {
+					listed[ref] = true
+					bundleDevices = append(bundleDevices, automation.BundleDevice{Ref: ref, ID: ref, Name: ref})
+				}
+			}
+		}
+
+		deviceMap := make(map[string]string)
+		unresolvedDevices := []string{}
+		for _, d := range bundleDevices {
+			var localID string
+			candidates := []struct{ query, arg string }{
+				{"SELECT id FROM devices WHERE name=$1 AND owner_id=$2 ORDER BY id LIMIT 1", d.Name},
+				{"SELECT id FROM devices WHERE id=$1 AND owner_id=$2", d.ID},
+			}
+			if mapped, ok := bundle.DeviceMap[d.Ref]; ok {
+				candidates = []struct{ query, arg string }{
+					{"SELECT id FROM devices WHERE id=$1 AND owner_id=$2", mapped},
+				}
+			}
+			for _, candidate := range candidates {
+				if candidate.arg == "" {
+					continue
+				}
+				if err := dbConn.QueryRow(c, candidate.query, candidate.arg, userID).Scan(&localID); err == nil {
+					break
+				}
+			}
+			if localID == "" {
+				unresolvedDevices = append(unresolvedDevices, d.Ref)
+				continue
+			}
+			deviceMap[d.Ref] = localID
+		}
+		toLocalID := func(ref string) (string, bool) {
+			id, ok := deviceMap[ref]
+			return id, ok
+		}
+
+		// Existing rules of the user by name, for conflict detection
+		existing := make(map[string]string)
+		rows, err := dbConn.Query(c, "SELECT id, name FROM rules WHERE owner_id=$1", userID)
+		if err != nil {
+			c.JSON(500, gin.H{"error": "Failed to fetch rules"})
+			return
+		}
+		for rows.Next() {
+			var id, name string
+			if err := rows.Scan(&id, &name); err == nil {
+				existing[name] = id
+			}
+		}
+		rows.Close()
+
+		// Rules reference each other by name: either another rule in the bundle or an existing rule
+		bundleNames := make(map[string]bool)
+		for _, br := range bundle.Rules {
+			bundleNames[br.Name] = true
+		}
+		unresolvedRules := []string{}
+
+		plans := []importRulePlan{}
+		conflicts := []string{}
+		seenNames := make(map[string]bool)
+		for _, br := range bundle.Rules {
+			if br.Name == "" || seenNames[br.Name] {
+				c.JSON(400, gin.H{"error": fmt.Sprintf("Bundle contains an empty or duplicate rule name %q", br.Name)})
+				return
+			}
+			seenNames[br.Name] = true
+
+			conditions, _ := automation.RemapDeviceIDs(br.Conditions, toLocalID)
+			actions, _ := automation.RemapDeviceIDs(br.Actions, toLocalID)
+
+			plan := importRulePlan{Name: br.Name, Action: "create", enabled: br.Enabled, execution: br.Execution}
+			for _, ref := range append(automation.CollectRuleRefs(br.Conditions), automation.CollectRuleRefs(br.Actions)...) {
+				plan.ruleRefs = true
+				if !bundleNames[ref] && existing[ref] == "" {
+					unresolvedRules = append(unresolvedRules, ref)
+				}
+			}
+			plan.conditions, _ = json.Marshal(conditions)
+			plan.actions, _ = json.Marshal(actions)
+			if err := automation.ValidateConditions(plan.conditions); err != nil {
+				c.JSON(400, gin.H{"error": fmt.Sprintf("Rule %q: %v", br.Name, err)})
+				return
+			}
+			if err := automation.ValidateActions(plan.actions); err != nil {
+				c.JSON(400, gin.H{"error": fmt.Sprintf("Rule %q: %v", br.Name, err)})
+				return
+			}
+			if err := automation.ValidateExecution(plan.execution); err != nil {
+				c.JSON(400, gin.H{"error": fmt.Sprintf("Rule %q: %v", br.Name, err)})
+				return
+			}
+			// Calendars are not part of bundles; calendar conditions must name one of the user's calendars
+			for _, ref := range automation.ExtractCalendarRefs(plan.conditions) {
+				var exists bool
+				err := dbConn.QueryRow(c, "SELECT EXISTS(SELECT 1 FROM calendars WHERE id::text=$1 AND owner_id=$2)", ref, userID).Scan(&exists)
+				if err != nil || !exists {
+					c.JSON(400, gin.H{"error": fmt.Sprintf("Rule %q: unknown calendar %s", br.Name, ref)})
+					return
+				}
+			}
+
+			if existingID, ok := existing[br.Name]; ok {
+				conflicts = append(conflicts, br.Name)
+				switch onConflict {
+				case "skip":
+					plan.Action = "skip"
+					plan.RuleID = existingID
+				case "overwrite":
+					plan.Action = "update"
+					plan.RuleID = existingID
+				case "rename":
+					plan.NewName = uniqueRuleName(br.Name, existing)
+					existing[plan.NewName] = ""
+				}
+			}
+			plans = append(plans, plan)
+		}
+		for _, bs := range bundle.Schedules {
+			schedule := models.Schedule{CronExpression: bs.CronExpression, RunAt: bs.RunAt, Timezone: bs.Timezone, ExcludeDates: bs.ExcludeDates, CatchUp: bs.CatchUp, CatchUpGrace: bs.CatchUpGrace}
+			if err := scheduler.ValidateSchedule(schedule); err != nil {
+				c.JSON(400, gin.H{"error": fmt.Sprintf("Schedule of rule %q: %v", bs.Rule, err)})
+				return
+			}
+		}
+
+		report := gin.H{
+			"dry_run":            dryRun,
+			"rules":              plans,
+			"device_map":         deviceMap,
+			"unresolved_devices": unresolvedDevices,
+			"unresolved_rules":   unresolvedRules,
+			"conflicts":          conflicts,
+		}
+		if dryRun {
+			c.JSON(200, report)
+			return
+		}
+		if len(unresolvedDevices) > 0 {
+			report["error"] = "Bundle references devices that could not be resolved; add them to device_map"
+			c.JSON(422, report)
+			return
+		}
+		if len(unresolvedRules) > 0 {
+			report["error"] = "Bundle references rules that are neither in the bundle nor exist"
+			c.JSON(422, report)
+			return
+		}
+		if len(conflicts) > 0 && onConflict == "fail" {
+			report["error"] = "Rules with the same name already exist; choose on_conflict=skip, overwrite or rename"
+			c.JSON(409, report)
+			return
+		}
+
+		tx, err := dbConn.Begin(c)
+		if err != nil {
+			c.JSON(500, gin.H{"error": "Failed to start import"})
+			return
+		}
+		defer tx.Rollback(c)
+
+		ruleIDs := make(map[string]string) // bundle rule name -> local rule ID
+		var previousRules []models.Rule
+		for i := range plans {
+			plan := &plans[i]
+			name := plan.Name
+			if plan.NewName != "" {
+				name = plan.NewName
+			}
+
+			switch plan.Action {
+			case "create":
+				err = tx.QueryRow(c, "INSERT INTO rules (name, conditions, actions, enabled, owner_id, execution) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id",
+					name, plan.conditions, plan.actions, plan.enabled, userID, plan.execution).Scan(&plan.RuleID)
+			case "update":
+				var previous models.Rule
+				err = tx.QueryRow(c, "SELECT id, name, conditions, actions, enabled, owner_id, execution FROM rules WHERE id=$1", plan.RuleID).
+					Scan(&previous.ID, &previous.Name, &previous.Conditions, &previous.Actions, &previous.Enabled, &previous.OwnerID, &previous.Execution)
+				if err == nil {
+					previousRules = append(previousRules, previous)
+					_, err = tx.Exec(c, "UPDATE rules SET conditions=$1, actions=$2, enabled=$3, execution=$4 WHERE id=$5 AND owner_id=$6",
+						plan.conditions, plan.actions, plan.enabled, plan.execution, plan.RuleID, userID)
+				}
+			}
+			if err != nil {
+				println("Error importing rule:", err.Error())
+				c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to import rule %q", plan.Name)})
+				return
+			}
+			if plan.Action != "skip" {
+				ruleIDs[plan.Name] = plan.RuleID
+			}
+		}
+
+		// Rule names can be resolved to IDs now that every imported rule exists
+		toLocalRuleID := func(name string) (string, bool) {
+			if id, ok := ruleIDs[name]; ok {
+				return id, true
+			}
+			id := existing[name]
+			return id, id != ""
+		}
+		for i := range plans {
+			plan := &plans[i]
+			if plan.Action == "skip" || !plan.ruleRefs {
+				continue
+			}
+			conditions, _ := automation.RemapRuleRefs(automation.DecodeJSONValue(plan.conditions), toLocalRuleID)
+			actions, _ := automation.RemapRuleRefs(automation.DecodeJSONValue(plan.actions), toLocalRuleID)
+			plan.conditions, _ = json.Marshal(conditions)
+			plan.actions, _ = json.Marshal(actions)
+			if _, err := tx.Exec(c, "UPDATE rules SET conditions=$1, actions=$2 WHERE id=$3", plan.conditions, plan.actions, plan.RuleID); err != nil {
+				println("Error importing rule:", err.Error())
+				c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to import rule %q", plan.Name)})
+				return
+			}
+		}
+
+		// Imported rules must pass the same reference checks as rules saved through
+		// the API; the transaction sees the rules created above
+		for _, plan := range plans {
+			if plan.Action == "skip" {
+				continue
+			}
+			if err := checkRuleReferences(c, tx, userID, plan.conditions, plan.actions); err != nil {
+				var validationErr *ruleValidationError
+				if errors.As(err, &validationErr) {
+					c.JSON(400, gin.H{"error": fmt.Sprintf("Rule %q: %v", plan.Name, err)})
+					return
+				}
+				println("Error checking imported rule:", err.Error())
+				c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to import rule %q", plan.Name)})
+				return
+			}
+		}
+
+		for _, s := range bundle.Schedules {
+			ruleID, ok := ruleIDs[s.Rule]
+			if !ok {
+				continue
+			}
+			excludeDates := s.ExcludeDates
+			if excludeDates == nil {
+				excludeDates = []string{}
+			}
+			catchUp, catchUpGrace := s.CatchUp, s.CatchUpGrace
+			if catchUp == "" {
+				catchUp = scheduler.CatchUpSkip
+			}
+			if catchUpGrace == 0 {
+				catchUpGrace = scheduler.DefaultCatchUpGrace
+			}
+			_, err = tx.Exec(c,
+				`INSERT INTO schedules (rule_id, cron_expression, run_at, timezone, exclude_dates, catch_up, catch_up_grace_seconds, enabled)
+				 SELECT $1, $2, $3, $4, $5, $6, $7, $8 WHERE NOT EXISTS (
+				   SELECT 1 FROM schedules WHERE rule_id = $1 AND cron_expression = $2 AND run_at IS NOT DISTINCT FROM $3 AND timezone = $4)`,
+				ruleID, s.CronExpression, s.RunAt, s.Timezone, excludeDates, catchUp, catchUpGrace, s.Enabled)
+			if err != nil {
+				println("Error importing schedule:", err.Error())
+				c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to import schedule for rule %q", s.Rule)})
+				return
+			}
+		}
+
+		// Revisions are recorded in the import transaction so history cannot miss an imported change
+		type importedRule struct {
+			rule     models.Rule
+			previous *models.Rule
+		}
+		imported := []importedRule{}
+		for _, plan := range plans {
+			if plan.Action == "skip" {
+				continue
+			}
+			var rule models.Rule
+			err := tx.QueryRow(c, "SELECT id, name, conditions, actions, enabled, owner_id, execution FROM rules WHERE id=$1", plan.RuleID).
+				Scan(&rule.ID, &rule.Name, &rule.Conditions, &rule.Actions, &rule.Enabled, &rule.OwnerID, &rule.Execution)
+			if err == nil {
+				var previous *models.Rule
+				if plan.Action == "update" {
+					for i := range previousRules {
+						if previousRules[i].ID == rule.ID {
+							previous = &previousRules[i]
+						}
+					}
+				}
+				err = recordRuleRevision(c, tx, previous, rule, userID, nil)
+				imported = append(imported, importedRule{rule: rule, previous: previous})
+			}
+			if err != nil {
+				println("Error recording imported rule:", err.Error())
+				c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to import rule %q", plan.Name)})
+				return
+			}
+		}
+
+		if err := tx.Commit(c); err != nil {
+			c.JSON(500, gin.H{"error": "Failed to commit import"})
+			return
+		}
+
+		// Audit and notify the engine about every imported rule
+		for _, ir := range imported {
+			rule := ir.rule
+			entry := audit.Entry{
+				ActorID: userID,
+				Action:  audit.ActionRuleCreate,
+				Source:  audit.RequestSource(c.Request),
+				RuleID:  rule.ID,
+				Details: audit.Marshal(gin.H{"import": true}),
+				After:   audit.Marshal(rule),
+			}
+			if ir.previous != nil {
+				entry.Action = audit.ActionRuleUpdate
+				entry.Before = audit.Marshal(ir.previous)
+			}
+			auditLog.Record(c, entry)
+
+			if err := engine.RefreshRuleAssociations(rule.ID); err != nil {
+				log.Printf("Error refreshing rule associations for rule %s: %v", rule.ID, err)
+			} else if rule.Enabled {
+				engine.TriggerRuleEvaluation(rule.ID)
+			}
+		}
+
+		c.JSON(200, report)
+	})
+}
+
+// uniqueRuleName appends an "(imported)" suffix until the name is free
+func uniqueRuleName(name string, existing map[string]string) string {
+	candidate := name + " (imported)"
+	for i := 2; ; i++ {
+		if _, taken := existing[candidate]; !taken {
+			return candidate
+		}
+		candidate = fmt.Sprintf("%s (imported %d)", name, i)
+	}
+}
@@ -0,0 +1,406 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+
+	"smarthome/internal/audit"
+	"smarthome/internal/automation"
+	"smarthome/internal/models"
+	webModels "smarthome/internal/web/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// blueprintInstance links a rule to the blueprint and inputs it was created from
+type blueprintInstance struct {
+	RuleID  string                 `json:"rule_id"`
+	Name    string                 `json:"name"`
+	Enabled bool                   `json:"enabled"`
+	Inputs  map[string]interface{} `json:"inputs"`
+}
+
+// getBlueprint returns a built-in blueprint or one of the user's own
+func getBlueprint(c *gin.Context, dbConn *pgxpool.Pool, userID, slug string) (*automation.Blueprint, error) {
+	if b, ok := automation.BuiltinBlueprint(slug); ok {
+		return b, nil
+	}
+
+	var b automation.Blueprint
+	var inputs json.RawMessage
+	var ownerID string
+	err := dbConn.QueryRow(c, "SELECT slug, name, description, inputs, conditions, actions, owner_id FROM blueprints WHERE slug=$1 AND owner_id=$2", slug, userID).
+		Scan(&b.Slug, &b.Name, &b.Description, &inputs, &b.Conditions, &b.Actions, &ownerID)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(inputs, &b.Inputs); err != nil {
+		return nil, err
+	}
+	b.OwnerID = &ownerID
+	return &b, nil
+}
+
+// userDeviceType looks up the type of a device owned by the user
+func userDeviceType(c *gin.Context, dbConn *pgxpool.Pool, userID string) func(string) (string, bool) {
+	return func(deviceID string) (string, bool) {
+		var deviceType string
+		err := dbConn.QueryRow(c, "SELECT type FROM devices WHERE id=$1 AND owner_id=$2", deviceID, userID).Scan(&deviceType)
+		if err != nil {
+			return "", false
+		}
+		return deviceType, true
+	}
+}
+
+// getBlueprintInstances lists the user's rules created from a blueprint
+func getBlueprintInstances(c *gin.Context, dbConn *pgxpool.Pool, userID, slug string) ([]blueprintInstance, error) {
+	rows, err := dbConn.Query(c,
+		`SELECT r.id, r.name, r.enabled, bi.inputs FROM blueprint_instances bi
+		 JOIN rules r ON r.id = bi.rule_id
+		 WHERE bi.blueprint_slug=$1 AND r.owner_id=$2 ORDER BY r.id`, slug, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	instances := []blueprintInstance{}
+	for rows.Next() {
+		var inst blueprintInstance
+		var inputs json.RawMessage
+		if err := rows.Scan(&inst.RuleID, &inst.Name, &inst.Enabled, &inputs); err != nil {
+			println("Error scanning blueprint instance:", err.Error())
+			continue
+		}
+		json.Unmarshal(inputs, &inst.Inputs)
+		instances = append(instances, inst)
+	}
+	return instances, nil
+}
+
+// renderBlueprintInstance re-renders an instance's rule from the blueprint and saves it
+func renderBlueprintInstance(c *gin.Context, dbConn *pgxpool.Pool, engine EngineInterface, auditLog *audit.Logger, userID string, blueprint *automation.Blueprint, ruleID string, values map[string]interface{}) (*models.Rule, error) {
+	inputs, err := blueprint.ResolveInputs(values, userDeviceType(c, dbConn, userID))
+	if err != nil {
+		return nil, err
+	}
+	conditions, actions, err := blueprint.Render(inputs)
+	if err != nil {
+		return nil, err
+	}
+
+	var existingRule models.Rule
+	row := dbConn.QueryRow(c, "SELECT id, name, conditions, actions, enabled, owner_id, execution FROM rules WHERE id=$1 AND owner_id=$2", ruleID, userID)
+	if err := row.Scan(&existingRule.ID, &existingRule.Name, &existingRule.Conditions, &existingRule.Actions, &existingRule.Enabled, &existingRule.OwnerID, &existingRule.Execution); err != nil {
+		return nil, err
+	}
+
+	updated := existingRule
+	updated.Conditions = conditions
+	updated.Actions = actions
+	if !jsonEqual(existingRule.Conditions, updated.Conditions) || !jsonEqual(existingRule.Actions, updated.Actions) {
+		if err := updateRule(c, dbConn, engine, auditLog, userID, existingRule, updated, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	inputsJSON, _ := json.Marshal(inputs)
+	if _, err := dbConn.Exec(c, "UPDATE blueprint_instances SET inputs=$1 WHERE rule_id=$2", inputsJSON, ruleID); err != nil {
+		return nil, err
+	}
+	return &updated, nil
+}
+
+func registerBlueprintRoutes(automations *gin.RouterGroup, dbConn *pgxpool.Pool, engine EngineInterface, auditLog *audit.Logger) {
+	automations.GET("/blueprints", func(c *gin.Context) {
+		userID := c.GetString("user_id")
+		blueprints := automation.BuiltinBlueprints()
+
+		rows, err := dbConn.Query(c, "SELECT slug, name, description, inputs, conditions, actions, owner_id FROM blueprints WHERE owner_id=$1 ORDER BY slug", userID)
+		if err != nil {
+			println("Error fetching blueprints:", err.Error())
+			c.JSON(500, gin.H{"error": "Failed to fetch blueprints"})
+			return
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var b automation.Blueprint
+			var inputs json.RawMessage
+			var ownerID string
+			if err := rows.Scan(&b.Slug, &b.Name, &b.Description, &inputs, &b.Conditions, &b.Actions, &ownerID); err != nil {
+				println("Error scanning blueprint:", err.Error())
+				continue
+			}
+			json.Unmarshal(inputs, &b.Inputs)
+			b.OwnerID = &ownerID
+			blueprints = append(blueprints, b)
+		}
+		c.JSON(200, blueprints)
+	})
+
+	automations.POST("/blueprints", func(c *gin.Context) {
+		userID := c.GetString("user_id")
+		var blueprint automation.Blueprint
+		if err := c.ShouldBindJSON(&blueprint); err != nil {
+			println("Error binding JSON:", err.Error())
+			c.JSON(400, gin.H{"error": "Invalid request"})
+			return
+		}
+		blueprint.Builtin = false
+		blueprint.OwnerID = &userID
+		if err := blueprint.Validate(); err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		if _, ok := automation.BuiltinBlueprint(blueprint.Slug); ok {
+			c.JSON(409, gin.H{"error": "A built-in blueprint with this slug already exists"})
+			return
+		}
+
+		inputs, _ := json.Marshal(blueprint.Inputs)
+		tag, err := dbConn.Exec(c,
+			"INSERT INTO blueprints (slug, name, description, inputs, conditions, actions, owner_id) VALUES ($1, $2, $3, $4, $5, $6, $7) ON CONFLICT (owner_id, slug) DO NOTHING",
+			blueprint.Slug, blueprint.Name, blueprint.Description, inputs, blueprint.Conditions, blueprint.Actions, userID)
+		if err != nil {
+			println("Error creating blueprint:", err.Error())
+			c.JSON(500, gin.H{"error": "Failed to create blueprint"})
+			return
+		}
+		if tag.RowsAffected() == 0 {
+			c.JSON(409, gin.H{"error": "A blueprint with this slug already exists"})
+			return
+		}
+		c.JSON(201, blueprint)
+	})
+
+	automations.GET("/blueprints/:slug", func(c *gin.Context) {
+		blueprint, err := getBlueprint(c, dbConn, c.GetString("user_id"), c.Param("slug"))
+		if err != nil {
+			c.JSON(404, gin.H{"error": "Blueprint not found"})
+			return
+		}
+		c.JSON(200, blueprint)
+	})
+
+	// Update a blueprint; with ?update_instances=true every rule created from it is re-rendered
+	automations.PATCH("/blueprints/:slug", func(c *gin.Context) {
+		userID := c.GetString("user_id")
+		slug := c.Param("slug")
+		var req webModels.UpdateBlueprintRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			println("Error binding JSON:", err.Error())
+			c.JSON(400, gin.H{"error": "Invalid request"})
+			return
+		}
+
+		if _, ok := automation.BuiltinBlueprint(slug); ok {
+			c.JSON(403, gin.H{"error": "Built-in blueprints cannot be modified"})
+			return
+		}
+		blueprint, err := getBlueprint(c, dbConn, userID, slug)
+		if err != nil {
+			c.JSON(404, gin.H{"error": "Blueprint not found"})
+			return
+		}
+
+		if req.Name != nil {
+			blueprint.Name = *req.Name
+		}
+		if req.Description != nil {
+			blueprint.Description = *req.Description
+		}
+		if req.Inputs != nil {
+			if err := json.Unmarshal(*req.Inputs, &blueprint.Inputs); err != nil {
+				c.JSON(400, gin.H{"error": "Invalid inputs"})
+				return
+			}
+		}
+		if req.Conditions != nil {
+			blueprint.Conditions = *req.Conditions
+		}
+		if req.Actions != nil {
+			blueprint.Actions = *req.Actions
+		}
+		if err := blueprint.Validate(); err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+
+		inputs, _ := json.Marshal(blueprint.Inputs)
+		_, err = dbConn.Exec(c, "UPDATE blueprints SET name=$1, description=$2, inputs=$3, conditions=$4, actions=$5 WHERE slug=$6 AND owner_id=$7",
+			blueprint.Name, blueprint.Description, inputs, blueprint.Conditions, blueprint.Actions, slug, userID)
+		if err != nil {
+			println("Error updating blueprint:", err.Error())
+			c.JSON(500, gin.H{"error": "Failed to update blueprint"})
+			return
+		}
+
+		if c.Query("update_instances") != "true" {
+			c.JSON(200, gin.H{"blueprint": blueprint})
+			return
+		}
+
+		instances, err := getBlueprintInstances(c, dbConn, userID, slug)
+		if err != nil {
+			println("Error fetching blueprint instances:", err.Error())
+			c.JSON(500, gin.H{"error": "Blueprint updated but its instances could not be fetched"})
+			return
+		}
+
+		// Instances whose stored inputs no longer fit the blueprint are left unchanged and reported
+		updated := []string{}
+		failed := []gin.H{}
+		for _, inst := range instances {
+			// Stored values of inputs that were removed from the blueprint are dropped
+			values := make(map[string]interface{})
+			for _, in := range blueprint.Inputs {
+				if value, ok := inst.Inputs[in.Name]; ok {
+					values[in.Name] = value
+				}
+			}
+			if _, err := renderBlueprintInstance(c, dbConn, engine, auditLog, userID, blueprint, inst.RuleID, values); err != nil {
+				log.Printf("API: Failed to update rule %s from blueprint %s: %v", inst.RuleID, slug, err)
+				failed = append(failed, gin.H{"rule_id": inst.RuleID, "error": err.Error()})
+				continue
+			}
+			updated = append(updated, inst.RuleID)
+		}
+		c.JSON(200, gin.H{"blueprint": blueprint, "updated_rules": updated, "failed_rules": failed})
+	})
+
+	// Delete a blueprint; rules created from it are kept as regular rules
+	automations.DELETE("/blueprints/:slug", func(c *gin.Context) {
+		userID := c.GetString("user_id")
+		slug := c.Param("slug")
+		if _, ok := automation.BuiltinBlueprint(slug); ok {
+			c.JSON(403, gin.H{"error": "Built-in blueprints cannot be deleted"})
+			return
+		}
+
+		tag, err := dbConn.Exec(c, "DELETE FROM blueprints WHERE slug=$1 AND owner_id=$2", slug, userID)
+		if err != nil {
+			println("Error deleting blueprint:", err.Error())
+			c.JSON(500, gin.H{"error": "Failed to delete blueprint"})
+			return
+		}
+		if tag.RowsAffected() == 0 {
+			c.JSON(404, gin.H{"error": "Blueprint not found"})
+			return
+		}
+		_, err = dbConn.Exec(c, "DELETE FROM blueprint_instances WHERE blueprint_slug=$1 AND rule_id IN (SELECT id FROM rules WHERE owner_id=$2)", slug, userID)
+		if err != nil {
+			println("Error unlinking blueprint instances:", err.Error())
+		}
+		c.JSON(200, gin.H{"status": "Blueprint deleted successfully"})
+	})
+
+	// Create a concrete rule from a blueprint
+	automations.POST("/blueprints/:slug/instantiate", func(c *gin.Context) {
+		userID := c.GetString("user_id")
+		slug := c.Param("slug")
+		var req webModels.InstantiateBlueprintRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			println("Error binding JSON:", err.Error())
+			c.JSON(400, gin.H{"error": "Invalid request"})
+			return
+		}
+
+		blueprint, err := getBlueprint(c, dbConn, userID, slug)
+		if err != nil {
+			c.JSON(404, gin.H{"error": "Blueprint not found"})
+			return
+		}
+
+		inputs, err := blueprint.ResolveInputs(req.Inputs, userDeviceType(c, dbConn, userID))
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		conditions, actions, err := blueprint.Render(inputs)
+		if err != nil {
+			println("Error rendering blueprint:", err.Error())
+			c.JSON(500, gin.H{"error": "Failed to render blueprint"})
+			return
+		}
+
+		name := req.Name
+		if name == "" {
+			name = blueprint.Name
+		}
+		enabled := true
+		if req.Enabled != nil {
+			enabled = *req.Enabled
+		}
+
+		createdRule, err := createRule(c, dbConn, engine, auditLog, userID, webModels.AddRuleRequest{
+			Name:       name,
+			Conditions: conditions,
+			Actions:    actions,
+			Enabled:    enabled,
+		}, gin.H{"blueprint": slug, "inputs": inputs})
+		if err != nil {
+			respondRuleSaveError(c, err, "Failed to create rule")
+			return
+		}
+
+		inputsJSON, _ := json.Marshal(inputs)
+		if _, err := dbConn.Exec(c, "INSERT INTO blueprint_instances (rule_id, blueprint_slug, inputs) VALUES ($1, $2, $3)", createdRule.ID, slug, inputsJSON); err != nil {
+			log.Printf("API: Failed to link rule %s to blueprint %s: %v", createdRule.ID, slug, err)
+		}
+
+		c.JSON(201, createdRule)
+	})
+
+	automations.GET("/blueprints/:slug/instances", func(c *gin.Context) {
+		instances, err := getBlueprintInstances(c, dbConn, c.GetString("user_id"), c.Param("slug"))
+		if err != nil {
+			println("Error fetching blueprint instances:", err.Error())
+			c.JSON(500, gin.H{"error": "Failed to fetch blueprint instances"})
+			return
+		}
+		c.JSON(200, instances)
+	})
+
+	// Change the inputs of a single instance and re-render its rule
+	automations.PATCH("/blueprints/:slug/instances/:rule_id", func(c *gin.Context) {
+		userID := c.GetString("user_id")
+		slug := c.Param("slug")
+		var req webModels.UpdateBlueprintInstanceRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			println("Error binding JSON:", err.Error())
+			c.JSON(400, gin.H{"error": "Invalid request"})
+			return
+		}
+
+		blueprint, err := getBlueprint(c, dbConn, userID, slug)
+		if err != nil {
+			c.JSON(404, gin.H{"error": "Blueprint not found"})
+			return
+		}
+
+		var stored json.RawMessage
+		err = dbConn.QueryRow(c,
+			"SELECT bi.inputs FROM blueprint_instances bi JOIN rules r ON r.id = bi.rule_id WHERE bi.rule_id=$1 AND bi.blueprint_slug=$2 AND r.owner_id=$3",
+			c.Param("rule_id"), slug, userID).Scan(&stored)
+		if err != nil {
+			c.JSON(404, gin.H{"error": "Blueprint instance not found"})
+			return
+		}
+
+		// Inputs not supplied keep their stored values
+		values := make(map[string]interface{})
+		json.Unmarshal(stored, &values)
+		for name, value := range req.Inputs {
+			values[name] = value
+		}
+
+		rule, err := renderBlueprintInstance(c, dbConn, engine, auditLog, userID, blueprint, c.Param("rule_id"), values)
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200, rule)
+	})
+}
@@ -0,0 +1,270 @@
+package api
+
+import (
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"smarthome/internal/audit"
+	"smarthome/internal/calendar"
+	"smarthome/internal/clock"
+	"smarthome/internal/models"
+	webModels "smarthome/internal/web/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const calendarColumns = "id, owner_id, name, url, content, timezone, refresh_minutes, refreshed_at, last_error"
+
+// defaultCalendarOccurrences is how many upcoming occurrences are listed per calendar
+const defaultCalendarOccurrences = 20
+
+func scanCalendarRow(row pgx.Row) (*models.Calendar, error) {
+	var cal models.Calendar
+	err := row.Scan(&cal.ID, &cal.OwnerID, &cal.Name, &cal.URL, &cal.Content, &cal.Timezone, &cal.RefreshMinutes, &cal.RefreshedAt, &cal.LastError)
+	if err != nil {
+		return nil, err
+	}
+	return &cal, nil
+}
+
+// getUserCalendar fetches a calendar owned by the user
+func getUserCalendar(c *gin.Context, dbConn *pgxpool.Pool, userID, id string) (*models.Calendar, error) {
+	return scanCalendarRow(dbConn.QueryRow(c, "SELECT "+calendarColumns+" FROM calendars WHERE id=$1 AND owner_id=$2", id, userID))
+}
+
+// validateCalendar checks a calendar's source and settings. Imported content is parsed
+// here so a broken file is rejected; URLs are fetched by the refresh.
+func validateCalendar(cal models.Calendar) string {
+	if strings.TrimSpace(cal.Name) == "" {
+		return "Name is required"
+	}
+	if (cal.URL == "") == (cal.Content == "") {
+		return "Exactly one of url or content is required"
+	}
+	if cal.URL != "" && !strings.HasPrefix(cal.URL, "http://") && !strings.HasPrefix(cal.URL, "https://") && !strings.HasPrefix(cal.URL, "webcal://") {
+		return "Calendar url must be http, https or webcal"
+	}
+	loc := time.Local
+	if cal.Timezone != "" {
+		var err error
+		if loc, err = time.LoadLocation(cal.Timezone); err != nil {
+			return "Unknown timezone " + cal.Timezone
+		}
+	}
+	if cal.RefreshMinutes < 5 || cal.RefreshMinutes > 1440 {
+		return "refresh_minutes must be between 5 and 1440"
+	}
+	if cal.Content != "" {
+		if _, err := calendar.Parse([]byte(cal.Content), loc); err != nil {
+			return "Invalid calendar: " + err.Error()
+		}
+	}
+	return ""
+}
+
+// calendarResponse adds the calendar's current and upcoming occurrences
+func calendarResponse(engine EngineInterface, cal models.Calendar, count int) webModels.CalendarResponse {
+	resp := webModels.CalendarResponse{Calendar: cal, Occurrences: []calendar.Occurrence{}}
+	now := clock.Now()
+	for _, occ := range engine.CalendarOccurrences(cal.ID) {
+		if len(resp.Occurrences) == count {
+			break
+		}
+		if occ.End.After(now) {
+			resp.Occurrences = append(resp.Occurrences, occ)
+		}
+	}
+	return resp
+}
+
+// refreshUserCalendar refreshes a calendar and reloads it so the response shows the outcome
+func refreshUserCalendar(c *gin.Context, dbConn *pgxpool.Pool, engine EngineInterface, userID string, cal *models.Calendar) *models.Calendar {
+	if err := engine.RefreshCalendar(cal.ID); err != nil {
+		log.Printf("Error refreshing calendar %s: %v", cal.ID, err)
+	}
+	if refreshed, err := getUserCalendar(c, dbConn, userID, cal.ID); err == nil {
+		return refreshed
+	}
+	return cal
+}
+
+func registerCalendarRoutes(automations *gin.RouterGroup, dbConn *pgxpool.Pool, engine EngineInterface, auditLog *audit.Logger) {
+	automations.GET("/calendars", func(c *gin.Context) {
+		rows, err := dbConn.Query(c, "SELECT "+calendarColumns+" FROM calendars WHERE owner_id=$1 ORDER BY name, id", c.GetString("user_id"))
+		if err != nil {
+			println("Error fetching calendars:", err.Error())
+			c.JSON(500, gin.H{"error": "Failed to fetch calendars"})
+			return
+		}
+		defer rows.Close()
+
+		calendars := []models.Calendar{}
+		for rows.Next() {
+			cal, err := scanCalendarRow(rows)
+			if err != nil {
+				println("Error scanning calendar:", err.Error())
+				continue
+			}
+			calendars = append(calendars, *cal)
+		}
+		c.JSON(200, calendars)
+	})
+
+	// Get a calendar with its next ?count= occurrences, including those in progress
+	automations.GET("/calendars/:id", func(c *gin.Context) {
+		cal, err := getUserCalendar(c, dbConn, c.GetString("user_id"), c.Param("id"))
+		if err != nil {
+			c.JSON(404, gin.H{"error": "Calendar not found"})
+			return
+		}
+		count := defaultCalendarOccurrences
+		if value := c.Query("count"); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 || n > 500 {
+				c.JSON(400, gin.H{"error": "Invalid count, expected 1-500"})
+				return
+			}
+			count = n
+		}
+		c.JSON(200, calendarResponse(engine, *cal, count))
+	})
+
+	automations.POST("/calendars", func(c *gin.Context) {
+		userID := c.GetString("user_id")
+		var req webModels.CreateCalendarRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			println("Error binding JSON:", err.Error())
+			c.JSON(400, gin.H{"error": "Invalid request"})
+			return
+		}
+
+		cal := models.Calendar{OwnerID: userID, Name: req.Name, URL: req.URL, Content: req.Content, Timezone: req.Timezone, RefreshMinutes: 60}
+		if req.RefreshMinutes != nil {
+			cal.RefreshMinutes = *req.RefreshMinutes
+		}
+		if msg := validateCalendar(cal); msg != "" {
+			c.JSON(400, gin.H{"error": msg})
+			return
+		}
+
+		err := dbConn.QueryRow(c,
+			"INSERT INTO calendars (owner_id, name, url, content, timezone, refresh_minutes) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id",
+			userID, cal.Name, cal.URL, cal.Content, cal.Timezone, cal.RefreshMinutes).Scan(&cal.ID)
+		if err != nil {
+			println("Error creating calendar:", err.Error())
+			c.JSON(500, gin.H{"error": "Failed to create calendar"})
+			return
+		}
+		auditLog.Record(c, audit.Entry{
+			ActorID: userID,
+			Action:  audit.ActionCalendarSave,
+			Source:  audit.RequestSource(c.Request),
+			Details: audit.Marshal(gin.H{"calendar_id": cal.ID, "name": cal.Name}),
+			After:   audit.Marshal(cal),
+		})
+
+		c.JSON(201, calendarResponse(engine, *refreshUserCalendar(c, dbConn, engine, userID, &cal), defaultCalendarOccurrences))
+	})
+
+	automations.PATCH("/calendars/:id", func(c *gin.Context) {
+		userID := c.GetString("user_id")
+		var req webModels.UpdateCalendarRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			println("Error binding JSON:", err.Error())
+			c.JSON(400, gin.H{"error": "Invalid request"})
+			return
+		}
+
+		cal, err := getUserCalendar(c, dbConn, userID, c.Param("id"))
+		if err != nil {
+			c.JSON(404, gin.H{"error": "Calendar not found"})
+			return
+		}
+		before := *cal
+
+		if req.Name != nil {
+			cal.Name = *req.Name
+		}
+		// A calendar is either fetched or imported; setting one source clears the other
+		if req.URL != nil {
+			cal.URL = *req.URL
+			if cal.URL != "" {
+				cal.Content = ""
+			}
+		}
+		if req.Content != nil {
+			cal.Content = *req.Content
+			if cal.Content != "" {
+				cal.URL = ""
+			}
+		}
+		if req.Timezone != nil {
+			cal.Timezone = *req.Timezone
+		}
+		if req.RefreshMinutes != nil {
+			cal.RefreshMinutes = *req.RefreshMinutes
+		}
+		if msg := validateCalendar(*cal); msg != "" {
+			c.JSON(400, gin.H{"error": msg})
+			return
+		}
+
+		_, err = dbConn.Exec(c, "UPDATE calendars SET name=$1, url=$2, content=$3, timezone=$4, refresh_minutes=$5 WHERE id=$6 AND owner_id=$7",
+			cal.Name, cal.URL, cal.Content, cal.Timezone, cal.RefreshMinutes, cal.ID, userID)
+		if err != nil {
+			println("Error updating calendar:", err.Error())
+			c.JSON(500, gin.H{"error": "Failed to update calendar"})
+			return
+		}
+		auditLog.Record(c, audit.Entry{
+			ActorID: userID,
+			Action:  audit.ActionCalendarSave,
+			Source:  audit.RequestSource(c.Request),
+			Details: audit.Marshal(gin.H{"calendar_id": cal.ID, "name": cal.Name}),
+			Before:  audit.Marshal(before),
+			After:   audit.Marshal(cal),
+		})
+
+		c.JSON(200, calendarResponse(engine, *refreshUserCalendar(c, dbConn, engine, userID, cal), defaultCalendarOccurrences))
+	})
+
+	// Refetch a calendar now instead of waiting for its refresh interval
+	automations.POST("/calendars/:id/refresh", func(c *gin.Context) {
+		userID := c.GetString("user_id")
+		cal, err := getUserCalendar(c, dbConn, userID, c.Param("id"))
+		if err != nil {
+			c.JSON(404, gin.H{"error": "Calendar not found"})
+			return
+		}
+		c.JSON(200, calendarResponse(engine, *refreshUserCalendar(c, dbConn, engine, userID, cal), defaultCalendarOccurrences))
+	})
+
+	// Deleting a calendar also deletes the schedules firing on its events
+	automations.DELETE("/calendars/:id", func(c *gin.Context) {
+		userID := c.GetString("user_id")
+		cal, err := getUserCalendar(c, dbConn, userID, c.Param("id"))
+		if err != nil {
+			c.JSON(404, gin.H{"error": "Calendar not found"})
+			return
+		}
+
+		engine.RemoveCalendar(cal.ID)
+		if _, err := dbConn.Exec(c, "DELETE FROM calendars WHERE id=$1 AND owner_id=$2", cal.ID, userID); err != nil {
+			println("Error deleting calendar:", err.Error())
+			c.JSON(500, gin.H{"error": "Failed to delete calendar"})
+			return
+		}
+		auditLog.Record(c, audit.Entry{
+			ActorID: userID,
+			Action:  audit.ActionCalendarDelete,
+			Source:  audit.RequestSource(c.Request),
+			Details: audit.Marshal(gin.H{"calendar_id": cal.ID, "name": cal.Name}),
+			Before:  audit.Marshal(cal),
+		})
+		c.JSON(200, gin.H{"status": "Calendar deleted successfully"})
+	})
+}
@@ -2,8 +2,12 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"strings"
 
+	"smarthome/internal/audit"
+	"smarthome/internal/automation"
 	"smarthome/internal/models"
 	"smarthome/internal/web/middleware"
 
@@ -12,14 +16,17 @@ import (
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
-func RegisterDeviceRoutes(r *gin.Engine, middleware *middleware.MiddlewareManager, dbConn *pgxpool.Pool, mqttClient mqtt.Client) {
+func RegisterDeviceRoutes(r *gin.Engine, middlewareManager *middleware.MiddlewareManager, dbConn *pgxpool.Pool, mqttClient mqtt.Client, engine EngineInterface, auditLog *audit.Logger) {
 	devices := r.Group("/devices")
-	devices.Use(middleware.RequireAuth())
+	devices.Use(middlewareManager.RequireAuth(), middlewareManager.RateLimit(middleware.RouteClassAPI))
 	{
+		registerVirtualDeviceRoutes(devices, dbConn, engine, auditLog)
+
 		devices.GET("/", func(c *gin.Context) {
 			userID := c.GetString("user_id")
 			println("User ID from context:", userID)
-			rows, err := dbConn.Query(c, "SELECT id, name, type, state, mqtt_topic, accepted, owner_id FROM devices WHERE owner_id=$1 AND accepted=true", userID)
+			rows, err := dbConn.Query(c, `SELECT d.id, d.name, d.type, d.state, d.mqtt_topic, d.accepted, d.owner_id, v.device_id IS NOT NULL, d.room
+				FROM devices d LEFT JOIN virtual_devices v ON v.device_id = d.id WHERE d.owner_id=$1 AND d.accepted=true`, userID)
 			if err != nil {
 				println("Error fetching devices:", err.Error())
 				c.JSON(500, gin.H{"error": "Failed to fetch devices"})
@@ -30,7 +37,7 @@ func RegisterDeviceRoutes(r *gin.Engine, middleware *middleware.MiddlewareManage
 			devices := []models.Device{}
 			for rows.Next() {
 				var device models.Device
-				if err := rows.Scan(&device.ID, &device.Name, &device.Type, &device.State, &device.MQTTTopic, &device.Accepted, &device.OwnerID); err != nil {
+				if err := rows.Scan(&device.ID, &device.Name, &device.Type, &device.State, &device.MQTTTopic, &device.Accepted, &device.OwnerID, &device.Virtual, &device.Room); err != nil {
 					c.JSON(500, gin.H{"error": "Failed to scan device"})
 					return
 				}
@@ -75,6 +82,15 @@ func RegisterDeviceRoutes(r *gin.Engine, middleware *middleware.MiddlewareManage
 				c.JSON(404, gin.H{"error": "Device not found"})
 				return
 			}
+			auditLog.Record(c, audit.Entry{
+				ActorID:  userID,
+				Action:   audit.ActionDeviceAccept,
+				Source:   audit.RequestSource(c.Request),
+				DeviceID: deviceID,
+			})
+			if err := engine.RefreshDeviceOwner(deviceID); err != nil {
+				println("Error caching device owner:", err.Error())
+			}
 			c.JSON(200, gin.H{"status": "Device accepted successfully"})
 		})
 
@@ -82,6 +98,12 @@ func RegisterDeviceRoutes(r *gin.Engine, middleware *middleware.MiddlewareManage
 			deviceID := c.Param("id")
 			newOwnerID := c.GetString("user_id")
 
+			var previousOwnerID *string
+			if err := dbConn.QueryRow(c, "SELECT owner_id FROM devices WHERE id=$1", deviceID).Scan(&previousOwnerID); err != nil {
+				c.JSON(404, gin.H{"error": "Device not found"})
+				return
+			}
+
 			commandTag, err := dbConn.Exec(c, "UPDATE devices SET owner_id=$1 WHERE id=$2", newOwnerID, deviceID)
 			if err != nil {
 				c.JSON(500, gin.H{"error": "Failed to update device owner"})
@@ -91,17 +113,28 @@ func RegisterDeviceRoutes(r *gin.Engine, middleware *middleware.MiddlewareManage
 				c.JSON(404, gin.H{"error": "Device not found"})
 				return
 			}
+			auditLog.Record(c, audit.Entry{
+				ActorID:  newOwnerID,
+				Action:   audit.ActionDeviceOwnerChange,
+				Source:   audit.RequestSource(c.Request),
+				DeviceID: deviceID,
+				Before:   audit.Marshal(gin.H{"owner_id": previousOwnerID}),
+				After:    audit.Marshal(gin.H{"owner_id": newOwnerID}),
+			})
+			if err := engine.RefreshDeviceOwner(deviceID); err != nil {
+				println("Error caching device owner:", err.Error())
+			}
 			c.JSON(200, gin.H{"status": "Owner updated successfully"})
 		})
 
-		devices.POST("/:id/command", func(c *gin.Context) {
+		devices.POST("/:id/command", middlewareManager.RateLimit(middleware.RouteClassCommand), func(c *gin.Context) {
 			deviceID := c.Param("id")
 			userID := c.GetString("user_id")
 
 			// Verify device ownership and acceptance
 			var ownerID *string
-			var accepted bool
-			err := dbConn.QueryRow(c, "SELECT owner_id, accepted FROM devices WHERE id=$1", deviceID).Scan(&ownerID, &accepted)
+			var accepted, virtual bool
+			err := dbConn.QueryRow(c, "SELECT owner_id, accepted, EXISTS(SELECT 1 FROM virtual_devices WHERE device_id=$1) FROM devices WHERE id=$1", deviceID).Scan(&ownerID, &accepted, &virtual)
 			if err != nil {
 				c.JSON(404, gin.H{"error": "Device not found"})
 				return
@@ -114,6 +147,10 @@ func RegisterDeviceRoutes(r *gin.Engine, middleware *middleware.MiddlewareManage
 				c.JSON(403, gin.H{"error": "Unauthorized: You don't own this device"})
 				return
 			}
+			if virtual {
+				c.JSON(400, gin.H{"error": "Virtual devices cannot receive commands"})
+				return
+			}
 
 			// Parse command parameters from request body
 			var commandParams map[string]interface{}
@@ -122,7 +159,7 @@ func RegisterDeviceRoutes(r *gin.Engine, middleware *middleware.MiddlewareManage
 				return
 			}
 
-			// Publish command to MQTT
+			// Publish command to MQTT through the interlock gate
 			if mqttClient != nil {
 				payload, err := json.Marshal(commandParams)
 				if err != nil {
@@ -131,14 +168,31 @@ func RegisterDeviceRoutes(r *gin.Engine, middleware *middleware.MiddlewareManage
 				}
 
 				topic := fmt.Sprintf("devices/%s/commands", deviceID)
-				token := mqttClient.Publish(topic, 1, false, payload)
-				token.Wait()
-
-				if token.Error() != nil {
+				if err := engine.SendCommand(deviceID, commandParams); err != nil {
+					var rejection *automation.InterlockError
+					if errors.As(err, &rejection) {
+						auditLog.Record(c, audit.Entry{
+							ActorID:  userID,
+							Action:   audit.ActionCommandRejected,
+							Source:   audit.RequestSource(c.Request),
+							DeviceID: deviceID,
+							Details:  audit.Marshal(gin.H{"params": commandParams, "interlock": rejection}),
+						})
+						c.JSON(409, gin.H{"error": rejection.Reason, "interlock": rejection.Name})
+						return
+					}
 					c.JSON(500, gin.H{"error": "Failed to publish command"})
 					return
 				}
 
+				auditLog.Record(c, audit.Entry{
+					ActorID:  userID,
+					Action:   audit.ActionDeviceCommand,
+					Source:   audit.RequestSource(c.Request),
+					DeviceID: deviceID,
+					Details:  payload,
+				})
+
 				c.JSON(200, gin.H{
 					"status":  "Command sent successfully",
 					"topic":   topic,
@@ -191,7 +245,8 @@ func RegisterDeviceRoutes(r *gin.Engine, middleware *middleware.MiddlewareManage
 			})
 		})
 
-		devices.DELETE("/:id", func(c *gin.Context) {
+		// Set the room a device is in, empty to clear it; energy summaries group devices by room
+		devices.PATCH("/:id/room", func(c *gin.Context) {
 			deviceID := c.Param("id")
 			userID := c.GetString("user_id")
 
@@ -207,6 +262,48 @@ func RegisterDeviceRoutes(r *gin.Engine, middleware *middleware.MiddlewareManage
 				return
 			}
 
+			var requestBody struct {
+				Room *string `json:"room" binding:"required"`
+			}
+			if err := c.ShouldBindJSON(&requestBody); err != nil {
+				c.JSON(400, gin.H{"error": "Invalid request: room is required"})
+				return
+			}
+			room := strings.TrimSpace(*requestBody.Room)
+
+			commandTag, err := dbConn.Exec(c, "UPDATE devices SET room=$1 WHERE id=$2", room, deviceID)
+			if err != nil {
+				c.JSON(500, gin.H{"error": "Failed to update device room"})
+				return
+			}
+			if commandTag.RowsAffected() == 0 {
+				c.JSON(404, gin.H{"error": "Device not found"})
+				return
+			}
+
+			c.JSON(200, gin.H{
+				"status": "Device room updated successfully",
+				"room":   room,
+			})
+		})
+
+		devices.DELETE("/:id", func(c *gin.Context) {
+			deviceID := c.Param("id")
+			userID := c.GetString("user_id")
+
+			// Verify device ownership
+			var ownerID *string
+			var virtual bool
+			err := dbConn.QueryRow(c, "SELECT owner_id, EXISTS(SELECT 1 FROM virtual_devices WHERE device_id=$1) FROM devices WHERE id=$1", deviceID).Scan(&ownerID, &virtual)
+			if err != nil {
+				c.JSON(404, gin.H{"error": "Device not found"})
+				return
+			}
+			if ownerID == nil || *ownerID != userID {
+				c.JSON(403, gin.H{"error": "Unauthorized: You don't own this device"})
+				return
+			}
+
 			// Delete the device
 			commandTag, err := dbConn.Exec(c, "DELETE FROM devices WHERE id=$1", deviceID)
 			if err != nil {
@@ -217,6 +314,20 @@ func RegisterDeviceRoutes(r *gin.Engine, middleware *middleware.MiddlewareManage
 				c.JSON(404, gin.H{"error": "Device not found"})
 				return
 			}
+			auditLog.Record(c, audit.Entry{
+				ActorID:  userID,
+				Action:   audit.ActionDeviceDelete,
+				Source:   audit.RequestSource(c.Request),
+				DeviceID: deviceID,
+			})
+			if err := engine.RefreshDeviceOwner(deviceID); err != nil {
+				println("Error forgetting device owner:", err.Error())
+			}
+			if virtual {
+				if err := engine.RemoveVirtualDevice(deviceID); err != nil {
+					println("Error removing virtual device:", err.Error())
+				}
+			}
 
 			c.JSON(200, gin.H{
 				"status": "Device deleted successfully",
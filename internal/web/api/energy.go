@@ -0,0 +1,210 @@
+package api
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"smarthome/internal/audit"
+	"smarthome/internal/automation"
+	"smarthome/internal/clock"
+	"smarthome/internal/models"
+	"smarthome/internal/web/middleware"
+	webModels "smarthome/internal/web/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// getUserTariff fetches the tariff of a household
+func getUserTariff(c *gin.Context, dbConn *pgxpool.Pool, userID string) (*models.EnergyTariff, error) {
+	var t models.EnergyTariff
+	err := dbConn.QueryRow(c, "SELECT id, owner_id, kind, currency, rate, periods FROM energy_tariffs WHERE owner_id=$1", userID).
+		Scan(&t.ID, &t.OwnerID, &t.Kind, &t.Currency, &t.Rate, &t.Periods)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// energyPeriod resolves the summary period: a day (date=YYYY-MM-DD) or a month
+// (date=YYYY-MM), today or this month by default, as [from, to) dates
+func energyPeriod(period, date string) (time.Time, time.Time, string) {
+	now := clock.Now().In(clock.Location())
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	switch period {
+	case "", automation.EnergyDay:
+		from := today
+		if date != "" {
+			parsed, err := time.ParseInLocation("2006-01-02", date, now.Location())
+			if err != nil {
+				return time.Time{}, time.Time{}, "date must be YYYY-MM-DD"
+			}
+			from = parsed
+		}
+		return from, from.AddDate(0, 0, 1), ""
+	case automation.EnergyMonth:
+		from := today.AddDate(0, 0, 1-today.Day())
+		if date != "" {
+			parsed, err := time.ParseInLocation("2006-01", date, now.Location())
+			if err != nil {
+				return time.Time{}, time.Time{}, "date must be YYYY-MM"
+			}
+			from = parsed
+		}
+		return from, from.AddDate(0, 1, 0), ""
+	}
+	return time.Time{}, time.Time{}, "period must be day or month"
+}
+
+func RegisterEnergyRoutes(r *gin.Engine, middlewareManager *middleware.MiddlewareManager, dbConn *pgxpool.Pool, engine EngineInterface, auditLog *audit.Logger) {
+	energy := r.Group("/energy")
+	energy.Use(middlewareManager.RequireAuth(), middlewareManager.RateLimit(middleware.RouteClassAPI))
+	{
+		// Consumption and cost per device, per room and per day, e.g. ?period=month&date=2024-05
+		energy.GET("/summary", func(c *gin.Context) {
+			userID := c.GetString("user_id")
+			period := c.DefaultQuery("period", automation.EnergyDay)
+			from, to, msg := energyPeriod(period, c.Query("date"))
+			if msg != "" {
+				c.JSON(400, gin.H{"error": msg})
+				return
+			}
+
+			resp := webModels.EnergySummaryResponse{
+				Period:  period,
+				From:    from.Format("2006-01-02"),
+				To:      to.Format("2006-01-02"),
+				Devices: []webModels.EnergyUsage{},
+				Rooms:   []webModels.EnergyUsage{},
+				Days:    []webModels.EnergyUsage{},
+			}
+			if tariff, err := getUserTariff(c, dbConn, userID); err == nil {
+				resp.Currency = tariff.Currency
+			}
+
+			rows, err := dbConn.Query(c, `SELECT d.id, d.name, d.room, SUM(e.kwh), SUM(e.cost)
+				FROM energy_daily e JOIN devices d ON d.id = e.device_id
+				WHERE d.owner_id=$1 AND e.day >= $2 AND e.day < $3
+				GROUP BY d.id, d.name, d.room ORDER BY d.id`,
+				userID, resp.From, resp.To)
+			if err != nil {
+				println("Error fetching energy usage:", err.Error())
+				c.JSON(500, gin.H{"error": "Failed to fetch energy usage"})
+				return
+			}
+			rooms := make(map[string]*webModels.EnergyUsage)
+			for rows.Next() {
+				var usage webModels.EnergyUsage
+				if err := rows.Scan(&usage.DeviceID, &usage.Name, &usage.Room, &usage.KWh, &usage.Cost); err != nil {
+					println("Error scanning energy usage:", err.Error())
+					continue
+				}
+				resp.Devices = append(resp.Devices, usage)
+				resp.KWh += usage.KWh
+				resp.Cost += usage.Cost
+
+				room, ok := rooms[usage.Room]
+				if !ok {
+					room = &webModels.EnergyUsage{Room: usage.Room}
+					rooms[usage.Room] = room
+				}
+				room.KWh += usage.KWh
+				room.Cost += usage.Cost
+			}
+			rows.Close()
+			for _, room := range rooms {
+				resp.Rooms = append(resp.Rooms, *room)
+			}
+			sort.Slice(resp.Rooms, func(i, j int) bool { return resp.Rooms[i].Room < resp.Rooms[j].Room })
+
+			rows, err = dbConn.Query(c, `SELECT e.day::text, SUM(e.kwh), SUM(e.cost)
+				FROM energy_daily e JOIN devices d ON d.id = e.device_id
+				WHERE d.owner_id=$1 AND e.day >= $2 AND e.day < $3
+				GROUP BY e.day ORDER BY e.day`,
+				userID, resp.From, resp.To)
+			if err != nil {
+				println("Error fetching daily energy usage:", err.Error())
+				c.JSON(500, gin.H{"error": "Failed to fetch energy usage"})
+				return
+			}
+			defer rows.Close()
+			for rows.Next() {
+				var usage webModels.EnergyUsage
+				if err := rows.Scan(&usage.Day, &usage.KWh, &usage.Cost); err != nil {
+					println("Error scanning daily energy usage:", err.Error())
+					continue
+				}
+				resp.Days = append(resp.Days, usage)
+			}
+			c.JSON(200, resp)
+		})
+
+		energy.GET("/tariff", func(c *gin.Context) {
+			tariff, err := getUserTariff(c, dbConn, c.GetString("user_id"))
+			if err != nil {
+				c.JSON(404, gin.H{"error": "No tariff configured"})
+				return
+			}
+			c.JSON(200, tariff)
+		})
+
+		// Set the household's tariff; consumption already recorded keeps its cost
+		energy.PUT("/tariff", func(c *gin.Context) {
+			userID := c.GetString("user_id")
+			var req webModels.EnergyTariffRequest
+			if err := c.ShouldBindJSON(&req); err != nil {
+				println("Error binding JSON:", err.Error())
+				c.JSON(400, gin.H{"error": "Invalid request"})
+				return
+			}
+
+			tariff := models.EnergyTariff{OwnerID: userID, Kind: req.Kind, Currency: strings.ToUpper(strings.TrimSpace(req.Currency)), Rate: req.Rate, Periods: req.Periods}
+			if tariff.Currency == "" {
+				tariff.Currency = "EUR"
+			}
+			if tariff.Periods == nil {
+				tariff.Periods = []models.TariffPeriod{}
+			}
+			if err := automation.ValidateTariff(tariff); err != nil {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+
+			before, err := getUserTariff(c, dbConn, userID)
+			if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+				println("Error fetching tariff:", err.Error())
+				c.JSON(500, gin.H{"error": "Failed to fetch tariff"})
+				return
+			}
+			err = dbConn.QueryRow(c, `INSERT INTO energy_tariffs (owner_id, kind, currency, rate, periods) VALUES ($1, $2, $3, $4, $5)
+				ON CONFLICT (owner_id) DO UPDATE SET kind = EXCLUDED.kind, currency = EXCLUDED.currency, rate = EXCLUDED.rate, periods = EXCLUDED.periods
+				RETURNING id`,
+				userID, tariff.Kind, tariff.Currency, tariff.Rate, tariff.Periods).Scan(&tariff.ID)
+			if err != nil {
+				println("Error saving tariff:", err.Error())
+				c.JSON(500, gin.H{"error": "Failed to save tariff"})
+				return
+			}
+			entry := audit.Entry{
+				ActorID: userID,
+				Action:  audit.ActionTariffSave,
+				Source:  audit.RequestSource(c.Request),
+				Details: audit.Marshal(gin.H{"tariff_id": tariff.ID, "kind": tariff.Kind}),
+				After:   audit.Marshal(tariff),
+			}
+			if before != nil {
+				entry.Before = audit.Marshal(before)
+			}
+			auditLog.Record(c, entry)
+
+			if err := engine.RefreshTariff(userID); err != nil {
+				log.Printf("Error refreshing tariff of household %s: %v", userID, err)
+			}
+			c.JSON(200, tariff)
+		})
+	}
+}
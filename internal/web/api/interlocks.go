@@ -0,0 +1,245 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"strings"
+
+	"smarthome/internal/audit"
+	"smarthome/internal/automation"
+	"smarthome/internal/models"
+	"smarthome/internal/web/middleware"
+	webModels "smarthome/internal/web/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const interlockColumns = "id, owner_id, name, device_id, kind, key, value, condition, min_value, max_value, max_seconds, off_value, enabled"
+
+func scanInterlockRow(row pgx.Row) (*models.Interlock, error) {
+	var il models.Interlock
+	err := row.Scan(&il.ID, &il.OwnerID, &il.Name, &il.DeviceID, &il.Kind, &il.Key, &il.Value, &il.Condition,
+		&il.Min, &il.Max, &il.MaxSeconds, &il.OffValue, &il.Enabled)
+	if err != nil {
+		return nil, err
+	}
+	return &il, nil
+}
+
+// nullJSON stores empty JSON as NULL
+func nullJSON(raw json.RawMessage) interface{} {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil
+	}
+	return raw
+}
+
+// validateInterlock checks an interlock and that the caller owns its device
+func validateInterlock(c *gin.Context, dbConn *pgxpool.Pool, il models.Interlock) string {
+	if strings.TrimSpace(il.Name) == "" {
+		return "Name is required"
+	}
+	if err := automation.ValidateInterlock(il); err != nil {
+		return err.Error()
+	}
+	var owned bool
+	err := dbConn.QueryRow(c, "SELECT EXISTS(SELECT 1 FROM devices WHERE id=$1 AND owner_id=$2)", il.DeviceID, il.OwnerID).Scan(&owned)
+	if err != nil || !owned {
+		return "Device not found"
+	}
+	return ""
+}
+
+// refreshInterlocks re-caches the interlocks of the devices an interlock change touched
+func refreshInterlocks(engine EngineInterface, deviceIDs ...string) {
+	seen := make(map[string]bool)
+	for _, deviceID := range deviceIDs {
+		if seen[deviceID] {
+			continue
+		}
+		seen[deviceID] = true
+		if err := engine.RefreshInterlocks(deviceID); err != nil {
+			log.Printf("Error refreshing interlocks of device %s: %v", deviceID, err)
+		}
+	}
+}
+
+func RegisterInterlockRoutes(r *gin.Engine, middlewareManager *middleware.MiddlewareManager, dbConn *pgxpool.Pool, engine EngineInterface, auditLog *audit.Logger) {
+	interlocks := r.Group("/interlocks")
+	interlocks.Use(middlewareManager.RequireAuth(), middlewareManager.RateLimit(middleware.RouteClassAPI))
+	{
+		interlocks.GET("", func(c *gin.Context) {
+			query := "SELECT " + interlockColumns + " FROM interlocks WHERE owner_id=$1"
+			args := []interface{}{c.GetString("user_id")}
+			if deviceID := c.Query("device_id"); deviceID != "" {
+				query += " AND device_id=$2"
+				args = append(args, deviceID)
+			}
+			rows, err := dbConn.Query(c, query+" ORDER BY device_id, id", args...)
+			if err != nil {
+				println("Error fetching interlocks:", err.Error())
+				c.JSON(500, gin.H{"error": "Failed to fetch interlocks"})
+				return
+			}
+			defer rows.Close()
+
+			result := []models.Interlock{}
+			for rows.Next() {
+				il, err := scanInterlockRow(rows)
+				if err != nil {
+					println("Error scanning interlock:", err.Error())
+					continue
+				}
+				result = append(result, *il)
+			}
+			c.JSON(200, result)
+		})
+
+		interlocks.POST("", func(c *gin.Context) {
+			userID := c.GetString("user_id")
+			var req webModels.CreateInterlockRequest
+			if err := c.ShouldBindJSON(&req); err != nil {
+				println("Error binding JSON:", err.Error())
+				c.JSON(400, gin.H{"error": "Invalid request"})
+				return
+			}
+
+			il := models.Interlock{
+				OwnerID:    userID,
+				Name:       req.Name,
+				DeviceID:   req.DeviceID,
+				Kind:       req.Kind,
+				Key:        req.Key,
+				Value:      req.Value,
+				Condition:  req.Condition,
+				Min:        req.Min,
+				Max:        req.Max,
+				MaxSeconds: req.MaxSeconds,
+				OffValue:   req.OffValue,
+				Enabled:    req.Enabled == nil || *req.Enabled,
+			}
+			if msg := validateInterlock(c, dbConn, il); msg != "" {
+				c.JSON(400, gin.H{"error": msg})
+				return
+			}
+
+			err := dbConn.QueryRow(c, `INSERT INTO interlocks (owner_id, name, device_id, kind, key, value, condition, min_value, max_value, max_seconds, off_value, enabled)
+				VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12) RETURNING id`,
+				userID, il.Name, il.DeviceID, il.Kind, il.Key, nullJSON(il.Value), nullJSON(il.Condition), il.Min, il.Max, il.MaxSeconds, nullJSON(il.OffValue), il.Enabled).Scan(&il.ID)
+			if err != nil {
+				println("Error creating interlock:", err.Error())
+				c.JSON(500, gin.H{"error": "Failed to create interlock"})
+				return
+			}
+			auditLog.Record(c, audit.Entry{
+				ActorID:  userID,
+				Action:   audit.ActionInterlockSave,
+				Source:   audit.RequestSource(c.Request),
+				DeviceID: il.DeviceID,
+				Details:  audit.Marshal(gin.H{"interlock_id": il.ID, "name": il.Name}),
+				After:    audit.Marshal(il),
+			})
+
+			refreshInterlocks(engine, il.DeviceID)
+			c.JSON(201, il)
+		})
+
+		interlocks.PATCH("/:id", func(c *gin.Context) {
+			userID := c.GetString("user_id")
+			var req webModels.UpdateInterlockRequest
+			if err := c.ShouldBindJSON(&req); err != nil {
+				println("Error binding JSON:", err.Error())
+				c.JSON(400, gin.H{"error": "Invalid request"})
+				return
+			}
+
+			il, err := scanInterlockRow(dbConn.QueryRow(c, "SELECT "+interlockColumns+" FROM interlocks WHERE id=$1 AND owner_id=$2", c.Param("id"), userID))
+			if err != nil {
+				c.JSON(404, gin.H{"error": "Interlock not found"})
+				return
+			}
+			before := *il
+
+			if req.Name != nil {
+				il.Name = *req.Name
+			}
+			if req.DeviceID != nil {
+				il.DeviceID = *req.DeviceID
+			}
+			if req.Kind != nil {
+				il.Kind = *req.Kind
+			}
+			if req.Key != nil {
+				il.Key = *req.Key
+			}
+			if req.Value != nil {
+				il.Value = req.Value
+			}
+			if req.Condition != nil {
+				il.Condition = req.Condition
+			}
+			if req.Min != nil {
+				il.Min = req.Min
+			}
+			if req.Max != nil {
+				il.Max = req.Max
+			}
+			if req.MaxSeconds != nil {
+				il.MaxSeconds = *req.MaxSeconds
+			}
+			if req.OffValue != nil {
+				il.OffValue = req.OffValue
+			}
+			if req.Enabled != nil {
+				il.Enabled = *req.Enabled
+			}
+			if msg := validateInterlock(c, dbConn, *il); msg != "" {
+				c.JSON(400, gin.H{"error": msg})
+				return
+			}
+
+			_, err = dbConn.Exec(c, `UPDATE interlocks SET name=$1, device_id=$2, kind=$3, key=$4, value=$5, condition=$6,
+				min_value=$7, max_value=$8, max_seconds=$9, off_value=$10, enabled=$11 WHERE id=$12 AND owner_id=$13`,
+				il.Name, il.DeviceID, il.Kind, il.Key, nullJSON(il.Value), nullJSON(il.Condition), il.Min, il.Max, il.MaxSeconds, nullJSON(il.OffValue), il.Enabled, il.ID, userID)
+			if err != nil {
+				println("Error updating interlock:", err.Error())
+				c.JSON(500, gin.H{"error": "Failed to update interlock"})
+				return
+			}
+			auditLog.Record(c, audit.Entry{
+				ActorID:  userID,
+				Action:   audit.ActionInterlockSave,
+				Source:   audit.RequestSource(c.Request),
+				DeviceID: il.DeviceID,
+				Details:  audit.Marshal(gin.H{"interlock_id": il.ID, "name": il.Name}),
+				Before:   audit.Marshal(before),
+				After:    audit.Marshal(il),
+			})
+
+			refreshInterlocks(engine, before.DeviceID, il.DeviceID)
+			c.JSON(200, il)
+		})
+
+		interlocks.DELETE("/:id", func(c *gin.Context) {
+			userID := c.GetString("user_id")
+			il, err := scanInterlockRow(dbConn.QueryRow(c, "DELETE FROM interlocks WHERE id=$1 AND owner_id=$2 RETURNING "+interlockColumns, c.Param("id"), userID))
+			if err != nil {
+				c.JSON(404, gin.H{"error": "Interlock not found"})
+				return
+			}
+			auditLog.Record(c, audit.Entry{
+				ActorID:  userID,
+				Action:   audit.ActionInterlockDelete,
+				Source:   audit.RequestSource(c.Request),
+				DeviceID: il.DeviceID,
+				Details:  audit.Marshal(gin.H{"interlock_id": il.ID, "name": il.Name}),
+				Before:   audit.Marshal(il),
+			})
+
+			refreshInterlocks(engine, il.DeviceID)
+			c.JSON(200, gin.H{"status": "Interlock deleted successfully"})
+		})
+	}
+}
@@ -0,0 +1,327 @@
+package api
+
+import (
+	"log"
+	"strings"
+
+	"smarthome/internal/audit"
+	"smarthome/internal/automation"
+	"smarthome/internal/clock"
+	"smarthome/internal/models"
+	"smarthome/internal/presence"
+	"smarthome/internal/web/middleware"
+	webModels "smarthome/internal/web/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const personColumns = "id, owner_id, name, user_id, mqtt_topic, mac_addresses, presence, presence_source, presence_changed_at"
+
+func scanPersonRow(row pgx.Row) (*models.Person, error) {
+	var p models.Person
+	err := row.Scan(&p.ID, &p.OwnerID, &p.Name, &p.UserID, &p.MQTTTopic, &p.MACAddresses, &p.Presence, &p.PresenceSource, &p.PresenceChangedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// getUserPerson fetches a person of the user's household
+func getUserPerson(c *gin.Context, dbConn *pgxpool.Pool, userID, id string) (*models.Person, error) {
+	return scanPersonRow(dbConn.QueryRow(c, "SELECT "+personColumns+" FROM people WHERE id=$1 AND owner_id=$2", id, userID))
+}
+
+// validatePerson checks a person's name, linked user and sources, normalizing MAC addresses
+func validatePerson(c *gin.Context, dbConn *pgxpool.Pool, p *models.Person) (int, string) {
+	if strings.TrimSpace(p.Name) == "" {
+		return 400, "Name is required"
+	}
+	for i, mac := range p.MACAddresses {
+		normalized, err := presence.NormalizeMAC(mac)
+		if err != nil {
+			return 400, "Invalid MAC address " + mac
+		}
+		p.MACAddresses[i] = normalized
+	}
+	if p.UserID != nil {
+		var exists, linked bool
+		err := dbConn.QueryRow(c, `SELECT EXISTS(SELECT 1 FROM users WHERE id::text=$1),
+			EXISTS(SELECT 1 FROM people WHERE user_id::text=$1 AND id::text<>$2)`, *p.UserID, p.ID).Scan(&exists, &linked)
+		if err != nil {
+			return 500, "Failed to check user"
+		}
+		if !exists {
+			return 404, "User not found"
+		}
+		if linked {
+			return 409, "The user is already linked to another person"
+		}
+	}
+	if p.MQTTTopic != "" {
+		var taken bool
+		err := dbConn.QueryRow(c, "SELECT EXISTS(SELECT 1 FROM people WHERE mqtt_topic=$1 AND id::text<>$2)", p.MQTTTopic, p.ID).Scan(&taken)
+		if err != nil {
+			return 500, "Failed to check MQTT topic"
+		}
+		if taken {
+			return 409, "The MQTT topic is already used by another person"
+		}
+	}
+	return 0, ""
+}
+
+// personResponse adds a person's current state
+func personResponse(p models.Person) webModels.PersonResponse {
+	return webModels.PersonResponse{Person: p, State: automation.PersonRecord(p).State(clock.Now())}
+}
+
+// reportPresence records a presence reported through the API and answers with the person
+func reportPresence(c *gin.Context, dbConn *pgxpool.Pool, engine EngineInterface, auditLog *audit.Logger, userID string, person *models.Person, source string) {
+	var req webModels.PresenceRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		println("Error binding JSON:", err.Error())
+		c.JSON(400, gin.H{"error": "Invalid request"})
+		return
+	}
+	state, ok := presence.ParseWord(req.Presence)
+	if !ok {
+		c.JSON(400, gin.H{"error": "Presence must be home or away"})
+		return
+	}
+
+	before := person.Presence
+	if err := engine.ReportPresence(person.ID, state, source); err != nil {
+		println("Error reporting presence:", err.Error())
+		c.JSON(500, gin.H{"error": "Failed to report presence"})
+		return
+	}
+	if state != before {
+		auditLog.Record(c, audit.Entry{
+			ActorID: userID,
+			Action:  audit.ActionPresenceSet,
+			Source:  audit.RequestSource(c.Request),
+			Details: audit.Marshal(gin.H{"person_id": person.ID, "name": person.Name, "source": source}),
+			Before:  audit.Marshal(before),
+			After:   audit.Marshal(state),
+		})
+	}
+
+	if updated, err := scanPersonRow(dbConn.QueryRow(c, "SELECT "+personColumns+" FROM people WHERE id=$1", person.ID)); err == nil {
+		person = updated
+	}
+	c.JSON(200, personResponse(*person))
+}
+
+func RegisterPresenceRoutes(r *gin.Engine, middlewareManager *middleware.MiddlewareManager, dbConn *pgxpool.Pool, engine EngineInterface, auditLog *audit.Logger) {
+	presenceRoutes := r.Group("/presence")
+	presenceRoutes.Use(middlewareManager.RequireAuth(), middlewareManager.RateLimit(middleware.RouteClassAPI))
+	{
+		// Household state: home while anyone is home, just_left shortly after the last person left
+		presenceRoutes.GET("", func(c *gin.Context) {
+			rows, err := dbConn.Query(c, "SELECT "+personColumns+" FROM people WHERE owner_id=$1 ORDER BY name, id", c.GetString("user_id"))
+			if err != nil {
+				println("Error fetching people:", err.Error())
+				c.JSON(500, gin.H{"error": "Failed to fetch presence"})
+				return
+			}
+			defer rows.Close()
+
+			people := []models.Person{}
+			resp := webModels.PresenceResponse{People: []webModels.PersonResponse{}}
+			for rows.Next() {
+				p, err := scanPersonRow(rows)
+				if err != nil {
+					println("Error scanning person:", err.Error())
+					continue
+				}
+				people = append(people, *p)
+				resp.People = append(resp.People, personResponse(*p))
+			}
+			household := automation.HouseholdRecord(people)
+			resp.State = household.State(clock.Now())
+			if !household.ChangedAt.IsZero() {
+				resp.ChangedAt = &household.ChangedAt
+			}
+			c.JSON(200, resp)
+		})
+
+		// A phone app checks in for the person linked to its user
+		presenceRoutes.POST("/checkin", func(c *gin.Context) {
+			userID := c.GetString("user_id")
+			person, err := scanPersonRow(dbConn.QueryRow(c, "SELECT "+personColumns+" FROM people WHERE user_id=$1", userID))
+			if err != nil {
+				c.JSON(404, gin.H{"error": "No person is linked to this user"})
+				return
+			}
+			reportPresence(c, dbConn, engine, auditLog, userID, person, presence.SourceCheckin)
+		})
+
+		presenceRoutes.GET("/people", func(c *gin.Context) {
+			rows, err := dbConn.Query(c, "SELECT "+personColumns+" FROM people WHERE owner_id=$1 ORDER BY name, id", c.GetString("user_id"))
+			if err != nil {
+				println("Error fetching people:", err.Error())
+				c.JSON(500, gin.H{"error": "Failed to fetch people"})
+				return
+			}
+			defer rows.Close()
+
+			people := []webModels.PersonResponse{}
+			for rows.Next() {
+				p, err := scanPersonRow(rows)
+				if err != nil {
+					println("Error scanning person:", err.Error())
+					continue
+				}
+				people = append(people, personResponse(*p))
+			}
+			c.JSON(200, people)
+		})
+
+		presenceRoutes.GET("/people/:id", func(c *gin.Context) {
+			person, err := getUserPerson(c, dbConn, c.GetString("user_id"), c.Param("id"))
+			if err != nil {
+				c.JSON(404, gin.H{"error": "Person not found"})
+				return
+			}
+			c.JSON(200, personResponse(*person))
+		})
+
+		presenceRoutes.POST("/people", func(c *gin.Context) {
+			userID := c.GetString("user_id")
+			var req webModels.CreatePersonRequest
+			if err := c.ShouldBindJSON(&req); err != nil {
+				println("Error binding JSON:", err.Error())
+				c.JSON(400, gin.H{"error": "Invalid request"})
+				return
+			}
+
+			person := models.Person{OwnerID: userID, Name: req.Name, UserID: req.UserID, MQTTTopic: req.MQTTTopic, MACAddresses: req.MACAddresses, Presence: automation.PresenceAway}
+			if person.MACAddresses == nil {
+				person.MACAddresses = []string{}
+			}
+			if status, msg := validatePerson(c, dbConn, &person); msg != "" {
+				c.JSON(status, gin.H{"error": msg})
+				return
+			}
+
+			err := dbConn.QueryRow(c,
+				"INSERT INTO people (owner_id, name, user_id, mqtt_topic, mac_addresses) VALUES ($1, $2, $3, $4, $5) RETURNING id",
+				userID, person.Name, person.UserID, person.MQTTTopic, person.MACAddresses).Scan(&person.ID)
+			if err != nil {
+				println("Error creating person:", err.Error())
+				c.JSON(500, gin.H{"error": "Failed to create person"})
+				return
+			}
+			auditLog.Record(c, audit.Entry{
+				ActorID: userID,
+				Action:  audit.ActionPersonSave,
+				Source:  audit.RequestSource(c.Request),
+				Details: audit.Marshal(gin.H{"person_id": person.ID, "name": person.Name}),
+				After:   audit.Marshal(person),
+			})
+
+			if err := engine.RefreshPerson(person.ID); err != nil {
+				log.Printf("Error refreshing person %s: %v", person.ID, err)
+			}
+			c.JSON(201, personResponse(person))
+		})
+
+		presenceRoutes.PATCH("/people/:id", func(c *gin.Context) {
+			userID := c.GetString("user_id")
+			var req webModels.UpdatePersonRequest
+			if err := c.ShouldBindJSON(&req); err != nil {
+				println("Error binding JSON:", err.Error())
+				c.JSON(400, gin.H{"error": "Invalid request"})
+				return
+			}
+
+			person, err := getUserPerson(c, dbConn, userID, c.Param("id"))
+			if err != nil {
+				c.JSON(404, gin.H{"error": "Person not found"})
+				return
+			}
+			before := *person
+
+			if req.Name != nil {
+				person.Name = *req.Name
+			}
+			if req.UserID != nil {
+				person.UserID = req.UserID
+				if *req.UserID == "" {
+					person.UserID = nil
+				}
+			}
+			if req.MQTTTopic != nil {
+				person.MQTTTopic = *req.MQTTTopic
+			}
+			if req.MACAddresses != nil {
+				person.MACAddresses = append([]string{}, *req.MACAddresses...)
+			}
+			if status, msg := validatePerson(c, dbConn, person); msg != "" {
+				c.JSON(status, gin.H{"error": msg})
+				return
+			}
+
+			_, err = dbConn.Exec(c, "UPDATE people SET name=$1, user_id=$2, mqtt_topic=$3, mac_addresses=$4 WHERE id=$5 AND owner_id=$6",
+				person.Name, person.UserID, person.MQTTTopic, person.MACAddresses, person.ID, userID)
+			if err != nil {
+				println("Error updating person:", err.Error())
+				c.JSON(500, gin.H{"error": "Failed to update person"})
+				return
+			}
+			auditLog.Record(c, audit.Entry{
+				ActorID: userID,
+				Action:  audit.ActionPersonSave,
+				Source:  audit.RequestSource(c.Request),
+				Details: audit.Marshal(gin.H{"person_id": person.ID, "name": person.Name}),
+				Before:  audit.Marshal(before),
+				After:   audit.Marshal(person),
+			})
+
+			if err := engine.RefreshPerson(person.ID); err != nil {
+				log.Printf("Error refreshing person %s: %v", person.ID, err)
+			}
+			c.JSON(200, personResponse(*person))
+		})
+
+		// Set a person's presence by hand, e.g. for someone without a phone
+		presenceRoutes.PUT("/people/:id/presence", func(c *gin.Context) {
+			userID := c.GetString("user_id")
+			person, err := getUserPerson(c, dbConn, userID, c.Param("id"))
+			if err != nil {
+				c.JSON(404, gin.H{"error": "Person not found"})
+				return
+			}
+			reportPresence(c, dbConn, engine, auditLog, userID, person, presence.SourceManual)
+		})
+
+		presenceRoutes.DELETE("/people/:id", func(c *gin.Context) {
+			userID := c.GetString("user_id")
+			person, err := getUserPerson(c, dbConn, userID, c.Param("id"))
+			if err != nil {
+				c.JSON(404, gin.H{"error": "Person not found"})
+				return
+			}
+
+			if _, err := dbConn.Exec(c, "DELETE FROM people WHERE id=$1 AND owner_id=$2", person.ID, userID); err != nil {
+				println("Error deleting person:", err.Error())
+				c.JSON(500, gin.H{"error": "Failed to delete person"})
+				return
+			}
+			auditLog.Record(c, audit.Entry{
+				ActorID: userID,
+				Action:  audit.ActionPersonDelete,
+				Source:  audit.RequestSource(c.Request),
+				Details: audit.Marshal(gin.H{"person_id": person.ID, "name": person.Name}),
+				Before:  audit.Marshal(person),
+			})
+
+			if err := engine.RemovePerson(*person); err != nil {
+				log.Printf("Error removing person %s: %v", person.ID, err)
+			}
+			c.JSON(200, gin.H{"status": "Person deleted successfully"})
+		})
+	}
+}
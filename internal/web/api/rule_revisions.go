@@ -0,0 +1,219 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"smarthome/internal/audit"
+	"smarthome/internal/models"
+	"smarthome/internal/utils"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// recordRuleRevision stores the current state of a rule as its next revision.
+// Rules created before versioning have no history yet; for those the previous
+// state is stored first as the baseline revision. It runs in the transaction that
+// saves the rule: the rule's row lock serializes concurrent saves, so MAX+1 cannot
+// hand out the same revision twice, and rule_revisions_rule_id_revision_key backs that up.
+func recordRuleRevision(c *gin.Context, tx pgx.Tx, previous *models.Rule, current models.Rule, authorID string, restoredFrom *int) error {
+	if previous != nil {
+		var count int
+		if err := tx.QueryRow(c, "SELECT COUNT(*) FROM rule_revisions WHERE rule_id=$1", current.ID).Scan(&count); err != nil {
+			return fmt.Errorf("count revisions of rule %s: %w", current.ID, err)
+		}
+		if count == 0 {
+			if err := insertRuleRevision(c, tx, *previous, "", nil); err != nil {
+				return err
+			}
+		}
+	}
+	return insertRuleRevision(c, tx, current, authorID, restoredFrom)
+}
+
+func insertRuleRevision(c *gin.Context, tx pgx.Tx, rule models.Rule, authorID string, restoredFrom *int) error {
+	var author interface{}
+	if authorID != "" {
+		author = authorID
+	}
+
+	_, err := tx.Exec(c,
+		`INSERT INTO rule_revisions (rule_id, revision, name, conditions, actions, enabled, execution, author_id, restored_from)
+		 SELECT $1, COALESCE(MAX(revision), 0) + 1, $2, $3, $4, $5, $6, $7, $8 FROM rule_revisions WHERE rule_id = $1`,
+		rule.ID, rule.Name, rule.Conditions, rule.Actions, rule.Enabled, rule.Execution, author, restoredFrom)
+	if err != nil {
+		return fmt.Errorf("record revision of rule %s: %w", rule.ID, err)
+	}
+	return nil
+}
+
+// getRuleRevision fetches a single revision of a rule
+func getRuleRevision(c *gin.Context, dbConn *pgxpool.Pool, ruleID string, revision int) (*models.RuleRevision, error) {
+	var r models.RuleRevision
+	err := dbConn.QueryRow(c,
+		"SELECT rule_id, revision, name, conditions, actions, enabled, execution, author_id, restored_from, created_at FROM rule_revisions WHERE rule_id=$1 AND revision=$2",
+		ruleID, revision).
+		Scan(&r.RuleID, &r.Revision, &r.Name, &r.Conditions, &r.Actions, &r.Enabled, &r.Execution, &r.AuthorID, &r.RestoredFrom, &r.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// revisionDocument decodes the versioned fields of a revision for diffing
+func revisionDocument(r *models.RuleRevision) map[string]interface{} {
+	var conditions, actions interface{}
+	json.Unmarshal(r.Conditions, &conditions)
+	json.Unmarshal(r.Actions, &actions)
+	return map[string]interface{}{
+		"name":       r.Name,
+		"conditions": conditions,
+		"actions":    actions,
+		"enabled":    r.Enabled,
+		"execution":  r.Execution,
+	}
+}
+
+func registerRuleRevisionRoutes(automations *gin.RouterGroup, dbConn *pgxpool.Pool, engine EngineInterface, auditLog *audit.Logger) {
+	// ownsRule verifies the rule exists and belongs to the current user
+	ownsRule := func(c *gin.Context) bool {
+		var exists bool
+		err := dbConn.QueryRow(c, "SELECT EXISTS(SELECT 1 FROM rules WHERE id=$1 AND owner_id=$2)", c.Param("id"), c.GetString("user_id")).Scan(&exists)
+		if err != nil || !exists {
+			c.JSON(404, gin.H{"error": "Rule not found"})
+			return false
+		}
+		return true
+	}
+
+	parseRevision := func(c *gin.Context, value string) (int, bool) {
+		rev, err := strconv.Atoi(value)
+		if err != nil || rev < 1 {
+			c.JSON(400, gin.H{"error": "Invalid revision"})
+			return 0, false
+		}
+		return rev, true
+	}
+
+	automations.GET("/rules/:id/revisions", func(c *gin.Context) {
+		if !ownsRule(c) {
+			return
+		}
+
+		rows, err := dbConn.Query(c,
+			"SELECT rule_id, revision, name, conditions, actions, enabled, execution, author_id, restored_from, created_at FROM rule_revisions WHERE rule_id=$1 ORDER BY revision DESC",
+			c.Param("id"))
+		if err != nil {
+			println("Error fetching rule revisions:", err.Error())
+			c.JSON(500, gin.H{"error": "Failed to fetch revisions"})
+			return
+		}
+		defer rows.Close()
+
+		revisions := []models.RuleRevision{}
+		for rows.Next() {
+			var r models.RuleRevision
+			if err := rows.Scan(&r.RuleID, &r.Revision, &r.Name, &r.Conditions, &r.Actions, &r.Enabled, &r.Execution, &r.AuthorID, &r.RestoredFrom, &r.CreatedAt); err != nil {
+				println("Error scanning rule revision:", err.Error())
+				continue
+			}
+			revisions = append(revisions, r)
+		}
+		c.JSON(200, revisions)
+	})
+
+	automations.GET("/rules/:id/revisions/:rev", func(c *gin.Context) {
+		if !ownsRule(c) {
+			return
+		}
+		rev, ok := parseRevision(c, c.Param("rev"))
+		if !ok {
+			return
+		}
+
+		revision, err := getRuleRevision(c, dbConn, c.Param("id"), rev)
+		if err != nil {
+			c.JSON(404, gin.H{"error": "Revision not found"})
+			return
+		}
+		c.JSON(200, revision)
+	})
+
+	// Diff a revision against another one (?against=<rev>, defaults to the previous revision)
+	automations.GET("/rules/:id/revisions/:rev/diff", func(c *gin.Context) {
+		if !ownsRule(c) {
+			return
+		}
+		rev, ok := parseRevision(c, c.Param("rev"))
+		if !ok {
+			return
+		}
+		against := rev - 1
+		if value := c.Query("against"); value != "" {
+			if against, ok = parseRevision(c, value); !ok {
+				return
+			}
+		}
+		if against < 1 {
+			c.JSON(400, gin.H{"error": "No previous revision to compare against"})
+			return
+		}
+
+		to, err := getRuleRevision(c, dbConn, c.Param("id"), rev)
+		if err != nil {
+			c.JSON(404, gin.H{"error": "Revision not found"})
+			return
+		}
+		from, err := getRuleRevision(c, dbConn, c.Param("id"), against)
+		if err != nil {
+			c.JSON(404, gin.H{"error": "Revision to compare against not found"})
+			return
+		}
+
+		c.JSON(200, gin.H{
+			"from":    from.Revision,
+			"to":      to.Revision,
+			"changes": utils.DiffJSON(revisionDocument(from), revisionDocument(to)),
+		})
+	})
+
+	automations.POST("/rules/:id/revisions/:rev/restore", func(c *gin.Context) {
+		userID := c.GetString("user_id")
+		ruleID := c.Param("id")
+		rev, ok := parseRevision(c, c.Param("rev"))
+		if !ok {
+			return
+		}
+
+		var existingRule models.Rule
+		row := dbConn.QueryRow(c, "SELECT id, name, conditions, actions, enabled, owner_id, execution FROM rules WHERE id=$1 AND owner_id=$2", ruleID, userID)
+		if err := row.Scan(&existingRule.ID, &existingRule.Name, &existingRule.Conditions, &existingRule.Actions, &existingRule.Enabled, &existingRule.OwnerID, &existingRule.Execution); err != nil {
+			c.JSON(404, gin.H{"error": "Rule not found"})
+			return
+		}
+
+		revision, err := getRuleRevision(c, dbConn, ruleID, rev)
+		if err != nil {
+			c.JSON(404, gin.H{"error": "Revision not found"})
+			return
+		}
+
+		restoredRule := existingRule
+		restoredRule.Name = revision.Name
+		restoredRule.Conditions = revision.Conditions
+		restoredRule.Actions = revision.Actions
+		restoredRule.Enabled = revision.Enabled
+		restoredRule.Execution = revision.Execution
+
+		// Saving re-indexes the restored conditions in the engine
+		if err := updateRule(c, dbConn, engine, auditLog, userID, existingRule, restoredRule, &rev); err != nil {
+			respondRuleSaveError(c, err, "Failed to restore rule")
+			return
+		}
+
+		c.JSON(200, restoredRule)
+	})
+}
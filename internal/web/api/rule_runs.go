@@ -0,0 +1,70 @@
+package api
+
+import (
+	"strconv"
+	"time"
+
+	"smarthome/internal/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+func registerRuleRunRoutes(automations *gin.RouterGroup, dbConn *pgxpool.Pool) {
+	// List a rule's run traces, newest first (?outcome=, ?before=<RFC3339>, ?limit=, default 50)
+	automations.GET("/rules/:id/runs", func(c *gin.Context) {
+		var exists bool
+		err := dbConn.QueryRow(c, "SELECT EXISTS(SELECT 1 FROM rules WHERE id=$1 AND owner_id=$2)", c.Param("id"), c.GetString("user_id")).Scan(&exists)
+		if err != nil || !exists {
+			c.JSON(404, gin.H{"error": "Rule not found"})
+			return
+		}
+
+		limit := 50
+		if value := c.Query("limit"); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				c.JSON(400, gin.H{"error": "Invalid limit"})
+				return
+			}
+			limit = n
+		}
+		var before interface{}
+		if value := c.Query("before"); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				c.JSON(400, gin.H{"error": "Invalid 'before' timestamp, expected RFC3339"})
+				return
+			}
+			before = t
+		}
+		var outcome interface{}
+		if value := c.Query("outcome"); value != "" {
+			outcome = value
+		}
+
+		rows, err := dbConn.Query(c,
+			`SELECT id, rule_id, triggered_by, outcome, COALESCE(reason, ''), conditions, conflicts, actions, errors, started_at, duration_ms
+			 FROM rule_runs
+			 WHERE rule_id=$1 AND ($2::timestamptz IS NULL OR started_at < $2) AND ($3::text IS NULL OR outcome = $3)
+			 ORDER BY started_at DESC, id DESC LIMIT $4`,
+			c.Param("id"), before, outcome, limit)
+		if err != nil {
+			println("Error fetching rule runs:", err.Error())
+			c.JSON(500, gin.H{"error": "Failed to fetch rule runs"})
+			return
+		}
+		defer rows.Close()
+
+		runs := []models.RuleRun{}
+		for rows.Next() {
+			var r models.RuleRun
+			if err := rows.Scan(&r.ID, &r.RuleID, &r.TriggeredBy, &r.Outcome, &r.Reason, &r.Conditions, &r.Conflicts, &r.Actions, &r.Errors, &r.StartedAt, &r.DurationMs); err != nil {
+				println("Error scanning rule run:", err.Error())
+				continue
+			}
+			runs = append(runs, r)
+		}
+		c.JSON(200, runs)
+	})
+}
@@ -0,0 +1,280 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"strings"
+
+	"smarthome/internal/audit"
+	"smarthome/internal/automation"
+	"smarthome/internal/models"
+	webModels "smarthome/internal/web/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// ruleValidationError reports a rule that cannot be saved because its content is invalid
+type ruleValidationError struct {
+	err error
+}
+
+func (e *ruleValidationError) Error() string {
+	return e.err.Error()
+}
+
+// validateRule statically checks a rule's conditions and action templates before it is saved
+func validateRule(conditions, actions json.RawMessage, execution models.RuleExecution) error {
+	if err := automation.ValidateConditions(conditions); err != nil {
+		return &ruleValidationError{err: err}
+	}
+	if err := automation.ValidateActions(actions); err != nil {
+		return &ruleValidationError{err: err}
+	}
+	if err := automation.ValidateExecution(execution); err != nil {
+		return &ruleValidationError{err: err}
+	}
+	return nil
+}
+
+// rowQuerier is satisfied by both the pool and a transaction, so references can
+// be checked against rules created earlier in the same transaction
+type rowQuerier interface {
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+// checkRuleReferences verifies that devices read or commanded by conditions,
+// expressions, templates and actions, rules referenced by rule_fired conditions
+// and rule chaining actions, and calendars read by calendar conditions belong to the user
+func checkRuleReferences(c *gin.Context, dbConn rowQuerier, userID string, conditions, actions json.RawMessage) error {
+	deviceIDs := append(automation.CollectDeviceIDs(automation.DecodeJSONValue(conditions)),
+		automation.CollectDeviceIDs(automation.DecodeJSONValue(actions))...)
+	for _, id := range deviceIDs {
+		var exists bool
+		err := dbConn.QueryRow(c, "SELECT EXISTS(SELECT 1 FROM devices WHERE id=$1 AND owner_id=$2 AND accepted=true)", id, userID).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return &ruleValidationError{err: fmt.Errorf("unknown device %s", id)}
+		}
+	}
+
+	refs := append(automation.CollectRuleRefs(automation.DecodeJSONValue(conditions)),
+		automation.CollectRuleRefs(automation.DecodeJSONValue(actions))...)
+	for _, ref := range refs {
+		if strings.Contains(ref, "{{") {
+			continue // Templated targets are checked when the action runs
+		}
+		var exists bool
+		err := dbConn.QueryRow(c, "SELECT EXISTS(SELECT 1 FROM rules WHERE id::text=$1 AND owner_id=$2)", ref, userID).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return &ruleValidationError{err: fmt.Errorf("unknown rule %s", ref)}
+		}
+	}
+	for _, ref := range automation.ExtractCalendarRefs(conditions) {
+		var exists bool
+		err := dbConn.QueryRow(c, "SELECT EXISTS(SELECT 1 FROM calendars WHERE id::text=$1 AND owner_id=$2)", ref, userID).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return &ruleValidationError{err: fmt.Errorf("unknown calendar %s", ref)}
+		}
+	}
+	for _, ref := range automation.ExtractPresenceRefs(conditions) {
+		if ref == "" {
+			continue // The household itself
+		}
+		var exists bool
+		err := dbConn.QueryRow(c, "SELECT EXISTS(SELECT 1 FROM people WHERE id::text=$1 AND owner_id=$2)", ref, userID).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return &ruleValidationError{err: fmt.Errorf("unknown person %s", ref)}
+		}
+	}
+	for _, ref := range automation.ExtractZoneRefs(conditions) {
+		var exists bool
+		err := dbConn.QueryRow(c, "SELECT EXISTS(SELECT 1 FROM zones WHERE id::text=$1 AND owner_id=$2)", ref, userID).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return &ruleValidationError{err: fmt.Errorf("unknown zone %s", ref)}
+		}
+	}
+	return nil
+}
+
+// respondRuleSaveError answers a failed create or update: validation errors
+// are the client's fault, anything else is logged as a server error
+func respondRuleSaveError(c *gin.Context, err error, msg string) {
+	var validationErr *ruleValidationError
+	if errors.As(err, &validationErr) {
+		c.JSON(400, gin.H{"error": validationErr.Error()})
+		return
+	}
+	println(msg+":", err.Error())
+	c.JSON(500, gin.H{"error": msg})
+}
+
+// createRule stores a new rule, records its first revision and audit entry and
+// notifies the engine. All rule creation paths (API, blueprints) go through here.
+func createRule(c *gin.Context, dbConn *pgxpool.Pool, engine EngineInterface, auditLog *audit.Logger, userID string, req webModels.AddRuleRequest, details gin.H) (*models.Rule, error) {
+	if err := validateRule(req.Conditions, req.Actions, req.Execution); err != nil {
+		return nil, err
+	}
+	if err := checkRuleReferences(c, dbConn, userID, req.Conditions, req.Actions); err != nil {
+		return nil, err
+	}
+
+	// The rule and its first revision are stored together
+	tx, err := dbConn.Begin(c)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(c)
+
+	var createdRule models.Rule
+	err = tx.QueryRow(c, "INSERT INTO rules (name, conditions, actions, enabled, owner_id, execution) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id, name, conditions, actions, enabled, owner_id, execution",
+		req.Name, req.Conditions, req.Actions, req.Enabled, userID, req.Execution).
+		Scan(&createdRule.ID, &createdRule.Name, &createdRule.Conditions, &createdRule.Actions, &createdRule.Enabled, &createdRule.OwnerID, &createdRule.Execution)
+	if err != nil {
+		return nil, err
+	}
+	if err := recordRuleRevision(c, tx, nil, createdRule, userID, nil); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(c); err != nil {
+		return nil, err
+	}
+
+	entry := audit.Entry{
+		ActorID: userID,
+		Action:  audit.ActionRuleCreate,
+		Source:  audit.RequestSource(c.Request),
+		RuleID:  createdRule.ID,
+		After:   audit.Marshal(createdRule),
+	}
+	if details != nil {
+		entry.Details = audit.Marshal(details)
+	}
+	auditLog.Record(c, entry)
+
+	// Refresh engine associations for the new rule
+	if err := engine.RefreshRuleAssociations(createdRule.ID); err != nil {
+		log.Printf("Error refreshing rule associations for rule %s: %v", createdRule.ID, err)
+		// Don't fail the request, just log the error
+	} else {
+		log.Printf("Successfully refreshed rule associations for new rule %s", createdRule.ID)
+		// Trigger immediate evaluation of the new rule if it's enabled
+		if createdRule.Enabled {
+			engine.TriggerRuleEvaluation(createdRule.ID)
+			log.Printf("Triggered immediate evaluation for new rule %s", createdRule.ID)
+		}
+	}
+
+	return &createdRule, nil
+}
+
+// updateRule saves a modified rule, records a revision and audit entry and
+// notifies the engine. restoredFrom is set when the update restores a revision.
+func updateRule(c *gin.Context, dbConn *pgxpool.Pool, engine EngineInterface, auditLog *audit.Logger, userID string, before, updated models.Rule, restoredFrom *int) error {
+	if err := validateRule(updated.Conditions, updated.Actions, updated.Execution); err != nil {
+		return err
+	}
+	if err := checkRuleReferences(c, dbConn, userID, updated.Conditions, updated.Actions); err != nil {
+		return err
+	}
+
+	// The update and its revision are stored together
+	tx, err := dbConn.Begin(c)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(c)
+
+	_, err = tx.Exec(c, "UPDATE rules SET name=$1, conditions=$2, actions=$3, enabled=$4, execution=$5 WHERE id=$6 AND owner_id=$7",
+		updated.Name, updated.Conditions, updated.Actions, updated.Enabled, updated.Execution, updated.ID, updated.OwnerID)
+	if err != nil {
+		return err
+	}
+	if err := recordRuleRevision(c, tx, &before, updated, userID, restoredFrom); err != nil {
+		return err
+	}
+	if err := tx.Commit(c); err != nil {
+		return err
+	}
+
+	details := gin.H{"changed": changedRuleFields(before, updated)}
+	if restoredFrom != nil {
+		details["restored_from"] = *restoredFrom
+	}
+	auditLog.Record(c, audit.Entry{
+		ActorID: userID,
+		Action:  audit.ActionRuleUpdate,
+		Source:  audit.RequestSource(c.Request),
+		RuleID:  updated.ID,
+		Details: audit.Marshal(details),
+		Before:  audit.Marshal(before),
+		After:   audit.Marshal(updated),
+	})
+
+	// Refresh engine associations for the updated rule
+	if err := engine.RefreshRuleAssociations(updated.ID); err != nil {
+		log.Printf("Error refreshing rule associations for rule %s: %v", updated.ID, err)
+		// Don't fail the request, just log the error
+	} else {
+		log.Printf("Successfully refreshed rule associations for updated rule %s", updated.ID)
+		// Trigger immediate evaluation of the updated rule if it's enabled
+		if updated.Enabled {
+			engine.TriggerRuleEvaluation(updated.ID)
+			log.Printf("Triggered immediate evaluation for updated rule %s", updated.ID)
+		}
+	}
+
+	return nil
+}
+
+// changedRuleFields lists the fields that differ between two versions of a rule
+func changedRuleFields(before, after models.Rule) []string {
+	changed := []string{}
+	if before.Name != after.Name {
+		changed = append(changed, "name")
+	}
+	if !jsonEqual(before.Conditions, after.Conditions) {
+		changed = append(changed, "conditions")
+	}
+	if !jsonEqual(before.Actions, after.Actions) {
+		changed = append(changed, "actions")
+	}
+	if before.Enabled != after.Enabled {
+		changed = append(changed, "enabled")
+	}
+	if before.Execution != after.Execution {
+		changed = append(changed, "execution")
+	}
+	return changed
+}
+
+// jsonEqual compares two JSON documents semantically, ignoring formatting and key order
+func jsonEqual(a, b json.RawMessage) bool {
+	var va, vb interface{}
+	if err := json.Unmarshal(a, &va); err != nil {
+		return false
+	}
+	if err := json.Unmarshal(b, &vb); err != nil {
+		return false
+	}
+	return reflect.DeepEqual(va, vb)
+}
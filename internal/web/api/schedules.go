@@ -0,0 +1,325 @@
+package api
+
+import (
+	"log"
+	"strconv"
+	"time"
+
+	"smarthome/internal/audit"
+	"smarthome/internal/clock"
+	"smarthome/internal/models"
+	"smarthome/internal/scheduler"
+	webModels "smarthome/internal/web/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const scheduleColumns = "s.id, s.rule_id, s.cron_expression, s.run_at, COALESCE(s.calendar_id::text, ''), s.calendar_filter, s.timezone, s.exclude_dates, s.enabled, s.auto, s.last_fired_at, s.catch_up, s.catch_up_grace_seconds"
+
+// defaultNextFireTimes is how many upcoming fire times are listed per schedule
+const defaultNextFireTimes = 5
+
+func scanScheduleRow(row pgx.Row) (*models.Schedule, error) {
+	var s models.Schedule
+	if err := row.Scan(&s.ID, &s.RuleID, &s.CronExpression, &s.RunAt, &s.CalendarID, &s.CalendarFilter, &s.Timezone, &s.ExcludeDates, &s.Enabled, &s.Auto, &s.LastFiredAt, &s.CatchUp, &s.CatchUpGrace); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// getUserSchedule fetches a schedule of one of the user's rules
+func getUserSchedule(c *gin.Context, dbConn *pgxpool.Pool, userID, id string) (*models.Schedule, error) {
+	return scanScheduleRow(dbConn.QueryRow(c,
+		"SELECT "+scheduleColumns+" FROM schedules s JOIN rules r ON r.id = s.rule_id WHERE s.id=$1 AND r.owner_id=$2", id, userID))
+}
+
+// scheduleResponse adds the next count fire times of an enabled schedule
+func scheduleResponse(engine EngineInterface, s models.Schedule, count int) webModels.ScheduleResponse {
+	resp := webModels.ScheduleResponse{Schedule: s, NextFireTimes: []time.Time{}}
+	if s.Enabled {
+		resp.NextFireTimes = engine.ScheduleFireTimes(s, count)
+	}
+	return resp
+}
+
+// validateUserSchedule checks a schedule's settings and that its calendar belongs to the user.
+// On failure it returns the status and message to answer with.
+func validateUserSchedule(c *gin.Context, dbConn *pgxpool.Pool, userID string, s models.Schedule) (int, string) {
+	if err := scheduler.ValidateSchedule(s); err != nil {
+		return 400, "Invalid schedule: " + err.Error()
+	}
+	if s.CalendarID != "" {
+		var exists bool
+		err := dbConn.QueryRow(c, "SELECT EXISTS(SELECT 1 FROM calendars WHERE id::text=$1 AND owner_id=$2)", s.CalendarID, userID).Scan(&exists)
+		if err != nil || !exists {
+			return 404, "Calendar not found"
+		}
+	}
+	return 0, ""
+}
+
+// saveSchedule stores a changed schedule, records the audit entry and reloads it in the scheduler
+func saveSchedule(c *gin.Context, dbConn *pgxpool.Pool, engine EngineInterface, auditLog *audit.Logger, userID string, before, s *models.Schedule) error {
+	_, err := dbConn.Exec(c,
+		"UPDATE schedules SET cron_expression=$1, run_at=$2, calendar_filter=$3, timezone=$4, exclude_dates=$5, enabled=$6, catch_up=$7, catch_up_grace_seconds=$8 WHERE id=$9",
+		s.CronExpression, s.RunAt, s.CalendarFilter, s.Timezone, s.ExcludeDates, s.Enabled, s.CatchUp, s.CatchUpGrace, s.ID)
+	if err != nil {
+		return err
+	}
+	auditLog.Record(c, audit.Entry{
+		ActorID: userID,
+		Action:  audit.ActionScheduleUpdate,
+		Source:  audit.RequestSource(c.Request),
+		RuleID:  s.RuleID,
+		Details: audit.Marshal(gin.H{"schedule_id": s.ID}),
+		Before:  audit.Marshal(before),
+		After:   audit.Marshal(s),
+	})
+	if err := engine.RefreshSchedule(s.ID); err != nil {
+		log.Printf("Error refreshing schedule %s: %v", s.ID, err)
+	}
+	return nil
+}
+
+func registerScheduleRoutes(automations *gin.RouterGroup, dbConn *pgxpool.Pool, engine EngineInterface, auditLog *audit.Logger) {
+	// List the user's schedules (?rule_id= limits them to one rule)
+	automations.GET("/schedules", func(c *gin.Context) {
+		userID := c.GetString("user_id")
+		var ruleID interface{}
+		if value := c.Query("rule_id"); value != "" {
+			ruleID = value
+		}
+
+		rows, err := dbConn.Query(c,
+			"SELECT "+scheduleColumns+" FROM schedules s JOIN rules r ON r.id = s.rule_id WHERE r.owner_id=$1 AND ($2::text IS NULL OR s.rule_id::text = $2) ORDER BY s.id",
+			userID, ruleID)
+		if err != nil {
+			println("Error fetching schedules:", err.Error())
+			c.JSON(500, gin.H{"error": "Failed to fetch schedules"})
+			return
+		}
+		defer rows.Close()
+
+		schedules := []webModels.ScheduleResponse{}
+		for rows.Next() {
+			s, err := scanScheduleRow(rows)
+			if err != nil {
+				println("Error scanning schedule:", err.Error())
+				continue
+			}
+			schedules = append(schedules, scheduleResponse(engine, *s, defaultNextFireTimes))
+		}
+		c.JSON(200, schedules)
+	})
+
+	// Get a schedule with its next ?count= fire times
+	automations.GET("/schedules/:id", func(c *gin.Context) {
+		s, err := getUserSchedule(c, dbConn, c.GetString("user_id"), c.Param("id"))
+		if err != nil {
+			c.JSON(404, gin.H{"error": "Schedule not found"})
+			return
+		}
+		count := defaultNextFireTimes
+		if value := c.Query("count"); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 || n > 100 {
+				c.JSON(400, gin.H{"error": "Invalid count, expected 1-100"})
+				return
+			}
+			count = n
+		}
+		c.JSON(200, scheduleResponse(engine, *s, count))
+	})
+
+	automations.POST("/schedules", func(c *gin.Context) {
+		userID := c.GetString("user_id")
+		var req webModels.CreateScheduleRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			println("Error binding JSON:", err.Error())
+			c.JSON(400, gin.H{"error": "Invalid request"})
+			return
+		}
+		s := models.Schedule{
+			RuleID:         req.RuleID,
+			CronExpression: req.CronExpression,
+			RunAt:          req.RunAt,
+			CalendarID:     req.CalendarID,
+			CalendarFilter: req.CalendarFilter,
+			Timezone:       req.Timezone,
+			ExcludeDates:   req.ExcludeDates,
+			Enabled:        true,
+			CatchUp:        scheduler.CatchUpSkip,
+			CatchUpGrace:   scheduler.DefaultCatchUpGrace,
+		}
+		if req.CatchUp != "" {
+			s.CatchUp = req.CatchUp
+		}
+		if req.CatchUpGrace != nil {
+			s.CatchUpGrace = *req.CatchUpGrace
+		}
+		if s.ExcludeDates == nil {
+			s.ExcludeDates = []string{}
+		}
+		if req.Enabled != nil {
+			s.Enabled = *req.Enabled
+		}
+		if s.RunAt != nil && !s.RunAt.After(clock.Now()) {
+			c.JSON(400, gin.H{"error": "Invalid schedule: run_at must be in the future"})
+			return
+		}
+
+		var exists bool
+		err := dbConn.QueryRow(c, "SELECT EXISTS(SELECT 1 FROM rules WHERE id::text=$1 AND owner_id=$2)", req.RuleID, userID).Scan(&exists)
+		if err != nil || !exists {
+			c.JSON(404, gin.H{"error": "Rule not found"})
+			return
+		}
+
+		if status, msg := validateUserSchedule(c, dbConn, userID, s); status != 0 {
+			c.JSON(status, gin.H{"error": msg})
+			return
+		}
+
+		err = dbConn.QueryRow(c,
+			`INSERT INTO schedules (rule_id, cron_expression, run_at, calendar_id, calendar_filter, timezone, exclude_dates, enabled, auto, catch_up, catch_up_grace_seconds)
+			 VALUES ($1, $2, $3, NULLIF($4, '')::integer, $5, $6, $7, $8, false, $9, $10) RETURNING id`,
+			s.RuleID, s.CronExpression, s.RunAt, s.CalendarID, s.CalendarFilter, s.Timezone, s.ExcludeDates, s.Enabled, s.CatchUp, s.CatchUpGrace).Scan(&s.ID)
+		if err != nil {
+			println("Error creating schedule:", err.Error())
+			c.JSON(500, gin.H{"error": "Failed to create schedule"})
+			return
+		}
+		auditLog.Record(c, audit.Entry{
+			ActorID: userID,
+			Action:  audit.ActionScheduleCreate,
+			Source:  audit.RequestSource(c.Request),
+			RuleID:  s.RuleID,
+			Details: audit.Marshal(gin.H{"schedule_id": s.ID}),
+			After:   audit.Marshal(s),
+		})
+		if err := engine.RefreshSchedule(s.ID); err != nil {
+			log.Printf("Error refreshing schedule %s: %v", s.ID, err)
+		}
+
+		c.JSON(201, scheduleResponse(engine, s, defaultNextFireTimes))
+	})
+
+	automations.PATCH("/schedules/:id", func(c *gin.Context) {
+		userID := c.GetString("user_id")
+		var req webModels.UpdateScheduleRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			println("Error binding JSON:", err.Error())
+			c.JSON(400, gin.H{"error": "Invalid request"})
+			return
+		}
+
+		s, err := getUserSchedule(c, dbConn, userID, c.Param("id"))
+		if err != nil {
+			c.JSON(404, gin.H{"error": "Schedule not found"})
+			return
+		}
+		before := *s
+
+		// Auto-generated schedules follow the rule's time conditions; they can only be
+		// paused or given exclusion dates and a catch-up policy
+		if s.Auto && (req.CronExpression != nil || req.RunAt != nil || req.CalendarFilter != nil || req.Timezone != nil) {
+			c.JSON(409, gin.H{"error": "Schedule is generated from the rule's time conditions; edit the rule instead"})
+			return
+		}
+		if req.CronExpression != nil {
+			s.CronExpression = *req.CronExpression
+		}
+		if req.RunAt != nil {
+			if !req.RunAt.After(clock.Now()) {
+				c.JSON(400, gin.H{"error": "Invalid schedule: run_at must be in the future"})
+				return
+			}
+			s.RunAt = req.RunAt
+		}
+		if req.CalendarFilter != nil {
+			s.CalendarFilter = *req.CalendarFilter
+		}
+		if req.Timezone != nil {
+			s.Timezone = *req.Timezone
+		}
+		if req.ExcludeDates != nil {
+			s.ExcludeDates = *req.ExcludeDates
+			if s.ExcludeDates == nil {
+				s.ExcludeDates = []string{}
+			}
+		}
+		if req.CatchUp != nil {
+			s.CatchUp = *req.CatchUp
+		}
+		if req.CatchUpGrace != nil {
+			s.CatchUpGrace = *req.CatchUpGrace
+		}
+		if req.Enabled != nil {
+			s.Enabled = *req.Enabled
+		}
+		if status, msg := validateUserSchedule(c, dbConn, userID, *s); status != 0 {
+			c.JSON(status, gin.H{"error": msg})
+			return
+		}
+
+		if err := saveSchedule(c, dbConn, engine, auditLog, userID, &before, s); err != nil {
+			println("Error updating schedule:", err.Error())
+			c.JSON(500, gin.H{"error": "Failed to update schedule"})
+			return
+		}
+		c.JSON(200, scheduleResponse(engine, *s, defaultNextFireTimes))
+	})
+
+	// Pause and resume enable or disable a schedule without changing it
+	setEnabled := func(enabled bool) gin.HandlerFunc {
+		return func(c *gin.Context) {
+			userID := c.GetString("user_id")
+			s, err := getUserSchedule(c, dbConn, userID, c.Param("id"))
+			if err != nil {
+				c.JSON(404, gin.H{"error": "Schedule not found"})
+				return
+			}
+			before := *s
+			s.Enabled = enabled
+			if err := saveSchedule(c, dbConn, engine, auditLog, userID, &before, s); err != nil {
+				println("Error updating schedule:", err.Error())
+				c.JSON(500, gin.H{"error": "Failed to update schedule"})
+				return
+			}
+			c.JSON(200, scheduleResponse(engine, *s, defaultNextFireTimes))
+		}
+	}
+	automations.POST("/schedules/:id/pause", setEnabled(false))
+	automations.POST("/schedules/:id/resume", setEnabled(true))
+
+	automations.DELETE("/schedules/:id", func(c *gin.Context) {
+		userID := c.GetString("user_id")
+		s, err := getUserSchedule(c, dbConn, userID, c.Param("id"))
+		if err != nil {
+			c.JSON(404, gin.H{"error": "Schedule not found"})
+			return
+		}
+		if s.Auto {
+			c.JSON(409, gin.H{"error": "Schedule is generated from the rule's time conditions; pause it or edit the rule instead"})
+			return
+		}
+
+		engine.RemoveSchedule(s.ID)
+		if _, err := dbConn.Exec(c, "DELETE FROM schedules WHERE id=$1", s.ID); err != nil {
+			println("Error deleting schedule:", err.Error())
+			c.JSON(500, gin.H{"error": "Failed to delete schedule"})
+			return
+		}
+		auditLog.Record(c, audit.Entry{
+			ActorID: userID,
+			Action:  audit.ActionScheduleDelete,
+			Source:  audit.RequestSource(c.Request),
+			RuleID:  s.RuleID,
+			Details: audit.Marshal(gin.H{"schedule_id": s.ID}),
+			Before:  audit.Marshal(s),
+		})
+		c.JSON(200, gin.H{"status": "Schedule deleted successfully"})
+	})
+}
@@ -9,14 +9,15 @@ import (
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
-func RegisterUserRoutes(r *gin.Engine, middleware *middleware.MiddlewareManager, dbConn *pgxpool.Pool) {
+func RegisterUserRoutes(r *gin.Engine, middlewareManager *middleware.MiddlewareManager, dbConn *pgxpool.Pool) {
 	users := r.Group("/users")
-	users.Use(middleware.RequireAuth())
+	users.Use(middlewareManager.RequireAuth(), middlewareManager.RateLimit(middleware.RouteClassAPI))
 	{
 		users.GET("/me", func(c *gin.Context) {
 			userID := c.GetString("user_id")
 			var user models.User
-			err := dbConn.QueryRow(c, "SELECT id, email, username FROM users WHERE id=$1", userID).Scan(&user.ID, &user.Email, &user.Name)
+			err := dbConn.QueryRow(c, "SELECT id, email, username, role, totp_enabled FROM users WHERE id=$1", userID).
+				Scan(&user.ID, &user.Email, &user.Name, &user.Role, &user.TwoFactorEnabled)
 			if err != nil {
 				log.Printf("API: Failed to fetch user data: %v", err)
 				c.JSON(404, gin.H{"error": "User not found"})
@@ -0,0 +1,166 @@
+package api
+
+import (
+	"errors"
+	"log"
+
+	"smarthome/internal/audit"
+	"smarthome/internal/models"
+	"smarthome/internal/vacation"
+	"smarthome/internal/web/middleware"
+	webModels "smarthome/internal/web/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const vacationModeColumns = "id, owner_id, devices, weeks, jitter_minutes, enabled, enabled_at, saved_states"
+
+// getUserVacation fetches the vacation mode of a household
+func getUserVacation(c *gin.Context, dbConn *pgxpool.Pool, userID string) (*models.VacationMode, error) {
+	var v models.VacationMode
+	err := dbConn.QueryRow(c, "SELECT "+vacationModeColumns+" FROM vacation_modes WHERE owner_id=$1", userID).
+		Scan(&v.ID, &v.OwnerID, &v.Devices, &v.Weeks, &v.JitterMinutes, &v.Enabled, &v.EnabledAt, &v.SavedStates)
+	if err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// validateVacation checks the replay settings and that the caller owns every device
+func validateVacation(c *gin.Context, dbConn *pgxpool.Pool, userID string, v models.VacationMode) string {
+	switch {
+	case v.Weeks < 1 || v.Weeks > 12:
+		return "Weeks must be between 1 and 12"
+	case v.JitterMinutes < 0 || v.JitterMinutes > 120:
+		return "Jitter must be between 0 and 120 minutes"
+	}
+	var owned int
+	err := dbConn.QueryRow(c, "SELECT COUNT(*) FROM devices WHERE id = ANY($1) AND owner_id=$2", v.Devices, userID).Scan(&owned)
+	if err != nil || owned != len(v.Devices) {
+		return "Unknown device in devices"
+	}
+	return ""
+}
+
+func RegisterVacationRoutes(r *gin.Engine, middlewareManager *middleware.MiddlewareManager, dbConn *pgxpool.Pool, engine EngineInterface, auditLog *audit.Logger) {
+	vacationRoutes := r.Group("/vacation")
+	vacationRoutes.Use(middlewareManager.RequireAuth(), middlewareManager.RateLimit(middleware.RouteClassAPI))
+	{
+		vacationRoutes.GET("", func(c *gin.Context) {
+			mode, err := getUserVacation(c, dbConn, c.GetString("user_id"))
+			if err != nil {
+				c.JSON(404, gin.H{"error": "Vacation mode not configured"})
+				return
+			}
+			c.JSON(200, mode)
+		})
+
+		// Choose the replayed devices and how the replay varies
+		vacationRoutes.PUT("", func(c *gin.Context) {
+			userID := c.GetString("user_id")
+			var req webModels.VacationModeRequest
+			if err := c.ShouldBindJSON(&req); err != nil {
+				println("Error binding JSON:", err.Error())
+				c.JSON(400, gin.H{"error": "Invalid request"})
+				return
+			}
+
+			mode, err := getUserVacation(c, dbConn, userID)
+			created := errors.Is(err, pgx.ErrNoRows)
+			switch {
+			case created:
+				mode = &models.VacationMode{OwnerID: userID, Devices: []string{}, Weeks: 2, JitterMinutes: 15}
+			case err != nil:
+				println("Error fetching vacation mode:", err.Error())
+				c.JSON(500, gin.H{"error": "Failed to fetch vacation mode"})
+				return
+			case mode.Enabled:
+				c.JSON(409, gin.H{"error": "Turn vacation mode off before changing it"})
+				return
+			}
+			before := *mode
+
+			if req.Devices != nil {
+				mode.Devices = *req.Devices
+			}
+			if req.Weeks != nil {
+				mode.Weeks = *req.Weeks
+			}
+			if req.JitterMinutes != nil {
+				mode.JitterMinutes = *req.JitterMinutes
+			}
+			if msg := validateVacation(c, dbConn, userID, *mode); msg != "" {
+				c.JSON(400, gin.H{"error": msg})
+				return
+			}
+
+			if created {
+				err = dbConn.QueryRow(c, "INSERT INTO vacation_modes (owner_id, devices, weeks, jitter_minutes) VALUES ($1, $2, $3, $4) RETURNING id",
+					userID, mode.Devices, mode.Weeks, mode.JitterMinutes).Scan(&mode.ID)
+			} else {
+				_, err = dbConn.Exec(c, "UPDATE vacation_modes SET devices=$1, weeks=$2, jitter_minutes=$3 WHERE id=$4 AND owner_id=$5 AND NOT enabled",
+					mode.Devices, mode.Weeks, mode.JitterMinutes, mode.ID, userID)
+			}
+			if err != nil {
+				println("Error saving vacation mode:", err.Error())
+				c.JSON(500, gin.H{"error": "Failed to save vacation mode"})
+				return
+			}
+			entry := audit.Entry{
+				ActorID: userID,
+				Action:  audit.ActionVacationSave,
+				Source:  audit.RequestSource(c.Request),
+				Details: audit.Marshal(gin.H{"vacation_id": mode.ID, "devices": len(mode.Devices)}),
+				After:   audit.Marshal(mode),
+			}
+			if !created {
+				entry.Before = audit.Marshal(before)
+			}
+			auditLog.Record(c, entry)
+
+			status := 200
+			if created {
+				status = 201
+			}
+			c.JSON(status, mode)
+		})
+
+		setVacation := func(enabled bool) gin.HandlerFunc {
+			return func(c *gin.Context) {
+				userID := c.GetString("user_id")
+				changed, err := engine.SetVacation(userID, enabled)
+				if errors.Is(err, vacation.ErrNotConfigured) {
+					c.JSON(400, gin.H{"error": "Choose the devices to replay first"})
+					return
+				}
+				if err != nil {
+					log.Printf("Error setting vacation mode of household %s: %v", userID, err)
+					c.JSON(500, gin.H{"error": "Failed to set vacation mode"})
+					return
+				}
+				if changed {
+					action := audit.ActionVacationDisable
+					if enabled {
+						action = audit.ActionVacationEnable
+					}
+					auditLog.Record(c, audit.Entry{
+						ActorID: userID,
+						Action:  action,
+						Source:  audit.RequestSource(c.Request),
+					})
+				}
+
+				mode, err := getUserVacation(c, dbConn, userID)
+				if err != nil {
+					c.JSON(404, gin.H{"error": "Vacation mode not configured"})
+					return
+				}
+				c.JSON(200, mode)
+			}
+		}
+		vacationRoutes.POST("/enable", setVacation(true))
+		vacationRoutes.POST("/disable", setVacation(false))
+	}
+}
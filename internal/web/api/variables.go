@@ -0,0 +1,264 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+
+	"smarthome/internal/audit"
+	"smarthome/internal/automation"
+	"smarthome/internal/models"
+	webModels "smarthome/internal/web/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const variableColumns = "id, name, type, options, min, max, value, rule_id, owner_id, updated_at"
+
+func scanVariableRow(row pgx.Row) (*models.Variable, error) {
+	var v models.Variable
+	var options json.RawMessage
+	if err := row.Scan(&v.ID, &v.Name, &v.Type, &options, &v.Min, &v.Max, &v.Value, &v.RuleID, &v.OwnerID, &v.UpdatedAt); err != nil {
+		return nil, err
+	}
+	json.Unmarshal(options, &v.Options)
+	return &v, nil
+}
+
+// getUserVariable fetches a variable owned by the user
+func getUserVariable(c *gin.Context, dbConn *pgxpool.Pool, userID, id string) (*models.Variable, error) {
+	return scanVariableRow(dbConn.QueryRow(c, "SELECT "+variableColumns+" FROM variables WHERE id=$1 AND owner_id=$2", id, userID))
+}
+
+// saveVariable stores a variable definition and value, then lets the engine re-evaluate dependent rules
+func saveVariable(c *gin.Context, dbConn *pgxpool.Pool, engine EngineInterface, auditLog *audit.Logger, userID string, before, v *models.Variable) error {
+	options, _ := json.Marshal(v.Options)
+	err := dbConn.QueryRow(c,
+		"UPDATE variables SET options=$1, min=$2, max=$3, value=$4, updated_at=NOW() WHERE id=$5 AND owner_id=$6 RETURNING updated_at",
+		options, v.Min, v.Max, v.Value, v.ID, userID).Scan(&v.UpdatedAt)
+	if err != nil {
+		return err
+	}
+
+	entry := audit.Entry{
+		ActorID: userID,
+		Action:  audit.ActionVariableSet,
+		Source:  audit.RequestSource(c.Request),
+		Details: audit.Marshal(gin.H{"variable_id": v.ID, "name": v.Name}),
+		Before:  before.Value,
+		After:   v.Value,
+	}
+	if v.RuleID != nil {
+		entry.RuleID = *v.RuleID
+	}
+	auditLog.Record(c, entry)
+
+	if err := engine.RefreshVariable(*v); err != nil {
+		log.Printf("Error refreshing variable %s: %v", v.Name, err)
+	}
+	return nil
+}
+
+func registerVariableRoutes(automations *gin.RouterGroup, dbConn *pgxpool.Pool, engine EngineInterface, auditLog *audit.Logger) {
+	// List variables; ?rule_id= limits the list to one rule's private variables
+	automations.GET("/variables", func(c *gin.Context) {
+		userID := c.GetString("user_id")
+		query := "SELECT " + variableColumns + " FROM variables WHERE owner_id=$1"
+		args := []interface{}{userID}
+		if ruleID := c.Query("rule_id"); ruleID != "" {
+			query += " AND rule_id=$2"
+			args = append(args, ruleID)
+		}
+		rows, err := dbConn.Query(c, query+" ORDER BY name, id", args...)
+		if err != nil {
+			println("Error fetching variables:", err.Error())
+			c.JSON(500, gin.H{"error": "Failed to fetch variables"})
+			return
+		}
+		defer rows.Close()
+
+		variables := []models.Variable{}
+		for rows.Next() {
+			v, err := scanVariableRow(rows)
+			if err != nil {
+				println("Error scanning variable:", err.Error())
+				continue
+			}
+			variables = append(variables, *v)
+		}
+		c.JSON(200, variables)
+	})
+
+	automations.POST("/variables", func(c *gin.Context) {
+		userID := c.GetString("user_id")
+		var req webModels.CreateVariableRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			println("Error binding JSON:", err.Error())
+			c.JSON(400, gin.H{"error": "Invalid request"})
+			return
+		}
+
+		v := models.Variable{
+			Name:    req.Name,
+			Type:    req.Type,
+			Options: req.Options,
+			Min:     req.Min,
+			Max:     req.Max,
+			Value:   req.Value,
+			RuleID:  req.RuleID,
+			OwnerID: userID,
+		}
+		if len(v.Value) == 0 || string(v.Value) == "null" {
+			v.Value, _ = json.Marshal(automation.DefaultVariableValue(v))
+		}
+		if err := automation.ValidateVariable(v); err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+
+		if v.RuleID != nil {
+			var exists bool
+			err := dbConn.QueryRow(c, "SELECT EXISTS(SELECT 1 FROM rules WHERE id=$1 AND owner_id=$2)", *v.RuleID, userID).Scan(&exists)
+			if err != nil || !exists {
+				c.JSON(404, gin.H{"error": "Rule not found"})
+				return
+			}
+		}
+
+		options, _ := json.Marshal(v.Options)
+		err := dbConn.QueryRow(c,
+			"INSERT INTO variables (name, type, options, min, max, value, rule_id, owner_id) VALUES ($1, $2, $3, $4, $5, $6, $7, $8) ON CONFLICT DO NOTHING RETURNING id, updated_at",
+			v.Name, v.Type, options, v.Min, v.Max, v.Value, v.RuleID, userID).Scan(&v.ID, &v.UpdatedAt)
+		if err != nil {
+			// ON CONFLICT DO NOTHING returns no row for duplicates
+			var exists bool
+			dbConn.QueryRow(c, "SELECT EXISTS(SELECT 1 FROM variables WHERE owner_id=$1 AND COALESCE(rule_id, 0)=COALESCE($2::integer, 0) AND name=$3)", userID, v.RuleID, v.Name).Scan(&exists)
+			if exists {
+				c.JSON(409, gin.H{"error": "A variable with this name already exists"})
+				return
+			}
+			println("Error creating variable:", err.Error())
+			c.JSON(500, gin.H{"error": "Failed to create variable"})
+			return
+		}
+
+		entry := audit.Entry{
+			ActorID: userID,
+			Action:  audit.ActionVariableSet,
+			Source:  audit.RequestSource(c.Request),
+			Details: audit.Marshal(gin.H{"variable_id": v.ID, "name": v.Name, "created": true}),
+			After:   v.Value,
+		}
+		if v.RuleID != nil {
+			entry.RuleID = *v.RuleID
+		}
+		auditLog.Record(c, entry)
+
+		if err := engine.RefreshVariable(v); err != nil {
+			log.Printf("Error refreshing variable %s: %v", v.Name, err)
+		}
+		c.JSON(201, v)
+	})
+
+	automations.GET("/variables/:id", func(c *gin.Context) {
+		v, err := getUserVariable(c, dbConn, c.GetString("user_id"), c.Param("id"))
+		if err != nil {
+			c.JSON(404, gin.H{"error": "Variable not found"})
+			return
+		}
+		c.JSON(200, v)
+	})
+
+	// Change a variable's options, range or value; name and type are fixed
+	automations.PATCH("/variables/:id", func(c *gin.Context) {
+		userID := c.GetString("user_id")
+		var req webModels.UpdateVariableRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			println("Error binding JSON:", err.Error())
+			c.JSON(400, gin.H{"error": "Invalid request"})
+			return
+		}
+
+		existing, err := getUserVariable(c, dbConn, userID, c.Param("id"))
+		if err != nil {
+			c.JSON(404, gin.H{"error": "Variable not found"})
+			return
+		}
+
+		updated := *existing
+		if req.Options != nil {
+			updated.Options = *req.Options
+		}
+		if req.Min != nil {
+			updated.Min = req.Min
+		}
+		if req.Max != nil {
+			updated.Max = req.Max
+		}
+		if req.Value != nil {
+			updated.Value = *req.Value
+		}
+		if err := automation.ValidateVariable(updated); err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+
+		if err := saveVariable(c, dbConn, engine, auditLog, userID, existing, &updated); err != nil {
+			println("Error updating variable:", err.Error())
+			c.JSON(500, gin.H{"error": "Failed to update variable"})
+			return
+		}
+		c.JSON(200, updated)
+	})
+
+	// Set only the value, e.g. {"value": "away"}
+	automations.PUT("/variables/:id/value", func(c *gin.Context) {
+		userID := c.GetString("user_id")
+		var req webModels.SetVariableValueRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			println("Error binding JSON:", err.Error())
+			c.JSON(400, gin.H{"error": "Invalid request"})
+			return
+		}
+
+		existing, err := getUserVariable(c, dbConn, userID, c.Param("id"))
+		if err != nil {
+			c.JSON(404, gin.H{"error": "Variable not found"})
+			return
+		}
+
+		updated := *existing
+		updated.Value = req.Value
+		if err := automation.ValidateVariable(updated); err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+
+		if err := saveVariable(c, dbConn, engine, auditLog, userID, existing, &updated); err != nil {
+			println("Error updating variable:", err.Error())
+			c.JSON(500, gin.H{"error": "Failed to update variable"})
+			return
+		}
+		c.JSON(200, updated)
+	})
+
+	automations.DELETE("/variables/:id", func(c *gin.Context) {
+		userID := c.GetString("user_id")
+		existing, err := getUserVariable(c, dbConn, userID, c.Param("id"))
+		if err != nil {
+			c.JSON(404, gin.H{"error": "Variable not found"})
+			return
+		}
+
+		if _, err := dbConn.Exec(c, "DELETE FROM variables WHERE id=$1 AND owner_id=$2", existing.ID, userID); err != nil {
+			println("Error deleting variable:", err.Error())
+			c.JSON(500, gin.H{"error": "Failed to delete variable"})
+			return
+		}
+		if err := engine.RemoveVariable(*existing); err != nil {
+			log.Printf("Error removing variable %s: %v", existing.Name, err)
+		}
+		c.JSON(200, gin.H{"status": "Variable deleted successfully"})
+	})
+}
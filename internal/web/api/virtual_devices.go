@@ -0,0 +1,216 @@
+package api
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+
+	"smarthome/internal/audit"
+	"smarthome/internal/automation"
+	"smarthome/internal/models"
+	webModels "smarthome/internal/web/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Virtual device IDs share the namespace of MQTT device IDs
+var virtualDeviceIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// validateVirtualDevice checks a definition against the user's devices: inputs must be
+// accepted devices of the user and no virtual device may end up computed from itself
+func validateVirtualDevice(c *gin.Context, dbConn *pgxpool.Pool, userID string, vd models.VirtualDevice) error {
+	if _, err := automation.CompileVirtualDevice(vd); err != nil {
+		return err
+	}
+	inputs := automation.VirtualDeviceInputs(vd)
+
+	owned := make(map[string]bool)
+	rows, err := dbConn.Query(c, "SELECT id FROM devices WHERE id = ANY($1) AND owner_id=$2 AND accepted=true", inputs, userID)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err == nil {
+			owned[id] = true
+		}
+	}
+	rows.Close()
+	for _, id := range inputs {
+		if !owned[id] {
+			return fmt.Errorf("unknown device %s", id)
+		}
+	}
+
+	existing := make(map[string]models.VirtualDevice)
+	rows, err = dbConn.Query(c, "SELECT v.device_id, v.attributes FROM virtual_devices v JOIN devices d ON d.id = v.device_id WHERE d.owner_id=$1", userID)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var other models.VirtualDevice
+		if err := rows.Scan(&other.DeviceID, &other.Attributes); err == nil {
+			existing[other.DeviceID] = other
+		}
+	}
+	rows.Close()
+
+	return automation.CheckVirtualCycle(vd.DeviceID, inputs, func(id string) ([]string, bool) {
+		other, ok := existing[id]
+		if !ok {
+			return nil, false
+		}
+		return automation.VirtualDeviceInputs(other), true
+	})
+}
+
+func registerVirtualDeviceRoutes(devices *gin.RouterGroup, dbConn *pgxpool.Pool, engine EngineInterface, auditLog *audit.Logger) {
+	// List the user's virtual device definitions
+	devices.GET("/virtual", func(c *gin.Context) {
+		userID := c.GetString("user_id")
+		rows, err := dbConn.Query(c, "SELECT v.device_id, v.attributes FROM virtual_devices v JOIN devices d ON d.id = v.device_id WHERE d.owner_id=$1 ORDER BY v.device_id", userID)
+		if err != nil {
+			println("Error fetching virtual devices:", err.Error())
+			c.JSON(500, gin.H{"error": "Failed to fetch virtual devices"})
+			return
+		}
+		defer rows.Close()
+
+		virtualDevices := []models.VirtualDevice{}
+		for rows.Next() {
+			var vd models.VirtualDevice
+			if err := rows.Scan(&vd.DeviceID, &vd.Attributes); err != nil {
+				c.JSON(500, gin.H{"error": "Failed to scan virtual device"})
+				return
+			}
+			virtualDevices = append(virtualDevices, vd)
+		}
+		c.JSON(200, virtualDevices)
+	})
+
+	devices.GET("/virtual/:id", func(c *gin.Context) {
+		userID := c.GetString("user_id")
+		var vd models.VirtualDevice
+		err := dbConn.QueryRow(c, "SELECT v.device_id, v.attributes FROM virtual_devices v JOIN devices d ON d.id = v.device_id WHERE v.device_id=$1 AND d.owner_id=$2", c.Param("id"), userID).
+			Scan(&vd.DeviceID, &vd.Attributes)
+		if err != nil {
+			c.JSON(404, gin.H{"error": "Virtual device not found"})
+			return
+		}
+		c.JSON(200, vd)
+	})
+
+	// Create a virtual device, e.g. {"id": "living_temp", "name": "Living room", "type": "thermometer",
+	// "attributes": {"temperature": "avg(device.1.temperature, device.2.temperature)"}}
+	devices.POST("/virtual", func(c *gin.Context) {
+		userID := c.GetString("user_id")
+		var req webModels.CreateVirtualDeviceRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			println("Error binding JSON:", err.Error())
+			c.JSON(400, gin.H{"error": "Invalid request"})
+			return
+		}
+		if !virtualDeviceIDPattern.MatchString(req.ID) {
+			c.JSON(400, gin.H{"error": "Invalid device ID: use letters, digits, '-' and '_'"})
+			return
+		}
+		if req.Type == "" {
+			req.Type = "virtual"
+		}
+
+		vd := models.VirtualDevice{DeviceID: req.ID, Attributes: req.Attributes}
+		if err := validateVirtualDevice(c, dbConn, userID, vd); err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+
+		tx, err := dbConn.Begin(c)
+		if err != nil {
+			c.JSON(500, gin.H{"error": "Failed to create virtual device"})
+			return
+		}
+		defer tx.Rollback(c)
+
+		commandTag, err := tx.Exec(c,
+			"INSERT INTO devices (id, name, type, mqtt_topic, accepted, owner_id) VALUES ($1, $2, $3, $4, true, $5) ON CONFLICT DO NOTHING",
+			vd.DeviceID, req.Name, req.Type, fmt.Sprintf("virtual/%s", vd.DeviceID), userID)
+		if err != nil {
+			println("Error creating virtual device:", err.Error())
+			c.JSON(500, gin.H{"error": "Failed to create virtual device"})
+			return
+		}
+		if commandTag.RowsAffected() == 0 {
+			c.JSON(409, gin.H{"error": "A device with this ID already exists"})
+			return
+		}
+		if _, err := tx.Exec(c, "INSERT INTO virtual_devices (device_id, attributes) VALUES ($1, $2)", vd.DeviceID, vd.Attributes); err != nil {
+			println("Error creating virtual device:", err.Error())
+			c.JSON(500, gin.H{"error": "Failed to create virtual device"})
+			return
+		}
+		if err := tx.Commit(c); err != nil {
+			c.JSON(500, gin.H{"error": "Failed to create virtual device"})
+			return
+		}
+
+		auditLog.Record(c, audit.Entry{
+			ActorID:  userID,
+			Action:   audit.ActionVirtualDeviceSave,
+			Source:   audit.RequestSource(c.Request),
+			DeviceID: vd.DeviceID,
+			After:    audit.Marshal(vd.Attributes),
+		})
+		if err := engine.RefreshDeviceOwner(vd.DeviceID); err != nil {
+			log.Printf("Error caching owner of virtual device %s: %v", vd.DeviceID, err)
+		}
+		if err := engine.RefreshVirtualDevice(vd.DeviceID); err != nil {
+			log.Printf("Error refreshing virtual device %s: %v", vd.DeviceID, err)
+		}
+		c.JSON(201, vd)
+	})
+
+	// Replace the attribute expressions of a virtual device
+	devices.PATCH("/virtual/:id", func(c *gin.Context) {
+		userID := c.GetString("user_id")
+		var req webModels.UpdateVirtualDeviceRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			println("Error binding JSON:", err.Error())
+			c.JSON(400, gin.H{"error": "Invalid request"})
+			return
+		}
+
+		var before models.VirtualDevice
+		err := dbConn.QueryRow(c, "SELECT v.device_id, v.attributes FROM virtual_devices v JOIN devices d ON d.id = v.device_id WHERE v.device_id=$1 AND d.owner_id=$2", c.Param("id"), userID).
+			Scan(&before.DeviceID, &before.Attributes)
+		if err != nil {
+			c.JSON(404, gin.H{"error": "Virtual device not found"})
+			return
+		}
+
+		vd := models.VirtualDevice{DeviceID: before.DeviceID, Attributes: req.Attributes}
+		if err := validateVirtualDevice(c, dbConn, userID, vd); err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+
+		if _, err := dbConn.Exec(c, "UPDATE virtual_devices SET attributes=$1 WHERE device_id=$2", vd.Attributes, vd.DeviceID); err != nil {
+			println("Error updating virtual device:", err.Error())
+			c.JSON(500, gin.H{"error": "Failed to update virtual device"})
+			return
+		}
+
+		auditLog.Record(c, audit.Entry{
+			ActorID:  userID,
+			Action:   audit.ActionVirtualDeviceSave,
+			Source:   audit.RequestSource(c.Request),
+			DeviceID: vd.DeviceID,
+			Before:   audit.Marshal(before.Attributes),
+			After:    audit.Marshal(vd.Attributes),
+		})
+		if err := engine.RefreshVirtualDevice(vd.DeviceID); err != nil {
+			log.Printf("Error refreshing virtual device %s: %v", vd.DeviceID, err)
+		}
+		c.JSON(200, vd)
+	})
+}
@@ -0,0 +1,377 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"smarthome/internal/audit"
+	"smarthome/internal/models"
+	"smarthome/internal/presence"
+	"smarthome/internal/web/middleware"
+	webModels "smarthome/internal/web/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const zoneColumns = "id, owner_id, name, latitude, longitude, radius_meters, home"
+
+func scanZoneRow(row pgx.Row) (*models.Zone, error) {
+	var z models.Zone
+	if err := row.Scan(&z.ID, &z.OwnerID, &z.Name, &z.Latitude, &z.Longitude, &z.Radius, &z.Home); err != nil {
+		return nil, err
+	}
+	return &z, nil
+}
+
+// validateZone checks a zone's name, center and radius
+func validateZone(z models.Zone) string {
+	switch {
+	case strings.TrimSpace(z.Name) == "":
+		return "Name is required"
+	case z.Latitude < -90 || z.Latitude > 90:
+		return "Latitude must be between -90 and 90"
+	case z.Longitude < -180 || z.Longitude > 180:
+		return "Longitude must be between -180 and 180"
+	case z.Radius <= 0:
+		return "Radius must be positive"
+	}
+	return ""
+}
+
+// zoneResponse adds the people inside a zone
+func zoneResponse(c *gin.Context, dbConn *pgxpool.Pool, z models.Zone) webModels.ZoneResponse {
+	resp := webModels.ZoneResponse{Zone: z, People: []string{}}
+	rows, err := dbConn.Query(c, "SELECT person_id FROM zone_presence WHERE zone_id=$1 AND inside ORDER BY person_id", z.ID)
+	if err != nil {
+		println("Error fetching zone presence:", err.Error())
+		return resp
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var personID string
+		if err := rows.Scan(&personID); err == nil {
+			resp.People = append(resp.People, personID)
+		}
+	}
+	return resp
+}
+
+// geofenceToken reads a device token from the Authorization header, the basic
+// auth password as OwnTracks sends it, or the token query parameter
+func geofenceToken(c *gin.Context) string {
+	if header := c.GetHeader("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		return strings.TrimPrefix(header, "Bearer ")
+	}
+	if _, password, ok := c.Request.BasicAuth(); ok {
+		return password
+	}
+	return c.Query("token")
+}
+
+// geofenceFields reads a webhook body, JSON or form encoded, into flat fields
+func geofenceFields(c *gin.Context) (map[string]string, error) {
+	fields := make(map[string]string)
+	if c.ContentType() == "application/json" {
+		var body map[string]interface{}
+		if err := json.NewDecoder(c.Request.Body).Decode(&body); err != nil {
+			return nil, err
+		}
+		for key, value := range body {
+			switch v := value.(type) {
+			case string:
+				fields[key] = v
+			case float64:
+				fields[key] = strconv.FormatFloat(v, 'f', -1, 64)
+			case bool:
+				fields[key] = strconv.FormatBool(v)
+			}
+		}
+		return fields, nil
+	}
+	if err := c.Request.ParseForm(); err != nil {
+		return nil, err
+	}
+	for key := range c.Request.Form {
+		if key != "token" {
+			fields[key] = c.Request.Form.Get(key)
+		}
+	}
+	return fields, nil
+}
+
+func RegisterZoneRoutes(r *gin.Engine, middlewareManager *middleware.MiddlewareManager, dbConn *pgxpool.Pool, engine EngineInterface, auditLog *audit.Logger) {
+	// Geofence webhook of mobile apps such as Locative, Geofency and OwnTracks,
+	// authenticated by the token of one of the person's devices
+	r.POST("/presence/geofence", middlewareManager.RateLimit(middleware.RouteClassAuth), func(c *gin.Context) {
+		token := geofenceToken(c)
+		if token == "" {
+			c.JSON(401, gin.H{"error": "Device token required"})
+			return
+		}
+		var deviceID, personID string
+		err := dbConn.QueryRow(c, "UPDATE geofence_devices SET last_seen_at=NOW() WHERE token_hash=$1 RETURNING id, person_id",
+			presence.HashDeviceToken(token)).Scan(&deviceID, &personID)
+		if err != nil {
+			c.JSON(401, gin.H{"error": "Invalid device token"})
+			return
+		}
+
+		fields, err := geofenceFields(c)
+		if err != nil {
+			c.JSON(400, gin.H{"error": "Invalid request"})
+			return
+		}
+		if presence.IgnoredGeofence(fields) {
+			c.JSON(200, gin.H{"status": "Ignored"})
+			return
+		}
+		ev, err := presence.ParseGeofence(fields)
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+
+		if err := engine.ReportGeofence(personID, ev); err != nil {
+			if errors.Is(err, presence.ErrUnknownZone) {
+				c.JSON(404, gin.H{"error": fmt.Sprintf("Unknown zone %s", ev.Zone)})
+				return
+			}
+			log.Printf("Error reporting geofence event of device %s: %v", deviceID, err)
+			c.JSON(500, gin.H{"error": "Failed to report geofence event"})
+			return
+		}
+		c.JSON(200, gin.H{"status": "OK"})
+	})
+
+	zoneRoutes := r.Group("/presence")
+	zoneRoutes.Use(middlewareManager.RequireAuth(), middlewareManager.RateLimit(middleware.RouteClassAPI))
+	{
+		zoneRoutes.GET("/zones", func(c *gin.Context) {
+			rows, err := dbConn.Query(c, "SELECT "+zoneColumns+" FROM zones WHERE owner_id=$1 ORDER BY name, id", c.GetString("user_id"))
+			if err != nil {
+				println("Error fetching zones:", err.Error())
+				c.JSON(500, gin.H{"error": "Failed to fetch zones"})
+				return
+			}
+			var zones []models.Zone
+			for rows.Next() {
+				z, err := scanZoneRow(rows)
+				if err != nil {
+					println("Error scanning zone:", err.Error())
+					continue
+				}
+				zones = append(zones, *z)
+			}
+			rows.Close()
+
+			resp := []webModels.ZoneResponse{}
+			for _, z := range zones {
+				resp = append(resp, zoneResponse(c, dbConn, z))
+			}
+			c.JSON(200, resp)
+		})
+
+		zoneRoutes.POST("/zones", func(c *gin.Context) {
+			userID := c.GetString("user_id")
+			var req webModels.CreateZoneRequest
+			if err := c.ShouldBindJSON(&req); err != nil {
+				println("Error binding JSON:", err.Error())
+				c.JSON(400, gin.H{"error": "Invalid request"})
+				return
+			}
+
+			zone := models.Zone{OwnerID: userID, Name: req.Name, Latitude: *req.Latitude, Longitude: *req.Longitude, Radius: req.Radius, Home: req.Home}
+			if zone.Radius == 0 {
+				zone.Radius = 100
+			}
+			if msg := validateZone(zone); msg != "" {
+				c.JSON(400, gin.H{"error": msg})
+				return
+			}
+
+			err := dbConn.QueryRow(c,
+				"INSERT INTO zones (owner_id, name, latitude, longitude, radius_meters, home) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id",
+				userID, zone.Name, zone.Latitude, zone.Longitude, zone.Radius, zone.Home).Scan(&zone.ID)
+			if err != nil {
+				println("Error creating zone:", err.Error())
+				c.JSON(500, gin.H{"error": "Failed to create zone"})
+				return
+			}
+			auditLog.Record(c, audit.Entry{
+				ActorID: userID,
+				Action:  audit.ActionZoneSave,
+				Source:  audit.RequestSource(c.Request),
+				Details: audit.Marshal(gin.H{"zone_id": zone.ID, "name": zone.Name}),
+				After:   audit.Marshal(zone),
+			})
+			c.JSON(201, zoneResponse(c, dbConn, zone))
+		})
+
+		zoneRoutes.PATCH("/zones/:id", func(c *gin.Context) {
+			userID := c.GetString("user_id")
+			var req webModels.UpdateZoneRequest
+			if err := c.ShouldBindJSON(&req); err != nil {
+				println("Error binding JSON:", err.Error())
+				c.JSON(400, gin.H{"error": "Invalid request"})
+				return
+			}
+
+			zone, err := scanZoneRow(dbConn.QueryRow(c, "SELECT "+zoneColumns+" FROM zones WHERE id=$1 AND owner_id=$2", c.Param("id"), userID))
+			if err != nil {
+				c.JSON(404, gin.H{"error": "Zone not found"})
+				return
+			}
+			before := *zone
+
+			if req.Name != nil {
+				zone.Name = *req.Name
+			}
+			if req.Latitude != nil {
+				zone.Latitude = *req.Latitude
+			}
+			if req.Longitude != nil {
+				zone.Longitude = *req.Longitude
+			}
+			if req.Radius != nil {
+				zone.Radius = *req.Radius
+			}
+			if req.Home != nil {
+				zone.Home = *req.Home
+			}
+			if msg := validateZone(*zone); msg != "" {
+				c.JSON(400, gin.H{"error": msg})
+				return
+			}
+
+			_, err = dbConn.Exec(c, "UPDATE zones SET name=$1, latitude=$2, longitude=$3, radius_meters=$4, home=$5 WHERE id=$6 AND owner_id=$7",
+				zone.Name, zone.Latitude, zone.Longitude, zone.Radius, zone.Home, zone.ID, userID)
+			if err != nil {
+				println("Error updating zone:", err.Error())
+				c.JSON(500, gin.H{"error": "Failed to update zone"})
+				return
+			}
+			auditLog.Record(c, audit.Entry{
+				ActorID: userID,
+				Action:  audit.ActionZoneSave,
+				Source:  audit.RequestSource(c.Request),
+				Details: audit.Marshal(gin.H{"zone_id": zone.ID, "name": zone.Name}),
+				Before:  audit.Marshal(before),
+				After:   audit.Marshal(zone),
+			})
+			c.JSON(200, zoneResponse(c, dbConn, *zone))
+		})
+
+		zoneRoutes.DELETE("/zones/:id", func(c *gin.Context) {
+			userID := c.GetString("user_id")
+			zone, err := scanZoneRow(dbConn.QueryRow(c, "SELECT "+zoneColumns+" FROM zones WHERE id=$1 AND owner_id=$2", c.Param("id"), userID))
+			if err != nil {
+				c.JSON(404, gin.H{"error": "Zone not found"})
+				return
+			}
+
+			if _, err := dbConn.Exec(c, "DELETE FROM zones WHERE id=$1 AND owner_id=$2", zone.ID, userID); err != nil {
+				println("Error deleting zone:", err.Error())
+				c.JSON(500, gin.H{"error": "Failed to delete zone"})
+				return
+			}
+			auditLog.Record(c, audit.Entry{
+				ActorID: userID,
+				Action:  audit.ActionZoneDelete,
+				Source:  audit.RequestSource(c.Request),
+				Details: audit.Marshal(gin.H{"zone_id": zone.ID, "name": zone.Name}),
+				Before:  audit.Marshal(zone),
+			})
+
+			if err := engine.RemoveZone(*zone); err != nil {
+				log.Printf("Error removing zone %s: %v", zone.ID, err)
+			}
+			c.JSON(200, gin.H{"status": "Zone deleted successfully"})
+		})
+
+		zoneRoutes.GET("/people/:id/devices", func(c *gin.Context) {
+			person, err := getUserPerson(c, dbConn, c.GetString("user_id"), c.Param("id"))
+			if err != nil {
+				c.JSON(404, gin.H{"error": "Person not found"})
+				return
+			}
+			rows, err := dbConn.Query(c, "SELECT id, person_id, name, last_seen_at FROM geofence_devices WHERE person_id=$1 ORDER BY id", person.ID)
+			if err != nil {
+				println("Error fetching geofence devices:", err.Error())
+				c.JSON(500, gin.H{"error": "Failed to fetch devices"})
+				return
+			}
+			defer rows.Close()
+
+			devices := []models.GeofenceDevice{}
+			for rows.Next() {
+				var d models.GeofenceDevice
+				if err := rows.Scan(&d.ID, &d.PersonID, &d.Name, &d.LastSeenAt); err != nil {
+					println("Error scanning geofence device:", err.Error())
+					continue
+				}
+				devices = append(devices, d)
+			}
+			c.JSON(200, devices)
+		})
+
+		// Add a phone for a person; the token is only returned here
+		zoneRoutes.POST("/people/:id/devices", func(c *gin.Context) {
+			userID := c.GetString("user_id")
+			var req webModels.CreateGeofenceDeviceRequest
+			if err := c.ShouldBindJSON(&req); err != nil {
+				println("Error binding JSON:", err.Error())
+				c.JSON(400, gin.H{"error": "Invalid request"})
+				return
+			}
+			person, err := getUserPerson(c, dbConn, userID, c.Param("id"))
+			if err != nil {
+				c.JSON(404, gin.H{"error": "Person not found"})
+				return
+			}
+
+			token, hash := presence.NewDeviceToken()
+			device := models.GeofenceDevice{PersonID: person.ID, Name: req.Name}
+			err = dbConn.QueryRow(c, "INSERT INTO geofence_devices (person_id, name, token_hash) VALUES ($1, $2, $3) RETURNING id",
+				person.ID, device.Name, hash).Scan(&device.ID)
+			if err != nil {
+				println("Error creating geofence device:", err.Error())
+				c.JSON(500, gin.H{"error": "Failed to create device"})
+				return
+			}
+			auditLog.Record(c, audit.Entry{
+				ActorID: userID,
+				Action:  audit.ActionGeofenceCreate,
+				Source:  audit.RequestSource(c.Request),
+				Details: audit.Marshal(gin.H{"device_id": device.ID, "person_id": person.ID, "name": device.Name}),
+				After:   audit.Marshal(device),
+			})
+			c.JSON(201, webModels.GeofenceDeviceResponse{GeofenceDevice: device, Token: token})
+		})
+
+		zoneRoutes.DELETE("/devices/:id", func(c *gin.Context) {
+			userID := c.GetString("user_id")
+			var device models.GeofenceDevice
+			err := dbConn.QueryRow(c, `DELETE FROM geofence_devices g USING people p
+				WHERE g.id=$1 AND p.id=g.person_id AND p.owner_id=$2 RETURNING g.id, g.person_id, g.name, g.last_seen_at`,
+				c.Param("id"), userID).Scan(&device.ID, &device.PersonID, &device.Name, &device.LastSeenAt)
+			if err != nil {
+				c.JSON(404, gin.H{"error": "Device not found"})
+				return
+			}
+			auditLog.Record(c, audit.Entry{
+				ActorID: userID,
+				Action:  audit.ActionGeofenceDelete,
+				Source:  audit.RequestSource(c.Request),
+				Details: audit.Marshal(gin.H{"device_id": device.ID, "person_id": device.PersonID, "name": device.Name}),
+				Before:  audit.Marshal(device),
+			})
+			c.JSON(200, gin.H{"status": "Device deleted successfully"})
+		})
+	}
+}
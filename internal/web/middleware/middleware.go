@@ -2,6 +2,7 @@ package middleware
 
 import (
 	"smarthome/auth"
+	"smarthome/internal/config"
 
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/redis/go-redis/v9"
@@ -11,12 +12,14 @@ type MiddlewareManager struct {
 	pgClient    *pgxpool.Pool
 	redisClient *redis.Client
 	auth        *auth.AuthModule
+	rateLimits  config.RateLimitConfig
 }
 
-func NewMiddlewareManager(pgClient *pgxpool.Pool, redisClient *redis.Client, auth *auth.AuthModule) *MiddlewareManager {
+func NewMiddlewareManager(pgClient *pgxpool.Pool, redisClient *redis.Client, auth *auth.AuthModule, rateLimits config.RateLimitConfig) *MiddlewareManager {
 	return &MiddlewareManager{
 		pgClient:    pgClient,
 		redisClient: redisClient,
 		auth:        auth,
+		rateLimits:  rateLimits,
 	}
 }
@@ -0,0 +1,102 @@
+package middleware
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"time"
+
+	"smarthome/internal/audit"
+	"smarthome/internal/config"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Route classes with separately configured rate limits
+const (
+	RouteClassAuth    = "auth"
+	RouteClassCommand = "command"
+	RouteClassAPI     = "api"
+)
+
+// RateLimit limits requests of a route class per client IP and, on authenticated
+// routes, per user. Counters are fixed windows in Redis so limits are shared
+// between engine instances. Redis errors fail open.
+func (m *MiddlewareManager) RateLimit(class string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !m.rateLimits.Enabled {
+			c.Next()
+			return
+		}
+
+		rule := m.rateLimitRule(class)
+		if rule.Window <= 0 {
+			c.Next()
+			return
+		}
+
+		if rule.PerIP > 0 {
+			key := fmt.Sprintf("ratelimit:%s:ip:%s", class, audit.ClientIP(c.Request))
+			if retryAfter, limited := m.hitRateLimit(c, key, rule.PerIP, rule.Window); limited {
+				rejectRateLimited(c, retryAfter)
+				return
+			}
+		}
+
+		if userID := c.GetString("user_id"); rule.PerUser > 0 && userID != "" {
+			key := fmt.Sprintf("ratelimit:%s:user:%s", class, userID)
+			if retryAfter, limited := m.hitRateLimit(c, key, rule.PerUser, rule.Window); limited {
+				rejectRateLimited(c, retryAfter)
+				return
+			}
+		}
+
+		c.Next()
+	}
+}
+
+// rateLimitRule returns the configured rule for a route class
+func (m *MiddlewareManager) rateLimitRule(class string) config.RateLimitRule {
+	switch class {
+	case RouteClassAuth:
+		return m.rateLimits.Auth
+	case RouteClassCommand:
+		return m.rateLimits.Command
+	default:
+		return m.rateLimits.API
+	}
+}
+
+// hitRateLimit increments the counter for key and reports whether the limit is exceeded
+func (m *MiddlewareManager) hitRateLimit(c *gin.Context, key string, limit int, window time.Duration) (time.Duration, bool) {
+	pipe := m.redisClient.TxPipeline()
+	incr := pipe.Incr(c, key)
+	pipe.ExpireNX(c, key, window)
+	ttl := pipe.TTL(c, key)
+	if _, err := pipe.Exec(c); err != nil {
+		log.Printf("MIDDLEWARE: Rate limiter unavailable for %s: %v", key, err)
+		return 0, false
+	}
+
+	if incr.Val() <= int64(limit) {
+		return 0, false
+	}
+
+	retryAfter := ttl.Val()
+	if retryAfter <= 0 {
+		retryAfter = window
+	}
+	return retryAfter, true
+}
+
+// RejectTooManyRequests writes a 429 response with a Retry-After header
+func RejectTooManyRequests(c *gin.Context, retryAfter time.Duration, message string) {
+	c.Header("Retry-After", fmt.Sprintf("%d", int(math.Ceil(retryAfter.Seconds()))))
+	c.JSON(http.StatusTooManyRequests, gin.H{"error": message})
+}
+
+func rejectRateLimited(c *gin.Context, retryAfter time.Duration) {
+	RejectTooManyRequests(c, retryAfter, "Too many requests")
+	c.Abort()
+}
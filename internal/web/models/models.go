@@ -1,6 +1,12 @@
 package models
 
-import "encoding/json"
+import (
+	"encoding/json"
+	"time"
+
+	"smarthome/internal/calendar"
+	core "smarthome/internal/models"
+)
 
 type LoginRequest struct {
 	Username string `json:"username"`
@@ -13,22 +19,317 @@ type RegisterRequest struct {
 	Email    string `json:"email"`
 }
 
+type TwoFactorLoginRequest struct {
+	ChallengeToken string `json:"challenge_token"`
+	Code           string `json:"code"`
+}
+
+type TwoFactorCodeRequest struct {
+	Code string `json:"code"`
+}
+
+type DisableTwoFactorRequest struct {
+	Password string `json:"password"`
+	Code     string `json:"code"`
+}
+
 type AddRuleRequest struct {
-	Name       string          `json:"name"`
-	Conditions json.RawMessage `json:"conditions"`
-	Actions    json.RawMessage `json:"actions"`
-	Enabled    bool            `json:"enabled"`
+	Name       string             `json:"name"`
+	Conditions json.RawMessage    `json:"conditions"`
+	Actions    json.RawMessage    `json:"actions"`
+	Enabled    bool               `json:"enabled"`
+	Execution  core.RuleExecution `json:"execution"`
 }
 
 type UpdateRuleRequest struct {
-	Name       *string          `json:"name,omitempty"`
-	Conditions *json.RawMessage `json:"conditions,omitempty"`
-	Actions    *json.RawMessage `json:"actions,omitempty"`
-	Enabled    *bool            `json:"enabled,omitempty"`
+	Name       *string             `json:"name,omitempty"`
+	Conditions *json.RawMessage    `json:"conditions,omitempty"`
+	Actions    *json.RawMessage    `json:"actions,omitempty"`
+	Enabled    *bool               `json:"enabled,omitempty"`
+	Execution  *core.RuleExecution `json:"execution,omitempty"`
+}
+
+type RunRuleRequest struct {
+	SkipConditions bool `json:"skip_conditions"`
+}
+
+type UpdateBlueprintRequest struct {
+	Name        *string          `json:"name,omitempty"`
+	Description *string          `json:"description,omitempty"`
+	Inputs      *json.RawMessage `json:"inputs,omitempty"`
+	Conditions  *json.RawMessage `json:"conditions,omitempty"`
+	Actions     *json.RawMessage `json:"actions,omitempty"`
+}
+
+type InstantiateBlueprintRequest struct {
+	Name    string                 `json:"name"`
+	Enabled *bool                  `json:"enabled,omitempty"`
+	Inputs  map[string]interface{} `json:"inputs"`
+}
+
+type UpdateBlueprintInstanceRequest struct {
+	Inputs map[string]interface{} `json:"inputs"`
+}
+
+type CreateVariableRequest struct {
+	Name    string          `json:"name"`
+	Type    string          `json:"type"`
+	Options []string        `json:"options,omitempty"`
+	Min     *float64        `json:"min,omitempty"`
+	Max     *float64        `json:"max,omitempty"`
+	Value   json.RawMessage `json:"value,omitempty"`
+	RuleID  *string         `json:"rule_id,omitempty"`
+}
+
+type UpdateVariableRequest struct {
+	Options *[]string        `json:"options,omitempty"`
+	Min     *float64         `json:"min,omitempty"`
+	Max     *float64         `json:"max,omitempty"`
+	Value   *json.RawMessage `json:"value,omitempty"`
+}
+
+type SetVariableValueRequest struct {
+	Value json.RawMessage `json:"value"`
 }
 
 type User struct {
-	ID    string `json:"id"`
-	Email string `json:"email"`
-	Name  string `json:"name"`
+	ID               string `json:"id"`
+	Email            string `json:"email"`
+	Name             string `json:"name"`
+	Role             string `json:"role"`
+	TwoFactorEnabled bool   `json:"two_factor_enabled"`
+}
+
+type CreateVirtualDeviceRequest struct {
+	ID         string            `json:"id" binding:"required"`
+	Name       string            `json:"name" binding:"required"`
+	Type       string            `json:"type"`
+	Attributes map[string]string `json:"attributes" binding:"required"`
+}
+
+type UpdateVirtualDeviceRequest struct {
+	Attributes map[string]string `json:"attributes" binding:"required"`
+}
+
+// CreateScheduleRequest needs exactly one of cron_expression, run_at or calendar_id
+type CreateScheduleRequest struct {
+	RuleID         string     `json:"rule_id" binding:"required"`
+	CronExpression string     `json:"cron_expression"`
+	RunAt          *time.Time `json:"run_at,omitempty"`
+	CalendarID     string     `json:"calendar_id,omitempty"`
+	CalendarFilter string     `json:"calendar_filter,omitempty"`
+	Timezone       string     `json:"timezone"`
+	ExcludeDates   []string   `json:"exclude_dates,omitempty"`
+	CatchUp        string     `json:"catch_up,omitempty"`
+	CatchUpGrace   *int       `json:"catch_up_grace_seconds,omitempty"`
+	Enabled        *bool      `json:"enabled,omitempty"`
+}
+
+type UpdateScheduleRequest struct {
+	CronExpression *string    `json:"cron_expression,omitempty"`
+	RunAt          *time.Time `json:"run_at,omitempty"`
+	CalendarFilter *string    `json:"calendar_filter,omitempty"`
+	Timezone       *string    `json:"timezone,omitempty"`
+	ExcludeDates   *[]string  `json:"exclude_dates,omitempty"`
+	CatchUp        *string    `json:"catch_up,omitempty"`
+	CatchUpGrace   *int       `json:"catch_up_grace_seconds,omitempty"`
+	Enabled        *bool      `json:"enabled,omitempty"`
+}
+
+// ScheduleResponse is a schedule with its upcoming fire times (none while paused)
+type ScheduleResponse struct {
+	core.Schedule
+	NextFireTimes []time.Time `json:"next_fire_times"`
+}
+
+// CreateCalendarRequest imports an ICS calendar from a URL (http, https or webcal) or as file content
+type CreateCalendarRequest struct {
+	Name           string `json:"name" binding:"required"`
+	URL            string `json:"url,omitempty"`
+	Content        string `json:"content,omitempty"`
+	Timezone       string `json:"timezone"`
+	RefreshMinutes *int   `json:"refresh_minutes,omitempty"`
+}
+
+type UpdateCalendarRequest struct {
+	Name           *string `json:"name,omitempty"`
+	URL            *string `json:"url,omitempty"`
+	Content        *string `json:"content,omitempty"`
+	Timezone       *string `json:"timezone,omitempty"`
+	RefreshMinutes *int    `json:"refresh_minutes,omitempty"`
+}
+
+// CalendarResponse is a calendar with its upcoming occurrences
+type CalendarResponse struct {
+	core.Calendar
+	Occurrences []calendar.Occurrence `json:"occurrences"`
+}
+
+// CreatePersonRequest adds a person to the caller's household
+type CreatePersonRequest struct {
+	Name         string   `json:"name" binding:"required"`
+	UserID       *string  `json:"user_id,omitempty"`
+	MQTTTopic    string   `json:"mqtt_topic"`
+	MACAddresses []string `json:"mac_addresses"`
+}
+
+// UpdatePersonRequest changes a person; an empty user_id unlinks the user
+type UpdatePersonRequest struct {
+	Name         *string   `json:"name,omitempty"`
+	UserID       *string   `json:"user_id,omitempty"`
+	MQTTTopic    *string   `json:"mqtt_topic,omitempty"`
+	MACAddresses *[]string `json:"mac_addresses,omitempty"`
+}
+
+// PresenceRequest reports a presence, "home" or "away"
+type PresenceRequest struct {
+	Presence string `json:"presence" binding:"required"`
+}
+
+// PersonResponse is a person with their current state: home, away or just_left
+type PersonResponse struct {
+	core.Person
+	State string `json:"state"`
+}
+
+// PresenceResponse is the state of the household and its people
+type PresenceResponse struct {
+	State     string           `json:"state"`
+	ChangedAt *time.Time       `json:"changed_at"`
+	People    []PersonResponse `json:"people"`
+}
+
+// CreateZoneRequest adds a geofence zone to the caller's household
+type CreateZoneRequest struct {
+	Name      string   `json:"name" binding:"required"`
+	Latitude  *float64 `json:"latitude" binding:"required"`
+	Longitude *float64 `json:"longitude" binding:"required"`
+	Radius    float64  `json:"radius_meters"`
+	Home      bool     `json:"home"`
+}
+
+// UpdateZoneRequest changes a zone
+type UpdateZoneRequest struct {
+	Name      *string  `json:"name,omitempty"`
+	Latitude  *float64 `json:"latitude,omitempty"`
+	Longitude *float64 `json:"longitude,omitempty"`
+	Radius    *float64 `json:"radius_meters,omitempty"`
+	Home      *bool    `json:"home,omitempty"`
+}
+
+// ZoneResponse is a zone with the people currently inside it
+type ZoneResponse struct {
+	core.Zone
+	People []string `json:"people"`
+}
+
+// CreateGeofenceDeviceRequest adds a phone reporting a person's geofence events
+type CreateGeofenceDeviceRequest struct {
+	Name string `json:"name" binding:"required"`
+}
+
+// GeofenceDeviceResponse is a new geofence device with its token, shown only once
+type GeofenceDeviceResponse struct {
+	core.GeofenceDevice
+	Token string `json:"token"`
+}
+
+// AlarmPanelRequest creates or changes the caller's alarm panel. Changing a panel
+// with a PIN needs the current one in pin; new_pin sets it, empty to remove it.
+type AlarmPanelRequest struct {
+	PIN             string               `json:"pin"`
+	NewPIN          *string              `json:"new_pin,omitempty"`
+	Name            *string              `json:"name,omitempty"`
+	ArmRequiresPIN  *bool                `json:"arm_requires_pin,omitempty"`
+	EntryDelay      *int                 `json:"entry_delay_seconds,omitempty"`
+	ExitDelay       *int                 `json:"exit_delay_seconds,omitempty"`
+	TriggerDuration *int                 `json:"trigger_seconds,omitempty"`
+	Sensors         *map[string][]string `json:"sensors,omitempty"`
+	SirenActions    json.RawMessage      `json:"siren_actions,omitempty"`
+	SirenOffActions json.RawMessage      `json:"siren_off_actions,omitempty"`
+}
+
+// AlarmArmRequest arms the alarm in a mode: armed_home, armed_away or armed_night
+type AlarmArmRequest struct {
+	Mode string `json:"mode" binding:"required"`
+	PIN  string `json:"pin"`
+}
+
+// AlarmPINRequest carries the alarm PIN
+type AlarmPINRequest struct {
+	PIN string `json:"pin"`
+}
+
+// AlarmPanelResponse is an alarm panel and whether it has a PIN
+type AlarmPanelResponse struct {
+	core.AlarmPanel
+	HasPIN bool `json:"has_pin"`
+}
+
+// CreateInterlockRequest adds an interlock on one of the caller's devices
+type CreateInterlockRequest struct {
+	Name       string          `json:"name" binding:"required"`
+	DeviceID   string          `json:"device_id" binding:"required"`
+	Kind       string          `json:"kind" binding:"required"`
+	Key        string          `json:"key"`
+	Value      json.RawMessage `json:"value,omitempty"`
+	Condition  json.RawMessage `json:"condition,omitempty"`
+	Min        *float64        `json:"min,omitempty"`
+	Max        *float64        `json:"max,omitempty"`
+	MaxSeconds int             `json:"max_seconds"`
+	OffValue   json.RawMessage `json:"off_value,omitempty"`
+	Enabled    *bool           `json:"enabled,omitempty"`
+}
+
+// UpdateInterlockRequest changes an interlock
+type UpdateInterlockRequest struct {
+	Name       *string         `json:"name,omitempty"`
+	DeviceID   *string         `json:"device_id,omitempty"`
+	Kind       *string         `json:"kind,omitempty"`
+	Key        *string         `json:"key,omitempty"`
+	Value      json.RawMessage `json:"value,omitempty"`
+	Condition  json.RawMessage `json:"condition,omitempty"`
+	Min        *float64        `json:"min,omitempty"`
+	Max        *float64        `json:"max,omitempty"`
+	MaxSeconds *int            `json:"max_seconds,omitempty"`
+	OffValue   json.RawMessage `json:"off_value,omitempty"`
+	Enabled    *bool           `json:"enabled,omitempty"`
+}
+
+// VacationModeRequest configures the caller's vacation mode
+type VacationModeRequest struct {
+	Devices       *[]string `json:"devices,omitempty"`
+	Weeks         *int      `json:"weeks,omitempty"`
+	JitterMinutes *int      `json:"jitter_minutes,omitempty"`
+}
+
+// EnergyTariffRequest sets the caller's electricity tariff
+type EnergyTariffRequest struct {
+	Kind     string              `json:"kind" binding:"required"`
+	Currency string              `json:"currency"`
+	Rate     float64             `json:"rate"`
+	Periods  []core.TariffPeriod `json:"periods"`
+}
+
+// EnergyUsage is the consumption of a device, a room or a day
+type EnergyUsage struct {
+	DeviceID string  `json:"device_id,omitempty"`
+	Name     string  `json:"name,omitempty"`
+	Room     string  `json:"room,omitempty"`
+	Day      string  `json:"day,omitempty"`
+	KWh      float64 `json:"kwh"`
+	Cost     float64 `json:"cost"`
+}
+
+// EnergySummaryResponse is a household's consumption over a day or a month
+type EnergySummaryResponse struct {
+	Period   string        `json:"period"`
+	From     string        `json:"from"`
+	To       string        `json:"to"`
+	Currency string        `json:"currency"`
+	KWh      float64       `json:"kwh"`
+	Cost     float64       `json:"cost"`
+	Devices  []EnergyUsage `json:"devices"`
+	Rooms    []EnergyUsage `json:"rooms"`
+	Days     []EnergyUsage `json:"days"`
 }
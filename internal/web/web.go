@@ -2,8 +2,14 @@ package web
 
 import (
 	"smarthome/auth"
+	"smarthome/internal/audit"
+	"smarthome/internal/calendar"
+	"smarthome/internal/config"
+	"smarthome/internal/models"
+	"smarthome/internal/presence"
 	"smarthome/internal/web/api"
 	"smarthome/internal/web/middleware"
+	"time"
 
 	MQTT "github.com/eclipse/paho.mqtt.golang"
 	"github.com/gin-gonic/gin"
@@ -16,24 +22,67 @@ type EngineInterface interface {
 	RefreshRuleAssociations(ruleID string) error
 	RemoveRuleAssociations(ruleID string) error
 	TriggerRuleEvaluation(ruleID string)
+	RunRule(ruleID string, skipConditions bool) error
+	RefreshVariable(v models.Variable) error
+	RemoveVariable(v models.Variable) error
+	RefreshDeviceOwner(deviceID string) error
+	RefreshVirtualDevice(deviceID string) error
+	RemoveVirtualDevice(deviceID string) error
+	RefreshSchedule(scheduleID string) error
+	RemoveSchedule(scheduleID string)
+	ScheduleFireTimes(schedule models.Schedule, n int) []time.Time
+	RefreshCalendar(calendarID string) error
+	RemoveCalendar(calendarID string)
+	CalendarOccurrences(calendarID string) []calendar.Occurrence
+	ReportPresence(personID, presence, source string) error
+	RefreshPerson(personID string) error
+	RemovePerson(person models.Person) error
+	ReportGeofence(personID string, ev presence.GeofenceEvent) error
+	RemoveZone(zone models.Zone) error
+	ArmAlarm(panel *models.AlarmPanel, mode string) error
+	DisarmAlarm(panel *models.AlarmPanel) error
+	TriggerAlarm(panel *models.AlarmPanel) error
+	RefreshAlarm(panelID string) error
+	RemoveAlarm(panel models.AlarmPanel) error
+	RefreshInterlocks(deviceID string) error
+	SendCommand(deviceID string, params map[string]interface{}) error
+	SetVacation(ownerID string, enabled bool) (bool, error)
+	RefreshTariff(ownerID string) error
 }
 
 type WebServer struct {
 	router *gin.Engine
 }
 
-func NewWebServer(mqttClient MQTT.Client, dbConn *pgxpool.Pool, redisClient *redis.Client, JWTSecret string, engine EngineInterface, agentID string) *WebServer {
+func NewWebServer(mqttClient MQTT.Client, dbConn *pgxpool.Pool, redisClient *redis.Client, JWTSecret string, authCfg config.AuthConfig, rateLimitCfg config.RateLimitConfig, engine EngineInterface, agentID string) *WebServer {
 	router := gin.Default()
+	// Nothing sits in front of the engine, and the internet bridge forwards remote
+	// headers verbatim, so X-Forwarded-For is never trusted and ClientIP is the peer address
+	router.SetTrustedProxies(nil)
 
-	authModule := auth.NewAuthModule(dbConn, redisClient, JWTSecret)
-	middlewareManager := middleware.NewMiddlewareManager(dbConn, redisClient, authModule)
+	authModule := auth.NewAuthModule(dbConn, redisClient, JWTSecret, auth.Policy{
+		TOTPIssuer:        authCfg.TOTPIssuer,
+		TOTPRequiredRoles: authCfg.TOTPRequiredRoles,
+		LockoutThreshold:  authCfg.LockoutThreshold,
+		LockoutBase:       authCfg.LockoutBase,
+		LockoutMax:        authCfg.LockoutMax,
+	})
+	middlewareManager := middleware.NewMiddlewareManager(dbConn, redisClient, authModule, rateLimitCfg)
+	auditLog := audit.NewLogger(dbConn)
 	// pumpService := services.NewPumpService(mqttClient)
 
 	// api.RegisterTestRoutes(router, api.Dependencies{PumpService: pumpService})
-	api.RegisterAuthRoutes(router, authModule, middlewareManager, agentID)
-	api.RegisterDeviceRoutes(router, middlewareManager, dbConn, mqttClient)
-	api.RegisterAutomationRoutes(router, middlewareManager, dbConn, engine)
+	api.RegisterAuthRoutes(router, authModule, middlewareManager, agentID, auditLog)
+	api.RegisterDeviceRoutes(router, middlewareManager, dbConn, mqttClient, engine, auditLog)
+	api.RegisterAutomationRoutes(router, middlewareManager, dbConn, engine, auditLog)
 	api.RegisterUserRoutes(router, middlewareManager, dbConn)
+	api.RegisterAuditRoutes(router, middlewareManager, dbConn, auditLog)
+	api.RegisterPresenceRoutes(router, middlewareManager, dbConn, engine, auditLog)
+	api.RegisterZoneRoutes(router, middlewareManager, dbConn, engine, auditLog)
+	api.RegisterAlarmRoutes(router, middlewareManager, dbConn, engine, auditLog)
+	api.RegisterInterlockRoutes(router, middlewareManager, dbConn, engine, auditLog)
+	api.RegisterVacationRoutes(router, middlewareManager, dbConn, engine, auditLog)
+	api.RegisterEnergyRoutes(router, middlewareManager, dbConn, engine, auditLog)
 
 	// view.RegisterTestRoutes(router, view.Dependencies{DBConn: dbConn, RedisClient: redisClient})
 
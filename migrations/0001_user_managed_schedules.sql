@@ -0,0 +1,23 @@
+-- Upgrades a database created before schedules could be managed by users.
+-- Run once with: psql -U postgres -d smarthome -f migrations/0001_user_managed_schedules.sql
+
+BEGIN;
+
+ALTER TABLE public.schedules ADD COLUMN IF NOT EXISTS timezone text DEFAULT ''::text NOT NULL;
+
+-- Every existing schedule was generated from a rule's time conditions, so the
+-- column is added as true for them; schedules created from now on default to manual
+ALTER TABLE public.schedules ADD COLUMN IF NOT EXISTS auto boolean DEFAULT true NOT NULL;
+ALTER TABLE public.schedules ALTER COLUMN auto SET DEFAULT false;
+
+-- Manual schedules are deleted with their rule
+ALTER TABLE ONLY public.schedules DROP CONSTRAINT IF EXISTS schedules_rule_id_fkey;
+ALTER TABLE ONLY public.schedules
+    ADD CONSTRAINT schedules_rule_id_fkey FOREIGN KEY (rule_id) REFERENCES public.rules(id) ON DELETE CASCADE NOT VALID;
+
+-- Deleting a rule must not delete the device history it caused
+ALTER TABLE ONLY public.device_states_history DROP CONSTRAINT IF EXISTS device_states_history_rule_id_fkey;
+ALTER TABLE ONLY public.device_states_history
+    ADD CONSTRAINT device_states_history_rule_id_fkey FOREIGN KEY (rule_id) REFERENCES public.rules(id) NOT VALID;
+
+COMMIT;
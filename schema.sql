@@ -30,7 +30,7 @@ CREATE TABLE public.device_states_history (
     device_id text NOT NULL,
     "timestamp" timestamp with time zone DEFAULT CURRENT_TIMESTAMP NOT NULL,
     state jsonb,
-    rule_id integer NOT NULL
+    rule_id integer
 );
 
 
@@ -73,7 +73,8 @@ CREATE TABLE public.devices (
     mqtt_topic text NOT NULL,
     owner_id integer,
     accepted boolean DEFAULT false NOT NULL,
-    id text CONSTRAINT devices_device_id_not_null NOT NULL
+    id text CONSTRAINT devices_device_id_not_null NOT NULL,
+    room text DEFAULT ''::text NOT NULL
 );
 
 
@@ -90,7 +91,8 @@ CREATE TABLE public.rules (
     actions jsonb NOT NULL,
     enabled boolean DEFAULT true,
     owner_id integer,
-    id integer NOT NULL
+    id integer NOT NULL,
+    execution jsonb DEFAULT '{}'::jsonb NOT NULL
 );
 
 
@@ -111,6 +113,109 @@ ALTER TABLE public.rules ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
 );
 
 
+--
+-- Name: rule_runs; Type: TABLE; Schema: public; Owner: postgres
+--
+
+CREATE TABLE public.rule_runs (
+    id integer NOT NULL,
+    rule_id integer NOT NULL,
+    triggered_by text NOT NULL,
+    outcome text NOT NULL,
+    reason text,
+    conditions jsonb,
+    conflicts jsonb,
+    actions jsonb,
+    errors text[] DEFAULT '{}'::text[] NOT NULL,
+    started_at timestamp with time zone NOT NULL,
+    duration_ms integer NOT NULL
+);
+
+
+ALTER TABLE public.rule_runs OWNER TO postgres;
+
+--
+-- Name: rule_runs_id_seq; Type: SEQUENCE; Schema: public; Owner: postgres
+--
+
+ALTER TABLE public.rule_runs ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
+    SEQUENCE NAME public.rule_runs_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1
+);
+
+
+--
+-- Name: rule_revisions; Type: TABLE; Schema: public; Owner: postgres
+--
+
+CREATE TABLE public.rule_revisions (
+    id integer NOT NULL,
+    rule_id integer NOT NULL,
+    revision integer NOT NULL,
+    name text NOT NULL,
+    conditions jsonb NOT NULL,
+    actions jsonb NOT NULL,
+    enabled boolean NOT NULL,
+    execution jsonb DEFAULT '{}'::jsonb NOT NULL,
+    author_id integer,
+    restored_from integer,
+    created_at timestamp with time zone DEFAULT CURRENT_TIMESTAMP NOT NULL
+);
+
+
+ALTER TABLE public.rule_revisions OWNER TO postgres;
+
+--
+-- Name: rule_revisions_id_seq; Type: SEQUENCE; Schema: public; Owner: postgres
+--
+
+ALTER TABLE public.rule_revisions ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
+    SEQUENCE NAME public.rule_revisions_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1
+);
+
+
+--
+-- Name: calendars; Type: TABLE; Schema: public; Owner: postgres
+--
+
+CREATE TABLE public.calendars (
+    id integer NOT NULL,
+    owner_id integer NOT NULL,
+    name text NOT NULL,
+    url text DEFAULT ''::text NOT NULL,
+    content text DEFAULT ''::text NOT NULL,
+    timezone text DEFAULT ''::text NOT NULL,
+    refresh_minutes integer DEFAULT 60 NOT NULL,
+    refreshed_at timestamp with time zone,
+    last_error text DEFAULT ''::text NOT NULL
+);
+
+
+ALTER TABLE public.calendars OWNER TO postgres;
+
+--
+-- Name: calendars_id_seq; Type: SEQUENCE; Schema: public; Owner: postgres
+--
+
+ALTER TABLE public.calendars ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
+    SEQUENCE NAME public.calendars_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1
+);
+
+
 --
 -- TOC entry 224 (class 1259 OID 16414)
 -- Name: schedules; Type: TABLE; Schema: public; Owner: postgres
@@ -120,7 +225,16 @@ CREATE TABLE public.schedules (
     cron_expression text NOT NULL,
     enabled boolean DEFAULT false NOT NULL,
     id integer NOT NULL,
-    rule_id integer NOT NULL
+    rule_id integer NOT NULL,
+    timezone text DEFAULT ''::text NOT NULL,
+    auto boolean DEFAULT false NOT NULL,
+    run_at timestamp with time zone,
+    calendar_id integer,
+    calendar_filter text DEFAULT ''::text NOT NULL,
+    exclude_dates text[] DEFAULT '{}'::text[] NOT NULL,
+    last_fired_at timestamp with time zone,
+    catch_up text DEFAULT 'skip'::text NOT NULL,
+    catch_up_grace_seconds integer DEFAULT 3600 NOT NULL
 );
 
 
@@ -150,7 +264,11 @@ CREATE TABLE public.users (
     id integer NOT NULL,
     username text NOT NULL,
     password text NOT NULL,
-    email text NOT NULL
+    email text NOT NULL,
+    role text DEFAULT 'member'::text NOT NULL,
+    totp_secret text,
+    totp_enabled boolean DEFAULT false NOT NULL,
+    totp_last_counter bigint
 );
 
 
@@ -172,100 +290,949 @@ ALTER TABLE public.users ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
 
 
 --
--- TOC entry 3313 (class 2606 OID 32785)
--- Name: device_states_history device_states_history_pkey; Type: CONSTRAINT; Schema: public; Owner: postgres
+-- Name: audit_log; Type: TABLE; Schema: public; Owner: postgres
 --
 
-ALTER TABLE ONLY public.device_states_history
-    ADD CONSTRAINT device_states_history_pkey PRIMARY KEY (id);
+CREATE TABLE public.audit_log (
+    id bigint NOT NULL,
+    "timestamp" timestamp with time zone DEFAULT CURRENT_TIMESTAMP NOT NULL,
+    actor_id integer,
+    actor text NOT NULL,
+    action text NOT NULL,
+    source text NOT NULL,
+    device_id text,
+    rule_id integer,
+    details jsonb,
+    before jsonb,
+    after jsonb,
+    owner_id integer
+);
 
 
+ALTER TABLE public.audit_log OWNER TO postgres;
+
 --
--- TOC entry 3315 (class 2606 OID 24596)
--- Name: devices devices_pkey; Type: CONSTRAINT; Schema: public; Owner: postgres
+-- Name: audit_log_id_seq; Type: SEQUENCE; Schema: public; Owner: postgres
 --
 
-ALTER TABLE ONLY public.devices
-    ADD CONSTRAINT devices_pkey PRIMARY KEY (id);
+ALTER TABLE public.audit_log ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
+    SEQUENCE NAME public.audit_log_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1
+);
 
 
 --
--- TOC entry 3319 (class 2606 OID 32794)
--- Name: rules rules_pkey; Type: CONSTRAINT; Schema: public; Owner: postgres
+-- Name: audit_log_append_only(); Type: FUNCTION; Schema: public; Owner: postgres
 --
 
-ALTER TABLE ONLY public.rules
-    ADD CONSTRAINT rules_pkey PRIMARY KEY (id);
+CREATE FUNCTION public.audit_log_append_only() RETURNS trigger
+    LANGUAGE plpgsql
+    AS $$
+BEGIN
+    RAISE EXCEPTION 'audit_log is append-only';
+END;
+$$;
+
 
+ALTER FUNCTION public.audit_log_append_only() OWNER TO postgres;
 
 --
--- TOC entry 3321 (class 2606 OID 32812)
--- Name: schedules schedules_pkey; Type: CONSTRAINT; Schema: public; Owner: postgres
+-- Name: audit_log audit_log_no_modify; Type: TRIGGER; Schema: public; Owner: postgres
 --
 
-ALTER TABLE ONLY public.schedules
-    ADD CONSTRAINT schedules_pkey PRIMARY KEY (id);
+CREATE TRIGGER audit_log_no_modify BEFORE UPDATE OR DELETE ON public.audit_log FOR EACH ROW EXECUTE FUNCTION public.audit_log_append_only();
 
 
 --
--- TOC entry 3317 (class 2606 OID 24586)
--- Name: devices unique_device_id; Type: CONSTRAINT; Schema: public; Owner: postgres
+-- Name: user_recovery_codes; Type: TABLE; Schema: public; Owner: postgres
 --
 
-ALTER TABLE ONLY public.devices
-    ADD CONSTRAINT unique_device_id UNIQUE (id);
+CREATE TABLE public.user_recovery_codes (
+    id integer NOT NULL,
+    user_id integer NOT NULL,
+    code_hash text NOT NULL,
+    used_at timestamp with time zone
+);
 
 
+ALTER TABLE public.user_recovery_codes OWNER TO postgres;
+
 --
--- TOC entry 3323 (class 2606 OID 32770)
--- Name: users users_pkey; Type: CONSTRAINT; Schema: public; Owner: postgres
+-- Name: user_recovery_codes_id_seq; Type: SEQUENCE; Schema: public; Owner: postgres
 --
 
-ALTER TABLE ONLY public.users
-    ADD CONSTRAINT users_pkey PRIMARY KEY (id);
+ALTER TABLE public.user_recovery_codes ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
+    SEQUENCE NAME public.user_recovery_codes_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1
+);
 
 
 --
--- TOC entry 3324 (class 2606 OID 32788)
--- Name: device_states_history device_states_history_device_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: postgres
+-- Name: blueprints; Type: TABLE; Schema: public; Owner: postgres
 --
 
-ALTER TABLE ONLY public.device_states_history
-    ADD CONSTRAINT device_states_history_device_id_fkey FOREIGN KEY (device_id) REFERENCES public.devices(id) NOT VALID;
+CREATE TABLE public.blueprints (
+    id integer NOT NULL,
+    slug text NOT NULL,
+    name text NOT NULL,
+    description text DEFAULT ''::text NOT NULL,
+    inputs jsonb NOT NULL,
+    conditions jsonb NOT NULL,
+    actions jsonb NOT NULL,
+    owner_id integer NOT NULL
+);
+
 
+ALTER TABLE public.blueprints OWNER TO postgres;
 
 --
--- TOC entry 3325 (class 2606 OID 32795)
--- Name: device_states_history device_states_history_rule_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: postgres
+-- Name: blueprints_id_seq; Type: SEQUENCE; Schema: public; Owner: postgres
 --
 
-ALTER TABLE ONLY public.device_states_history
-    ADD CONSTRAINT device_states_history_rule_id_fkey FOREIGN KEY (rule_id) REFERENCES public.rules(id) NOT VALID;
+ALTER TABLE public.blueprints ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
+    SEQUENCE NAME public.blueprints_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1
+);
 
 
 --
--- TOC entry 3326 (class 2606 OID 32771)
--- Name: devices devices_owner_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: postgres
+-- Name: blueprint_instances; Type: TABLE; Schema: public; Owner: postgres
 --
 
-ALTER TABLE ONLY public.devices
-    ADD CONSTRAINT devices_owner_id_fkey FOREIGN KEY (owner_id) REFERENCES public.users(id) NOT VALID;
+CREATE TABLE public.blueprint_instances (
+    rule_id integer NOT NULL,
+    blueprint_slug text NOT NULL,
+    inputs jsonb NOT NULL
+);
+
 
+ALTER TABLE public.blueprint_instances OWNER TO postgres;
 
 --
--- TOC entry 3327 (class 2606 OID 32776)
--- Name: rules rules_owner_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: postgres
+-- Name: variables; Type: TABLE; Schema: public; Owner: postgres
 --
 
-ALTER TABLE ONLY public.rules
-    ADD CONSTRAINT rules_owner_id_fkey FOREIGN KEY (owner_id) REFERENCES public.users(id) NOT VALID;
+CREATE TABLE public.variables (
+    id integer NOT NULL,
+    name text NOT NULL,
+    type text NOT NULL,
+    options jsonb,
+    min double precision,
+    max double precision,
+    value jsonb NOT NULL,
+    rule_id integer,
+    owner_id integer NOT NULL,
+    updated_at timestamp with time zone DEFAULT CURRENT_TIMESTAMP NOT NULL
+);
 
 
+ALTER TABLE public.variables OWNER TO postgres;
+
 --
--- TOC entry 3328 (class 2606 OID 32813)
--- Name: schedules schedules_rule_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: postgres
+-- Name: variables_id_seq; Type: SEQUENCE; Schema: public; Owner: postgres
 --
 
-ALTER TABLE ONLY public.schedules
-    ADD CONSTRAINT schedules_rule_id_fkey FOREIGN KEY (rule_id) REFERENCES public.rules(id) NOT VALID;
+ALTER TABLE public.variables ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
+    SEQUENCE NAME public.variables_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1
+);
+
+
+
+--
+-- Name: people; Type: TABLE; Schema: public; Owner: postgres
+--
+
+CREATE TABLE public.people (
+    id integer NOT NULL,
+    owner_id integer NOT NULL,
+    name text NOT NULL,
+    user_id integer,
+    mqtt_topic text DEFAULT ''::text NOT NULL,
+    mac_addresses text[] DEFAULT '{}'::text[] NOT NULL,
+    presence text DEFAULT 'away'::text NOT NULL,
+    presence_source text DEFAULT ''::text NOT NULL,
+    presence_changed_at timestamp with time zone
+);
+
+
+ALTER TABLE public.people OWNER TO postgres;
+
+--
+-- Name: people_id_seq; Type: SEQUENCE; Schema: public; Owner: postgres
+--
+
+ALTER TABLE public.people ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
+    SEQUENCE NAME public.people_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1
+);
+
+
+--
+-- Name: zones; Type: TABLE; Schema: public; Owner: postgres
+--
+
+CREATE TABLE public.zones (
+    id integer NOT NULL,
+    owner_id integer NOT NULL,
+    name text NOT NULL,
+    latitude double precision NOT NULL,
+    longitude double precision NOT NULL,
+    radius_meters double precision DEFAULT 100 NOT NULL,
+    home boolean DEFAULT false NOT NULL
+);
+
+
+ALTER TABLE public.zones OWNER TO postgres;
+
+--
+-- Name: zones_id_seq; Type: SEQUENCE; Schema: public; Owner: postgres
+--
+
+ALTER TABLE public.zones ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
+    SEQUENCE NAME public.zones_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1
+);
+
+
+--
+-- Name: zone_presence; Type: TABLE; Schema: public; Owner: postgres
+--
+
+CREATE TABLE public.zone_presence (
+    zone_id integer NOT NULL,
+    person_id integer NOT NULL,
+    inside boolean NOT NULL,
+    changed_at timestamp with time zone NOT NULL
+);
+
+
+ALTER TABLE public.zone_presence OWNER TO postgres;
+
+--
+-- Name: geofence_devices; Type: TABLE; Schema: public; Owner: postgres
+--
+
+CREATE TABLE public.geofence_devices (
+    id integer NOT NULL,
+    person_id integer NOT NULL,
+    name text NOT NULL,
+    token_hash text NOT NULL,
+    last_seen_at timestamp with time zone
+);
+
+
+ALTER TABLE public.geofence_devices OWNER TO postgres;
+
+--
+-- Name: geofence_devices_id_seq; Type: SEQUENCE; Schema: public; Owner: postgres
+--
+
+ALTER TABLE public.geofence_devices ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
+    SEQUENCE NAME public.geofence_devices_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1
+);
+
+
+--
+-- Name: alarm_panels; Type: TABLE; Schema: public; Owner: postgres
+--
+
+CREATE TABLE public.alarm_panels (
+    id integer NOT NULL,
+    owner_id integer NOT NULL,
+    name text DEFAULT 'Alarm'::text NOT NULL,
+    pin_hash text DEFAULT ''::text NOT NULL,
+    arm_requires_pin boolean DEFAULT false NOT NULL,
+    entry_delay_seconds integer DEFAULT 30 NOT NULL,
+    exit_delay_seconds integer DEFAULT 60 NOT NULL,
+    trigger_seconds integer DEFAULT 600 NOT NULL,
+    sensors jsonb DEFAULT '{}'::jsonb NOT NULL,
+    siren_actions jsonb DEFAULT '[]'::jsonb NOT NULL,
+    siren_off_actions jsonb DEFAULT '[]'::jsonb NOT NULL,
+    state text DEFAULT 'disarmed'::text NOT NULL,
+    armed_mode text DEFAULT ''::text NOT NULL,
+    triggered_by text DEFAULT ''::text NOT NULL,
+    state_changed_at timestamp with time zone DEFAULT now() NOT NULL
+);
+
+
+ALTER TABLE public.alarm_panels OWNER TO postgres;
+
+--
+-- Name: alarm_panels_id_seq; Type: SEQUENCE; Schema: public; Owner: postgres
+--
+
+ALTER TABLE public.alarm_panels ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
+    SEQUENCE NAME public.alarm_panels_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1
+);
+
+
+--
+-- Name: interlocks; Type: TABLE; Schema: public; Owner: postgres
+--
+
+CREATE TABLE public.interlocks (
+    id integer NOT NULL,
+    owner_id integer NOT NULL,
+    name text NOT NULL,
+    device_id text NOT NULL,
+    kind text NOT NULL,
+    key text DEFAULT ''::text NOT NULL,
+    value jsonb,
+    condition jsonb,
+    min_value double precision,
+    max_value double precision,
+    max_seconds integer DEFAULT 0 NOT NULL,
+    off_value jsonb,
+    enabled boolean DEFAULT true NOT NULL
+);
+
+
+ALTER TABLE public.interlocks OWNER TO postgres;
+
+--
+-- Name: interlocks_id_seq; Type: SEQUENCE; Schema: public; Owner: postgres
+--
+
+ALTER TABLE public.interlocks ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
+    SEQUENCE NAME public.interlocks_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1
+);
+
+
+--
+-- Name: vacation_modes; Type: TABLE; Schema: public; Owner: postgres
+--
+
+CREATE TABLE public.vacation_modes (
+    id integer NOT NULL,
+    owner_id integer NOT NULL,
+    devices jsonb DEFAULT '[]'::jsonb NOT NULL,
+    weeks integer DEFAULT 2 NOT NULL,
+    jitter_minutes integer DEFAULT 15 NOT NULL,
+    enabled boolean DEFAULT false NOT NULL,
+    enabled_at timestamp with time zone,
+    saved_states jsonb
+);
+
+
+ALTER TABLE public.vacation_modes OWNER TO postgres;
+
+--
+-- Name: vacation_modes_id_seq; Type: SEQUENCE; Schema: public; Owner: postgres
+--
+
+ALTER TABLE public.vacation_modes ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
+    SEQUENCE NAME public.vacation_modes_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1
+);
+
+
+--
+-- Name: energy_daily; Type: TABLE; Schema: public; Owner: postgres
+--
+
+CREATE TABLE public.energy_daily (
+    device_id text NOT NULL,
+    day date NOT NULL,
+    kwh double precision DEFAULT 0 NOT NULL,
+    cost double precision DEFAULT 0 NOT NULL
+);
+
+
+ALTER TABLE public.energy_daily OWNER TO postgres;
+
+--
+-- Name: energy_tariffs; Type: TABLE; Schema: public; Owner: postgres
+--
+
+CREATE TABLE public.energy_tariffs (
+    id integer NOT NULL,
+    owner_id integer NOT NULL,
+    kind text DEFAULT 'flat'::text NOT NULL,
+    currency text DEFAULT 'EUR'::text NOT NULL,
+    rate double precision DEFAULT 0 NOT NULL,
+    periods jsonb DEFAULT '[]'::jsonb NOT NULL
+);
+
+
+ALTER TABLE public.energy_tariffs OWNER TO postgres;
+
+--
+-- Name: energy_tariffs_id_seq; Type: SEQUENCE; Schema: public; Owner: postgres
+--
+
+ALTER TABLE public.energy_tariffs ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
+    SEQUENCE NAME public.energy_tariffs_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1
+);
+
+--
+-- Name: virtual_devices; Type: TABLE; Schema: public; Owner: postgres
+--
+
+CREATE TABLE public.virtual_devices (
+    device_id text NOT NULL,
+    attributes jsonb NOT NULL
+);
+
+
+ALTER TABLE public.virtual_devices OWNER TO postgres;
+
+
+--
+-- TOC entry 3313 (class 2606 OID 32785)
+-- Name: device_states_history device_states_history_pkey; Type: CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.device_states_history
+    ADD CONSTRAINT device_states_history_pkey PRIMARY KEY (id);
+
+
+--
+-- TOC entry 3315 (class 2606 OID 24596)
+-- Name: devices devices_pkey; Type: CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.devices
+    ADD CONSTRAINT devices_pkey PRIMARY KEY (id);
+
+
+--
+-- TOC entry 3319 (class 2606 OID 32794)
+-- Name: rules rules_pkey; Type: CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.rules
+    ADD CONSTRAINT rules_pkey PRIMARY KEY (id);
+
+
+--
+-- Name: rule_runs rule_runs_pkey; Type: CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.rule_runs
+    ADD CONSTRAINT rule_runs_pkey PRIMARY KEY (id);
+
+
+--
+-- Name: rule_revisions rule_revisions_pkey; Type: CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.rule_revisions
+    ADD CONSTRAINT rule_revisions_pkey PRIMARY KEY (id);
+
+
+--
+-- Name: rule_revisions rule_revisions_rule_id_revision_key; Type: CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.rule_revisions
+    ADD CONSTRAINT rule_revisions_rule_id_revision_key UNIQUE (rule_id, revision);
+
+
+--
+-- Name: calendars calendars_pkey; Type: CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.calendars
+    ADD CONSTRAINT calendars_pkey PRIMARY KEY (id);
+
+
+--
+-- TOC entry 3321 (class 2606 OID 32812)
+-- Name: schedules schedules_pkey; Type: CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.schedules
+    ADD CONSTRAINT schedules_pkey PRIMARY KEY (id);
+
+
+--
+-- TOC entry 3317 (class 2606 OID 24586)
+-- Name: devices unique_device_id; Type: CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.devices
+    ADD CONSTRAINT unique_device_id UNIQUE (id);
+
+
+--
+-- TOC entry 3323 (class 2606 OID 32770)
+-- Name: users users_pkey; Type: CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.users
+    ADD CONSTRAINT users_pkey PRIMARY KEY (id);
+
+
+--
+-- Name: audit_log audit_log_pkey; Type: CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.audit_log
+    ADD CONSTRAINT audit_log_pkey PRIMARY KEY (id);
+
+
+--
+-- Name: audit_log_timestamp_idx; Type: INDEX; Schema: public; Owner: postgres
+--
+
+CREATE INDEX audit_log_timestamp_idx ON public.audit_log USING btree ("timestamp");
+
+
+--
+-- Name: audit_log_owner_id_timestamp_idx; Type: INDEX; Schema: public; Owner: postgres
+--
+
+CREATE INDEX audit_log_owner_id_timestamp_idx ON public.audit_log USING btree (owner_id, "timestamp");
+
+
+--
+-- Name: rule_runs_rule_id_started_at_idx; Type: INDEX; Schema: public; Owner: postgres
+--
+
+CREATE INDEX rule_runs_rule_id_started_at_idx ON public.rule_runs USING btree (rule_id, started_at DESC);
+
+
+--
+-- Name: user_recovery_codes user_recovery_codes_pkey; Type: CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.user_recovery_codes
+    ADD CONSTRAINT user_recovery_codes_pkey PRIMARY KEY (id);
+
+
+--
+-- Name: blueprints blueprints_pkey; Type: CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.blueprints
+    ADD CONSTRAINT blueprints_pkey PRIMARY KEY (id);
+
+
+--
+-- Name: blueprints blueprints_owner_id_slug_key; Type: CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.blueprints
+    ADD CONSTRAINT blueprints_owner_id_slug_key UNIQUE (owner_id, slug);
+
+
+--
+-- Name: blueprint_instances blueprint_instances_pkey; Type: CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.blueprint_instances
+    ADD CONSTRAINT blueprint_instances_pkey PRIMARY KEY (rule_id);
+
+
+--
+-- Name: variables variables_pkey; Type: CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.variables
+    ADD CONSTRAINT variables_pkey PRIMARY KEY (id);
+
+
+--
+-- Name: variables_owner_rule_name_idx; Type: INDEX; Schema: public; Owner: postgres
+--
+
+CREATE UNIQUE INDEX variables_owner_rule_name_idx ON public.variables USING btree (owner_id, COALESCE(rule_id, 0), name);
+
+
+--
+-- Name: people people_pkey; Type: CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.people
+    ADD CONSTRAINT people_pkey PRIMARY KEY (id);
+
+
+--
+-- Name: people_user_id_idx; Type: INDEX; Schema: public; Owner: postgres
+--
+
+CREATE UNIQUE INDEX people_user_id_idx ON public.people USING btree (user_id);
+
+
+--
+-- Name: zones zones_pkey; Type: CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.zones
+    ADD CONSTRAINT zones_pkey PRIMARY KEY (id);
+
+
+--
+-- Name: zone_presence zone_presence_pkey; Type: CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.zone_presence
+    ADD CONSTRAINT zone_presence_pkey PRIMARY KEY (zone_id, person_id);
+
+
+--
+-- Name: geofence_devices geofence_devices_pkey; Type: CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.geofence_devices
+    ADD CONSTRAINT geofence_devices_pkey PRIMARY KEY (id);
+
+
+--
+-- Name: geofence_devices_token_hash_idx; Type: INDEX; Schema: public; Owner: postgres
+--
+
+CREATE UNIQUE INDEX geofence_devices_token_hash_idx ON public.geofence_devices USING btree (token_hash);
+
+
+--
+-- Name: alarm_panels alarm_panels_pkey; Type: CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.alarm_panels
+    ADD CONSTRAINT alarm_panels_pkey PRIMARY KEY (id);
+
+
+--
+-- Name: alarm_panels_owner_id_idx; Type: INDEX; Schema: public; Owner: postgres
+--
+
+CREATE UNIQUE INDEX alarm_panels_owner_id_idx ON public.alarm_panels USING btree (owner_id);
+
+
+--
+-- Name: interlocks interlocks_pkey; Type: CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.interlocks
+    ADD CONSTRAINT interlocks_pkey PRIMARY KEY (id);
+
+
+--
+-- Name: interlocks_device_id_idx; Type: INDEX; Schema: public; Owner: postgres
+--
+
+CREATE INDEX interlocks_device_id_idx ON public.interlocks USING btree (device_id);
+
+
+--
+-- Name: vacation_modes vacation_modes_pkey; Type: CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.vacation_modes
+    ADD CONSTRAINT vacation_modes_pkey PRIMARY KEY (id);
+
+
+--
+-- Name: vacation_modes_owner_id_idx; Type: INDEX; Schema: public; Owner: postgres
+--
+
+CREATE UNIQUE INDEX vacation_modes_owner_id_idx ON public.vacation_modes USING btree (owner_id);
+
+
+--
+-- Name: device_states_history_device_id_timestamp_idx; Type: INDEX; Schema: public; Owner: postgres
+--
+
+CREATE INDEX device_states_history_device_id_timestamp_idx ON public.device_states_history USING btree (device_id, "timestamp");
+
+
+--
+-- Name: energy_daily energy_daily_pkey; Type: CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.energy_daily
+    ADD CONSTRAINT energy_daily_pkey PRIMARY KEY (device_id, day);
+
+
+--
+-- Name: energy_tariffs energy_tariffs_pkey; Type: CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.energy_tariffs
+    ADD CONSTRAINT energy_tariffs_pkey PRIMARY KEY (id);
+
+
+--
+-- Name: energy_tariffs_owner_id_idx; Type: INDEX; Schema: public; Owner: postgres
+--
+
+CREATE UNIQUE INDEX energy_tariffs_owner_id_idx ON public.energy_tariffs USING btree (owner_id);
+
+
+--
+-- Name: virtual_devices virtual_devices_pkey; Type: CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.virtual_devices
+    ADD CONSTRAINT virtual_devices_pkey PRIMARY KEY (device_id);
+
+
+--
+-- TOC entry 3324 (class 2606 OID 32788)
+-- Name: device_states_history device_states_history_device_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.device_states_history
+    ADD CONSTRAINT device_states_history_device_id_fkey FOREIGN KEY (device_id) REFERENCES public.devices(id) ON DELETE CASCADE NOT VALID;
+
+
+--
+-- TOC entry 3325 (class 2606 OID 32795)
+-- Name: device_states_history device_states_history_rule_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.device_states_history
+    ADD CONSTRAINT device_states_history_rule_id_fkey FOREIGN KEY (rule_id) REFERENCES public.rules(id) NOT VALID;
+
+
+--
+-- TOC entry 3326 (class 2606 OID 32771)
+-- Name: devices devices_owner_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.devices
+    ADD CONSTRAINT devices_owner_id_fkey FOREIGN KEY (owner_id) REFERENCES public.users(id) NOT VALID;
+
+
+--
+-- TOC entry 3327 (class 2606 OID 32776)
+-- Name: rules rules_owner_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.rules
+    ADD CONSTRAINT rules_owner_id_fkey FOREIGN KEY (owner_id) REFERENCES public.users(id) NOT VALID;
+
+
+--
+-- Name: calendars calendars_owner_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.calendars
+    ADD CONSTRAINT calendars_owner_id_fkey FOREIGN KEY (owner_id) REFERENCES public.users(id) ON DELETE CASCADE;
+
+
+--
+-- Name: schedules schedules_calendar_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.schedules
+    ADD CONSTRAINT schedules_calendar_id_fkey FOREIGN KEY (calendar_id) REFERENCES public.calendars(id) ON DELETE CASCADE;
+
+
+--
+-- TOC entry 3328 (class 2606 OID 32813)
+-- Name: schedules schedules_rule_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.schedules
+    ADD CONSTRAINT schedules_rule_id_fkey FOREIGN KEY (rule_id) REFERENCES public.rules(id) ON DELETE CASCADE NOT VALID;
+
+
+--
+-- Name: user_recovery_codes user_recovery_codes_user_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.user_recovery_codes
+    ADD CONSTRAINT user_recovery_codes_user_id_fkey FOREIGN KEY (user_id) REFERENCES public.users(id) ON DELETE CASCADE;
+
+
+--
+-- Name: rule_runs rule_runs_rule_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.rule_runs
+    ADD CONSTRAINT rule_runs_rule_id_fkey FOREIGN KEY (rule_id) REFERENCES public.rules(id) ON DELETE CASCADE;
+
+
+--
+-- Name: rule_revisions rule_revisions_rule_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.rule_revisions
+    ADD CONSTRAINT rule_revisions_rule_id_fkey FOREIGN KEY (rule_id) REFERENCES public.rules(id) ON DELETE CASCADE;
+
+
+--
+-- Name: blueprints blueprints_owner_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.blueprints
+    ADD CONSTRAINT blueprints_owner_id_fkey FOREIGN KEY (owner_id) REFERENCES public.users(id) ON DELETE CASCADE;
+
+
+--
+-- Name: blueprint_instances blueprint_instances_rule_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.blueprint_instances
+    ADD CONSTRAINT blueprint_instances_rule_id_fkey FOREIGN KEY (rule_id) REFERENCES public.rules(id) ON DELETE CASCADE;
+
+
+--
+-- Name: variables variables_owner_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.variables
+    ADD CONSTRAINT variables_owner_id_fkey FOREIGN KEY (owner_id) REFERENCES public.users(id) ON DELETE CASCADE;
+
+
+--
+-- Name: variables variables_rule_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.variables
+    ADD CONSTRAINT variables_rule_id_fkey FOREIGN KEY (rule_id) REFERENCES public.rules(id) ON DELETE CASCADE;
+
+
+--
+-- Name: people people_owner_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.people
+    ADD CONSTRAINT people_owner_id_fkey FOREIGN KEY (owner_id) REFERENCES public.users(id) ON DELETE CASCADE;
+
+
+--
+-- Name: people people_user_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.people
+    ADD CONSTRAINT people_user_id_fkey FOREIGN KEY (user_id) REFERENCES public.users(id) ON DELETE SET NULL;
+
+
+--
+-- Name: zones zones_owner_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.zones
+    ADD CONSTRAINT zones_owner_id_fkey FOREIGN KEY (owner_id) REFERENCES public.users(id) ON DELETE CASCADE;
+
+
+--
+-- Name: zone_presence zone_presence_zone_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.zone_presence
+    ADD CONSTRAINT zone_presence_zone_id_fkey FOREIGN KEY (zone_id) REFERENCES public.zones(id) ON DELETE CASCADE;
+
+
+--
+-- Name: zone_presence zone_presence_person_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.zone_presence
+    ADD CONSTRAINT zone_presence_person_id_fkey FOREIGN KEY (person_id) REFERENCES public.people(id) ON DELETE CASCADE;
+
+
+--
+-- Name: geofence_devices geofence_devices_person_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.geofence_devices
+    ADD CONSTRAINT geofence_devices_person_id_fkey FOREIGN KEY (person_id) REFERENCES public.people(id) ON DELETE CASCADE;
+
+
+--
+-- Name: alarm_panels alarm_panels_owner_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.alarm_panels
+    ADD CONSTRAINT alarm_panels_owner_id_fkey FOREIGN KEY (owner_id) REFERENCES public.users(id) ON DELETE CASCADE;
+
+
+--
+-- Name: interlocks interlocks_owner_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.interlocks
+    ADD CONSTRAINT interlocks_owner_id_fkey FOREIGN KEY (owner_id) REFERENCES public.users(id) ON DELETE CASCADE;
+
+
+--
+-- Name: interlocks interlocks_device_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.interlocks
+    ADD CONSTRAINT interlocks_device_id_fkey FOREIGN KEY (device_id) REFERENCES public.devices(id) ON DELETE CASCADE;
+
+
+--
+-- Name: vacation_modes vacation_modes_owner_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.vacation_modes
+    ADD CONSTRAINT vacation_modes_owner_id_fkey FOREIGN KEY (owner_id) REFERENCES public.users(id) ON DELETE CASCADE;
+
+
+--
+-- Name: energy_daily energy_daily_device_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.energy_daily
+    ADD CONSTRAINT energy_daily_device_id_fkey FOREIGN KEY (device_id) REFERENCES public.devices(id) ON DELETE CASCADE;
+
+
+--
+-- Name: energy_tariffs energy_tariffs_owner_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.energy_tariffs
+    ADD CONSTRAINT energy_tariffs_owner_id_fkey FOREIGN KEY (owner_id) REFERENCES public.users(id) ON DELETE CASCADE;
+
+
+--
+-- Name: virtual_devices virtual_devices_device_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: postgres
+--
 
+ALTER TABLE ONLY public.virtual_devices
+    ADD CONSTRAINT virtual_devices_device_id_fkey FOREIGN KEY (device_id) REFERENCES public.devices(id) ON DELETE CASCADE;